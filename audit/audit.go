@@ -0,0 +1,220 @@
+// Package audit は、エンティティの変更履歴 (誰が・いつ・何を変更したか) を記録・検索する機能を提供します。
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+
+	"github.com/golaboratory/gloudia/correlation"
+	"github.com/golaboratory/gloudia/json/diff"
+	"github.com/golaboratory/gloudia/middleware"
+)
+
+// ErrNoTenant はコンテキストからテナントを特定できない場合に返されます。
+var ErrNoTenant = ergo.NewSentinel("audit: tenant is not found in context")
+
+// Action は変更の種類です。
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// Entry は 1 件の監査ログです。
+type Entry struct {
+	ID         int64              `json:"id"`
+	TenantID   string             `json:"tenant_id"`
+	EntityType string             `json:"entity_type"`
+	EntityID   string             `json:"entity_id"`
+	Action     Action             `json:"action"`
+	Changes    []diff.ChangePoint `json:"changes"`
+	// UserID は変更を行ったユーザーの ID です。なりすまし中の場合は、なりすまされたユーザーの ID となります
+	// (auth.Claims.UserID と同じ意味です。実際に操作した管理者は ImpersonatorUserID を参照してください)。
+	UserID int64 `json:"user_id,omitempty"`
+	// APIKeyID は API キーによる変更の場合のキーの公開 ID です。
+	APIKeyID string `json:"api_key_id,omitempty"`
+	// ImpersonatorUserID はなりすまし中の場合に、実際に操作を行った管理者のユーザー ID です。
+	ImpersonatorUserID int64 `json:"impersonator_user_id,omitempty"`
+	// ImpersonationID はなりすまし中の場合に、なりすましのセッションを識別する ID です。
+	ImpersonationID string    `json:"impersonation_id,omitempty"`
+	RequestID       string    `json:"request_id,omitempty"`
+	OccurredAt      time.Time `json:"occurred_at"`
+}
+
+// AuditSink は監査ログの記録先を抽象化するインターフェースです。
+type AuditSink interface {
+	Record(ctx context.Context, entry *Entry) error
+}
+
+// Query は監査ログの検索条件です。空の項目は条件に含めません。
+type Query struct {
+	TenantID   string
+	EntityType string
+	EntityID   string
+	UserID     int64     // 変更を行ったユーザー (Entry.UserID または ImpersonatorUserID が一致するもの)
+	From       time.Time // この時刻以降 (含む)
+	To         time.Time // この時刻より前 (含まない)
+	Limit      int
+	Offset     int
+}
+
+// AuditReader は監査ログを検索するインターフェースです。結果は新しい順に返します。
+type AuditReader interface {
+	Find(ctx context.Context, q Query) ([]Entry, error)
+}
+
+// DefaultIgnoreFields は Recorder が既定で記録しないフィールドです。
+// 監査ログは長期間保存され、管理者が閲覧するため、パスワードのハッシュや秘密鍵などの機密情報を含めないようにします。
+var DefaultIgnoreFields = []string{
+	"password", "password_hash", "passwordHash",
+	"secret", "client_secret", "clientSecret", "totp_secret", "totpSecret",
+	"token", "access_token", "accessToken", "refresh_token", "refreshToken",
+	"api_key", "apiKey", "key_hash", "keyHash",
+}
+
+// Recorder は変更前後のエンティティから差分を計算し、AuditSink に記録する構造体です。
+type Recorder struct {
+	sink AuditSink
+	now  func() time.Time
+
+	// IgnoreFields は記録しないフィールドです (パスワードのハッシュや更新日時など)。既定値は DefaultIgnoreFields です。
+	// ドット記法のフィールド名を指定し、ネストしたフィールドも除外されます。
+	// ドットを含まないフィールド名は、ネストしたオブジェクト内の同名のフィールドにも一致します。
+	// 既定値に追加する場合は append(audit.DefaultIgnoreFields, "updated_at") のように指定してください。
+	IgnoreFields []string
+}
+
+// NewRecorder は新しい Recorder を作成します。
+func NewRecorder(sink AuditSink) *Recorder {
+	return &Recorder{sink: sink, now: time.Now, IgnoreFields: slices.Clone(DefaultIgnoreFields)}
+}
+
+// RecordChange は before と after の差分を監査ログとして記録します。
+//
+// before が nil の場合は作成、after が nil の場合は削除として記録します。
+// 変更者、なりすましを行った管理者、テナント、リクエスト ID はコンテキストから取得します。
+// 更新で差分がない場合は記録せず、nil を返します。
+func (r *Recorder) RecordChange(ctx context.Context, entityType string, entityID string, before any, after any) (*Entry, error) {
+	oldJSON, err := marshalEntity(before)
+	if err != nil {
+		return nil, err
+	}
+	newJSON, err := marshalEntity(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := diff.ComputeDiff(oldJSON, newJSON)
+	if err != nil {
+		return nil, ergo.Wrap(err, "failed to compute audit diff")
+	}
+	changes = slices.DeleteFunc(changes, func(c diff.ChangePoint) bool { return r.ignored(c.Field) })
+	// 作成・削除などでオブジェクト全体が値となる場合も、除外するフィールドを含めない
+	for i := range changes {
+		changes[i].OldValue = r.scrub(changes[i].Field, changes[i].OldValue)
+		changes[i].NewValue = r.scrub(changes[i].Field, changes[i].NewValue)
+	}
+
+	action := ActionUpdate
+	switch {
+	case oldJSON == nil:
+		action = ActionCreate
+	case newJSON == nil:
+		action = ActionDelete
+	}
+	if action == ActionUpdate && len(changes) == 0 {
+		return nil, nil
+	}
+
+	entry := &Entry{
+		EntityType: entityType,
+		EntityID:   entityID,
+		Action:     action,
+		Changes:    changes,
+		OccurredAt: r.now(),
+	}
+	if err := fillContext(ctx, entry); err != nil {
+		return nil, err
+	}
+	if err := r.sink.Record(ctx, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (r *Recorder) ignored(field string) bool {
+	for _, f := range r.IgnoreFields {
+		if field == f || strings.HasPrefix(field, f+".") {
+			return true
+		}
+		if !strings.Contains(f, ".") && slices.Contains(strings.Split(field, "."), f) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrub は値に含まれるオブジェクトから、除外するフィールドを削除します。path は値のフィールド名 (ドット記法) です。
+func (r *Recorder) scrub(path string, v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			childPath := path + "." + k
+			if r.ignored(childPath) {
+				delete(t, k)
+				continue
+			}
+			t[k] = r.scrub(childPath, child)
+		}
+	case []any:
+		for i, child := range t {
+			t[i] = r.scrub(path, child)
+		}
+	}
+	return v
+}
+
+// marshalEntity はエンティティを JSON に変換します。nil の場合は nil を返します。
+func marshalEntity(v any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, ergo.New("failed to marshal audit entity", slog.String("error", err.Error()))
+	}
+	if string(b) == "null" {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// fillContext はコンテキストからテナント、変更者、リクエスト ID を設定します。
+func fillContext(ctx context.Context, entry *Entry) error {
+	claims, hasClaims := middleware.ClaimsFrom(ctx)
+	if tenantID, ok := middleware.TenantFrom(ctx); ok {
+		entry.TenantID = tenantID
+	} else if hasClaims {
+		entry.TenantID = claims.TenantID
+	}
+	if entry.TenantID == "" {
+		return ErrNoTenant
+	}
+
+	if hasClaims {
+		entry.UserID = claims.UserID
+		entry.APIKeyID = claims.APIKeyID
+		entry.ImpersonatorUserID = claims.ActorUserID
+		entry.ImpersonationID = claims.ImpersonationID
+	}
+	entry.RequestID, _ = correlation.RequestIDFrom(ctx)
+	return nil
+}
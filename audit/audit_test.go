@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+	"github.com/golaboratory/gloudia/correlation"
+	"github.com/golaboratory/gloudia/json/diff"
+	"github.com/golaboratory/gloudia/middleware"
+)
+
+type memorySink struct {
+	entries []Entry
+}
+
+func (s *memorySink) Record(_ context.Context, entry *Entry) error {
+	entry.ID = int64(len(s.entries) + 1)
+	s.entries = append(s.entries, *entry)
+	return nil
+}
+
+type reservation struct {
+	Room         string `json:"room"`
+	Guests       int    `json:"guests"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+func TestRecorderRecordChange(t *testing.T) {
+	sink := &memorySink{}
+	recorder := NewRecorder(sink)
+	now := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	recorder.now = func() time.Time { return now }
+
+	ctx := middleware.WithTenant(context.Background(), "tenant-1")
+	ctx = middleware.WithClaims(ctx, &auth.Claims{UserID: 42, TenantID: "tenant-1", ActorUserID: 1, ImpersonationID: "imp-1"})
+	ctx = correlation.WithRequestID(ctx, "req-1")
+
+	t.Run("update", func(t *testing.T) {
+		entry, err := recorder.RecordChange(ctx, "reservation", "10",
+			&reservation{Room: "A", Guests: 2, PasswordHash: "old"},
+			&reservation{Room: "B", Guests: 2, PasswordHash: "new"})
+		require.NoError(t, err)
+		require.NotNil(t, entry)
+
+		assert.Equal(t, ActionUpdate, entry.Action)
+		assert.Equal(t, []diff.ChangePoint{{Field: "room", OldValue: "A", NewValue: "B"}}, entry.Changes)
+		assert.Equal(t, "tenant-1", entry.TenantID)
+		assert.Equal(t, int64(42), entry.UserID)
+		assert.Equal(t, int64(1), entry.ImpersonatorUserID)
+		assert.Equal(t, "imp-1", entry.ImpersonationID)
+		assert.Equal(t, "req-1", entry.RequestID)
+		assert.Equal(t, now, entry.OccurredAt)
+	})
+
+	t.Run("create and delete", func(t *testing.T) {
+		entry, err := recorder.RecordChange(ctx, "reservation", "11", nil, &reservation{Room: "A", Guests: 1})
+		require.NoError(t, err)
+		assert.Equal(t, ActionCreate, entry.Action)
+		assert.Len(t, entry.Changes, 2)
+
+		var deleted *reservation
+		entry, err = recorder.RecordChange(ctx, "reservation", "11", &reservation{Room: "A", Guests: 1}, deleted)
+		require.NoError(t, err)
+		assert.Equal(t, ActionDelete, entry.Action)
+	})
+
+	t.Run("no changes are not recorded", func(t *testing.T) {
+		before := len(sink.entries)
+		entry, err := recorder.RecordChange(ctx, "reservation", "10", &reservation{Room: "A", PasswordHash: "x"}, &reservation{Room: "A", PasswordHash: "y"})
+		require.NoError(t, err)
+		assert.Nil(t, entry)
+		assert.Len(t, sink.entries, before)
+	})
+
+	t.Run("secrets are ignored by default", func(t *testing.T) {
+		type account struct {
+			Name    string         `json:"name"`
+			Profile map[string]any `json:"profile"`
+		}
+		entry, err := recorder.RecordChange(ctx, "account", "1", nil, &account{
+			Name:    "user",
+			Profile: map[string]any{"email": "a@example.com", "password_hash": "x", "oauth": map[string]any{"refresh_token": "y"}},
+		})
+		require.NoError(t, err)
+		i := slices.IndexFunc(entry.Changes, func(c diff.ChangePoint) bool { return c.Field == "profile" })
+		require.GreaterOrEqual(t, i, 0)
+		assert.Equal(t, map[string]any{"email": "a@example.com", "oauth": map[string]any{}}, entry.Changes[i].NewValue)
+
+		entry, err = recorder.RecordChange(ctx, "account", "1",
+			&account{Name: "user", Profile: map[string]any{"password_hash": "x", "email": "a@example.com"}},
+			&account{Name: "user", Profile: map[string]any{"password_hash": "y", "email": "b@example.com"}})
+		require.NoError(t, err)
+		assert.Equal(t, []diff.ChangePoint{{Field: "profile.email", OldValue: "a@example.com", NewValue: "b@example.com"}}, entry.Changes)
+	})
+
+	t.Run("tenant is required", func(t *testing.T) {
+		_, err := recorder.RecordChange(context.Background(), "reservation", "10", nil, &reservation{Room: "A"})
+		assert.ErrorIs(t, err, ErrNoTenant)
+	})
+}
+
+func TestPostgresSinkFindQuery(t *testing.T) {
+	sink := NewPostgresSink(nil)
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	query, args := sink.findQuery(Query{TenantID: "tenant-1", EntityType: "reservation", EntityID: "10", UserID: 42, From: from, Limit: 1000})
+	assert.Contains(t, query, `FROM "audit_logs"`)
+	assert.Contains(t, query, "WHERE tenant_id = $1 AND entity_type = $2 AND entity_id = $3 AND (user_id = $4 OR impersonator_user_id = $4) AND occurred_at >= $5")
+	assert.Contains(t, query, "LIMIT $6 OFFSET $7")
+	assert.Equal(t, []any{"tenant-1", "reservation", "10", int64(42), from, maxQueryLimit, 0}, args)
+
+	query, args = sink.findQuery(Query{TenantID: "tenant-1"})
+	assert.Contains(t, query, "WHERE tenant_id = $1\n")
+	assert.Equal(t, []any{"tenant-1", defaultQueryLimit, 0}, args)
+}
@@ -0,0 +1,116 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+
+	"github.com/golaboratory/gloudia/api"
+	"github.com/golaboratory/gloudia/auth"
+	"github.com/golaboratory/gloudia/middleware"
+)
+
+// ReadScope は監査ログの検索に必要なスコープです。
+const ReadScope = "audit:read"
+
+// Handler は監査ログを検索する API を提供する api.Handler の実装です。
+//
+// 監査ログにはテナント内のすべての変更が含まれるため、認証済みで、かつ以下のいずれかを満たすリクエストのみ許可します。
+//   - API キー認証の場合: キーが ReadScope を持つ
+//   - トークン認証 (ユーザー) の場合: ロールが NewHandler で指定したロールのいずれかである
+type Handler struct {
+	reader      AuditReader
+	readerRoles []int64
+}
+
+// NewHandler は新しい Handler を作成します。
+// readerRoleIDs には監査ログの検索を許可するロール ID (管理者など) を指定します。
+// 指定しない場合、ユーザーは検索できず、ReadScope を持つ API キーのみ許可されます。
+func NewHandler(reader AuditReader, readerRoleIDs ...int64) *Handler {
+	return &Handler{reader: reader, readerRoles: readerRoleIDs}
+}
+
+// FindInput は監査ログの検索条件です。
+type FindInput struct {
+	EntityType string    `query:"entityType" doc:"エンティティの種類"`
+	EntityID   string    `query:"entityId" doc:"エンティティの ID"`
+	UserID     int64     `query:"userId" doc:"変更を行ったユーザーの ID"`
+	From       time.Time `query:"from" doc:"この日時以降の変更 (RFC 3339)"`
+	To         time.Time `query:"to" doc:"この日時より前の変更 (RFC 3339)"`
+	Limit      int       `query:"limit" minimum:"1" maximum:"500" default:"50" doc:"取得件数"`
+	Offset     int       `query:"offset" minimum:"0" doc:"読み飛ばす件数"`
+}
+
+// RegisterRoutes は GET {rootPath}/audit-logs を登録します。
+// SecurityScheme を指定した場合、ReadScope を要求します。
+func (h *Handler) RegisterRoutes(humaAPI huma.API, middlewares huma.Middlewares, SecurityScheme string, rootPath string) {
+	op := huma.Operation{
+		OperationID: "list-audit-logs",
+		Method:      http.MethodGet,
+		Path:        rootPath + "/audit-logs",
+		Summary:     "監査ログの検索",
+		Description: "エンティティ、ユーザー、期間を指定して監査ログを新しい順に検索します。",
+		Tags:        []string{"audit"},
+		Middlewares: middlewares,
+	}
+	if SecurityScheme != "" {
+		op.Security = []map[string][]string{{SecurityScheme: {ReadScope}}}
+	}
+	huma.Register(humaAPI, op, h.find)
+}
+
+func (h *Handler) find(ctx context.Context, in *FindInput) (*api.UnifiedResponse[[]Entry], error) {
+	claims, ok := middleware.ClaimsFrom(ctx)
+	if !ok {
+		return nil, huma.Error401Unauthorized("Authentication is required")
+	}
+	if !h.canRead(claims) {
+		return nil, huma.Error403Forbidden("Not allowed to read audit logs")
+	}
+
+	tenantID, ok := middleware.TenantFrom(ctx)
+	if !ok {
+		tenantID = claims.TenantID
+	}
+	if tenantID == "" {
+		return nil, huma.Error400BadRequest("Tenant could not be determined")
+	}
+	if !in.From.IsZero() && !in.To.IsZero() && !in.From.Before(in.To) {
+		return nil, huma.Error422UnprocessableEntity("from must be before to")
+	}
+
+	entries, err := h.reader.Find(ctx, Query{
+		TenantID:   tenantID,
+		EntityType: in.EntityType,
+		EntityID:   in.EntityID,
+		UserID:     in.UserID,
+		From:       in.From,
+		To:         in.To,
+		Limit:      in.Limit,
+		Offset:     in.Offset,
+	})
+	if err != nil {
+		if errors.Is(err, ErrNoTenant) {
+			return nil, huma.Error400BadRequest("Tenant could not be determined")
+		}
+		slog.ErrorContext(ctx, "Failed to find audit logs", "error", err)
+		return nil, huma.Error500InternalServerError("Failed to find audit logs")
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	return api.NewSuccessResponse(entries, ""), nil
+}
+
+// canRead は Claims が監査ログを検索できるかを判定します。
+func (h *Handler) canRead(claims *auth.Claims) bool {
+	if claims.IsAPIKey() {
+		return claims.HasScope(ReadScope)
+	}
+	return slices.Contains(h.readerRoles, claims.RoleID)
+}
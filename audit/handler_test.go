@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+	"github.com/golaboratory/gloudia/middleware"
+)
+
+type fakeReader struct {
+	query Query
+}
+
+func (r *fakeReader) Find(_ context.Context, q Query) ([]Entry, error) {
+	r.query = q
+	return []Entry{{ID: 1, TenantID: q.TenantID, EntityType: q.EntityType, EntityID: q.EntityID, Action: ActionUpdate}}, nil
+}
+
+// adminRoleID はテストで監査ログの検索を許可するロール ID です。
+const adminRoleID = 1
+
+func TestHandler(t *testing.T) {
+	reader := &fakeReader{}
+	_, api := humatest.New(t)
+	authenticate := func(ctx huma.Context, next func(huma.Context)) {
+		if tenantID := ctx.Header("X-Test-Tenant"); tenantID != "" {
+			ctx = huma.WithContext(ctx, middleware.WithTenant(ctx.Context(), tenantID))
+		}
+		switch ctx.Header("X-Test-Auth") {
+		case "admin":
+			ctx = huma.WithContext(ctx, middleware.WithClaims(ctx.Context(), &auth.Claims{UserID: 1, TenantID: "tenant-1", RoleID: adminRoleID}))
+		case "user":
+			ctx = huma.WithContext(ctx, middleware.WithClaims(ctx.Context(), &auth.Claims{UserID: 2, TenantID: "tenant-1", RoleID: 2}))
+		case "api-key":
+			ctx = huma.WithContext(ctx, middleware.WithClaims(ctx.Context(), &auth.Claims{TenantID: "tenant-1", APIKeyID: "key-1", Scopes: []string{ReadScope}}))
+		case "api-key-without-scope":
+			ctx = huma.WithContext(ctx, middleware.WithClaims(ctx.Context(), &auth.Claims{TenantID: "tenant-1", APIKeyID: "key-2", Scopes: []string{"reservations:read"}}))
+		}
+		next(ctx)
+	}
+	NewHandler(reader, adminRoleID).RegisterRoutes(api, huma.Middlewares{authenticate}, "", "/api/v1")
+
+	resp := api.Get("/api/v1/audit-logs?entityType=reservation&entityId=10&userId=42&from=2026-10-01T00:00:00Z&to=2026-10-02T00:00:00Z", "X-Test-Tenant: tenant-1", "X-Test-Auth: admin")
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Contains(t, resp.Body.String(), `"entity_type":"reservation"`)
+	assert.Equal(t, Query{
+		TenantID:   "tenant-1",
+		EntityType: "reservation",
+		EntityID:   "10",
+		UserID:     42,
+		From:       time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		To:         time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC),
+		Limit:      50,
+	}, reader.query)
+
+	t.Run("anonymous requests are rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, api.Get("/api/v1/audit-logs", "X-Test-Tenant: tenant-1").Code)
+	})
+
+	t.Run("users without a reader role are rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, api.Get("/api/v1/audit-logs", "X-Test-Auth: user").Code)
+	})
+
+	t.Run("api keys require the read scope", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, api.Get("/api/v1/audit-logs", "X-Test-Auth: api-key").Code)
+		assert.Equal(t, "tenant-1", reader.query.TenantID, "tenant falls back to the claims")
+		assert.Equal(t, http.StatusForbidden, api.Get("/api/v1/audit-logs", "X-Test-Auth: api-key-without-scope").Code)
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		resp := api.Get("/api/v1/audit-logs?from=2026-10-02T00:00:00Z&to=2026-10-01T00:00:00Z", "X-Test-Tenant: tenant-1", "X-Test-Auth: admin")
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	})
+}
@@ -0,0 +1,222 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/newmo-oss/ergo"
+
+	"github.com/golaboratory/gloudia/middleware"
+)
+
+// PostgresSchema は PostgresSink が使用するテーブルの定義です。マイグレーションに組み込んで使用してください。
+// 監査ログは追記のみとするため、アプリケーションのロールには UPDATE / DELETE の権限を付与しないことを推奨します。
+const PostgresSchema = `CREATE TABLE IF NOT EXISTS audit_logs (
+    id                   bigserial PRIMARY KEY,
+    tenant_id            uuid        NOT NULL,
+    entity_type          text        NOT NULL,
+    entity_id            text        NOT NULL,
+    action               text        NOT NULL,
+    changes              jsonb       NOT NULL,
+    user_id              bigint,
+    api_key_id           text,
+    impersonator_user_id bigint,
+    impersonation_id     text,
+    request_id           text,
+    occurred_at          timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_logs_entity_idx ON audit_logs (tenant_id, entity_type, entity_id, occurred_at DESC);
+CREATE INDEX IF NOT EXISTS audit_logs_user_idx ON audit_logs (tenant_id, user_id, occurred_at DESC);
+ALTER TABLE audit_logs ENABLE ROW LEVEL SECURITY;
+CREATE POLICY audit_logs_tenant_isolation ON audit_logs
+    USING (tenant_id = NULLIF(current_setting('app.current_tenant_id', true), '')::uuid);
+`
+
+// 検索件数の既定値と上限です。
+const (
+	defaultQueryLimit = 50
+	maxQueryLimit     = 500
+)
+
+// PostgresSink は PostgreSQL に監査ログを記録・検索する AuditSink / AuditReader の実装です。
+//
+// コンテキストに middleware.NewRLSProvider のトランザクションがある場合はそのトランザクションを使用するため、
+// 監査ログは業務データの変更と同時にコミット (失敗時はロールバック) され、RLS のポリシーも適用されます。
+// トランザクションがない場合 (ワーカーなど) は、新たにトランザクションを開始してテナントの変数を設定します。
+type PostgresSink struct {
+	pool *pgxpool.Pool
+
+	// Table は監査ログのテーブル名です。既定値は "audit_logs" です。
+	Table string
+	// TenantVariable は RLS のポリシーが参照するテナント ID の変数名です。既定値は "app.current_tenant_id" です。
+	TenantVariable string
+}
+
+// NewPostgresSink は新しい PostgresSink を作成します。
+func NewPostgresSink(pool *pgxpool.Pool) *PostgresSink {
+	return &PostgresSink{
+		pool:           pool,
+		Table:          "audit_logs",
+		TenantVariable: middleware.DefaultRLSConfig().TenantVariable,
+	}
+}
+
+// Record は監査ログを 1 件追加し、採番された ID を entry.ID に設定します。
+func (s *PostgresSink) Record(ctx context.Context, entry *Entry) error {
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return ergo.Wrap(err, "failed to marshal audit changes")
+	}
+
+	query := `INSERT INTO ` + s.table() + ` (tenant_id, entity_type, entity_id, action, changes, user_id, api_key_id, impersonator_user_id, impersonation_id, request_id, occurred_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`
+	return s.withTx(ctx, entry.TenantID, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, query,
+			entry.TenantID, entry.EntityType, entry.EntityID, string(entry.Action), changes,
+			nullInt64(entry.UserID), nullString(entry.APIKeyID),
+			nullInt64(entry.ImpersonatorUserID), nullString(entry.ImpersonationID), nullString(entry.RequestID),
+			entry.OccurredAt,
+		).Scan(&entry.ID)
+		if err != nil {
+			return ergo.Wrap(err, "failed to insert audit log")
+		}
+		return nil
+	})
+}
+
+// Find は検索条件に一致する監査ログを新しい順に返します。
+func (s *PostgresSink) Find(ctx context.Context, q Query) ([]Entry, error) {
+	if q.TenantID == "" {
+		return nil, ErrNoTenant
+	}
+	query, args := s.findQuery(q)
+
+	var entries []Entry
+	err := s.withTx(ctx, q.TenantID, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, args...)
+		if err != nil {
+			return ergo.Wrap(err, "failed to query audit logs")
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				e                                    Entry
+				action                               string
+				changes                              []byte
+				user, impersonator                   *int64
+				apiKeyID, impersonationID, requestID *string
+			)
+			if err := rows.Scan(&e.ID, &e.TenantID, &e.EntityType, &e.EntityID, &action, &changes,
+				&user, &apiKeyID, &impersonator, &impersonationID, &requestID, &e.OccurredAt); err != nil {
+				return ergo.Wrap(err, "failed to scan audit log")
+			}
+			if err := json.Unmarshal(changes, &e.Changes); err != nil {
+				return ergo.Wrap(err, "failed to unmarshal audit changes")
+			}
+			e.Action = Action(action)
+			e.UserID, e.ImpersonatorUserID = deref(user), deref(impersonator)
+			e.APIKeyID, e.ImpersonationID, e.RequestID = deref(apiKeyID), deref(impersonationID), deref(requestID)
+			entries = append(entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			return ergo.Wrap(err, "failed to read audit logs")
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// findQuery は検索条件から SQL と引数を組み立てます。
+// RLS に加えてテナント ID を明示的に条件に含め、ポリシーの設定漏れがあっても他テナントのログを返さないようにします。
+func (s *PostgresSink) findQuery(q Query) (string, []any) {
+	args := []any{q.TenantID}
+	conds := []string{"tenant_id = $1"}
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+	}
+
+	if q.EntityType != "" {
+		add("entity_type = ?", q.EntityType)
+	}
+	if q.EntityID != "" {
+		add("entity_id = ?", q.EntityID)
+	}
+	if q.UserID != 0 {
+		add("(user_id = ? OR impersonator_user_id = ?)", q.UserID)
+	}
+	if !q.From.IsZero() {
+		add("occurred_at >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		add("occurred_at < ?", q.To)
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	limit = min(limit, maxQueryLimit)
+	args = append(args, limit, max(q.Offset, 0))
+
+	query := `SELECT id, tenant_id::text, entity_type, entity_id, action, changes, user_id, api_key_id, impersonator_user_id, impersonation_id, request_id, occurred_at
+FROM ` + s.table() + `
+WHERE ` + strings.Join(conds, " AND ") + `
+ORDER BY occurred_at DESC, id DESC
+LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args))
+	return query, args
+}
+
+// withTx はコンテキストのトランザクション、またはテナントの変数を設定した新しいトランザクションで fn を実行します。
+func (s *PostgresSink) withTx(ctx context.Context, tenantID string, fn func(tx pgx.Tx) error) error {
+	if tx, ok := middleware.TxFrom(ctx); ok {
+		return fn(tx)
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return ergo.Wrap(err, "failed to begin audit transaction")
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	if _, err := tx.Exec(ctx, "SELECT set_config($1, $2, true)", s.TenantVariable, tenantID); err != nil {
+		return ergo.Wrap(err, "failed to set audit tenant")
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return ergo.Wrap(err, "failed to commit audit transaction")
+	}
+	return nil
+}
+
+func (s *PostgresSink) table() string {
+	return pgx.Identifier(strings.Split(s.Table, ".")).Sanitize()
+}
+
+func nullInt64(v int64) any {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+func nullString(v string) any {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
+func deref[T any](p *T) T {
+	if p == nil {
+		return *new(T)
+	}
+	return *p
+}
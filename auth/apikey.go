@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+)
+
+var (
+	// ErrAPIKeyMalformed は API キーの書式が不正な場合に返されます。
+	ErrAPIKeyMalformed = ergo.NewSentinel("malformed api key")
+	// ErrAPIKeyNotFound は API キーが存在しない、またはシークレットが一致しない場合に返されます。
+	ErrAPIKeyNotFound = ergo.NewSentinel("api key not found")
+	// ErrAPIKeyExpired は API キーの有効期限が切れている場合に返されます。
+	ErrAPIKeyExpired = ergo.NewSentinel("api key expired")
+	// ErrAPIKeyRevoked は API キーが失効済みの場合に返されます。
+	ErrAPIKeyRevoked = ergo.NewSentinel("api key revoked")
+)
+
+const (
+	// DefaultAPIKeyPrefix は API キー文字列の先頭に付与される既定のプレフィックスです。
+	DefaultAPIKeyPrefix = "gld"
+
+	// apiKeyIDBytes はキー検索用 ID のバイト長です。
+	apiKeyIDBytes = 6
+	// apiKeySecretBytes はシークレット部のバイト長です。
+	apiKeySecretBytes = 32
+)
+
+// APIKey はデータストアに保存される API キーのレコードです。
+// シークレットそのものは保持せず、SHA-256 ハッシュのみを保存します。
+type APIKey struct {
+	// KeyID はキー文字列に埋め込まれた検索用の公開 ID です。
+	KeyID string `json:"key_id"`
+	// TenantID はキーが属するテナントの ID です。
+	TenantID string `json:"tenant_id"`
+	// UserID はキーの発行者、またはキーに紐づくサービスユーザーの ID です。
+	UserID int64 `json:"user_id"`
+	// RoleID はキーで実行される処理に適用されるロールの ID です。
+	RoleID int64 `json:"role_id"`
+	// Name は管理画面などで表示するためのキーの名称です。
+	Name string `json:"name"`
+	// Hash はシークレット部の SHA-256 ハッシュ (Hex) です。
+	Hash string `json:"-"`
+	// Scopes はキーに許可された操作範囲です。
+	Scopes []string `json:"scopes"`
+	// ExpiresAt はキーの有効期限です。nil の場合は無期限です。
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// RevokedAt はキーが失効された日時です。nil の場合は有効です。
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// LastUsedAt は最後に認証に成功した日時です。
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// CreatedAt はキーの作成日時です。
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HasScope はキーが指定されたスコープを持っているかどうかを判定します。
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// Claims は API キーの情報から、PASETO トークンと同じ形式の合成 Claims を生成します。
+// これにより RLS やテナントのミドルウェアをトークン認証と同様に利用できます。
+func (k *APIKey) Claims() *Claims {
+	return &Claims{
+		UserID:   k.UserID,
+		TenantID: k.TenantID,
+		RoleID:   k.RoleID,
+		Scopes:   slices.Clone(k.Scopes),
+		APIKeyID: k.KeyID,
+	}
+}
+
+// APIKeyStore は API キーの永続化を抽象化するインターフェースです。
+// 具体的な実装（PostgreSQLなど）はこのインターフェースを満たす必要があります。
+type APIKeyStore interface {
+	// FindAPIKeyByID は公開 ID からキーを取得します。
+	// 見つからない場合は ErrAPIKeyNotFound を返すことが期待されます。
+	FindAPIKeyByID(ctx context.Context, keyID string) (*APIKey, error)
+
+	// TouchAPIKey はキーの最終利用日時を更新します。
+	TouchAPIKey(ctx context.Context, keyID string, usedAt time.Time) error
+}
+
+// IssuedAPIKey は新規発行された API キーです。
+// PlainText は発行時に一度だけ利用者へ表示し、保存するのは Key のみとしてください。
+type IssuedAPIKey struct {
+	// PlainText は "<prefix>_<key_id>_<secret>" 形式のキー文字列です。
+	PlainText string
+	// Key はデータストアに保存するレコードです。
+	Key *APIKey
+}
+
+// GenerateAPIKey は新しい API キーを発行します。
+// prefix が空の場合は DefaultAPIKeyPrefix が使用されます。
+// 戻り値の Key には KeyID, Hash, Scopes, ExpiresAt, CreatedAt のみが設定されるため、
+// TenantID や UserID などは呼び出し元で設定してから保存してください。
+func GenerateAPIKey(prefix string, scopes []string, duration time.Duration) (*IssuedAPIKey, error) {
+	if prefix == "" {
+		prefix = DefaultAPIKeyPrefix
+	}
+	if strings.Contains(prefix, "_") {
+		return nil, ergo.New("api key prefix must not contain '_'", slog.String("prefix", prefix))
+	}
+
+	idBytes := make([]byte, apiKeyIDBytes)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, ergo.New("failed to generate api key id", slog.String("error", err.Error()))
+	}
+	secretBytes := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, ergo.New("failed to generate api key secret", slog.String("error", err.Error()))
+	}
+
+	keyID := hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	now := time.Now()
+	key := &APIKey{
+		KeyID:     keyID,
+		Hash:      hashAPIKeySecret(secret),
+		Scopes:    slices.Clone(scopes),
+		CreatedAt: now,
+	}
+	if duration > 0 {
+		expiresAt := now.Add(duration)
+		key.ExpiresAt = &expiresAt
+	}
+
+	return &IssuedAPIKey{
+		PlainText: prefix + "_" + keyID + "_" + secret,
+		Key:       key,
+	}, nil
+}
+
+// ParseAPIKey はキー文字列をプレフィックス、公開 ID、シークレットに分解します。
+func ParseAPIKey(plainText string) (prefix string, keyID string, secret string, err error) {
+	// シークレット部 (base64url) には '_' が含まれ得るため、先頭から 2 回だけ分割します
+	parts := strings.SplitN(plainText, "_", 3)
+	if len(parts) != 3 || parts[0] == "" || len(parts[1]) != apiKeyIDBytes*2 || parts[2] == "" {
+		return "", "", "", ErrAPIKeyMalformed
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// VerifyAPIKey はキー文字列を検証し、有効なキーのレコードを返します。
+// 検証に成功した場合はストアの最終利用日時も更新します（更新の失敗は認証結果に影響しません）。
+func VerifyAPIKey(ctx context.Context, store APIKeyStore, plainText string) (*APIKey, error) {
+	_, keyID, secret, err := ParseAPIKey(plainText)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := store.FindAPIKeyByID(ctx, keyID)
+	if err != nil {
+		return nil, ergo.Wrap(err, "failed to find api key", slog.String("key_id", keyID))
+	}
+	if key == nil {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	// タイミング攻撃を避けるため、ハッシュ同士を定数時間で比較します
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKeySecret(secret))) != 1 {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	now := time.Now()
+	if key.RevokedAt != nil && !key.RevokedAt.After(now) {
+		return nil, ErrAPIKeyRevoked
+	}
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(now) {
+		return nil, ErrAPIKeyExpired
+	}
+
+	if err := store.TouchAPIKey(ctx, key.KeyID, now); err != nil {
+		slog.WarnContext(ctx, "Failed to update api key last used", "key_id", key.KeyID, "error", err)
+	} else {
+		key.LastUsedAt = &now
+	}
+
+	return key, nil
+}
+
+// hashAPIKeySecret はシークレット部の SHA-256 ハッシュを Hex 文字列で返します。
+// API キーは十分なエントロピーを持つため、bcrypt ではなく高速なハッシュを使用します。
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
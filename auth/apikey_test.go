@@ -0,0 +1,150 @@
+package auth_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golaboratory/gloudia/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryAPIKeyStore はテスト用のインメモリ APIKeyStore です。
+type memoryAPIKeyStore struct {
+	keys    map[string]*auth.APIKey
+	touched map[string]time.Time
+}
+
+func newMemoryAPIKeyStore() *memoryAPIKeyStore {
+	return &memoryAPIKeyStore{
+		keys:    map[string]*auth.APIKey{},
+		touched: map[string]time.Time{},
+	}
+}
+
+func (s *memoryAPIKeyStore) FindAPIKeyByID(_ context.Context, keyID string) (*auth.APIKey, error) {
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, auth.ErrAPIKeyNotFound
+	}
+	copied := *key
+	return &copied, nil
+}
+
+func (s *memoryAPIKeyStore) TouchAPIKey(_ context.Context, keyID string, usedAt time.Time) error {
+	s.touched[keyID] = usedAt
+	return nil
+}
+
+func TestGenerateAPIKey(t *testing.T) {
+	t.Run("generates prefixed key with hashed secret", func(t *testing.T) {
+		issued, err := auth.GenerateAPIKey("", []string{"reports:read"}, time.Hour)
+		require.NoError(t, err)
+
+		assert.True(t, strings.HasPrefix(issued.PlainText, auth.DefaultAPIKeyPrefix+"_"))
+		assert.NotContains(t, issued.PlainText, issued.Key.Hash)
+		assert.Equal(t, []string{"reports:read"}, issued.Key.Scopes)
+		require.NotNil(t, issued.Key.ExpiresAt)
+
+		prefix, keyID, _, err := auth.ParseAPIKey(issued.PlainText)
+		require.NoError(t, err)
+		assert.Equal(t, auth.DefaultAPIKeyPrefix, prefix)
+		assert.Equal(t, issued.Key.KeyID, keyID)
+	})
+
+	t.Run("no expiry when duration is zero", func(t *testing.T) {
+		issued, err := auth.GenerateAPIKey("partner", nil, 0)
+		require.NoError(t, err)
+		assert.Nil(t, issued.Key.ExpiresAt)
+		assert.True(t, strings.HasPrefix(issued.PlainText, "partner_"))
+	})
+
+	t.Run("rejects prefix containing separator", func(t *testing.T) {
+		_, err := auth.GenerateAPIKey("bad_prefix", nil, 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestVerifyAPIKey(t *testing.T) {
+	ctx := context.Background()
+
+	newKey := func(t *testing.T, store *memoryAPIKeyStore, duration time.Duration) string {
+		t.Helper()
+		issued, err := auth.GenerateAPIKey("", []string{"reports:read"}, duration)
+		require.NoError(t, err)
+		issued.Key.TenantID = "tenant-a"
+		issued.Key.UserID = 42
+		issued.Key.RoleID = 3
+		store.keys[issued.Key.KeyID] = issued.Key
+		return issued.PlainText
+	}
+
+	t.Run("valid key returns record and updates last used", func(t *testing.T) {
+		store := newMemoryAPIKeyStore()
+		plain := newKey(t, store, time.Hour)
+
+		key, err := auth.VerifyAPIKey(ctx, store, plain)
+		require.NoError(t, err)
+		assert.Equal(t, "tenant-a", key.TenantID)
+		assert.NotNil(t, key.LastUsedAt)
+		assert.Contains(t, store.touched, key.KeyID)
+
+		claims := key.Claims()
+		assert.Equal(t, int64(42), claims.UserID)
+		assert.Equal(t, "tenant-a", claims.TenantID)
+		assert.Equal(t, int64(3), claims.RoleID)
+		assert.True(t, claims.IsAPIKey())
+		assert.True(t, claims.HasScope("reports:read"))
+		assert.False(t, claims.HasScope("reports:write"))
+	})
+
+	t.Run("wrong secret is rejected", func(t *testing.T) {
+		store := newMemoryAPIKeyStore()
+		plain := newKey(t, store, time.Hour)
+
+		tampered := plain[:len(plain)-1] + "x"
+		if tampered == plain {
+			tampered = plain[:len(plain)-1] + "y"
+		}
+		_, err := auth.VerifyAPIKey(ctx, store, tampered)
+		assert.ErrorIs(t, err, auth.ErrAPIKeyNotFound)
+	})
+
+	t.Run("malformed key is rejected", func(t *testing.T) {
+		_, err := auth.VerifyAPIKey(ctx, newMemoryAPIKeyStore(), "not-a-key")
+		assert.ErrorIs(t, err, auth.ErrAPIKeyMalformed)
+	})
+
+	t.Run("unknown key is rejected", func(t *testing.T) {
+		issued, err := auth.GenerateAPIKey("", nil, 0)
+		require.NoError(t, err)
+		_, err = auth.VerifyAPIKey(ctx, newMemoryAPIKeyStore(), issued.PlainText)
+		assert.ErrorIs(t, err, auth.ErrAPIKeyNotFound)
+	})
+
+	t.Run("expired key is rejected", func(t *testing.T) {
+		store := newMemoryAPIKeyStore()
+		plain := newKey(t, store, time.Hour)
+		expiredAt := time.Now().Add(-time.Minute)
+		for _, k := range store.keys {
+			k.ExpiresAt = &expiredAt
+		}
+
+		_, err := auth.VerifyAPIKey(ctx, store, plain)
+		assert.ErrorIs(t, err, auth.ErrAPIKeyExpired)
+	})
+
+	t.Run("revoked key is rejected", func(t *testing.T) {
+		store := newMemoryAPIKeyStore()
+		plain := newKey(t, store, time.Hour)
+		revokedAt := time.Now().Add(-time.Second)
+		for _, k := range store.keys {
+			k.RevokedAt = &revokedAt
+		}
+
+		_, err := auth.VerifyAPIKey(ctx, store, plain)
+		assert.ErrorIs(t, err, auth.ErrAPIKeyRevoked)
+	})
+}
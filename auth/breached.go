@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+)
+
+// BreachedPasswordChecker は、パスワードが既知の漏洩パスワードに含まれるかどうかを判定するインターフェースです。
+type BreachedPasswordChecker interface {
+	// IsBreached はパスワードが漏洩済みの場合に true と、漏洩データ中の出現回数を返します。
+	// 出現回数が不明な実装では 1 を返します。
+	IsBreached(ctx context.Context, password string) (bool, int, error)
+}
+
+// passwordSHA1 はパスワードの SHA-1 ハッシュを大文字の Hex 文字列で返します。
+// 漏洩パスワードのデータセット (Have I Been Pwned 形式) が SHA-1 で提供されているために使用します。
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// RangeBreachedPasswordChecker は k-匿名性を持つ範囲検索 API (Have I Been Pwned の Pwned Passwords 形式) を
+// 使用する BreachedPasswordChecker の実装です。
+// SHA-1 ハッシュの先頭 5 文字のみを送信するため、パスワードやハッシュ全体が外部に送信されることはありません。
+// BaseURL を変更することで、社内のミラーサーバーを参照できます。
+type RangeBreachedPasswordChecker struct {
+	// BaseURL は範囲検索 API のベース URL です。末尾にハッシュの先頭 5 文字が付与されます。
+	BaseURL string
+	// HTTPClient は API との通信に使用する HTTP クライアントです。nil の場合は 5 秒でタイムアウトするクライアントを使用します。
+	HTTPClient *http.Client
+	// MinCount は漏洩済みとみなす最小の出現回数です。0 以下の場合は 1 回でも出現すれば漏洩済みとみなします。
+	MinCount int
+}
+
+// DefaultPwnedPasswordsRangeURL は Have I Been Pwned の範囲検索 API の URL です。
+const DefaultPwnedPasswordsRangeURL = "https://api.pwnedpasswords.com/range/"
+
+// defaultRangeHTTPClient は HTTPClient が指定されていない場合に使用する HTTP クライアントです。
+var defaultRangeHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+// NewRangeBreachedPasswordChecker は新しい RangeBreachedPasswordChecker を作成します。
+// baseURL が空の場合は DefaultPwnedPasswordsRangeURL が使用されます。
+func NewRangeBreachedPasswordChecker(baseURL string) *RangeBreachedPasswordChecker {
+	if baseURL == "" {
+		baseURL = DefaultPwnedPasswordsRangeURL
+	}
+	return &RangeBreachedPasswordChecker{
+		BaseURL:    baseURL,
+		HTTPClient: defaultRangeHTTPClient,
+	}
+}
+
+// IsBreached はハッシュの先頭 5 文字で範囲検索を行い、残りのハッシュが結果に含まれるかを判定します。
+func (c *RangeBreachedPasswordChecker) IsBreached(ctx context.Context, password string) (bool, int, error) {
+	hash := passwordSHA1(password)
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+prefix, nil)
+	if err != nil {
+		return false, 0, ergo.New("failed to create range request", slog.String("error", err.Error()))
+	}
+	// レスポンスサイズから問い合わせ内容を推測されないよう、パディングを要求する
+	req.Header.Set("Add-Padding", "true")
+
+	client := c.HTTPClient
+	if client == nil {
+		client = defaultRangeHTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, 0, ergo.New("range request failed", slog.String("error", err.Error()))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, 0, ergo.New("range api returned an error", slog.Int("status", resp.StatusCode))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		candidate, countStr, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !strings.EqualFold(candidate, suffix) {
+			continue
+		}
+		count, _ := strconv.Atoi(countStr)
+		// パディング用のダミー行は出現回数が 0 となる
+		if count <= 0 || count < c.MinCount {
+			return false, count, nil
+		}
+		return true, count, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, 0, ergo.New("failed to read range response", slog.String("error", err.Error()))
+	}
+	return false, 0, nil
+}
+
+// FileBreachedPasswordChecker はローカルのファイルを使用する BreachedPasswordChecker の実装です。
+// インターネットに接続できない環境 (エアギャップ環境) で使用します。
+//
+// ファイルは 1 行に 1 件の "<SHA-1 ハッシュ (Hex)>[:<出現回数>]" を、ハッシュの昇順に並べた形式です
+// (Have I Been Pwned の "ordered by hash" 形式のダウンロードファイルと互換)。
+// ファイル全体をメモリに読み込まず、二分探索で検索するため、大きなファイルでも使用できます。
+type FileBreachedPasswordChecker struct {
+	file *os.File
+	size int64
+}
+
+// NewFileBreachedPasswordChecker は指定されたファイルを開いて FileBreachedPasswordChecker を作成します。
+// 使用後は Close を呼び出してください。
+func NewFileBreachedPasswordChecker(path string) (*FileBreachedPasswordChecker, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, ergo.New("failed to open breached password file", slog.String("error", err.Error()))
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ergo.New("failed to stat breached password file", slog.String("error", err.Error()))
+	}
+	return &FileBreachedPasswordChecker{file: f, size: info.Size()}, nil
+}
+
+// Close はファイルを閉じます。
+func (c *FileBreachedPasswordChecker) Close() error {
+	return c.file.Close()
+}
+
+// IsBreached はファイルを二分探索し、パスワードのハッシュが含まれるかを判定します。
+func (c *FileBreachedPasswordChecker) IsBreached(ctx context.Context, password string) (bool, int, error) {
+	target := passwordSHA1(password)
+
+	// 「offset 以降で最初に始まる行のハッシュが target 以上」となる最小の offset を探す
+	lo, hi := int64(0), c.size
+	for lo < hi {
+		if err := ctx.Err(); err != nil {
+			return false, 0, err
+		}
+		mid := lo + (hi-lo)/2
+		line, ok, err := c.lineAfter(mid)
+		if err != nil {
+			return false, 0, err
+		}
+		if !ok || hashOfLine(line) >= target {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	line, ok, err := c.lineAfter(lo)
+	if err != nil || !ok {
+		return false, 0, err
+	}
+	if hashOfLine(line) != target {
+		return false, 0, nil
+	}
+	_, countStr, found := strings.Cut(line, ":")
+	if !found {
+		return true, 1, nil
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if err != nil || count < 1 {
+		count = 1
+	}
+	return true, count, nil
+}
+
+// lineAfter は offset 以降で最初に始まる行を返します (offset が 0 の場合は先頭行)。
+// 該当する行がない場合は ok が false となります。
+func (c *FileBreachedPasswordChecker) lineAfter(offset int64) (string, bool, error) {
+	start := offset
+	if start > 0 {
+		// 直前の位置から読み始め、行の途中であれば次の行頭まで読み飛ばす
+		start--
+	}
+	reader := bufio.NewReader(io.NewSectionReader(c.file, start, c.size-start))
+	if offset > 0 {
+		if _, err := reader.ReadString('\n'); err != nil {
+			if err == io.EOF {
+				return "", false, nil
+			}
+			return "", false, ergo.New("failed to read breached password file", slog.String("error", err.Error()))
+		}
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", false, ergo.New("failed to read breached password file", slog.String("error", err.Error()))
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", false, nil
+	}
+	return line, true, nil
+}
+
+// hashOfLine は行からハッシュ部分を取り出し、大文字に正規化して返します。
+func hashOfLine(line string) string {
+	hash, _, _ := strings.Cut(line, ":")
+	return strings.ToUpper(strings.TrimSpace(hash))
+}
@@ -0,0 +1,170 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/golaboratory/gloudia/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestRangeBreachedPasswordChecker(t *testing.T) {
+	leaked := sha1Hex("password")
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		assert.Equal(t, "true", r.Header.Get("Add-Padding"))
+		prefix := strings.TrimPrefix(r.URL.Path, "/range/")
+		fmt.Fprintf(w, "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n")
+		if prefix == leaked[:5] {
+			fmt.Fprintf(w, "%s:3861493\r\n", strings.ToLower(leaked[5:]))
+		}
+		// パディング用のダミー行
+		fmt.Fprintf(w, "%s:0\r\n", sha1Hex("padding")[5:])
+	}))
+	t.Cleanup(srv.Close)
+
+	checker := auth.NewRangeBreachedPasswordChecker(srv.URL + "/range/")
+	ctx := context.Background()
+
+	breached, count, err := checker.IsBreached(ctx, "password")
+	require.NoError(t, err)
+	assert.True(t, breached)
+	assert.Equal(t, 3861493, count)
+	// ハッシュの先頭 5 文字のみが送信される
+	assert.Equal(t, "/range/"+leaked[:5], requested[0])
+
+	breached, _, err = checker.IsBreached(ctx, "Tr0ub4dor&3-unique")
+	require.NoError(t, err)
+	assert.False(t, breached)
+
+	breached, _, err = checker.IsBreached(ctx, "padding")
+	require.NoError(t, err)
+	assert.False(t, breached)
+
+	checker.MinCount = 5000000
+	breached, _, err = checker.IsBreached(ctx, "password")
+	require.NoError(t, err)
+	assert.False(t, breached)
+}
+
+func TestRangeBreachedPasswordCheckerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	_, _, err := auth.NewRangeBreachedPasswordChecker(srv.URL+"/").IsBreached(context.Background(), "password")
+	assert.Error(t, err)
+}
+
+func TestRangeBreachedPasswordCheckerLiteral(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+
+	// 構造体リテラルで HTTPClient を指定しない場合も動作する
+	checker := &auth.RangeBreachedPasswordChecker{BaseURL: srv.URL + "/"}
+	breached, _, err := checker.IsBreached(context.Background(), "password")
+	require.NoError(t, err)
+	assert.False(t, breached)
+}
+
+func TestFileBreachedPasswordChecker(t *testing.T) {
+	leaked := []string{"password", "123456", "qwerty", "letmein", "dragon", "monkey", "iloveyou"}
+	var lines []string
+	for i, p := range leaked {
+		if i%2 == 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d", sha1Hex(p), (i+1)*10))
+		} else {
+			lines = append(lines, sha1Hex(p))
+		}
+	}
+	slices.Sort(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600))
+
+	checker, err := auth.NewFileBreachedPasswordChecker(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { checker.Close() })
+
+	ctx := context.Background()
+	for i, p := range leaked {
+		breached, count, err := checker.IsBreached(ctx, p)
+		require.NoError(t, err)
+		assert.True(t, breached, p)
+		if i%2 == 0 {
+			assert.Equal(t, (i+1)*10, count, p)
+		} else {
+			assert.Equal(t, 1, count, p)
+		}
+	}
+
+	for _, p := range []string{"", "correct horse battery staple", "zzzzzzzz"} {
+		breached, _, err := checker.IsBreached(ctx, p)
+		require.NoError(t, err)
+		assert.False(t, breached, p)
+	}
+}
+
+type stubBreachedChecker struct {
+	breached bool
+	err      error
+}
+
+func (s stubBreachedChecker) IsBreached(context.Context, string) (bool, int, error) {
+	return s.breached, 1, s.err
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	ctx := context.Background()
+	policy := auth.PasswordPolicy{
+		IncludeUpper:  true,
+		IncludeLower:  true,
+		IncludeNumber: true,
+		MinLength:     8,
+	}
+
+	t.Run("returns all violations", func(t *testing.T) {
+		violations, err := policy.Validate(ctx, "abc")
+		require.NoError(t, err)
+		assert.Equal(t, []auth.PasswordViolation{auth.PasswordTooShort, auth.PasswordMissingUpper, auth.PasswordMissingNumber}, violations)
+	})
+
+	t.Run("breached password is reported as a violation", func(t *testing.T) {
+		p := policy
+		p.BreachedChecker = stubBreachedChecker{breached: true}
+		violations, err := p.Validate(ctx, "Passw0rdOK")
+		require.NoError(t, err)
+		assert.Equal(t, []auth.PasswordViolation{auth.PasswordBreached}, violations)
+		assert.NotEmpty(t, violations[0].Message())
+	})
+
+	t.Run("checker error", func(t *testing.T) {
+		p := policy
+		p.BreachedChecker = stubBreachedChecker{err: errors.New("unavailable")}
+		_, err := p.Validate(ctx, "Passw0rdOK")
+		assert.Error(t, err)
+
+		p.FailOpen = true
+		violations, err := p.Validate(ctx, "Passw0rdOK")
+		require.NoError(t, err)
+		assert.Empty(t, violations)
+	})
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+)
+
+// DefaultMaxImpersonationDuration はなりすましトークンの有効期間の既定の上限です。
+const DefaultMaxImpersonationDuration = 30 * time.Minute
+
+var (
+	// ErrNestedImpersonation はなりすまし中のトークンで、さらになりすましを開始しようとした場合に返されます。
+	ErrNestedImpersonation = ergo.NewSentinel("nested impersonation is not allowed")
+	// ErrNotImpersonating はなりすましトークンでない Claims で終了処理を行った場合に返されます。
+	ErrNotImpersonating = ergo.NewSentinel("not impersonating")
+	// ErrImpersonationSessionStoreRequired は SessionStore を指定せずに Impersonator を使用した場合に返されます。
+	// なりすましトークンはセッションとして登録しなければ失効できないため、SessionStore は必須です。
+	ErrImpersonationSessionStoreRequired = ergo.NewSentinel("impersonation requires a session store")
+)
+
+// ImpersonationEventType はなりすまし監査イベントの種類です。
+type ImpersonationEventType string
+
+const (
+	// ImpersonationStarted はなりすましの開始を表します。
+	ImpersonationStarted ImpersonationEventType = "started"
+	// ImpersonationEnded はなりすましの終了を表します。
+	ImpersonationEnded ImpersonationEventType = "ended"
+)
+
+// ImpersonationEvent はなりすましの開始・終了を記録する監査イベントです。
+type ImpersonationEvent struct {
+	ImpersonationID string                 `json:"impersonation_id"`
+	Type            ImpersonationEventType `json:"type"`
+	ActorUserID     int64                  `json:"actor_user_id"`
+	ActorTenantID   string                 `json:"actor_tenant_id"`
+	SubjectUserID   int64                  `json:"subject_user_id"`
+	SubjectTenantID string                 `json:"subject_tenant_id"`
+	Reason          string                 `json:"reason"`
+	OccurredAt      time.Time              `json:"occurred_at"`
+	ExpiresAt       time.Time              `json:"expires_at"`
+}
+
+// ImpersonationAuditSink はなりすまし監査イベントの記録先を抽象化するインターフェースです。
+// 具体的な実装（PostgreSQL、ログ基盤など）はこのインターフェースを満たす必要があります。
+type ImpersonationAuditSink interface {
+	RecordImpersonation(ctx context.Context, event *ImpersonationEvent) error
+}
+
+// SlogImpersonationAuditSink は監査イベントを slog に出力する ImpersonationAuditSink の実装です。
+// 専用の記録先を用意できない場合や開発環境向けの既定値として使用します。
+type SlogImpersonationAuditSink struct{}
+
+// RecordImpersonation は監査イベントを Warn レベルでログに出力します。
+func (SlogImpersonationAuditSink) RecordImpersonation(ctx context.Context, event *ImpersonationEvent) error {
+	slog.WarnContext(ctx, "Impersonation "+string(event.Type),
+		slog.String("impersonation_id", event.ImpersonationID),
+		slog.Int64("actor_user_id", event.ActorUserID),
+		slog.String("actor_tenant_id", event.ActorTenantID),
+		slog.Int64("subject_user_id", event.SubjectUserID),
+		slog.String("subject_tenant_id", event.SubjectTenantID),
+		slog.String("reason", event.Reason),
+		slog.Time("expires_at", event.ExpiresAt),
+	)
+	return nil
+}
+
+// Impersonator は管理者による代理ログイン（なりすまし）トークンの発行と、その監査記録を行う構造体です。
+// 発行したトークンはセッションとして登録されるため、End や SessionManager.Revoke で失効させることができます。
+type Impersonator struct {
+	maker *TokenMaker
+	store SessionStore
+	sink  ImpersonationAuditSink
+
+	// MaxDuration はなりすましトークンの有効期間の上限です。
+	// これを超える期間が指定された場合は MaxDuration に切り詰められます。
+	MaxDuration time.Duration
+}
+
+// NewImpersonator は新しい Impersonator を作成します。
+// store には SessionManager と同じ SessionStore を指定してください (必須です)。
+// 発行したトークンを失効させるため、NewAuthProviderWithConfig の AuthConfig.Sessions にも同じ SessionManager を指定してください。
+// sink が nil の場合は SlogImpersonationAuditSink が使用されます。
+func NewImpersonator(maker *TokenMaker, store SessionStore, sink ImpersonationAuditSink) *Impersonator {
+	if sink == nil {
+		sink = SlogImpersonationAuditSink{}
+	}
+	return &Impersonator{
+		maker:       maker,
+		store:       store,
+		sink:        sink,
+		MaxDuration: DefaultMaxImpersonationDuration,
+	}
+}
+
+// Start はなりすましを開始し、対象ユーザーとして振る舞うトークンを発行します。
+// 発行前に開始イベントを監査記録へ書き込み、記録に失敗した場合はトークンを発行しません。
+// トークンは対象ユーザーのセッションとして登録されます（Device は "impersonation"）。
+//
+// 引数:
+//   - actor: 操作を行う管理者の Claims
+//   - subjectUserID, subjectTenantID, subjectRoleID: なりすまし対象のユーザー情報
+//   - reason: なりすましの理由（問い合わせ番号など）
+//   - duration: トークンの有効期間（MaxDuration と TokenMaker.MaxImpersonationDuration が上限）
+func (i *Impersonator) Start(ctx context.Context, actor *Claims, subjectUserID int64, subjectTenantID string, subjectRoleID int64, reason string, duration time.Duration) (string, *ImpersonationEvent, error) {
+	if i.store == nil {
+		return "", nil, ErrImpersonationSessionStoreRequired
+	}
+	if actor.IsImpersonated() {
+		return "", nil, ErrNestedImpersonation
+	}
+	maxDuration := min(i.MaxDuration, i.maker.MaxImpersonationDuration)
+	if duration <= 0 || duration > maxDuration {
+		duration = maxDuration
+	}
+
+	impersonationID, err := newRandomID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	event := &ImpersonationEvent{
+		ImpersonationID: impersonationID,
+		Type:            ImpersonationStarted,
+		ActorUserID:     actor.UserID,
+		ActorTenantID:   actor.TenantID,
+		SubjectUserID:   subjectUserID,
+		SubjectTenantID: subjectTenantID,
+		Reason:          reason,
+		OccurredAt:      now,
+		ExpiresAt:       now.Add(duration),
+	}
+	if err := i.sink.RecordImpersonation(ctx, event); err != nil {
+		return "", nil, ergo.Wrap(err, "failed to record impersonation start")
+	}
+
+	sessionID, err := newRandomID()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := i.store.CreateSession(ctx, &Session{
+		ID:         sessionID,
+		UserID:     subjectUserID,
+		TenantID:   subjectTenantID,
+		Device:     "impersonation",
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  event.ExpiresAt,
+	}); err != nil {
+		return "", nil, ergo.Wrap(err, "failed to create impersonation session")
+	}
+
+	token, err := i.maker.CreateTokenWithClaims(&Claims{
+		UserID:          subjectUserID,
+		TenantID:        subjectTenantID,
+		RoleID:          subjectRoleID,
+		SessionID:       sessionID,
+		ActorUserID:     actor.UserID,
+		ActorTenantID:   actor.TenantID,
+		ImpersonationID: impersonationID,
+	}, duration)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, event, nil
+}
+
+// End はなりすましのトークンに紐づくセッションを失効させ、終了を監査記録へ書き込みます。
+// 以降、そのトークンは SessionManager.ValidateSession で拒否されます。
+func (i *Impersonator) End(ctx context.Context, claims *Claims, reason string) (*ImpersonationEvent, error) {
+	if i.store == nil {
+		return nil, ErrImpersonationSessionStoreRequired
+	}
+	if !claims.IsImpersonated() {
+		return nil, ErrNotImpersonating
+	}
+	if claims.SessionID == "" {
+		return nil, ErrSessionNotFound
+	}
+	if err := i.store.RevokeSession(ctx, claims.SessionID, time.Now()); err != nil {
+		return nil, ergo.Wrap(err, "failed to revoke impersonation session")
+	}
+
+	event := &ImpersonationEvent{
+		ImpersonationID: claims.ImpersonationID,
+		Type:            ImpersonationEnded,
+		ActorUserID:     claims.ActorUserID,
+		ActorTenantID:   claims.ActorTenantID,
+		SubjectUserID:   claims.UserID,
+		SubjectTenantID: claims.TenantID,
+		Reason:          reason,
+		OccurredAt:      time.Now(),
+	}
+	if err := i.sink.RecordImpersonation(ctx, event); err != nil {
+		return nil, ergo.Wrap(err, "failed to record impersonation end")
+	}
+	return event, nil
+}
@@ -0,0 +1,154 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+// memoryAuditSink はテスト用に監査イベントを保持する ImpersonationAuditSink です。
+type memoryAuditSink struct {
+	events []*auth.ImpersonationEvent
+	err    error
+}
+
+func (s *memoryAuditSink) RecordImpersonation(_ context.Context, event *auth.ImpersonationEvent) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestImpersonator(t *testing.T) {
+	ctx := context.Background()
+	maker, err := auth.NewTokenMaker(auth.GenerateRandomKey())
+	require.NoError(t, err)
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	store := auth.NewRedisSessionStore(rdb, "")
+	manager := auth.NewSessionManager(maker, store)
+
+	admin := &auth.Claims{UserID: 1, TenantID: "platform", RoleID: 99}
+
+	t.Run("issues token carrying actor and subject", func(t *testing.T) {
+		sink := &memoryAuditSink{}
+		impersonator := auth.NewImpersonator(maker, store, sink)
+
+		token, event, err := impersonator.Start(ctx, admin, 42, "tenant-a", 3, "ticket #123", 10*time.Minute)
+		require.NoError(t, err)
+		require.Len(t, sink.events, 1)
+		assert.Equal(t, auth.ImpersonationStarted, event.Type)
+
+		claims, err := maker.VerifyToken(token)
+		require.NoError(t, err)
+		assert.True(t, claims.IsImpersonated())
+		assert.Equal(t, int64(42), claims.UserID)
+		assert.Equal(t, "tenant-a", claims.TenantID)
+		assert.Equal(t, int64(3), claims.RoleID)
+		assert.Equal(t, int64(1), claims.ActorUserID)
+		assert.Equal(t, "platform", claims.ActorTenantID)
+		assert.Equal(t, event.ImpersonationID, claims.ImpersonationID)
+		assert.NotEmpty(t, claims.SessionID)
+		assert.NoError(t, manager.ValidateSession(ctx, claims))
+
+		ended, err := impersonator.End(ctx, claims, "resolved")
+		require.NoError(t, err)
+		assert.Equal(t, auth.ImpersonationEnded, ended.Type)
+		assert.Equal(t, event.ImpersonationID, ended.ImpersonationID)
+		assert.Len(t, sink.events, 2)
+
+		// 終了後のトークンは失効している
+		assert.ErrorIs(t, manager.ValidateSession(ctx, claims), auth.ErrSessionRevoked)
+	})
+
+	t.Run("rejects impersonation tokens without session", func(t *testing.T) {
+		claims := &auth.Claims{UserID: 42, TenantID: "tenant-a", ActorUserID: 1, ImpersonationID: "x"}
+		assert.ErrorIs(t, manager.ValidateSession(ctx, claims), auth.ErrSessionNotFound)
+	})
+
+	t.Run("caps duration to max", func(t *testing.T) {
+		impersonator := auth.NewImpersonator(maker, store, &memoryAuditSink{})
+		impersonator.MaxDuration = 5 * time.Minute
+
+		_, event, err := impersonator.Start(ctx, admin, 42, "tenant-a", 3, "", 24*time.Hour)
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(5*time.Minute), event.ExpiresAt, time.Second)
+	})
+
+	t.Run("rejects tokens exceeding the maximum lifetime at verification", func(t *testing.T) {
+		claims := &auth.Claims{UserID: 42, TenantID: "tenant-a", SessionID: "s", ActorUserID: 1, ImpersonationID: "x"}
+		_, err := maker.CreateTokenWithClaims(claims, 24*time.Hour)
+		assert.Error(t, err)
+
+		// 上限を緩めた TokenMaker で生成したトークンも、検証時に拒否する
+		key := auth.GenerateRandomKey()
+		lenient, err := auth.NewTokenMaker(key)
+		require.NoError(t, err)
+		lenient.MaxImpersonationDuration = 24 * time.Hour
+		strict, err := auth.NewTokenMaker(key)
+		require.NoError(t, err)
+
+		token, err := lenient.CreateTokenWithClaims(claims, 24*time.Hour)
+		require.NoError(t, err)
+		_, err = lenient.VerifyToken(token)
+		require.NoError(t, err)
+		_, err = strict.VerifyToken(token)
+		assert.ErrorIs(t, err, auth.ErrTokenInvalid)
+
+		// セッションに紐づかないなりすましトークンは生成できない
+		_, err = maker.CreateTokenWithClaims(&auth.Claims{UserID: 42, ActorUserID: 1, ImpersonationID: "x"}, time.Minute)
+		assert.Error(t, err)
+	})
+
+	t.Run("requires a session store", func(t *testing.T) {
+		impersonator := auth.NewImpersonator(maker, nil, &memoryAuditSink{})
+
+		_, _, err := impersonator.Start(ctx, admin, 42, "tenant-a", 3, "", time.Minute)
+		assert.ErrorIs(t, err, auth.ErrImpersonationSessionStoreRequired)
+		_, err = impersonator.End(ctx, &auth.Claims{UserID: 42, SessionID: "s", ActorUserID: 1, ImpersonationID: "x"}, "")
+		assert.ErrorIs(t, err, auth.ErrImpersonationSessionStoreRequired)
+	})
+
+	t.Run("rejects nested impersonation", func(t *testing.T) {
+		impersonator := auth.NewImpersonator(maker, store, &memoryAuditSink{})
+		impersonated := &auth.Claims{UserID: 42, TenantID: "tenant-a", ActorUserID: 1, ImpersonationID: "x"}
+
+		_, _, err := impersonator.Start(ctx, impersonated, 43, "tenant-a", 3, "", time.Minute)
+		assert.ErrorIs(t, err, auth.ErrNestedImpersonation)
+	})
+
+	t.Run("does not issue token when audit fails", func(t *testing.T) {
+		impersonator := auth.NewImpersonator(maker, store, &memoryAuditSink{err: errors.New("db down")})
+
+		token, _, err := impersonator.Start(ctx, admin, 42, "tenant-a", 3, "", time.Minute)
+		assert.Error(t, err)
+		assert.Empty(t, token)
+	})
+
+	t.Run("end requires impersonation claims", func(t *testing.T) {
+		impersonator := auth.NewImpersonator(maker, store, nil)
+
+		_, err := impersonator.End(ctx, admin, "")
+		assert.ErrorIs(t, err, auth.ErrNotImpersonating)
+	})
+
+	t.Run("regular tokens are not impersonated", func(t *testing.T) {
+		token, err := maker.CreateToken(1, "tenant-a", 2, time.Minute)
+		require.NoError(t, err)
+		claims, err := maker.VerifyToken(token)
+		require.NoError(t, err)
+		assert.False(t, claims.IsImpersonated())
+		assert.Zero(t, claims.ActorUserID)
+	})
+}
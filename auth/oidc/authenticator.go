@@ -0,0 +1,93 @@
+package oidc
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+// ErrIdentityNotLinked は外部 ID に対応するローカルユーザーが存在しない場合に、
+// IdentityMapper が返すことが期待されるエラーです。
+var ErrIdentityNotLinked = ergo.NewSentinel("external identity is not linked to a local user")
+
+// Identity は IdP で認証された外部ユーザーの情報です。
+type Identity struct {
+	// Issuer は IdP の Issuer URL です。Subject と組み合わせて外部ユーザーを一意に識別します。
+	Issuer string
+	// Subject は IdP 内で一意なユーザー識別子 (sub クレーム) です。
+	Subject string
+	// Email はユーザーのメールアドレスです。
+	Email string
+	// EmailVerified は IdP によってメールアドレスが確認済みかどうかです。
+	EmailVerified bool
+	// Name はユーザーの表示名です。
+	Name string
+	// IDToken は検証済みの ID トークンのクレーム全体です。
+	IDToken *IDTokenClaims
+}
+
+// IdentityMapper は外部 ID をローカルのユーザーに対応付けるインターフェースです。
+// 具体的な実装（ユーザーテーブルの検索、初回ログイン時の自動作成など）はアプリケーション側で行います。
+type IdentityMapper interface {
+	// MapIdentity は外部 ID に対応するローカルユーザーの Claims を返します。
+	// 対応するユーザーが存在しない場合は ErrIdentityNotLinked を返すことが期待されます。
+	MapIdentity(ctx context.Context, identity *Identity) (*auth.Claims, error)
+}
+
+// Authenticator は Provider、IdentityMapper、TokenMaker を組み合わせて、
+// 外部 IdP によるログインからローカルのトークン発行までを行う構造体です。
+type Authenticator struct {
+	provider *Provider
+	mapper   IdentityMapper
+	maker    *auth.TokenMaker
+
+	// TokenDuration は発行するトークンの有効期間です。
+	TokenDuration time.Duration
+}
+
+// NewAuthenticator は新しい Authenticator を作成します。トークンの有効期間は既定で 24 時間です。
+func NewAuthenticator(provider *Provider, mapper IdentityMapper, maker *auth.TokenMaker) *Authenticator {
+	return &Authenticator{
+		provider:      provider,
+		mapper:        mapper,
+		maker:         maker,
+		TokenDuration: 24 * time.Hour,
+	}
+}
+
+// Begin はログインを開始し、IdP へのリダイレクト URL と検証用の値を返します。
+// 戻り値の AuthRequest は Complete の呼び出しまで安全な場所に保存してください。
+func (a *Authenticator) Begin(extraParams map[string]string) (*AuthRequest, error) {
+	return a.provider.AuthCodeURL(extraParams)
+}
+
+// Complete はコールバックを検証して外部 ID をローカルユーザーに対応付け、
+// auth.TokenMaker で署名したトークンと、その Claims を返します。
+func (a *Authenticator) Complete(ctx context.Context, req *AuthRequest, callback url.Values) (string, *auth.Claims, error) {
+	idToken, _, err := a.provider.Exchange(ctx, req, callback)
+	if err != nil {
+		return "", nil, err
+	}
+
+	claims, err := a.mapper.MapIdentity(ctx, &Identity{
+		Issuer:        idToken.Issuer,
+		Subject:       idToken.Subject,
+		Email:         idToken.Email,
+		EmailVerified: idToken.EmailVerified,
+		Name:          idToken.Name,
+		IDToken:       idToken,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := a.maker.CreateToken(claims.UserID, claims.TenantID, claims.RoleID, a.TokenDuration)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
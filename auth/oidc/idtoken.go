@@ -0,0 +1,188 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+)
+
+var (
+	// ErrInvalidIDToken は ID トークンの形式・署名・クレームが不正な場合に返されます。
+	ErrInvalidIDToken = ergo.NewSentinel("invalid oidc id token")
+	// ErrIDTokenExpired は ID トークンの有効期限が切れている場合に返されます。
+	ErrIDTokenExpired = ergo.NewSentinel("oidc id token expired")
+)
+
+// audience は JWT の aud クレームです。文字列と文字列の配列の両方の形式を受け付けます。
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*a = multi
+	return nil
+}
+
+// IDTokenClaims は検証済みの ID トークンのクレームです。
+type IDTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp,omitempty"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	// HostedDomain は Google Workspace のドメイン (hd クレーム) です。
+	HostedDomain string `json:"hd,omitempty"`
+	// TenantID は Microsoft Entra ID のディレクトリ ID (tid クレーム) です。
+	TenantID string `json:"tid,omitempty"`
+
+	// Raw は上記以外のクレームも含む、ペイロード全体です。
+	Raw map[string]any `json:"-"`
+}
+
+// VerifyIDToken は ID トークンの署名と、iss / aud / exp / iat / nonce の各クレームを検証します。
+// nonce には認可リクエスト時に生成した値 (AuthRequest.Nonce) を指定します。リプレイ対策のため、空の場合はエラーとなります。
+func (p *Provider) VerifyIDToken(ctx context.Context, rawToken string, nonce string) (*IDTokenClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, ergo.Wrap(ErrInvalidIDToken, "malformed jwt")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ergo.Wrap(ErrInvalidIDToken, "malformed jwt header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, ergo.Wrap(ErrInvalidIDToken, "malformed jwt header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ergo.Wrap(ErrInvalidIDToken, "malformed jwt signature")
+	}
+
+	key, err := p.jwks.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ergo.Wrap(ErrInvalidIDToken, "malformed jwt payload")
+	}
+	claims := &IDTokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ergo.Wrap(ErrInvalidIDToken, "malformed jwt payload", slog.String("error", err.Error()))
+	}
+	if err := json.Unmarshal(payload, &claims.Raw); err != nil {
+		return nil, ergo.Wrap(ErrInvalidIDToken, "malformed jwt payload", slog.String("error", err.Error()))
+	}
+
+	if err := p.validateClaims(claims, nonce); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// validateClaims は署名検証済みの ID トークンのクレームを検証します (OpenID Connect Core 3.1.3.7)。
+func (p *Provider) validateClaims(claims *IDTokenClaims, nonce string) error {
+	if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(p.discovery.Issuer, "/") {
+		return ergo.Wrap(ErrInvalidIDToken, "issuer mismatch", slog.String("iss", claims.Issuer))
+	}
+
+	validAudience := false
+	for _, aud := range claims.Audience {
+		if aud == p.cfg.ClientID {
+			validAudience = true
+			break
+		}
+	}
+	if !validAudience {
+		return ergo.Wrap(ErrInvalidIDToken, "audience mismatch")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedBy != "" && claims.AuthorizedBy != p.cfg.ClientID {
+		return ergo.Wrap(ErrInvalidIDToken, "authorized party mismatch")
+	}
+
+	if claims.Subject == "" {
+		return ergo.Wrap(ErrInvalidIDToken, "subject is missing")
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(p.cfg.ClockSkew)) {
+		return ErrIDTokenExpired
+	}
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(p.cfg.ClockSkew)) {
+		return ergo.Wrap(ErrInvalidIDToken, "token issued in the future")
+	}
+
+	if nonce == "" {
+		return ergo.Wrap(ErrInvalidIDToken, "expected nonce is required")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return ergo.Wrap(ErrInvalidIDToken, "nonce mismatch")
+	}
+	return nil
+}
+
+// verifySignature は JWS の署名を検証します。RS256 と ES256 に対応しています。
+// "none" や HMAC など、公開鍵で検証できないアルゴリズムは拒否します。
+func verifySignature(alg string, key crypto.PublicKey, signingInput []byte, signature []byte) error {
+	digest := sha256.Sum256(signingInput)
+
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ergo.Wrap(ErrInvalidIDToken, "key type does not match alg")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return ergo.Wrap(ErrInvalidIDToken, "signature verification failed")
+		}
+		return nil
+
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ergo.Wrap(ErrInvalidIDToken, "key type does not match alg")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return ergo.Wrap(ErrInvalidIDToken, "signature verification failed")
+		}
+		return nil
+
+	default:
+		return ergo.Wrap(ErrInvalidIDToken, "unsupported alg", slog.String("alg", alg))
+	}
+}
@@ -0,0 +1,190 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+)
+
+// ErrUnknownKey は ID トークンの kid に対応する公開鍵が JWKS に存在しない場合に返されます。
+var ErrUnknownKey = ergo.NewSentinel("oidc signing key not found")
+
+// jwksMinRefreshInterval は未知の kid による JWKS の再取得の最小間隔です。
+// 不正なトークンを大量に送りつけられた場合に IdP へ過剰にリクエストしないために使用します。
+const jwksMinRefreshInterval = 10 * time.Second
+
+// minRSAKeyBits は受け入れる RSA 公開鍵の最小の鍵長です。
+const minRSAKeyBits = 2048
+
+// jsonWebKey は JWKS に含まれる 1 つの鍵 (RFC 7517) です。
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwksCache は IdP の公開鍵をキャッシュし、期限切れや鍵のローテーション時に再取得する構造体です。
+type jwksCache struct {
+	client *http.Client
+	uri    string
+	ttl    time.Duration
+
+	// refreshMu は JWKS の取得を直列化します。取得中もキャッシュ済みの鍵は mu で読み取れます。
+	refreshMu sync.Mutex
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newJWKSCache(client *http.Client, uri string, ttl time.Duration) *jwksCache {
+	return &jwksCache{
+		client: client,
+		uri:    uri,
+		ttl:    ttl,
+		keys:   map[string]crypto.PublicKey{},
+	}
+}
+
+// key は kid に対応する公開鍵を返します。
+// キャッシュの期限切れ、または未知の kid の場合は JWKS を再取得します。
+// 再取得は 1 つのゴルーチンのみが行い、その間もキャッシュが有効な鍵の検証はブロックしません。
+func (c *jwksCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if key, ok, _ := c.lookup(kid); ok {
+		return key, nil
+	}
+
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	// 待機中に他のゴルーチンが再取得した場合は、その結果を使用する
+	key, ok, fetchedAt := c.lookup(kid)
+	if ok {
+		return key, nil
+	}
+
+	// 未知の kid の場合も鍵のローテーションを考慮して再取得する (ただし間隔を制限)
+	if since := time.Since(fetchedAt); since >= c.ttl || since >= jwksMinRefreshInterval {
+		if err := c.refresh(ctx); err != nil {
+			// 取得に失敗しても、キャッシュ済みの鍵があれば使用を継続する
+			c.mu.RLock()
+			key, ok := c.keys[kid]
+			c.mu.RUnlock()
+			if ok {
+				slog.WarnContext(ctx, "Failed to refresh jwks, using cached key", "error", err)
+				return key, nil
+			}
+			return nil, err
+		}
+	}
+
+	if key, ok, _ := c.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, ergo.Wrap(ErrUnknownKey, "unknown kid", slog.String("kid", kid))
+}
+
+// lookup はキャッシュが有効な場合に kid に対応する公開鍵を返します。あわせて最後に取得した時刻を返します。
+func (c *jwksCache) lookup(kid string) (crypto.PublicKey, bool, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key, ok := c.keys[kid]
+	return key, ok && time.Since(c.fetchedAt) < c.ttl, c.fetchedAt
+}
+
+// refresh は JWKS を取得してキャッシュを置き換えます。呼び出し元で refreshMu のロックを取得してください。
+func (c *jwksCache) refresh(ctx context.Context) error {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, c.client, c.uri, &set); err != nil {
+		return ergo.Wrap(err, "failed to fetch jwks")
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			slog.WarnContext(ctx, "Skipping unsupported jwk", "kid", jwk.Kid, "error", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// publicKey は JWK を crypto.PublicKey に変換します。RSA と EC (P-256) に対応しています。
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, ergo.New("invalid rsa modulus")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ergo.New("invalid rsa exponent")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		modulus := new(big.Int).SetBytes(n)
+		if modulus.BitLen() < minRSAKeyBits {
+			return nil, ergo.New("rsa key is too short", slog.Int("bits", modulus.BitLen()))
+		}
+		return &rsa.PublicKey{N: modulus, E: exponent}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, ergo.New("unsupported ec curve", slog.String("crv", k.Crv))
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, ergo.New("invalid ec x coordinate")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, ergo.New("invalid ec y coordinate")
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, ergo.New("invalid ec coordinate length")
+		}
+		// SEC 1 の非圧縮形式 (0x04 || X || Y) に変換して、曲線上の点であることも検証する
+		point := append(append([]byte{0x04}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, ergo.New("invalid ec public key", slog.String("error", err.Error()))
+		}
+		return key, nil
+
+	default:
+		return nil, ergo.New("unsupported key type", slog.String("kty", k.Kty))
+	}
+}
@@ -0,0 +1,32 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONWebKey_RSAKeySize(t *testing.T) {
+	jwk := func(t *testing.T, bits int) jsonWebKey {
+		t.Helper()
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		require.NoError(t, err)
+		return jsonWebKey{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	}
+
+	_, err := jwk(t, 1024).publicKey()
+	assert.Error(t, err)
+
+	key, err := jwk(t, 2048).publicKey()
+	require.NoError(t, err)
+	assert.Equal(t, 2048, key.(*rsa.PublicKey).N.BitLen())
+}
@@ -0,0 +1,355 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+	"github.com/golaboratory/gloudia/auth/oidc"
+)
+
+const testClientID = "gloudia-client"
+
+// fakeIdP は httptest 上で動作する最小限の OpenID Provider です。
+type fakeIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu         sync.Mutex
+	challenge  string
+	nonce      string
+	claims     map[string]any
+	jwksHits   int
+	tokenCalls int
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idp := &fakeIdP{key: key, kid: "key-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		idp.jwksHits++
+		idp.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": idp.kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		idp.tokenCalls++
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "valid-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		claims := map[string]any{
+			"iss":            idp.server.URL,
+			"sub":            "external-user-1",
+			"aud":            testClientID,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          idp.nonce,
+			"email":          "taro@example.com",
+			"email_verified": true,
+		}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idp.sign(t, claims),
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// authorize は利用者が IdP でログインした状況を模擬し、認可 URL から PKCE と nonce の値を記録します。
+func (idp *fakeIdP) authorize(t *testing.T, authURL string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	q := u.Query()
+	require.Equal(t, "S256", q.Get("code_challenge_method"))
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.challenge = q.Get("code_challenge")
+	idp.nonce = q.Get("nonce")
+}
+
+func (idp *fakeIdP) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": idp.kid})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// mapperFunc は関数を IdentityMapper として扱うためのアダプターです。
+type mapperFunc func(ctx context.Context, identity *oidc.Identity) (*auth.Claims, error)
+
+func (f mapperFunc) MapIdentity(ctx context.Context, identity *oidc.Identity) (*auth.Claims, error) {
+	return f(ctx, identity)
+}
+
+func newTestProvider(t *testing.T, idp *fakeIdP) *oidc.Provider {
+	t.Helper()
+	provider, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:       idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example.com/callback",
+	})
+	require.NoError(t, err)
+	return provider
+}
+
+func TestAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	maker, err := auth.NewTokenMaker(auth.GenerateRandomKey())
+	require.NoError(t, err)
+
+	mapper := mapperFunc(func(_ context.Context, identity *oidc.Identity) (*auth.Claims, error) {
+		if identity.Subject != "external-user-1" || !identity.EmailVerified {
+			return nil, oidc.ErrIdentityNotLinked
+		}
+		return &auth.Claims{UserID: 7, TenantID: "tenant-a", RoleID: 2}, nil
+	})
+
+	t.Run("completes login and issues local token", func(t *testing.T) {
+		idp := newFakeIdP(t)
+		authenticator := oidc.NewAuthenticator(newTestProvider(t, idp), mapper, maker)
+
+		req, err := authenticator.Begin(map[string]string{"prompt": "select_account"})
+		require.NoError(t, err)
+		assert.Contains(t, req.URL, "prompt=select_account")
+		idp.authorize(t, req.URL)
+
+		token, claims, err := authenticator.Complete(ctx, req, url.Values{"code": {"valid-code"}, "state": {req.State}})
+		require.NoError(t, err)
+		assert.Equal(t, int64(7), claims.UserID)
+
+		verified, err := maker.VerifyToken(token)
+		require.NoError(t, err)
+		assert.Equal(t, "tenant-a", verified.TenantID)
+	})
+
+	t.Run("rejects state mismatch", func(t *testing.T) {
+		idp := newFakeIdP(t)
+		authenticator := oidc.NewAuthenticator(newTestProvider(t, idp), mapper, maker)
+
+		req, err := authenticator.Begin(nil)
+		require.NoError(t, err)
+		idp.authorize(t, req.URL)
+
+		_, _, err = authenticator.Complete(ctx, req, url.Values{"code": {"valid-code"}, "state": {"forged"}})
+		assert.ErrorIs(t, err, oidc.ErrStateMismatch)
+		assert.Zero(t, idp.tokenCalls)
+	})
+
+	t.Run("requires a nonce in the auth request", func(t *testing.T) {
+		idp := newFakeIdP(t)
+		authenticator := oidc.NewAuthenticator(newTestProvider(t, idp), mapper, maker)
+
+		req, err := authenticator.Begin(nil)
+		require.NoError(t, err)
+		idp.authorize(t, req.URL)
+
+		req.Nonce = ""
+		_, _, err = authenticator.Complete(ctx, req, url.Values{"code": {"valid-code"}, "state": {req.State}})
+		assert.Error(t, err)
+		assert.Zero(t, idp.tokenCalls)
+	})
+
+	t.Run("reports idp errors", func(t *testing.T) {
+		idp := newFakeIdP(t)
+		authenticator := oidc.NewAuthenticator(newTestProvider(t, idp), mapper, maker)
+
+		req, err := authenticator.Begin(nil)
+		require.NoError(t, err)
+
+		_, _, err = authenticator.Complete(ctx, req, url.Values{"error": {"access_denied"}, "state": {req.State}})
+		assert.ErrorIs(t, err, oidc.ErrAuthorizationDenied)
+	})
+
+	t.Run("rejects wrong pkce verifier", func(t *testing.T) {
+		idp := newFakeIdP(t)
+		authenticator := oidc.NewAuthenticator(newTestProvider(t, idp), mapper, maker)
+
+		req, err := authenticator.Begin(nil)
+		require.NoError(t, err)
+		idp.authorize(t, req.URL)
+
+		req.CodeVerifier = "tampered"
+		_, _, err = authenticator.Complete(ctx, req, url.Values{"code": {"valid-code"}, "state": {req.State}})
+		assert.Error(t, err)
+	})
+
+	t.Run("rejects nonce mismatch", func(t *testing.T) {
+		idp := newFakeIdP(t)
+		authenticator := oidc.NewAuthenticator(newTestProvider(t, idp), mapper, maker)
+
+		req, err := authenticator.Begin(nil)
+		require.NoError(t, err)
+		idp.authorize(t, req.URL)
+		idp.claims = map[string]any{"nonce": "replayed"}
+
+		_, _, err = authenticator.Complete(ctx, req, url.Values{"code": {"valid-code"}, "state": {req.State}})
+		assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+	})
+
+	t.Run("unlinked identity is rejected", func(t *testing.T) {
+		idp := newFakeIdP(t)
+		authenticator := oidc.NewAuthenticator(newTestProvider(t, idp), mapper, maker)
+
+		req, err := authenticator.Begin(nil)
+		require.NoError(t, err)
+		idp.authorize(t, req.URL)
+		idp.claims = map[string]any{"sub": "someone-else"}
+
+		_, _, err = authenticator.Complete(ctx, req, url.Values{"code": {"valid-code"}, "state": {req.State}})
+		assert.ErrorIs(t, err, oidc.ErrIdentityNotLinked)
+	})
+}
+
+// testNonce は VerifyIDToken のテストで使用する nonce です。
+const testNonce = "nonce-1"
+
+func TestProvider_VerifyIDToken(t *testing.T) {
+	ctx := context.Background()
+	idp := newFakeIdP(t)
+	provider := newTestProvider(t, idp)
+
+	base := func() map[string]any {
+		return map[string]any{
+			"iss":   idp.server.URL,
+			"sub":   "external-user-1",
+			"aud":   []string{testClientID, "other"},
+			"azp":   testClientID,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": testNonce,
+		}
+	}
+
+	t.Run("valid token with audience array", func(t *testing.T) {
+		claims, err := provider.VerifyIDToken(ctx, idp.sign(t, base()), testNonce)
+		require.NoError(t, err)
+		assert.Equal(t, "external-user-1", claims.Subject)
+		assert.Equal(t, testClientID, claims.Raw["azp"])
+	})
+
+	t.Run("caches jwks between verifications", func(t *testing.T) {
+		before := idp.jwksHits
+		for range 3 {
+			_, err := provider.VerifyIDToken(ctx, idp.sign(t, base()), testNonce)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, before, idp.jwksHits)
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		c := base()
+		c["exp"] = time.Now().Add(-time.Hour).Unix()
+		_, err := provider.VerifyIDToken(ctx, idp.sign(t, c), testNonce)
+		assert.ErrorIs(t, err, oidc.ErrIDTokenExpired)
+	})
+
+	t.Run("wrong issuer or audience", func(t *testing.T) {
+		c := base()
+		c["iss"] = "https://evil.example.com"
+		_, err := provider.VerifyIDToken(ctx, idp.sign(t, c), testNonce)
+		assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+
+		c = base()
+		c["aud"] = "another-client"
+		_, err = provider.VerifyIDToken(ctx, idp.sign(t, c), testNonce)
+		assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+	})
+
+	t.Run("tampered payload", func(t *testing.T) {
+		token := idp.sign(t, base())
+		other := idp.sign(t, map[string]any{"iss": idp.server.URL, "sub": "admin", "aud": testClientID, "exp": time.Now().Add(time.Hour).Unix()})
+
+		// 別のトークンのペイロードに差し替えると署名が一致しない
+		parts := strings.Split(token, ".")
+		parts[1] = strings.Split(other, ".")[1]
+		_, err := provider.VerifyIDToken(ctx, parts[0]+"."+parts[1]+"."+parts[2], testNonce)
+		assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+	})
+
+	t.Run("nonce is required", func(t *testing.T) {
+		token := idp.sign(t, base())
+		_, err := provider.VerifyIDToken(ctx, token, "")
+		assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+		_, err = provider.VerifyIDToken(ctx, token, "other")
+		assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+	})
+
+	t.Run("alg none is rejected", func(t *testing.T) {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"key-1"}`))
+		payload, _ := json.Marshal(base())
+		_, err := provider.VerifyIDToken(ctx, header+"."+base64.RawURLEncoding.EncodeToString(payload)+".", testNonce)
+		assert.ErrorIs(t, err, oidc.ErrInvalidIDToken)
+	})
+}
+
+func TestNewProvider_IssuerMismatch(t *testing.T) {
+	idp := newFakeIdP(t)
+	_, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:      idp.server.URL + "/other",
+		ClientID:    testClientID,
+		RedirectURL: "https://app.example.com/callback",
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,289 @@
+// Package oidc は OpenID Connect (OAuth2 認可コードフロー + PKCE) によるログインを提供します。
+// Google Workspace や Microsoft Entra ID などの外部 IdP で認証したユーザーを、
+// IdentityMapper を通じてローカルのユーザーに対応付け、auth.TokenMaker のトークンを発行します。
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+)
+
+var (
+	// ErrStateMismatch はコールバックの state が認可リクエスト時の値と一致しない場合に返されます。
+	ErrStateMismatch = ergo.NewSentinel("oidc state mismatch")
+	// ErrAuthorizationDenied は IdP が認可エラー (error パラメータ) を返した場合に返されます。
+	ErrAuthorizationDenied = ergo.NewSentinel("oidc authorization denied")
+)
+
+// Config は OIDC プロバイダーの設定構造体です。
+type Config struct {
+	// Issuer は IdP の Issuer URL です (例: "https://accounts.google.com")。
+	// "<Issuer>/.well-known/openid-configuration" からエンドポイント情報を取得します。
+	Issuer string
+	// ClientID は IdP に登録したクライアントの ID です。
+	ClientID string
+	// ClientSecret は IdP に登録したクライアントのシークレットです。
+	// パブリッククライアント (PKCE のみ) の場合は空にします。
+	ClientSecret string
+	// RedirectURL は認可後に IdP からリダイレクトされるコールバック URL です。
+	RedirectURL string
+	// Scopes は要求するスコープです。空の場合は "openid email profile" が使用されます。
+	Scopes []string
+	// HTTPClient は IdP との通信に使用する HTTP クライアントです。nil の場合は 10 秒のタイムアウトを持つクライアントが使用されます。
+	HTTPClient *http.Client
+	// JWKSCacheTTL は署名検証用の公開鍵 (JWKS) をキャッシュする期間です。0 の場合は 1 時間です。
+	JWKSCacheTTL time.Duration
+	// ClockSkew は ID トークンの有効期限検証で許容する時刻のずれです。0 の場合は 1 分です。
+	ClockSkew time.Duration
+}
+
+// Discovery は OpenID Provider Metadata のうち、本パッケージで使用する項目です。
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint,omitempty"`
+}
+
+// Provider は 1 つの IdP との OIDC 通信を行う構造体です。
+type Provider struct {
+	cfg       Config
+	discovery Discovery
+	client    *http.Client
+	jwks      *jwksCache
+}
+
+// NewProvider は Discovery ドキュメントを取得して新しい Provider を作成します。
+func NewProvider(ctx context.Context, cfg Config) (*Provider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, ergo.New("oidc issuer, client id and redirect url are required")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.JWKSCacheTTL == 0 {
+		cfg.JWKSCacheTTL = time.Hour
+	}
+	if cfg.ClockSkew == 0 {
+		cfg.ClockSkew = time.Minute
+	}
+
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	var discovery Discovery
+	if err := getJSON(ctx, cfg.HTTPClient, discoveryURL, &discovery); err != nil {
+		return nil, ergo.Wrap(err, "failed to fetch oidc discovery document")
+	}
+
+	// Issuer の詐称を防ぐため、設定値と Discovery の値が一致することを確認
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(cfg.Issuer, "/") {
+		return nil, ergo.New("oidc issuer mismatch",
+			slog.String("expected", cfg.Issuer),
+			slog.String("actual", discovery.Issuer))
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, ergo.New("oidc discovery document is missing required endpoints")
+	}
+
+	return &Provider{
+		cfg:       cfg,
+		discovery: discovery,
+		client:    cfg.HTTPClient,
+		jwks:      newJWKSCache(cfg.HTTPClient, discovery.JWKSURI, cfg.JWKSCacheTTL),
+	}, nil
+}
+
+// Discovery は取得済みの Discovery ドキュメントを返します。
+func (p *Provider) Discovery() Discovery {
+	return p.discovery
+}
+
+// AuthRequest は認可リクエストの開始時に生成され、コールバックの検証に使用する値です。
+// URL 以外の値は、署名付き Cookie やサーバー側セッションなど改ざんできない場所に保存してください。
+type AuthRequest struct {
+	// URL は利用者をリダイレクトさせる IdP の認可エンドポイントの URL です。
+	URL string `json:"-"`
+	// State は CSRF 対策のためのランダム値です。
+	State string `json:"state"`
+	// Nonce は ID トークンのリプレイ対策のためのランダム値です。
+	Nonce string `json:"nonce"`
+	// CodeVerifier は PKCE のコード検証値です。
+	CodeVerifier string `json:"code_verifier"`
+}
+
+// AuthCodeURL は state, nonce, PKCE の値を生成し、認可エンドポイントの URL を組み立てます。
+// extraParams には "hd" (Google のドメイン制限) や "prompt" などの追加パラメータを指定できます。
+func (p *Provider) AuthCodeURL(extraParams map[string]string) (*AuthRequest, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomString(48)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(p.discovery.AuthorizationEndpoint)
+	if err != nil {
+		return nil, ergo.New("invalid authorization endpoint", slog.String("error", err.Error()))
+	}
+	query := u.Query()
+	for k, v := range extraParams {
+		query.Set(k, v)
+	}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.ClientID)
+	query.Set("redirect_uri", p.cfg.RedirectURL)
+	query.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallengeS256(verifier))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+
+	return &AuthRequest{
+		URL:          u.String(),
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+	}, nil
+}
+
+// TokenResponse はトークンエンドポイントのレスポンスです。
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	IDToken      string `json:"id_token"`
+}
+
+// Exchange はコールバックで受け取ったクエリパラメータを検証し、認可コードをトークンと交換します。
+// state の照合、PKCE の検証値の送信、ID トークンの署名・nonce の検証までを行います。
+//
+// 引数:
+//   - req: AuthCodeURL で生成し、保存しておいた AuthRequest
+//   - callback: コールバック URL のクエリパラメータ (code, state, error など)
+func (p *Provider) Exchange(ctx context.Context, req *AuthRequest, callback url.Values) (*IDTokenClaims, *TokenResponse, error) {
+	if errCode := callback.Get("error"); errCode != "" {
+		return nil, nil, ergo.Wrap(ErrAuthorizationDenied, "idp returned an error",
+			slog.String("error", errCode),
+			slog.String("error_description", callback.Get("error_description")))
+	}
+	if req == nil || req.State == "" || subtle.ConstantTimeCompare([]byte(callback.Get("state")), []byte(req.State)) != 1 {
+		return nil, nil, ErrStateMismatch
+	}
+	// nonce がない場合は ID トークンのリプレイを検出できないため、トークンの交換を行わない
+	if req.Nonce == "" {
+		return nil, nil, ergo.New("oidc auth request has no nonce")
+	}
+	code := callback.Get("code")
+	if code == "" {
+		return nil, nil, ergo.New("authorization code is missing")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", req.CodeVerifier)
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, ergo.New("failed to create token request", slog.String("error", err.Error()))
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, nil, ergo.New("token request failed", slog.String("error", err.Error()))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, ergo.New("failed to read token response", slog.String("error", err.Error()))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, ergo.New("token endpoint returned an error",
+			slog.Int("status", resp.StatusCode),
+			slog.String("body", string(body)))
+	}
+
+	token := &TokenResponse{}
+	if err := json.Unmarshal(body, token); err != nil {
+		return nil, nil, ergo.New("failed to decode token response", slog.String("error", err.Error()))
+	}
+	if token.IDToken == "" {
+		return nil, nil, ergo.New("token response does not contain id_token")
+	}
+
+	claims, err := p.VerifyIDToken(ctx, token.IDToken, req.Nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claims, token, nil
+}
+
+// getJSON は GET リクエストを送信し、JSON レスポンスを v にデコードします。
+func getJSON(ctx context.Context, client *http.Client, rawURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return ergo.New("failed to create request", slog.String("error", err.Error()))
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return ergo.New("request failed", slog.String("url", rawURL), slog.String("error", err.Error()))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ergo.New(fmt.Sprintf("unexpected status %d", resp.StatusCode), slog.String("url", rawURL))
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return ergo.New("failed to decode response", slog.String("url", rawURL), slog.String("error", err.Error()))
+	}
+	return nil
+}
+
+// randomString は n バイトの乱数を base64url (パディングなし) でエンコードした文字列を返します。
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", ergo.New("failed to generate random value", slog.String("error", err.Error()))
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallengeS256 は PKCE のコード検証値から S256 のコードチャレンジを計算します。
+func codeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
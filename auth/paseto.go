@@ -3,22 +3,64 @@ package auth
 import (
 	"encoding/hex"
 	"log/slog"
+	"slices"
 	"time"
 
 	"aidanwoods.dev/go-paseto"
 	"github.com/newmo-oss/ergo"
 )
 
+var (
+	// ErrTokenInvalid はトークンの形式が不正、または復号・署名検証に失敗した場合のエラーです。
+	ErrTokenInvalid = ergo.NewSentinel("invalid token")
+	// ErrTokenExpired はトークンの有効期限が切れている場合のエラーです。
+	ErrTokenExpired = ergo.NewSentinel("token expired")
+)
+
 // Claims はトークンに含まれるペイロード情報を定義します。
 type Claims struct {
 	UserID   int64  `json:"user_id"`
 	TenantID string `json:"tenant_id"`
 	RoleID   int64  `json:"role_id"`
+
+	// Scopes は API キー認証時に許可された操作範囲です。トークン認証時は空です。
+	Scopes []string `json:"scopes,omitempty"`
+	// APIKeyID は API キー認証時のキーの公開 ID です。トークン認証時は空です。
+	APIKeyID string `json:"api_key_id,omitempty"`
+	// SessionID はセッション管理を利用する場合に、トークンに紐づくセッションの ID です。
+	SessionID string `json:"session_id,omitempty"`
+
+	// ActorUserID はなりすまし（代理ログイン）トークンの場合に、操作を行っている管理者のユーザー ID です。
+	ActorUserID int64 `json:"actor_user_id,omitempty"`
+	// ActorTenantID はなりすましトークンの場合に、操作を行っている管理者のテナント ID です。
+	ActorTenantID string `json:"actor_tenant_id,omitempty"`
+	// ImpersonationID はなりすましトークンの場合に、開始から終了までを識別するための ID です。
+	ImpersonationID string `json:"impersonation_id,omitempty"`
+}
+
+// IsAPIKey は Claims が API キー認証によって生成されたものかどうかを判定します。
+func (c *Claims) IsAPIKey() bool {
+	return c.APIKeyID != ""
+}
+
+// IsImpersonated は Claims がなりすましトークンによるものかどうかを判定します。
+// true の場合、UserID / TenantID はなりすまし対象のユーザーを、ActorUserID は操作している管理者を表します。
+func (c *Claims) IsImpersonated() bool {
+	return c.ImpersonationID != ""
+}
+
+// HasScope は Claims が指定されたスコープを持っているかどうかを判定します。
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
 }
 
 // TokenMaker は PASETO トークンの生成と検証を行う構造体です。
 type TokenMaker struct {
 	symmetricKey paseto.V4SymmetricKey
+
+	// MaxImpersonationDuration はなりすましトークンの有効期間の上限です。既定値は DefaultMaxImpersonationDuration です。
+	// これを超える有効期間のなりすましトークンは、生成も検証も拒否されます (Impersonator.MaxDuration もこの値が上限となります)。
+	MaxImpersonationDuration time.Duration
 }
 
 // NewTokenMaker は Hexエンコードされた32バイトの秘密鍵から TokenMaker を生成します。
@@ -39,12 +81,34 @@ func NewTokenMaker(hexKey string) (*TokenMaker, error) {
 	}
 
 	return &TokenMaker{
-		symmetricKey: key,
+		symmetricKey:             key,
+		MaxImpersonationDuration: DefaultMaxImpersonationDuration,
 	}, nil
 }
 
 // CreateToken はユーザー情報を受け取り、署名・暗号化された PASETO トークン文字列を生成します。
 func (maker *TokenMaker) CreateToken(userID int64, tenantID string, roleID int64, duration time.Duration) (string, error) {
+	return maker.CreateTokenWithClaims(&Claims{
+		UserID:   userID,
+		TenantID: tenantID,
+		RoleID:   roleID,
+	}, duration)
+}
+
+// CreateTokenWithClaims は Claims を受け取り、署名・暗号化された PASETO トークン文字列を生成します。
+// セッション ID など、CreateToken の引数にない情報を含める場合に使用します。
+// なりすましトークン (ImpersonationID を指定した場合) は、SessionID と MaxImpersonationDuration 以内の有効期間が必要です。
+func (maker *TokenMaker) CreateTokenWithClaims(claims *Claims, duration time.Duration) (string, error) {
+	if claims.ImpersonationID != "" {
+		if claims.SessionID == "" {
+			return "", ergo.New("impersonation token requires a session id")
+		}
+		if duration > maker.MaxImpersonationDuration {
+			return "", ergo.New("impersonation token duration exceeds the maximum",
+				slog.Duration("duration", duration), slog.Duration("max", maker.MaxImpersonationDuration))
+		}
+	}
+
 	token := paseto.NewToken()
 
 	// 標準クレームの設定
@@ -55,9 +119,19 @@ func (maker *TokenMaker) CreateToken(userID int64, tenantID string, roleID int64
 	// カスタムクレームの設定 (JSONとしてシリアライズ可能な型を渡す)
 	// ※ int64はJSONでは数値ですが、Pasetoライブラリの仕様に合わせて文字列化するか、SetString等を使うか選択します。
 	// ここでは汎用的な Set メソッドを使用します。
-	token.Set("user_id", userID)
-	token.Set("tenant_id", tenantID)
-	token.Set("role_id", roleID)
+	token.Set("user_id", claims.UserID)
+	token.Set("tenant_id", claims.TenantID)
+	token.Set("role_id", claims.RoleID)
+
+	// 任意クレーム (設定されている場合のみ)
+	if claims.SessionID != "" {
+		token.SetString("session_id", claims.SessionID)
+	}
+	if claims.ImpersonationID != "" {
+		token.SetString("impersonation_id", claims.ImpersonationID)
+		token.Set("actor_user_id", claims.ActorUserID)
+		token.SetString("actor_tenant_id", claims.ActorTenantID)
+	}
 
 	// v4.local (共有鍵) で暗号化
 	encrypted := token.V4Encrypt(maker.symmetricKey, nil)
@@ -66,16 +140,21 @@ func (maker *TokenMaker) CreateToken(userID int64, tenantID string, roleID int64
 
 // VerifyToken はトークン文字列を復号・検証し、クレーム情報を返します。
 func (maker *TokenMaker) VerifyToken(tokenString string) (*Claims, error) {
-	parser := paseto.NewParser()
-
-	// 有効期限などの標準ルールを検証に追加
-	parser.AddRule(paseto.NotExpired())
-	parser.AddRule(paseto.ValidAt(time.Now()))
+	// 期限切れとそれ以外の不正を区別するため、ルールは復号後に個別に適用する
+	parser := paseto.NewParserWithoutExpiryCheck()
 
 	// 復号と解析
 	token, err := parser.ParseV4Local(maker.symmetricKey, tokenString, nil)
 	if err != nil {
-		return nil, ergo.New("failed to verify token", slog.String("error", err.Error()))
+		return nil, ergo.Wrap(ErrTokenInvalid, "failed to verify token", slog.String("error", err.Error()))
+	}
+
+	// 有効期限などの標準ルールを検証
+	if err := paseto.NotExpired()(*token); err != nil {
+		return nil, ergo.Wrap(ErrTokenExpired, "failed to verify token", slog.String("error", err.Error()))
+	}
+	if err := paseto.ValidAt(time.Now())(*token); err != nil {
+		return nil, ergo.Wrap(ErrTokenInvalid, "failed to verify token", slog.String("error", err.Error()))
 	}
 
 	// クレームの抽出
@@ -86,15 +165,47 @@ func (maker *TokenMaker) VerifyToken(tokenString string) (*Claims, error) {
 	if err := token.Get("user_id", &payload.UserID); err != nil {
 		// 文字列として入っている場合のフォールバックなどを検討しても良いですが、
 		// ここでは厳密に型チェックします。
-		return nil, ergo.New("invalid token payload: user_id")
+		return nil, ergo.Wrap(ErrTokenInvalid, "invalid token payload: user_id")
 	}
 
 	if err := token.Get("tenant_id", &payload.TenantID); err != nil {
-		return nil, ergo.New("invalid token payload: tenant_id")
+		return nil, ergo.Wrap(ErrTokenInvalid, "invalid token payload: tenant_id")
 	}
 
 	if err := token.Get("role_id", &payload.RoleID); err != nil {
-		return nil, ergo.New("invalid token payload: role_id")
+		return nil, ergo.Wrap(ErrTokenInvalid, "invalid token payload: role_id")
+	}
+
+	// 任意クレーム: セッション ID (セッション管理を利用しない場合は存在しない)
+	if sessionID, err := token.GetString("session_id"); err == nil {
+		payload.SessionID = sessionID
+	}
+
+	// 任意クレーム: なりすまし情報
+	if impersonationID, err := token.GetString("impersonation_id"); err == nil {
+		payload.ImpersonationID = impersonationID
+		if err := token.Get("actor_user_id", &payload.ActorUserID); err != nil {
+			return nil, ergo.Wrap(ErrTokenInvalid, "invalid token payload: actor_user_id")
+		}
+		if err := token.Get("actor_tenant_id", &payload.ActorTenantID); err != nil {
+			return nil, ergo.Wrap(ErrTokenInvalid, "invalid token payload: actor_tenant_id")
+		}
+		// 失効できるよう、なりすましトークンはセッションに紐づいている必要がある
+		if payload.SessionID == "" {
+			return nil, ergo.Wrap(ErrTokenInvalid, "invalid token payload: impersonation without session_id")
+		}
+		// 上限を超える有効期間で生成されたなりすましトークンは拒否する
+		issuedAt, err := token.GetIssuedAt()
+		if err != nil {
+			return nil, ergo.Wrap(ErrTokenInvalid, "invalid token payload: iat")
+		}
+		expiresAt, err := token.GetExpiration()
+		if err != nil {
+			return nil, ergo.Wrap(ErrTokenInvalid, "invalid token payload: exp")
+		}
+		if expiresAt.Sub(issuedAt) > maker.MaxImpersonationDuration {
+			return nil, ergo.Wrap(ErrTokenInvalid, "impersonation token lifetime exceeds the maximum")
+		}
 	}
 
 	return payload, nil
@@ -41,8 +41,12 @@ func TestPasetoMaker(t *testing.T) {
 	require.NoError(t, err)
 
 	payloadExpired, err := maker.VerifyToken(tokenShort)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrTokenExpired)
 	assert.Nil(t, payloadExpired)
+
+	// Test tampered token
+	_, err = maker.VerifyToken(token + "x")
+	assert.ErrorIs(t, err, ErrTokenInvalid)
 }
 
 func TestNewTokenMaker_InvalidKey(t *testing.T) {
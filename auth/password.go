@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"log/slog"
 	"strings"
 
@@ -65,6 +66,99 @@ func ValidateStrength(
 	return true, nil
 }
 
+// PasswordViolation はパスワードがポリシーを満たさない理由を表す型です。
+type PasswordViolation string
+
+const (
+	// PasswordTooShort は最小長に満たないことを表します。
+	PasswordTooShort PasswordViolation = "too_short"
+	// PasswordMissingUpper は大文字が含まれていないことを表します。
+	PasswordMissingUpper PasswordViolation = "missing_upper"
+	// PasswordMissingLower は小文字が含まれていないことを表します。
+	PasswordMissingLower PasswordViolation = "missing_lower"
+	// PasswordMissingNumber は数字が含まれていないことを表します。
+	PasswordMissingNumber PasswordViolation = "missing_number"
+	// PasswordMissingSymbol は記号が含まれていないことを表します。
+	PasswordMissingSymbol PasswordViolation = "missing_symbol"
+	// PasswordBreached は既知の漏洩パスワードに含まれていることを表します。
+	PasswordBreached PasswordViolation = "breached"
+)
+
+// Message は違反理由に対応する、ユーザー向けのメッセージを返します。
+func (v PasswordViolation) Message() string {
+	switch v {
+	case PasswordTooShort:
+		return "パスワードが短すぎます"
+	case PasswordMissingUpper:
+		return "パスワードに大文字を含めてください"
+	case PasswordMissingLower:
+		return "パスワードに小文字を含めてください"
+	case PasswordMissingNumber:
+		return "パスワードに数字を含めてください"
+	case PasswordMissingSymbol:
+		return "パスワードに記号を含めてください"
+	case PasswordBreached:
+		return "このパスワードは過去に漏洩したことが確認されているため使用できません"
+	}
+	return string(v)
+}
+
+// PasswordPolicy はパスワードの検証ポリシーです。
+// ValidateStrength と同じ文字種・長さの条件に加え、漏洩パスワードのチェックを行えます。
+type PasswordPolicy struct {
+	IncludeUpper  bool
+	IncludeLower  bool
+	IncludeNumber bool
+	IncludeSymbol bool
+	MinLength     int
+
+	// BreachedChecker は漏洩パスワードのチェックに使用する実装です。nil の場合はチェックを行いません。
+	BreachedChecker BreachedPasswordChecker
+	// FailOpen が true の場合、BreachedChecker がエラーを返しても警告ログを出力して検証を続行します。
+	// false の場合はエラーを呼び出し元に返します。
+	FailOpen bool
+}
+
+// Validate はパスワードがポリシーを満たすかどうかを検証し、満たさない理由をすべて返します。
+// 戻り値が空の場合、パスワードはポリシーを満たしています。
+// 漏洩パスワードのチェックは、文字種・長さの条件をすべて満たす場合にのみ行います。
+func (p PasswordPolicy) Validate(ctx context.Context, password string) ([]PasswordViolation, error) {
+	var violations []PasswordViolation
+
+	if len(password) < p.MinLength {
+		violations = append(violations, PasswordTooShort)
+	}
+	if p.IncludeUpper && !containsRunes(password, passwordUpperAlphabets) {
+		violations = append(violations, PasswordMissingUpper)
+	}
+	if p.IncludeLower && !containsRunes(password, passwordLowerAlphabets) {
+		violations = append(violations, PasswordMissingLower)
+	}
+	if p.IncludeNumber && !containsRunes(password, passwordNumbers) {
+		violations = append(violations, PasswordMissingNumber)
+	}
+	if p.IncludeSymbol && !containsRunes(password, passwordSymbols) {
+		violations = append(violations, PasswordMissingSymbol)
+	}
+
+	if len(violations) > 0 || p.BreachedChecker == nil {
+		return violations, nil
+	}
+
+	breached, _, err := p.BreachedChecker.IsBreached(ctx, password)
+	if err != nil {
+		if !p.FailOpen {
+			return nil, ergo.Wrap(err, "failed to check breached password")
+		}
+		slog.WarnContext(ctx, "Breached password check failed, skipping", "error", err)
+		return violations, nil
+	}
+	if breached {
+		violations = append(violations, PasswordBreached)
+	}
+	return violations, nil
+}
+
 // HashPassword は平文パスワードを bcrypt でハッシュ化して返します。
 func HashPassword(password string) (string, error) {
 
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+)
+
+var (
+	// ErrSessionNotFound はセッションが存在しない（期限切れを含む）場合に返されます。
+	ErrSessionNotFound = ergo.NewSentinel("session not found")
+	// ErrSessionRevoked はセッションが失効済みの場合に返されます。
+	ErrSessionRevoked = ergo.NewSentinel("session revoked")
+)
+
+// Session はトークンの発行単位（ログインした端末）を表すセッションレコードです。
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int64      `json:"user_id"`
+	TenantID   string     `json:"tenant_id"`
+	Device     string     `json:"device"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// IsActive はセッションが失効・期限切れでないかを判定します。
+func (s *Session) IsActive(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// SessionInfo はセッション作成時に記録する接続元の情報です。
+type SessionInfo struct {
+	// Device は端末名などの表示用の名称です (例: "iPhone", "Chrome on Windows")。
+	Device string
+	// IP は接続元の IP アドレスです。
+	IP string
+	// UserAgent はリクエストの User-Agent ヘッダーの値です。
+	UserAgent string
+}
+
+// SessionStore はセッションの永続化を抽象化するインターフェースです。
+type SessionStore interface {
+	// CreateSession はセッションを保存します。
+	CreateSession(ctx context.Context, session *Session) error
+
+	// FindSession はセッションを取得します。存在しない場合は ErrSessionNotFound を返します。
+	FindSession(ctx context.Context, sessionID string) (*Session, error)
+
+	// TouchSession はセッションの最終アクセス日時を更新します。
+	TouchSession(ctx context.Context, sessionID string, seenAt time.Time) error
+
+	// ListSessions はユーザーの有効なセッションの一覧を返します。
+	ListSessions(ctx context.Context, tenantID string, userID int64) ([]*Session, error)
+
+	// RevokeSession はセッションを失効させます。
+	RevokeSession(ctx context.Context, sessionID string, revokedAt time.Time) error
+}
+
+// SessionValidator はトークンに紐づくセッションの有効性を検証するインターフェースです。
+// middleware.NewAuthProvider から利用されます。
+type SessionValidator interface {
+	ValidateSession(ctx context.Context, claims *Claims) error
+}
+
+// SessionManager は TokenMaker と SessionStore を組み合わせて、
+// セッションに紐づくトークンの発行・検証・失効を行う構造体です。
+type SessionManager struct {
+	maker *TokenMaker
+	store SessionStore
+
+	// TouchInterval は最終アクセス日時を更新する最小間隔です。
+	// リクエストのたびにストアへ書き込むことを避けるために使用します。
+	TouchInterval time.Duration
+}
+
+// NewSessionManager は新しい SessionManager を作成します。
+func NewSessionManager(maker *TokenMaker, store SessionStore) *SessionManager {
+	return &SessionManager{
+		maker:         maker,
+		store:         store,
+		TouchInterval: time.Minute,
+	}
+}
+
+// Issue は新しいセッションを作成し、そのセッションに紐づくトークンを発行します。
+func (m *SessionManager) Issue(ctx context.Context, userID int64, tenantID string, roleID int64, info SessionInfo, duration time.Duration) (string, *Session, error) {
+	sessionID, err := newRandomID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:         sessionID,
+		UserID:     userID,
+		TenantID:   tenantID,
+		Device:     info.Device,
+		IP:         info.IP,
+		UserAgent:  info.UserAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(duration),
+	}
+	if err := m.store.CreateSession(ctx, session); err != nil {
+		return "", nil, ergo.Wrap(err, "failed to create session")
+	}
+
+	token, err := m.maker.CreateTokenWithClaims(&Claims{
+		UserID:    userID,
+		TenantID:  tenantID,
+		RoleID:    roleID,
+		SessionID: sessionID,
+	}, duration)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, session, nil
+}
+
+// ValidateSession はトークンの Claims に紐づくセッションが有効かどうかを検証します。
+// セッション ID を持たないトークンは、失効させる手段がないため拒否します。
+// なりすましトークンも Impersonator が登録したセッションで検証します。
+func (m *SessionManager) ValidateSession(ctx context.Context, claims *Claims) error {
+	if claims.SessionID == "" {
+		return ErrSessionNotFound
+	}
+
+	session, err := m.store.FindSession(ctx, claims.SessionID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if session.RevokedAt != nil {
+		return ErrSessionRevoked
+	}
+	if !session.IsActive(now) || session.UserID != claims.UserID || session.TenantID != claims.TenantID {
+		return ErrSessionNotFound
+	}
+
+	if now.Sub(session.LastSeenAt) >= m.TouchInterval {
+		if err := m.store.TouchSession(ctx, session.ID, now); err != nil {
+			slog.WarnContext(ctx, "Failed to update session last seen", "session_id", session.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// List はユーザーの有効なセッションの一覧を返します。
+func (m *SessionManager) List(ctx context.Context, tenantID string, userID int64) ([]*Session, error) {
+	return m.store.ListSessions(ctx, tenantID, userID)
+}
+
+// Revoke はユーザーのセッションを 1 つ失効させます。
+// 他のユーザーのセッションを指定した場合は ErrSessionNotFound を返します。
+func (m *SessionManager) Revoke(ctx context.Context, tenantID string, userID int64, sessionID string) error {
+	session, err := m.store.FindSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if session.UserID != userID || session.TenantID != tenantID {
+		return ErrSessionNotFound
+	}
+	return m.store.RevokeSession(ctx, sessionID, time.Now())
+}
+
+// RevokeAll はユーザーのすべてのセッションを失効させます（全端末からのログアウト）。
+// exceptSessionID を指定した場合、そのセッション（操作中の端末など）は失効させません。
+// 失効させたセッションの数を返します。
+func (m *SessionManager) RevokeAll(ctx context.Context, tenantID string, userID int64, exceptSessionID string) (int, error) {
+	sessions, err := m.store.ListSessions(ctx, tenantID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	revoked := 0
+	for _, session := range sessions {
+		if session.ID == exceptSessionID {
+			continue
+		}
+		if err := m.store.RevokeSession(ctx, session.ID, now); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// newRandomID はセッション ID などに使用するランダムな ID (32 文字の Hex) を生成します。
+func newRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", ergo.New("failed to generate random id", slog.String("error", err.Error()))
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisSessionStore は Redis を使用した SessionStore の実装です。
+// セッションは JSON として保存され、有効期限の経過とともに自動的に削除されます。
+type RedisSessionStore struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+// NewRedisSessionStore は新しい RedisSessionStore を作成します。
+// prefix が空の場合は "session" が使用されます。
+func NewRedisSessionStore(rdb *redis.Client, prefix string) *RedisSessionStore {
+	if prefix == "" {
+		prefix = "session"
+	}
+	return &RedisSessionStore{rdb: rdb, prefix: prefix}
+}
+
+// CreateSession はセッションを保存し、ユーザーごとのインデックスに登録します。
+func (s *RedisSessionStore) CreateSession(ctx context.Context, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return ergo.New("failed to marshal session", slog.String("error", err.Error()))
+	}
+
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return ergo.New("session already expired", slog.String("session_id", session.ID))
+	}
+
+	indexKey := s.userKey(session.TenantID, session.UserID)
+	pipe := s.rdb.TxPipeline()
+	pipe.Set(ctx, s.sessionKey(session.ID), data, ttl)
+	pipe.SAdd(ctx, indexKey, session.ID)
+	// インデックスは最も長いセッションに合わせて延長する
+	pipe.ExpireGT(ctx, indexKey, ttl)
+	pipe.ExpireNX(ctx, indexKey, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return ergo.New("failed to save session", slog.String("error", err.Error()))
+	}
+	return nil
+}
+
+// FindSession はセッションを取得します。
+func (s *RedisSessionStore) FindSession(ctx context.Context, sessionID string) (*Session, error) {
+	data, err := s.rdb.Get(ctx, s.sessionKey(sessionID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, ergo.New("failed to get session", slog.String("error", err.Error()))
+	}
+
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, ergo.New("failed to unmarshal session", slog.String("error", err.Error()))
+	}
+	return session, nil
+}
+
+// TouchSession はセッションの最終アクセス日時を更新します。
+func (s *RedisSessionStore) TouchSession(ctx context.Context, sessionID string, seenAt time.Time) error {
+	return s.update(ctx, sessionID, func(session *Session) {
+		session.LastSeenAt = seenAt
+	})
+}
+
+// ListSessions はユーザーの有効なセッションの一覧を作成日時の昇順で返します。
+// 期限切れで削除されたセッションはインデックスからも取り除きます。
+func (s *RedisSessionStore) ListSessions(ctx context.Context, tenantID string, userID int64) ([]*Session, error) {
+	indexKey := s.userKey(tenantID, userID)
+	ids, err := s.rdb.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return nil, ergo.New("failed to list sessions", slog.String("error", err.Error()))
+	}
+
+	now := time.Now()
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		session, err := s.FindSession(ctx, id)
+		if errors.Is(err, ErrSessionNotFound) {
+			s.rdb.SRem(ctx, indexKey, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if session.IsActive(now) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return sessions, nil
+}
+
+// RevokeSession はセッションを失効済みとして記録します。
+// レコードは有効期限まで残るため、失効済みのトークンは ErrSessionRevoked として識別できます。
+func (s *RedisSessionStore) RevokeSession(ctx context.Context, sessionID string, revokedAt time.Time) error {
+	return s.update(ctx, sessionID, func(session *Session) {
+		if session.RevokedAt == nil {
+			session.RevokedAt = &revokedAt
+		}
+	})
+}
+
+// maxSessionUpdateRetries は update が競合 (WATCH の失敗) 時に再試行する最大回数です。
+const maxSessionUpdateRetries = 10
+
+// update はセッションを読み込み、fn で変更した内容を残りの有効期限を維持したまま保存します。
+// 読み込みから保存までを WATCH / MULTI で囲み、並行して行われた更新 (失効など) を上書きしないようにします。
+// 競合した場合は最新の内容を読み込み直して再試行します。
+func (s *RedisSessionStore) update(ctx context.Context, sessionID string, fn func(*Session)) error {
+	key := s.sessionKey(sessionID)
+	for range maxSessionUpdateRetries {
+		// 読み込みや変換のエラーは Redis のエラーと区別してそのまま返す
+		var failed error
+		err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				failed = ErrSessionNotFound
+				return failed
+			}
+			if err != nil {
+				return err
+			}
+			session := &Session{}
+			if err := json.Unmarshal(data, session); err != nil {
+				failed = ergo.New("failed to unmarshal session", slog.String("error", err.Error()))
+				return failed
+			}
+			fn(session)
+
+			if data, err = json.Marshal(session); err != nil {
+				failed = ergo.New("failed to marshal session", slog.String("error", err.Error()))
+				return failed
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetArgs(ctx, key, data, redis.SetArgs{KeepTTL: true, Mode: "XX"})
+				return nil
+			})
+			return err
+		}, key)
+
+		switch {
+		case failed != nil:
+			return failed
+		case errors.Is(err, redis.TxFailedErr):
+			continue
+		case errors.Is(err, redis.Nil):
+			// 保存の直前に有効期限が切れた
+			return ErrSessionNotFound
+		case err == nil:
+			return nil
+		}
+		return ergo.New("failed to update session", slog.String("error", err.Error()))
+	}
+	return ergo.New("failed to update session: too many concurrent updates", slog.String("session_id", sessionID))
+}
+
+func (s *RedisSessionStore) sessionKey(sessionID string) string {
+	return fmt.Sprintf("%s:%s", s.prefix, sessionID)
+}
+
+func (s *RedisSessionStore) userKey(tenantID string, userID int64) string {
+	return fmt.Sprintf("%s:user:%s:%d", s.prefix, tenantID, userID)
+}
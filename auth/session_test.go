@@ -0,0 +1,138 @@
+package auth_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+func newTestSessionManager(t *testing.T) (*auth.SessionManager, *auth.TokenMaker) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	maker, err := auth.NewTokenMaker(auth.GenerateRandomKey())
+	require.NoError(t, err)
+
+	return auth.NewSessionManager(maker, auth.NewRedisSessionStore(rdb, "")), maker
+}
+
+func TestSessionManager(t *testing.T) {
+	ctx := context.Background()
+	info := auth.SessionInfo{Device: "Chrome on macOS", IP: "192.0.2.1", UserAgent: "Mozilla/5.0"}
+
+	t.Run("issued token carries a valid session", func(t *testing.T) {
+		manager, maker := newTestSessionManager(t)
+
+		token, session, err := manager.Issue(ctx, 1, "tenant-a", 2, info, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, "Chrome on macOS", session.Device)
+
+		claims, err := maker.VerifyToken(token)
+		require.NoError(t, err)
+		assert.Equal(t, session.ID, claims.SessionID)
+
+		assert.NoError(t, manager.ValidateSession(ctx, claims))
+	})
+
+	t.Run("lists and revokes a single session", func(t *testing.T) {
+		manager, maker := newTestSessionManager(t)
+
+		token1, s1, err := manager.Issue(ctx, 1, "tenant-a", 2, info, time.Hour)
+		require.NoError(t, err)
+		_, s2, err := manager.Issue(ctx, 1, "tenant-a", 2, info, time.Hour)
+		require.NoError(t, err)
+		_, _, err = manager.Issue(ctx, 99, "tenant-a", 2, info, time.Hour)
+		require.NoError(t, err)
+
+		sessions, err := manager.List(ctx, "tenant-a", 1)
+		require.NoError(t, err)
+		require.Len(t, sessions, 2)
+
+		// 他人のセッションは失効できない
+		assert.ErrorIs(t, manager.Revoke(ctx, "tenant-a", 99, s1.ID), auth.ErrSessionNotFound)
+
+		require.NoError(t, manager.Revoke(ctx, "tenant-a", 1, s1.ID))
+
+		claims, err := maker.VerifyToken(token1)
+		require.NoError(t, err)
+		assert.ErrorIs(t, manager.ValidateSession(ctx, claims), auth.ErrSessionRevoked)
+
+		sessions, err = manager.List(ctx, "tenant-a", 1)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, s2.ID, sessions[0].ID)
+	})
+
+	t.Run("revokes all sessions except current", func(t *testing.T) {
+		manager, _ := newTestSessionManager(t)
+
+		_, current, err := manager.Issue(ctx, 1, "tenant-a", 2, info, time.Hour)
+		require.NoError(t, err)
+		for range 3 {
+			_, _, err := manager.Issue(ctx, 1, "tenant-a", 2, info, time.Hour)
+			require.NoError(t, err)
+		}
+
+		revoked, err := manager.RevokeAll(ctx, "tenant-a", 1, current.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 3, revoked)
+
+		sessions, err := manager.List(ctx, "tenant-a", 1)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, current.ID, sessions[0].ID)
+	})
+
+	t.Run("rejects tokens without session", func(t *testing.T) {
+		manager, maker := newTestSessionManager(t)
+
+		token, err := maker.CreateToken(1, "tenant-a", 2, time.Hour)
+		require.NoError(t, err)
+		claims, err := maker.VerifyToken(token)
+		require.NoError(t, err)
+		assert.Empty(t, claims.SessionID)
+
+		assert.ErrorIs(t, manager.ValidateSession(ctx, claims), auth.ErrSessionNotFound)
+	})
+}
+
+func TestRedisSessionStore_ConcurrentTouchAndRevoke(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr(), PoolSize: 32})
+	t.Cleanup(func() { rdb.Close() })
+	store := auth.NewRedisSessionStore(rdb, "")
+
+	for i := range 20 {
+		now := time.Now()
+		session := &auth.Session{ID: fmt.Sprintf("s%d", i), UserID: 1, TenantID: "tenant-a", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}
+		require.NoError(t, store.CreateSession(ctx, session))
+
+		// 失効と並行してアクセス日時を更新しても、失効が取り消されないこと
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Go(func() {
+				assert.NoError(t, store.TouchSession(ctx, session.ID, time.Now()))
+			})
+		}
+		wg.Go(func() {
+			assert.NoError(t, store.RevokeSession(ctx, session.ID, time.Now()))
+		})
+		wg.Wait()
+
+		got, err := store.FindSession(ctx, session.ID)
+		require.NoError(t, err)
+		assert.NotNil(t, got.RevokedAt, "revocation must not be overwritten by a concurrent touch")
+	}
+}
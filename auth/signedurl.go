@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+)
+
+var (
+	// ErrSignedURLInvalid は署名付き URL のパラメータ不足や署名不一致の場合に返されます。
+	ErrSignedURLInvalid = ergo.NewSentinel("invalid signed url")
+	// ErrSignedURLExpired は署名付き URL の有効期限が切れている場合に返されます。
+	ErrSignedURLExpired = ergo.NewSentinel("signed url expired")
+)
+
+// 署名付き URL に付与されるクエリパラメータ名
+const (
+	signedURLParamExpires   = "exp"
+	signedURLParamTenant    = "tid"
+	signedURLParamUser      = "uid"
+	signedURLParamKeyID     = "kid"
+	signedURLParamSignature = "sig"
+)
+
+// URLSigningKey は URL の署名に使用する HMAC 鍵です。
+type URLSigningKey struct {
+	// ID は鍵の識別子です。URL に含まれ、検証時に鍵を選択するために使用されます。
+	ID string
+	// Secret は HMAC-SHA256 の秘密鍵です。32 バイト以上を推奨します。
+	Secret []byte
+}
+
+// NewURLSigningKey は Hex エンコードされた秘密鍵から URLSigningKey を生成します。
+func NewURLSigningKey(id string, hexSecret string) (URLSigningKey, error) {
+	secret, err := hex.DecodeString(hexSecret)
+	if err != nil {
+		return URLSigningKey{}, ergo.New("invalid hex secret", slog.String("error", err.Error()))
+	}
+	if len(secret) < 32 {
+		return URLSigningKey{}, ergo.New("signing key must be at least 32 bytes", slog.String("key_id", id))
+	}
+	return URLSigningKey{ID: id, Secret: secret}, nil
+}
+
+// SignedURLClaims は検証済みの署名付き URL から取り出した情報です。
+type SignedURLClaims struct {
+	// TenantID は URL の発行対象のテナント ID です。
+	TenantID string
+	// UserID は URL を利用できるユーザーの ID です。0 の場合はユーザーに紐づきません。
+	UserID int64
+	// ExpiresAt は URL の有効期限です。
+	ExpiresAt time.Time
+	// KeyID は署名に使用された鍵の ID です。
+	KeyID string
+}
+
+// URLSigner は有効期限付きの署名付き URL を生成・検証する構造体です。
+// メールのリンクや <a href> など Authorization ヘッダーを送信できない経路で、
+// 帳票などのファイルをダウンロードさせるために使用します。
+type URLSigner struct {
+	keys []URLSigningKey
+}
+
+// NewURLSigner は新しい URLSigner を作成します。
+// 先頭の鍵が署名に使用され、残りの鍵は検証のみに使用されます。
+// 鍵をローテーションする場合は、新しい鍵を先頭に追加し、古い鍵を URL の有効期限が切れるまで残してください。
+func NewURLSigner(keys ...URLSigningKey) (*URLSigner, error) {
+	if len(keys) == 0 {
+		return nil, ergo.New("at least one signing key is required")
+	}
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if key.ID == "" || len(key.Secret) == 0 {
+			return nil, ergo.New("signing key must have id and secret")
+		}
+		if _, ok := seen[key.ID]; ok {
+			return nil, ergo.New("duplicate signing key id", slog.String("key_id", key.ID))
+		}
+		seen[key.ID] = struct{}{}
+	}
+	return &URLSigner{keys: keys}, nil
+}
+
+// Sign は rawURL に有効期限、テナント、ユーザー、鍵 ID、署名のクエリパラメータを付与した URL を返します。
+// 署名にはパス、既存のクエリパラメータ、有効期限、テナント、ユーザーが含まれます。
+// userID に 0 を指定した場合、URL は特定のユーザーに紐づきません。
+func (s *URLSigner) Sign(rawURL string, tenantID string, userID int64, ttl time.Duration) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", ergo.New("failed to parse url", slog.String("error", err.Error()))
+	}
+
+	key := s.keys[0]
+	query := u.Query()
+	for _, name := range []string{signedURLParamExpires, signedURLParamTenant, signedURLParamUser, signedURLParamKeyID, signedURLParamSignature} {
+		query.Del(name)
+	}
+	query.Set(signedURLParamExpires, strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	query.Set(signedURLParamTenant, tenantID)
+	if userID != 0 {
+		query.Set(signedURLParamUser, strconv.FormatInt(userID, 10))
+	}
+	query.Set(signedURLParamKeyID, key.ID)
+	query.Set(signedURLParamSignature, computeURLSignature(key.Secret, u.EscapedPath(), query))
+
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Verify は署名付き URL の署名と有効期限を検証し、URL に含まれる情報を返します。
+func (s *URLSigner) Verify(u *url.URL) (*SignedURLClaims, error) {
+	query := u.Query()
+
+	signature := query.Get(signedURLParamSignature)
+	keyID := query.Get(signedURLParamKeyID)
+	if signature == "" || keyID == "" || query.Get(signedURLParamExpires) == "" || query.Get(signedURLParamTenant) == "" {
+		return nil, ErrSignedURLInvalid
+	}
+
+	var secret []byte
+	for _, key := range s.keys {
+		if key.ID == keyID {
+			secret = key.Secret
+			break
+		}
+	}
+	if secret == nil {
+		return nil, ErrSignedURLInvalid
+	}
+
+	expected := computeURLSignature(secret, u.EscapedPath(), query)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, ErrSignedURLInvalid
+	}
+
+	expUnix, err := strconv.ParseInt(query.Get(signedURLParamExpires), 10, 64)
+	if err != nil {
+		return nil, ErrSignedURLInvalid
+	}
+	expiresAt := time.Unix(expUnix, 0)
+	if !time.Now().Before(expiresAt) {
+		return nil, ErrSignedURLExpired
+	}
+
+	claims := &SignedURLClaims{
+		TenantID:  query.Get(signedURLParamTenant),
+		ExpiresAt: expiresAt,
+		KeyID:     keyID,
+	}
+	if uid := query.Get(signedURLParamUser); uid != "" {
+		claims.UserID, err = strconv.ParseInt(uid, 10, 64)
+		if err != nil {
+			return nil, ErrSignedURLInvalid
+		}
+	}
+	return claims, nil
+}
+
+// computeURLSignature はパスと（署名を除く）クエリパラメータから HMAC-SHA256 署名を計算します。
+// url.Values.Encode はキーをソートして出力するため、パラメータの順序に依存しません。
+func computeURLSignature(secret []byte, escapedPath string, query url.Values) string {
+	params := url.Values{}
+	for name, values := range query {
+		if name != signedURLParamSignature {
+			params[name] = values
+		}
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{escapedPath, params.Encode()}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,101 @@
+package auth_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+func newTestSigningKey(t *testing.T, id string) auth.URLSigningKey {
+	t.Helper()
+	key, err := auth.NewURLSigningKey(id, auth.GenerateRandomKey())
+	require.NoError(t, err)
+	return key
+}
+
+func TestURLSigner(t *testing.T) {
+	current := newTestSigningKey(t, "k2")
+	previous := newTestSigningKey(t, "k1")
+
+	signer, err := auth.NewURLSigner(current, previous)
+	require.NoError(t, err)
+
+	verify := func(t *testing.T, s *auth.URLSigner, signed string) (*auth.SignedURLClaims, error) {
+		t.Helper()
+		u, err := url.Parse(signed)
+		require.NoError(t, err)
+		return s.Verify(u)
+	}
+
+	t.Run("round trip with user binding", func(t *testing.T) {
+		signed, err := signer.Sign("https://app.example.com/reports/1.pdf?inline=1", "tenant-a", 42, time.Minute)
+		require.NoError(t, err)
+
+		claims, err := verify(t, signer, signed)
+		require.NoError(t, err)
+		assert.Equal(t, "tenant-a", claims.TenantID)
+		assert.Equal(t, int64(42), claims.UserID)
+		assert.Equal(t, "k2", claims.KeyID)
+	})
+
+	t.Run("tampered path, query or tenant is rejected", func(t *testing.T) {
+		signed, err := signer.Sign("/reports/1.pdf?inline=1", "tenant-a", 0, time.Minute)
+		require.NoError(t, err)
+
+		for _, tampered := range []string{
+			strings.Replace(signed, "/reports/1.pdf", "/reports/2.pdf", 1),
+			strings.Replace(signed, "inline=1", "inline=0", 1),
+			strings.Replace(signed, "tid=tenant-a", "tid=tenant-b", 1),
+		} {
+			_, err := verify(t, signer, tampered)
+			assert.ErrorIs(t, err, auth.ErrSignedURLInvalid, tampered)
+		}
+	})
+
+	t.Run("expired url is rejected", func(t *testing.T) {
+		signed, err := signer.Sign("/reports/1.pdf", "tenant-a", 0, -time.Minute)
+		require.NoError(t, err)
+
+		_, err = verify(t, signer, signed)
+		assert.ErrorIs(t, err, auth.ErrSignedURLExpired)
+	})
+
+	t.Run("url signed with rotated key is still accepted", func(t *testing.T) {
+		oldSigner, err := auth.NewURLSigner(previous)
+		require.NoError(t, err)
+		signed, err := oldSigner.Sign("/reports/1.pdf", "tenant-a", 0, time.Minute)
+		require.NoError(t, err)
+
+		claims, err := verify(t, signer, signed)
+		require.NoError(t, err)
+		assert.Equal(t, "k1", claims.KeyID)
+
+		// 鍵を破棄した後は検証できない
+		newOnly, err := auth.NewURLSigner(current)
+		require.NoError(t, err)
+		_, err = verify(t, newOnly, signed)
+		assert.ErrorIs(t, err, auth.ErrSignedURLInvalid)
+	})
+
+	t.Run("unsigned url is rejected", func(t *testing.T) {
+		_, err := verify(t, signer, "/reports/1.pdf")
+		assert.ErrorIs(t, err, auth.ErrSignedURLInvalid)
+	})
+
+	t.Run("invalid keys are rejected", func(t *testing.T) {
+		_, err := auth.NewURLSigner()
+		assert.Error(t, err)
+
+		_, err = auth.NewURLSigner(current, current)
+		assert.Error(t, err)
+
+		_, err = auth.NewURLSigningKey("short", "abcd")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/newmo-oss/ergo"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/golaboratory/gloudia/api"
+)
+
+// LoginThrottleConfig はログイン試行制限の設定構造体です。
+type LoginThrottleConfig struct {
+	// MaxAccountFailures はアカウントを一時ロックするまでの連続失敗回数です。
+	MaxAccountFailures int
+	// MaxIPFailures は IP アドレスを一時ブロックするまでの失敗回数です。
+	MaxIPFailures int
+	// FailureWindow は失敗回数を数える期間です。最後の失敗からこの期間が経過すると回数がリセットされます。
+	FailureWindow time.Duration
+	// LockoutDuration はロック（ブロック）の継続時間です。
+	LockoutDuration time.Duration
+	// BaseDelay は 1 回目の失敗後に課す待ち時間です。以降は失敗のたびに 2 倍になります。
+	BaseDelay time.Duration
+	// MaxDelay は段階的な待ち時間の上限です。
+	MaxDelay time.Duration
+	// KeyPrefix は Redis キーのプレフィックスです (例: "login")。
+	KeyPrefix string
+}
+
+// DefaultLoginThrottleConfig は標準的な設定を返します。
+func DefaultLoginThrottleConfig() LoginThrottleConfig {
+	return LoginThrottleConfig{
+		MaxAccountFailures: 5,
+		MaxIPFailures:      50,
+		FailureWindow:      15 * time.Minute,
+		LockoutDuration:    15 * time.Minute,
+		BaseDelay:          time.Second,
+		MaxDelay:           30 * time.Second,
+		KeyPrefix:          "login",
+	}
+}
+
+// LoginDecision はログイン試行の可否の判定結果です。
+type LoginDecision struct {
+	// Allowed はログイン試行（パスワード検証）を行ってよい場合に true となります。
+	Allowed bool
+	// Locked はアカウントまたは IP アドレスがロックされている場合に true となります。
+	Locked bool
+	// RetryAfter は次に試行可能になるまでの待ち時間です。
+	RetryAfter time.Duration
+	// Failures は現在のアカウントの連続失敗回数です。
+	Failures int
+	// Message は利用者に表示するためのメッセージです。
+	Message string
+}
+
+// RetryAfterSeconds は Retry-After ヘッダーに設定する秒数を返します（最低 1 秒）。
+func (d *LoginDecision) RetryAfterSeconds() int {
+	sec := int((d.RetryAfter + time.Second - 1) / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	return sec
+}
+
+// InvalidItems は api.NewInvalidResponse に渡すためのエラー詳細を返します。
+// 待ち時間は "retryAfter" フィールドに秒数で格納されます。
+func (d *LoginDecision) InvalidItems() api.InvalidItem {
+	if d.Allowed {
+		return nil
+	}
+	return api.InvalidItem{
+		"retryAfter": api.ErrorMessage(strconv.Itoa(d.RetryAfterSeconds())),
+	}
+}
+
+// LoginThrottler は Redis を使用してログインの失敗回数を記録し、
+// 段階的な遅延と一時的なアカウントロックを行う構造体です。
+type LoginThrottler struct {
+	rdb *redis.Client
+	cfg LoginThrottleConfig
+}
+
+// NewLoginThrottler は新しい LoginThrottler を作成します。
+// cfg の未設定 (ゼロ値) の項目には DefaultLoginThrottleConfig の値が使用されます。
+func NewLoginThrottler(rdb *redis.Client, cfg LoginThrottleConfig) *LoginThrottler {
+	def := DefaultLoginThrottleConfig()
+	if cfg.MaxAccountFailures <= 0 {
+		cfg.MaxAccountFailures = def.MaxAccountFailures
+	}
+	if cfg.MaxIPFailures <= 0 {
+		cfg.MaxIPFailures = def.MaxIPFailures
+	}
+	if cfg.FailureWindow <= 0 {
+		cfg.FailureWindow = def.FailureWindow
+	}
+	if cfg.LockoutDuration <= 0 {
+		cfg.LockoutDuration = def.LockoutDuration
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = def.BaseDelay
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = def.MaxDelay
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = def.KeyPrefix
+	}
+	return &LoginThrottler{rdb: rdb, cfg: cfg}
+}
+
+// Check はパスワード検証の前に呼び出し、ログイン試行を行ってよいかを判定します。
+// Allowed が false の場合は CheckPassword を呼ばずに、判定結果をそのまま利用者へ返してください。
+func (t *LoginThrottler) Check(ctx context.Context, account string, ip string) (*LoginDecision, error) {
+	pipe := t.rdb.Pipeline()
+	accountLock := pipe.PTTL(ctx, t.key("lock:acct", account))
+	ipLock := pipe.PTTL(ctx, t.key("lock:ip", ip))
+	delay := pipe.PTTL(ctx, t.key("delay:acct", account))
+	failures := pipe.Get(ctx, t.key("fail:acct", account))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, ergo.New("failed to check login throttle", slog.String("error", err.Error()))
+	}
+
+	count, _ := failures.Int()
+
+	if ttl := accountLock.Val(); ttl > 0 {
+		return &LoginDecision{Locked: true, RetryAfter: ttl, Failures: count, Message: "アカウントが一時的にロックされています。しばらくしてから再度お試しください。"}, nil
+	}
+	if ttl := ipLock.Val(); ttl > 0 {
+		return &LoginDecision{Locked: true, RetryAfter: ttl, Failures: count, Message: "ログインの試行回数が多すぎます。しばらくしてから再度お試しください。"}, nil
+	}
+	if ttl := delay.Val(); ttl > 0 {
+		return &LoginDecision{RetryAfter: ttl, Failures: count, Message: "ログインの試行間隔が短すぎます。しばらくしてから再度お試しください。"}, nil
+	}
+
+	return &LoginDecision{Allowed: true, Failures: count}, nil
+}
+
+// RegisterFailure はログイン失敗を記録し、次回の試行に対する判定結果を返します。
+// 失敗回数が MaxAccountFailures に達した場合はアカウントを LockoutDuration の間ロックし、
+// それ未満の場合は失敗回数に応じた待ち時間を課します。
+func (t *LoginThrottler) RegisterFailure(ctx context.Context, account string, ip string) (*LoginDecision, error) {
+	pipe := t.rdb.TxPipeline()
+	accountFailures := pipe.Incr(ctx, t.key("fail:acct", account))
+	pipe.PExpire(ctx, t.key("fail:acct", account), t.cfg.FailureWindow)
+	ipFailures := pipe.Incr(ctx, t.key("fail:ip", ip))
+	pipe.PExpire(ctx, t.key("fail:ip", ip), t.cfg.FailureWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, ergo.New("failed to register login failure", slog.String("error", err.Error()))
+	}
+
+	count := int(accountFailures.Val())
+
+	if ipFailures.Val() >= int64(t.cfg.MaxIPFailures) {
+		if err := t.rdb.Set(ctx, t.key("lock:ip", ip), "1", t.cfg.LockoutDuration).Err(); err != nil {
+			return nil, ergo.New("failed to lock ip address", slog.String("error", err.Error()))
+		}
+		slog.WarnContext(ctx, "Login blocked for ip address", "ip", ip, "failures", ipFailures.Val())
+	}
+
+	if count >= t.cfg.MaxAccountFailures {
+		if err := t.rdb.Set(ctx, t.key("lock:acct", account), "1", t.cfg.LockoutDuration).Err(); err != nil {
+			return nil, ergo.New("failed to lock account", slog.String("error", err.Error()))
+		}
+		slog.WarnContext(ctx, "Account locked due to login failures", "account", account, "failures", count)
+		return &LoginDecision{Locked: true, RetryAfter: t.cfg.LockoutDuration, Failures: count, Message: "ログインに連続して失敗したため、アカウントを一時的にロックしました。"}, nil
+	}
+
+	delay := t.delayFor(count)
+	if err := t.rdb.Set(ctx, t.key("delay:acct", account), "1", delay).Err(); err != nil {
+		return nil, ergo.New("failed to set login delay", slog.String("error", err.Error()))
+	}
+
+	return &LoginDecision{RetryAfter: delay, Failures: count, Message: "ID またはパスワードが正しくありません。"}, nil
+}
+
+// RegisterSuccess はログイン成功時に呼び出し、アカウントの失敗回数と待ち時間をリセットします。
+// IP アドレス単位の失敗回数は、多数のアカウントに対する攻撃を検知するためリセットしません。
+func (t *LoginThrottler) RegisterSuccess(ctx context.Context, account string) error {
+	if err := t.rdb.Del(ctx, t.key("fail:acct", account), t.key("delay:acct", account)).Err(); err != nil {
+		return ergo.New("failed to reset login failures", slog.String("error", err.Error()))
+	}
+	return nil
+}
+
+// Unlock は管理者操作などにより、アカウントのロックと失敗回数を解除します。
+func (t *LoginThrottler) Unlock(ctx context.Context, account string) error {
+	if err := t.rdb.Del(ctx,
+		t.key("lock:acct", account),
+		t.key("fail:acct", account),
+		t.key("delay:acct", account),
+	).Err(); err != nil {
+		return ergo.New("failed to unlock account", slog.String("error", err.Error()))
+	}
+	slog.InfoContext(ctx, "Account unlocked", "account", account)
+	return nil
+}
+
+// UnlockIP は管理者操作などにより、IP アドレスのブロックと失敗回数を解除します。
+func (t *LoginThrottler) UnlockIP(ctx context.Context, ip string) error {
+	if err := t.rdb.Del(ctx, t.key("lock:ip", ip), t.key("fail:ip", ip)).Err(); err != nil {
+		return ergo.New("failed to unlock ip address", slog.String("error", err.Error()))
+	}
+	slog.InfoContext(ctx, "IP address unlocked", "ip", ip)
+	return nil
+}
+
+// delayFor は失敗回数に応じた待ち時間 (BaseDelay * 2^(n-1), 上限 MaxDelay) を返します。
+func (t *LoginThrottler) delayFor(failures int) time.Duration {
+	delay := t.cfg.BaseDelay
+	for i := 1; i < failures && delay < t.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, t.cfg.MaxDelay)
+}
+
+// key は Redis キーを "<prefix>:<kind>:<id>" の形式で生成します。
+func (t *LoginThrottler) key(kind string, id string) string {
+	return fmt.Sprintf("%s:%s:%s", t.cfg.KeyPrefix, kind, id)
+}
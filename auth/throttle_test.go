@@ -0,0 +1,125 @@
+package auth_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+func newTestThrottler(t *testing.T) (*auth.LoginThrottler, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	throttler := auth.NewLoginThrottler(rdb, auth.LoginThrottleConfig{
+		MaxAccountFailures: 3,
+		MaxIPFailures:      10,
+		FailureWindow:      time.Minute,
+		LockoutDuration:    5 * time.Minute,
+		BaseDelay:          time.Second,
+		MaxDelay:           4 * time.Second,
+	})
+	return throttler, mr
+}
+
+func TestLoginThrottler(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("allows first attempt", func(t *testing.T) {
+		throttler, _ := newTestThrottler(t)
+
+		decision, err := throttler.Check(ctx, "user@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Nil(t, decision.InvalidItems())
+	})
+
+	t.Run("applies progressive delay after failure", func(t *testing.T) {
+		throttler, mr := newTestThrottler(t)
+
+		decision, err := throttler.RegisterFailure(ctx, "user@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.Equal(t, time.Second, decision.RetryAfter)
+
+		decision, err = throttler.Check(ctx, "user@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.False(t, decision.Locked)
+		assert.Equal(t, 1, decision.RetryAfterSeconds())
+		assert.Equal(t, "1", string(decision.InvalidItems()["retryAfter"]))
+
+		mr.FastForward(time.Second)
+		decision, err = throttler.RegisterFailure(ctx, "user@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.Equal(t, 2*time.Second, decision.RetryAfter)
+	})
+
+	t.Run("locks account after max failures and unlocks", func(t *testing.T) {
+		throttler, _ := newTestThrottler(t)
+
+		var decision *auth.LoginDecision
+		var err error
+		for range 3 {
+			decision, err = throttler.RegisterFailure(ctx, "user@example.com", "192.0.2.1")
+			require.NoError(t, err)
+		}
+		assert.True(t, decision.Locked)
+		assert.Equal(t, 5*time.Minute, decision.RetryAfter)
+
+		decision, err = throttler.Check(ctx, "user@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.True(t, decision.Locked)
+
+		// 別アカウントには影響しない
+		decision, err = throttler.Check(ctx, "other@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+
+		require.NoError(t, throttler.Unlock(ctx, "user@example.com"))
+		decision, err = throttler.Check(ctx, "user@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, 0, decision.Failures)
+	})
+
+	t.Run("success resets account failures", func(t *testing.T) {
+		throttler, _ := newTestThrottler(t)
+
+		_, err := throttler.RegisterFailure(ctx, "user@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		require.NoError(t, throttler.RegisterSuccess(ctx, "user@example.com"))
+
+		decision, err := throttler.Check(ctx, "user@example.com", "192.0.2.1")
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, 0, decision.Failures)
+	})
+
+	t.Run("blocks ip after max failures across accounts", func(t *testing.T) {
+		throttler, _ := newTestThrottler(t)
+
+		for i := range 10 {
+			_, err := throttler.RegisterFailure(ctx, "user"+string(rune('a'+i)), "192.0.2.9")
+			require.NoError(t, err)
+		}
+
+		decision, err := throttler.Check(ctx, "fresh@example.com", "192.0.2.9")
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.True(t, decision.Locked)
+
+		require.NoError(t, throttler.UnlockIP(ctx, "192.0.2.9"))
+		decision, err = throttler.Check(ctx, "fresh@example.com", "192.0.2.9")
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+	})
+}
@@ -0,0 +1,194 @@
+// Package correlation は、1 つのリクエストに起因する処理 (HTTP、ログ、ジョブ、メール) を
+// 横断して追跡するためのリクエスト ID と W3C Trace Context (traceparent) を扱います。
+package correlation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// HeaderRequestID はリクエスト ID を受け渡す HTTP ヘッダー (およびメールヘッダー) の名前です。
+	HeaderRequestID = "X-Request-ID"
+	// HeaderTraceParent は W3C Trace Context の traceparent ヘッダーの名前です。
+	HeaderTraceParent = "traceparent"
+
+	// maxRequestIDLength は外部から受け付けるリクエスト ID の最大長です。
+	maxRequestIDLength = 128
+)
+
+type contextKey string
+
+const (
+	keyRequestID   contextKey = "request_id"
+	keyTraceParent contextKey = "traceparent"
+)
+
+// NewRequestID は新しいリクエスト ID (32 文字の Hex 文字列) を生成します。
+func NewRequestID() string {
+	return randomHex(16)
+}
+
+// ValidRequestID は外部から受け取ったリクエスト ID をそのまま使用できるかを判定します。
+// ログやヘッダーへの注入を防ぐため、英数字と "-", "_", ".", ":" のみで構成された 128 文字以下の値のみを許可します。
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WithRequestID はリクエスト ID を保持するコンテキストを返します。
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, keyRequestID, id)
+}
+
+// RequestIDFrom はコンテキストからリクエスト ID を取得します。
+func RequestIDFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(keyRequestID).(string)
+	return id, ok && id != ""
+}
+
+// TraceParent は W3C Trace Context の traceparent ヘッダーの値です。
+type TraceParent struct {
+	// TraceID は 32 文字の Hex 文字列のトレース ID です。
+	TraceID string
+	// SpanID は 16 文字の Hex 文字列の親スパン ID です。
+	SpanID string
+	// Flags はトレースフラグです (01 はサンプリング対象)。
+	Flags string
+}
+
+// NewTraceParent は新しいトレースを開始する TraceParent を生成します。
+func NewTraceParent() TraceParent {
+	return TraceParent{TraceID: randomHex(16), SpanID: randomHex(8), Flags: "01"}
+}
+
+// ParseTraceParent は traceparent ヘッダーの値を解析します。
+// バージョン 00 の形式 "00-<trace-id>-<parent-id>-<flags>" 以外や、ID がすべて 0 の場合は false を返します。
+func ParseTraceParent(value string) (TraceParent, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return TraceParent{}, false
+	}
+	tp := TraceParent{TraceID: parts[1], SpanID: parts[2], Flags: parts[3]}
+	if !isLowerHex(tp.TraceID, 32) || !isLowerHex(tp.SpanID, 16) || !isLowerHex(tp.Flags, 2) {
+		return TraceParent{}, false
+	}
+	if strings.Trim(tp.TraceID, "0") == "" || strings.Trim(tp.SpanID, "0") == "" {
+		return TraceParent{}, false
+	}
+	return tp, true
+}
+
+// Child は同じトレースに属する、新しいスパン ID の TraceParent を返します。
+// 受け取った traceparent を次の処理 (自身のスパン) へ引き継ぐ場合に使用します。
+func (tp TraceParent) Child() TraceParent {
+	return TraceParent{TraceID: tp.TraceID, SpanID: randomHex(8), Flags: tp.Flags}
+}
+
+// String は traceparent ヘッダーの形式で返します。
+func (tp TraceParent) String() string {
+	return "00-" + tp.TraceID + "-" + tp.SpanID + "-" + tp.Flags
+}
+
+// FromSpanContext は OpenTelemetry のスパンの SpanContext から TraceParent を生成します。
+func FromSpanContext(sc trace.SpanContext) TraceParent {
+	return TraceParent{TraceID: sc.TraceID().String(), SpanID: sc.SpanID().String(), Flags: sc.TraceFlags().String()}
+}
+
+// traceParentHolder は TraceParent を保持します。
+// 下流のミドルウェア (middleware.NewTracing) が開始したスパンに置き換えた値を、
+// 外側のミドルウェア (アクセスログなど) からも参照できるようにポインタで共有します。
+type traceParentHolder struct {
+	tp TraceParent
+}
+
+// WithTraceParent は TraceParent を保持するコンテキストを返します。
+func WithTraceParent(ctx context.Context, tp TraceParent) context.Context {
+	return context.WithValue(ctx, keyTraceParent, &traceParentHolder{tp: tp})
+}
+
+// SetTraceParent は WithTraceParent で保存した TraceParent を置き換えます。
+// 置き換えた値は、同じリクエストの外側のコンテキストにも反映されます。
+// TraceParent が保存されていない場合は false を返します。
+func SetTraceParent(ctx context.Context, tp TraceParent) bool {
+	h, ok := ctx.Value(keyTraceParent).(*traceParentHolder)
+	if ok {
+		h.tp = tp
+	}
+	return ok
+}
+
+// TraceParentFrom はコンテキストから TraceParent を取得します。
+// OpenTelemetry の有効なスパンがある場合は、ログやジョブのトレース ID がスパンと一致するよう、そのスパンから生成します。
+func TraceParentFrom(ctx context.Context) (TraceParent, bool) {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return FromSpanContext(sc), true
+	}
+	h, ok := ctx.Value(keyTraceParent).(*traceParentHolder)
+	if !ok {
+		return TraceParent{}, false
+	}
+	return h.tp, true
+}
+
+// Values はプロセスをまたいで (ジョブのペイロードなどで) 引き継ぐための値です。
+// リクエストのキャンセルの影響を受けないコンテキストへ引き継ぐ場合は middleware.Detach を使用してください。
+type Values struct {
+	RequestID   string `json:"request_id,omitempty"`
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// Capture はコンテキストから引き継ぐ値を取り出します。
+func Capture(ctx context.Context) Values {
+	var v Values
+	v.RequestID, _ = RequestIDFrom(ctx)
+	if tp, ok := TraceParentFrom(ctx); ok {
+		v.TraceParent = tp.String()
+	}
+	return v
+}
+
+// Apply は値をコンテキストに設定して返します。
+// TraceParent は引き継ぎ先の処理を表す新しいスパン ID で設定されます。
+func (v Values) Apply(ctx context.Context) context.Context {
+	if ValidRequestID(v.RequestID) {
+		ctx = WithRequestID(ctx, v.RequestID)
+	}
+	if tp, ok := ParseTraceParent(v.TraceParent); ok {
+		ctx = WithTraceParent(ctx, tp.Child())
+	}
+	return ctx
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
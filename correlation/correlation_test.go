@@ -0,0 +1,108 @@
+package correlation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestValidRequestID(t *testing.T) {
+	assert.True(t, ValidRequestID(NewRequestID()))
+	assert.True(t, ValidRequestID("abc-123_x.y:z"))
+	assert.False(t, ValidRequestID(""))
+	assert.False(t, ValidRequestID("bad\nid"))
+	assert.False(t, ValidRequestID(string(bytes.Repeat([]byte("a"), 129))))
+}
+
+func TestParseTraceParent(t *testing.T) {
+	tp, ok := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tp.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", tp.SpanID)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tp.String())
+
+	child := tp.Child()
+	assert.Equal(t, tp.TraceID, child.TraceID)
+	assert.NotEqual(t, tp.SpanID, child.SpanID)
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		_, ok := ParseTraceParent(invalid)
+		assert.False(t, ok, invalid)
+	}
+
+	_, ok = ParseTraceParent(NewTraceParent().String())
+	assert.True(t, ok)
+}
+
+func TestValuesRoundTrip(t *testing.T) {
+	tp := NewTraceParent()
+	ctx := WithTraceParent(WithRequestID(context.Background(), "req-1"), tp)
+
+	b, err := json.Marshal(Capture(ctx))
+	require.NoError(t, err)
+
+	var v Values
+	require.NoError(t, json.Unmarshal(b, &v))
+	restored := v.Apply(context.Background())
+
+	id, ok := RequestIDFrom(restored)
+	require.True(t, ok)
+	assert.Equal(t, "req-1", id)
+	got, ok := TraceParentFrom(restored)
+	require.True(t, ok)
+	assert.Equal(t, tp.TraceID, got.TraceID)
+}
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewLogHandler(slog.NewJSONHandler(&buf, nil))).With("component", "test")
+
+	tp := NewTraceParent()
+	ctx := WithTraceParent(WithRequestID(context.Background(), "req-1"), tp)
+	logger.InfoContext(ctx, "hello")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "req-1", record["request_id"])
+	assert.Equal(t, tp.TraceID, record["trace_id"])
+	assert.Equal(t, "test", record["component"])
+
+	buf.Reset()
+	logger.Info("no context")
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.NotContains(t, buf.String(), "request_id")
+}
+
+func TestTraceParentFrom_PrefersSpan(t *testing.T) {
+	ctx := WithTraceParent(context.Background(), NewTraceParent())
+
+	span, ok := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	traceID, _ := trace.TraceIDFromHex(span.TraceID)
+	spanID, _ := trace.SpanIDFromHex(span.SpanID)
+	spanCtx := trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled,
+	}))
+
+	got, ok := TraceParentFrom(spanCtx)
+	require.True(t, ok)
+	assert.Equal(t, span, got)
+
+	// SetTraceParent は外側のコンテキストにも反映される
+	require.True(t, SetTraceParent(spanCtx, span))
+	got, _ = TraceParentFrom(ctx)
+	assert.Equal(t, span, got)
+	assert.False(t, SetTraceParent(context.Background(), span))
+}
@@ -0,0 +1,47 @@
+package correlation
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogHandler はコンテキストのリクエスト ID とトレース ID を、すべてのログレコードに付与する slog.Handler です。
+// slog.InfoContext などのコンテキストを受け取る関数で出力したログが対象となります。
+type LogHandler struct {
+	inner slog.Handler
+}
+
+// NewLogHandler は inner をラップした LogHandler を作成します。
+//
+// 使用例:
+//
+//	slog.SetDefault(slog.New(correlation.NewLogHandler(slog.NewJSONHandler(os.Stdout, nil))))
+func NewLogHandler(inner slog.Handler) *LogHandler {
+	return &LogHandler{inner: inner}
+}
+
+// Enabled は inner の設定に従います。
+func (h *LogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+// Handle はリクエスト ID (request_id) とトレース ID (trace_id, span_id) を付与して inner に渡します。
+func (h *LogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := RequestIDFrom(ctx); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if tp, ok := TraceParentFrom(ctx); ok {
+		record.AddAttrs(slog.String("trace_id", tp.TraceID), slog.String("span_id", tp.SpanID))
+	}
+	return h.inner.Handle(ctx, record)
+}
+
+// WithAttrs は属性を追加した LogHandler を返します。
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LogHandler{inner: h.inner.WithAttrs(attrs)}
+}
+
+// WithGroup はグループを追加した LogHandler を返します。
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return &LogHandler{inner: h.inner.WithGroup(name)}
+}
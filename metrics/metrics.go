@@ -0,0 +1,232 @@
+// Package metrics は gloudia の各コンポーネント (HTTP、レート制限、リアルタイム Hub、ワーカー、メール、PDF 変換) の
+// Prometheus メトリクスを提供します。
+//
+// 各コンポーネントは *Metrics を受け取る設定項目を持ち、nil の場合はメトリクスを記録しません。
+// *Metrics のメソッドはすべて nil レシーバーで安全に呼び出せます。
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Config はメトリクスの設定構造体です。
+type Config struct {
+	// Namespace はメトリクス名の接頭辞です。既定値は "gloudia" です。
+	Namespace string
+	// DisableTenantLabel が true の場合、メトリクスに tenant ラベルを付与しません。
+	// テナント数が多くカーディナリティが問題になる場合に使用します。
+	DisableTenantLabel bool
+	// TenantFromContext はコンテキストからテナント ID を取得する関数です。
+	// ワーカー、メール、PDF 変換のメトリクスで使用します (例: middleware.MetricsTenant)。
+	// nil の場合、これらのメトリクスの tenant ラベルは空になります。
+	TenantFromContext func(ctx context.Context) string
+	// Registerer はメトリクスの登録先です。nil の場合は新しいレジストリを作成します。
+	Registerer prometheus.Registerer
+	// Gatherer は Handler で公開するメトリクスの収集元です。
+	// Registerer を指定した場合は、対応する Gatherer を指定してください。
+	Gatherer prometheus.Gatherer
+	// Buckets はレイテンシのヒストグラムのバケット (秒) です。nil の場合は prometheus.DefBuckets を使用します。
+	Buckets []float64
+}
+
+// Metrics は gloudia のメトリクスを保持する構造体です。
+type Metrics struct {
+	cfg      Config
+	gatherer prometheus.Gatherer
+
+	httpRequests       *prometheus.CounterVec
+	httpDuration       *prometheus.HistogramVec
+	rateLimitDecisions *prometheus.CounterVec
+	hubConnections     *prometheus.GaugeVec
+	hubConnects        *prometheus.CounterVec
+	hubDrops           *prometheus.CounterVec
+	workerJobs         *prometheus.CounterVec
+	workerDuration     *prometheus.HistogramVec
+	mailSends          *prometheus.CounterVec
+	pdfConversions     *prometheus.HistogramVec
+}
+
+// New はメトリクスを作成して Registerer に登録します。
+func New(cfg Config) (*Metrics, error) {
+	if cfg.Namespace == "" {
+		cfg.Namespace = "gloudia"
+	}
+	if cfg.Buckets == nil {
+		cfg.Buckets = prometheus.DefBuckets
+	}
+	gatherer := cfg.Gatherer
+	if cfg.Registerer == nil {
+		reg := prometheus.NewRegistry()
+		cfg.Registerer = reg
+		gatherer = reg
+	}
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+
+	m := &Metrics{cfg: cfg, gatherer: gatherer}
+	labels := func(names ...string) []string {
+		if cfg.DisableTenantLabel {
+			return names
+		}
+		return append(names, "tenant")
+	}
+
+	m.httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: cfg.Namespace, Subsystem: "http", Name: "requests_total",
+		Help: "Total number of HTTP requests by route template and status.",
+	}, labels("method", "route", "status"))
+	m.httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: cfg.Namespace, Subsystem: "http", Name: "request_duration_seconds",
+		Help: "HTTP request latency by route template and status.", Buckets: cfg.Buckets,
+	}, labels("method", "route", "status"))
+	m.rateLimitDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: cfg.Namespace, Subsystem: "ratelimit", Name: "decisions_total",
+		Help: "Rate limiter decisions by limit name and result (allowed, denied, error).",
+	}, labels("limit", "result"))
+	m.hubConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: cfg.Namespace, Subsystem: "realtime", Name: "connections",
+		Help: "Number of active realtime hub connections.",
+	}, labels())
+	m.hubConnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: cfg.Namespace, Subsystem: "realtime", Name: "connections_total",
+		Help: "Total number of realtime hub connections.",
+	}, labels())
+	m.hubDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: cfg.Namespace, Subsystem: "realtime", Name: "dropped_clients_total",
+		Help: "Total number of realtime clients dropped because their send buffer was full.",
+	}, labels())
+	m.workerJobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: cfg.Namespace, Subsystem: "worker", Name: "jobs_total",
+		Help: "Total number of processed jobs by type and result (success, failure).",
+	}, labels("type", "result"))
+	m.workerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: cfg.Namespace, Subsystem: "worker", Name: "job_duration_seconds",
+		Help: "Job processing duration by type and result.", Buckets: cfg.Buckets,
+	}, labels("type", "result"))
+	m.mailSends = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: cfg.Namespace, Subsystem: "mail", Name: "sends_total",
+		Help: "Total number of SMTP sends by result (success, failure).",
+	}, labels("result"))
+	m.pdfConversions = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: cfg.Namespace, Subsystem: "pdf", Name: "conversion_duration_seconds",
+		Help: "Gotenberg conversion latency by result (success, failure).", Buckets: cfg.Buckets,
+	}, labels("result"))
+
+	for _, c := range []prometheus.Collector{
+		m.httpRequests, m.httpDuration, m.rateLimitDecisions,
+		m.hubConnections, m.hubConnects, m.hubDrops,
+		m.workerJobs, m.workerDuration, m.mailSends, m.pdfConversions,
+	} {
+		if err := cfg.Registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Handler は /metrics に登録する HTTP ハンドラーを返します。
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{})
+}
+
+// values はラベルの値に、設定に応じて tenant ラベルの値を追加します。
+func (m *Metrics) values(tenant string, values ...string) []string {
+	if m.cfg.DisableTenantLabel {
+		return values
+	}
+	return append(values, tenant)
+}
+
+// tenantFrom は TenantFromContext を使用してテナント ID を取得します。
+func (m *Metrics) tenantFrom(ctx context.Context) string {
+	if m.cfg.DisableTenantLabel || m.cfg.TenantFromContext == nil {
+		return ""
+	}
+	return m.cfg.TenantFromContext(ctx)
+}
+
+// result はエラーの有無を result ラベルの値に変換します。
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// ObserveHTTPRequest は HTTP リクエストの件数とレイテンシを記録します。
+// route にはパスそのものではなく、ルートのテンプレート (例: "/items/{id}") を指定してください。
+func (m *Metrics) ObserveHTTPRequest(tenant, method, route string, status int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	values := m.values(tenant, method, route, strconv.Itoa(status))
+	m.httpRequests.WithLabelValues(values...).Inc()
+	m.httpDuration.WithLabelValues(values...).Observe(duration.Seconds())
+}
+
+// RecordRateLimit はレート制限の判定結果を記録します。result は "allowed", "denied", "error" のいずれかです。
+func (m *Metrics) RecordRateLimit(tenant, limit, result string) {
+	if m == nil {
+		return
+	}
+	m.rateLimitDecisions.WithLabelValues(m.values(tenant, limit, result)...).Inc()
+}
+
+// HubConnected はリアルタイム Hub へのクライアントの接続を記録します。
+func (m *Metrics) HubConnected(tenant string) {
+	if m == nil {
+		return
+	}
+	m.hubConnections.WithLabelValues(m.values(tenant)...).Inc()
+	m.hubConnects.WithLabelValues(m.values(tenant)...).Inc()
+}
+
+// HubDisconnected はリアルタイム Hub からのクライアントの切断を記録します。
+func (m *Metrics) HubDisconnected(tenant string) {
+	if m == nil {
+		return
+	}
+	m.hubConnections.WithLabelValues(m.values(tenant)...).Dec()
+}
+
+// HubDropped は送信バッファの溢れによるクライアントの切断を記録します。HubDisconnected も合わせて記録されます。
+func (m *Metrics) HubDropped(tenant string) {
+	if m == nil {
+		return
+	}
+	m.hubDrops.WithLabelValues(m.values(tenant)...).Inc()
+	m.HubDisconnected(tenant)
+}
+
+// ObserveJob はワーカーのジョブの処理結果と処理時間を記録します。
+func (m *Metrics) ObserveJob(ctx context.Context, jobType string, err error, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	values := m.values(m.tenantFrom(ctx), jobType, result(err))
+	m.workerJobs.WithLabelValues(values...).Inc()
+	m.workerDuration.WithLabelValues(values...).Observe(duration.Seconds())
+}
+
+// RecordMailSend は SMTP によるメール送信の結果を記録します。
+func (m *Metrics) RecordMailSend(ctx context.Context, err error) {
+	if m == nil {
+		return
+	}
+	m.mailSends.WithLabelValues(m.values(m.tenantFrom(ctx), result(err))...).Inc()
+}
+
+// ObservePDFConversion は Gotenberg による PDF 変換の結果とレイテンシを記録します。
+func (m *Metrics) ObservePDFConversion(ctx context.Context, err error, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.pdfConversions.WithLabelValues(m.values(m.tenantFrom(ctx), result(err))...).Observe(duration.Seconds())
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tenantKey struct{}
+
+func TestMetrics(t *testing.T) {
+	m, err := New(Config{
+		TenantFromContext: func(ctx context.Context) string {
+			tenant, _ := ctx.Value(tenantKey{}).(string)
+			return tenant
+		},
+	})
+	require.NoError(t, err)
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "t1")
+
+	m.ObserveHTTPRequest("t1", http.MethodGet, "/items/{id}", 200, 10*time.Millisecond)
+	m.ObserveHTTPRequest("t1", http.MethodGet, "/items/{id}", 200, 20*time.Millisecond)
+	m.RecordRateLimit("t1", "login", "denied")
+	m.HubConnected("t1")
+	m.HubConnected("t1")
+	m.HubDropped("t1")
+	m.ObserveJob(ctx, "send_mail", errors.New("boom"), time.Second)
+	m.RecordMailSend(ctx, nil)
+	m.ObservePDFConversion(ctx, nil, time.Second)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.httpRequests.WithLabelValues("GET", "/items/{id}", "200", "t1")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.rateLimitDecisions.WithLabelValues("login", "denied", "t1")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.hubConnections.WithLabelValues("t1")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.hubDrops.WithLabelValues("t1")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.workerJobs.WithLabelValues("send_mail", "failure", "t1")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.mailSends.WithLabelValues("success", "t1")))
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `gloudia_http_request_duration_seconds_count{method="GET",route="/items/{id}",status="200",tenant="t1"} 2`)
+	assert.Contains(t, rec.Body.String(), `gloudia_pdf_conversion_duration_seconds_count{result="success",tenant="t1"} 1`)
+}
+
+func TestMetricsWithoutTenantLabel(t *testing.T) {
+	m, err := New(Config{DisableTenantLabel: true})
+	require.NoError(t, err)
+
+	m.ObserveHTTPRequest("t1", http.MethodPost, "/items", 201, time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.httpRequests.WithLabelValues("POST", "/items", "201")))
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	assert.NotPanics(t, func() {
+		m.ObserveHTTPRequest("", "GET", "/", 200, 0)
+		m.RecordRateLimit("", "global", "allowed")
+		m.HubConnected("")
+		m.HubDropped("")
+		m.ObserveJob(context.Background(), "job", nil, 0)
+		m.RecordMailSend(context.Background(), nil)
+		m.ObservePDFConversion(context.Background(), nil, 0)
+	})
+}
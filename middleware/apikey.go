@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+// APIKeyHeader は API キーを受け取るための専用ヘッダー名です。
+const APIKeyHeader = "X-API-Key"
+
+// NewAPIKeyProvider は API キーを検証する Huma ミドルウェアを生成します。
+//
+// X-API-Key ヘッダー、または "Authorization: ApiKey <key>" からキーを読み取り、検証を行います。
+// 検証に成功した場合、キーから生成した合成 Claims を KeyClaims としてコンテキストに保存するため、
+// 後続の NewAuthProvider や NewRLSProvider はトークン認証時と同様に動作します。
+// キーが送信されていない場合は何もせず、後続の処理（トークン認証など）に委譲します。
+//
+// 引数:
+//
+//	store: API キーの検索に使用する APIKeyStore
+func NewAPIKeyProvider(store auth.APIKeyStore) func(huma.Context, func(huma.Context)) {
+	return func(ctx huma.Context, next func(huma.Context)) {
+		// 1. API キーの取得
+		key := ctx.Header(APIKeyHeader)
+		if key == "" {
+			fields := strings.Fields(ctx.Header("Authorization"))
+			if len(fields) == 2 && strings.EqualFold(fields[0], "apikey") {
+				key = fields[1]
+			}
+		}
+
+		// API キーが送信されていない場合はトークン認証などに委譲
+		if key == "" {
+			next(ctx)
+			return
+		}
+
+		// 2. API キーの検証
+		apiKey, err := auth.VerifyAPIKey(ctx.Context(), store, key)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrAPIKeyExpired):
+				writeInvalidResponse(ctx, http.StatusUnauthorized, "API key has expired", nil)
+			case errors.Is(err, auth.ErrAPIKeyRevoked):
+				writeInvalidResponse(ctx, http.StatusUnauthorized, "API key has been revoked", nil)
+			case errors.Is(err, auth.ErrAPIKeyMalformed), errors.Is(err, auth.ErrAPIKeyNotFound):
+				writeInvalidResponse(ctx, http.StatusUnauthorized, "Invalid API key", nil)
+			default:
+				slog.ErrorContext(ctx.Context(), "Failed to verify api key", "error", err)
+				writeInvalidResponse(ctx, http.StatusInternalServerError, "Failed to verify API key", nil)
+			}
+			return
+		}
+
+		// 3. ホストなどから解決済みのテナントとキーのテナントが異なる場合は拒否
+		if tenantID, ok := TenantFrom(ctx.Context()); ok && tenantID != apiKey.TenantID {
+			writeInvalidResponse(ctx, http.StatusForbidden, "API key is not valid for this tenant", nil)
+			return
+		}
+
+		// 4. 検証成功: Context に合成 Claims を保存
+		claims := apiKey.Claims()
+		ctx = huma.WithValue(ctx, KeyClaims, claims)
+		ctx = huma.WithValue(ctx, KeyAuthMethod, AuthMethodAPIKey)
+		setAccessLogClaims(ctx.Context(), claims)
+
+		next(ctx)
+	}
+}
+
+// NewScopeGuard は API キー認証されたリクエストが指定されたスコープをすべて持つことを検証する
+// Huma ミドルウェアを生成します。
+// トークン認証（ユーザー）のリクエストはスコープの制限を受けず、そのまま通過します。
+func NewScopeGuard(scopes ...string) func(huma.Context, func(huma.Context)) {
+	return func(ctx huma.Context, next func(huma.Context)) {
+		claims, ok := ClaimsFrom(ctx.Context())
+		if ok && claims.IsAPIKey() {
+			for _, scope := range scopes {
+				if !claims.HasScope(scope) {
+					writeInvalidResponse(ctx, http.StatusForbidden, "API key does not have the required scope: "+scope, nil)
+					return
+				}
+			}
+		}
+		next(ctx)
+	}
+}
@@ -1,58 +1,290 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/danielgtaylor/huma/v2"
 
+	"github.com/golaboratory/gloudia/api"
 	"github.com/golaboratory/gloudia/auth"
 )
 
+// AuthMode は NewAuthProviderWithConfig が認証を要求する方法を表します。
+type AuthMode int
+
+const (
+	// AuthModeRequired はすべてのリクエストで有効なトークンを要求します。
+	AuthModeRequired AuthMode = iota
+	// AuthModeOptional はトークンが送信された場合のみ検証し、送信されていない場合はゲストとして後続に委譲します。
+	// 送信されたトークンが不正な場合は 401 を返します。
+	AuthModeOptional
+	// AuthModeOperation は Huma のオペレーションに定義された Security 要件に従います。
+	// Security が空、または空の要件 ({}) を含む場合は AuthModeOptional と同様に、
+	// それ以外の場合は AuthModeRequired と同様に動作し、要件のスコープも検証します。
+	AuthModeOperation
+)
+
+// 認証失敗の理由を表すコードです。レスポンスの errors.authorization に設定されます。
+const (
+	authErrorMissing   = "missing"
+	authErrorMalformed = "malformed"
+	authErrorExpired   = "expired"
+	authErrorRevoked   = "revoked"
+	authErrorForbidden = "insufficient_scope"
+)
+
 // NewAuthProvider は PASETO トークンを検証する Huma ミドルウェアを生成します。
 //
 // Authorization ヘッダーから Bearer トークンを読み取り、検証を行います。
 // 検証に成功した場合、トークンのペイロード（Claims）をコンテキストに保存します。
-// ヘッダーが存在しない場合は検証をスキップし、後続の処理に委譲します（ゲストアクセスの考慮）。
+// ヘッダーが存在しない場合は 401 を返します（AuthModeRequired）。
+// ゲストアクセスを許可する場合は NewAuthProviderWithConfig で Mode を指定してください。
 //
 // 引数:
 //
 //	maker: トークン検証に使用する TokenMaker インスタンス
 func NewAuthProvider(maker *auth.TokenMaker) func(huma.Context, func(huma.Context)) {
+	return NewAuthProviderWithConfig(AuthConfig{Maker: maker})
+}
+
+// AuthConfig は NewAuthProviderWithConfig の設定構造体です。
+type AuthConfig struct {
+	// Maker はトークン検証に使用する TokenMaker インスタンスです。
+	Maker *auth.TokenMaker
+	// Sessions はトークンに紐づくセッションの有効性を検証します。
+	// nil の場合はセッションを検証しません（ステートレスなトークン認証）。なりすましトークンは拒否されます。
+	Sessions auth.SessionValidator
+	// Mode は認証を要求する方法です。既定値は AuthModeRequired です。
+	Mode AuthMode
+	// Realm は WWW-Authenticate ヘッダーに設定する realm です。既定値は "api" です。
+	Realm string
+	// RoleScopes はロール ID ごとに許可するスコープです。AuthModeOperation で使用されます。
+	// 指定した場合、トークン認証（ユーザー）のリクエストもオペレーションの Security 要件の
+	// スコープをロールが持っているかで検証されます。nil の場合、ユーザーはスコープの制限を受けません。
+	// API キー認証のリクエストは、常にキーに付与されたスコープで検証されます。
+	RoleScopes map[int64][]string
+}
+
+// NewAuthProviderWithConfig は AuthConfig を使用して、PASETO トークンを検証する Huma ミドルウェアを生成します。
+// Sessions を指定した場合、失効済みのセッションに紐づくトークンは拒否されます。
+// なりすましトークン (auth.Impersonator) は失効を検証できないため、Sessions を指定していない場合は 500 を返します。
+//
+// 認証に失敗した場合は WWW-Authenticate ヘッダーと api.UnifiedResponse 形式のボディを返します。
+// ボディの errors.authorization には、失敗の理由 (missing / malformed / expired / revoked) が設定されます。
+func NewAuthProviderWithConfig(cfg AuthConfig) func(huma.Context, func(huma.Context)) {
+	if cfg.Realm == "" {
+		cfg.Realm = "api"
+	}
 	return func(ctx huma.Context, next func(huma.Context)) {
+		required, requirements := cfg.requirement(ctx.Operation())
+
+		// 0. NewAPIKeyProvider などで認証済みの場合はトークン検証をスキップ
+		if claims, ok := ClaimsFrom(ctx.Context()); ok {
+			if cfg.authorize(ctx, claims, requirements) {
+				next(ctx)
+			}
+			return
+		}
+
 		// 1. Authorization ヘッダーの取得
 		authHeader := ctx.Header("Authorization")
 
-		// ヘッダーがない場合は検証をスキップして次の処理へ (ゲストアクセスの可能性)
-		// ※ 認証必須のエンドポイントかどうかは、各Handler側またはHumaのSecurity Schemeで制御します
+		// ヘッダーがない場合、認証が任意であればゲストとして次の処理へ
 		if authHeader == "" {
-			ctx.SetStatus(http.StatusUnauthorized)
+			if !required {
+				next(ctx)
+				return
+			}
+			cfg.unauthorized(ctx, authErrorMissing, "Authentication is required")
 			return
 		}
 
-		// 2. Bearer スキーマの検証
-		fields := strings.Fields(authHeader)
-		if len(fields) < 2 || strings.ToLower(fields[0]) != "bearer" {
-			// ヘッダーがあるのに形式が不正な場合は 401 を返す
-			ctx.SetStatus(401)
+		// 2. Bearer トークンとセッションの検証
+		claims, failure := cfg.verifyBearer(ctx.Context(), authHeader)
+		if failure != nil {
+			if failure.status == http.StatusUnauthorized {
+				cfg.unauthorized(ctx, failure.reason, failure.message)
+			} else {
+				writeInvalidResponse(ctx, failure.status, failure.message, nil)
+			}
 			return
 		}
 
-		tokenString := fields[1]
-
-		// 3. トークンの検証 (internal/auth パッケージ利用)
-		claims, err := maker.VerifyToken(tokenString)
-		if err != nil {
-			// 期限切れや改ざん検知時
-			ctx.SetStatus(401)
+		// 3. オペレーションのスコープ要件の検証
+		if !cfg.authorize(ctx, claims, requirements) {
 			return
 		}
 
 		// 4. 検証成功: Context に Claims (構造体) を保存
 		// context_keys.go で定義した KeyClaims を使用
 		ctx = huma.WithValue(ctx, KeyClaims, claims)
+		ctx = huma.WithValue(ctx, KeyAuthMethod, AuthMethodBearer)
+		setAccessLogClaims(ctx.Context(), claims)
 
 		// 5. 次の処理へ
 		next(ctx)
 	}
 }
+
+// NewAuthHandler は NewAuthProviderWithConfig と同様に PASETO トークンを検証する Chi ミドルウェアを生成します。
+// Huma のオペレーションより前に認証が必要な Chi のミドルウェア (NewSignedURLVerifier のユーザーの検証など) の前に登録します。
+//
+// Chi の層ではオペレーションの Security 要件を参照できないため、AuthModeOperation は AuthModeOptional と同様に動作し、
+// スコープの検証は行いません。後続の NewAuthProviderWithConfig は、このミドルウェアで認証済みの Claims を使用してスコープを検証します。
+func NewAuthHandler(cfg AuthConfig) func(http.Handler) http.Handler {
+	if cfg.Realm == "" {
+		cfg.Realm = "api"
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" {
+				if cfg.Mode != AuthModeRequired {
+					next.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", cfg.challenge(authErrorMissing, ""))
+				writeInvalidJSON(w, r, http.StatusUnauthorized, "Authentication is required", api.InvalidItem{"authorization": authErrorMissing})
+				return
+			}
+
+			claims, failure := cfg.verifyBearer(r.Context(), authHeader)
+			if failure != nil {
+				var details api.InvalidItem
+				if failure.status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", cfg.challenge(failure.reason, failure.message))
+					details = api.InvalidItem{"authorization": api.ErrorMessage(failure.reason)}
+				}
+				writeInvalidJSON(w, r, failure.status, failure.message, details)
+				return
+			}
+
+			ctx := WithAuthMethod(WithClaims(r.Context(), claims), AuthMethodBearer)
+			setAccessLogClaims(ctx, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authFailure は Bearer トークンの検証に失敗した理由です。
+type authFailure struct {
+	status  int
+	reason  string // 401 の場合の errors.authorization の値
+	message string
+}
+
+// verifyBearer は Authorization ヘッダーの Bearer トークンと、トークンに紐づくセッションを検証します。
+func (cfg AuthConfig) verifyBearer(ctx context.Context, authHeader string) (*auth.Claims, *authFailure) {
+	// Bearer スキーマの検証
+	fields := strings.Fields(authHeader)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "bearer") {
+		// ヘッダーがあるのに形式が不正な場合は、認証が任意でも 401 を返す
+		return nil, &authFailure{http.StatusUnauthorized, authErrorMalformed, "Authorization header is malformed"}
+	}
+
+	// トークンの検証 (internal/auth パッケージ利用)
+	claims, err := cfg.Maker.VerifyToken(fields[1])
+	if err != nil {
+		if errors.Is(err, auth.ErrTokenExpired) {
+			return nil, &authFailure{http.StatusUnauthorized, authErrorExpired, "Token has expired"}
+		}
+		// 改ざん検知や形式不正
+		return nil, &authFailure{http.StatusUnauthorized, authErrorMalformed, "Token is invalid"}
+	}
+
+	// セッションの検証 (失効済みセッションの拒否)
+	// なりすましトークンはセッションの失効で終了するため、Sessions が指定されていない場合は受け付けない
+	if cfg.Sessions == nil && claims.IsImpersonated() {
+		slog.ErrorContext(ctx, "Impersonation token rejected: AuthConfig.Sessions is not configured")
+		return nil, &authFailure{status: http.StatusInternalServerError, message: "Impersonation requires session validation"}
+	}
+	if cfg.Sessions != nil {
+		if err := cfg.Sessions.ValidateSession(ctx, claims); err != nil {
+			if !errors.Is(err, auth.ErrSessionRevoked) && !errors.Is(err, auth.ErrSessionNotFound) {
+				slog.ErrorContext(ctx, "Failed to validate session", "error", err)
+				return nil, &authFailure{status: http.StatusInternalServerError, message: "Failed to validate session"}
+			}
+			return nil, &authFailure{http.StatusUnauthorized, authErrorRevoked, "Token has been revoked"}
+		}
+	}
+	return claims, nil
+}
+
+// requirement はリクエストで認証が必須かどうかと、満たすべきスコープの候補を返します。
+// スコープの候補はいずれか 1 つを満たせばよく (OR)、各候補内のスコープはすべて必要です (AND)。
+func (cfg AuthConfig) requirement(op *huma.Operation) (bool, [][]string) {
+	switch cfg.Mode {
+	case AuthModeOptional:
+		return false, nil
+	case AuthModeOperation:
+		if op == nil || len(op.Security) == 0 {
+			return false, nil
+		}
+		required := true
+		requirements := make([][]string, 0, len(op.Security))
+		for _, sec := range op.Security {
+			// 空の要件 ({}) は OpenAPI で「認証なしでも可」を意味する
+			if len(sec) == 0 {
+				required = false
+				continue
+			}
+			var scopes []string
+			for _, s := range sec {
+				scopes = append(scopes, s...)
+			}
+			requirements = append(requirements, scopes)
+		}
+		return required, requirements
+	}
+	return true, nil
+}
+
+// authorize は Claims がスコープの候補のいずれかを満たすか検証します。満たさない場合は 403 を返します。
+func (cfg AuthConfig) authorize(ctx huma.Context, claims *auth.Claims, requirements [][]string) bool {
+	if len(requirements) == 0 {
+		return true
+	}
+
+	var granted func(scope string) bool
+	switch {
+	case claims.IsAPIKey():
+		granted = claims.HasScope
+	case cfg.RoleScopes != nil:
+		roleScopes := cfg.RoleScopes[claims.RoleID]
+		granted = func(scope string) bool { return slices.Contains(roleScopes, scope) }
+	default:
+		return true
+	}
+
+	for _, scopes := range requirements {
+		if !slices.ContainsFunc(scopes, func(s string) bool { return !granted(s) }) {
+			return true
+		}
+	}
+
+	ctx.SetHeader("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q, error="insufficient_scope", scope=%q`,
+		cfg.Realm, strings.Join(requirements[0], " ")))
+	writeInvalidResponse(ctx, http.StatusForbidden, "Insufficient scope", api.InvalidItem{"authorization": authErrorForbidden})
+	return false
+}
+
+// unauthorized は WWW-Authenticate ヘッダーを付与して 401 を返します (RFC 6750)。
+func (cfg AuthConfig) unauthorized(ctx huma.Context, reason string, message string) {
+	ctx.SetHeader("WWW-Authenticate", cfg.challenge(reason, message))
+	writeInvalidResponse(ctx, http.StatusUnauthorized, message, api.InvalidItem{"authorization": api.ErrorMessage(reason)})
+}
+
+// challenge は 401 の WWW-Authenticate ヘッダーの値を返します。
+func (cfg AuthConfig) challenge(reason string, message string) string {
+	challenge := fmt.Sprintf("Bearer realm=%q", cfg.Realm)
+	if reason != authErrorMissing {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, message)
+	}
+	return challenge
+}
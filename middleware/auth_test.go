@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+type stubSessionValidator struct{ err error }
+
+func (s stubSessionValidator) ValidateSession(context.Context, *auth.Claims) error { return s.err }
+
+func newAuthTestAPI(t *testing.T, cfg AuthConfig) humatest.TestAPI {
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewAuthProviderWithConfig(cfg))
+
+	type output struct {
+		Body struct {
+			UserID int64 `json:"userId"`
+		}
+	}
+	handler := func(ctx context.Context, _ *struct{}) (*output, error) {
+		out := &output{}
+		if claims, ok := ctx.Value(KeyClaims).(*auth.Claims); ok {
+			out.Body.UserID = claims.UserID
+		}
+		return out, nil
+	}
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/public"}, handler)
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/private",
+		Security: []map[string][]string{{"bearer": {}}}}, handler)
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/mixed",
+		Security: []map[string][]string{{}, {"bearer": {}}}}, handler)
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/admin",
+		Security: []map[string][]string{{"bearer": {"admin"}}}}, handler)
+	return api
+}
+
+func TestNewAuthProviderWithConfig(t *testing.T) {
+	maker, err := auth.NewTokenMaker(auth.GenerateRandomKey())
+	require.NoError(t, err)
+	token, err := maker.CreateToken(42, "tenant", 1, time.Minute)
+	require.NoError(t, err)
+	expired, err := maker.CreateToken(42, "tenant", 1, -time.Minute)
+	require.NoError(t, err)
+
+	t.Run("required mode", func(t *testing.T) {
+		api := newAuthTestAPI(t, AuthConfig{Maker: maker})
+
+		resp := api.Get("/public")
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+		assert.Equal(t, `Bearer realm="api"`, resp.Header().Get("WWW-Authenticate"))
+		assert.Contains(t, resp.Body.String(), `"authorization":"missing"`)
+
+		resp = api.Get("/public", "Authorization: Basic xxx")
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+		assert.Contains(t, resp.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+		assert.Contains(t, resp.Body.String(), `"authorization":"malformed"`)
+
+		resp = api.Get("/public", "Authorization: Bearer "+expired)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"authorization":"expired"`)
+
+		resp = api.Get("/public", "Authorization: Bearer "+token)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"userId":42`)
+	})
+
+	t.Run("optional mode", func(t *testing.T) {
+		api := newAuthTestAPI(t, AuthConfig{Maker: maker, Mode: AuthModeOptional})
+
+		resp := api.Get("/private")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"userId":0`)
+
+		resp = api.Get("/private", "Authorization: Bearer broken")
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	})
+
+	t.Run("operation mode", func(t *testing.T) {
+		api := newAuthTestAPI(t, AuthConfig{
+			Maker:      maker,
+			Mode:       AuthModeOperation,
+			RoleScopes: map[int64][]string{1: {"read"}, 9: {"read", "admin"}},
+		})
+
+		assert.Equal(t, http.StatusOK, api.Get("/public").Code)
+		assert.Equal(t, http.StatusOK, api.Get("/mixed").Code)
+		assert.Equal(t, http.StatusUnauthorized, api.Get("/private").Code)
+		assert.Equal(t, http.StatusOK, api.Get("/private", "Authorization: Bearer "+token).Code)
+
+		resp := api.Get("/admin", "Authorization: Bearer "+token)
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+		assert.Contains(t, resp.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+
+		admin, err := maker.CreateToken(1, "tenant", 9, time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, api.Get("/admin", "Authorization: Bearer "+admin).Code)
+	})
+
+	t.Run("revoked session", func(t *testing.T) {
+		api := newAuthTestAPI(t, AuthConfig{Maker: maker, Sessions: stubSessionValidator{err: auth.ErrSessionRevoked}})
+
+		resp := api.Get("/public", "Authorization: Bearer "+token)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"authorization":"revoked"`)
+	})
+
+	t.Run("impersonation requires session validation", func(t *testing.T) {
+		impersonated, err := maker.CreateTokenWithClaims(&auth.Claims{
+			UserID: 42, TenantID: "tenant", RoleID: 1, SessionID: "s", ActorUserID: 1, ImpersonationID: "imp",
+		}, time.Minute)
+		require.NoError(t, err)
+
+		api := newAuthTestAPI(t, AuthConfig{Maker: maker})
+		assert.Equal(t, http.StatusInternalServerError, api.Get("/public", "Authorization: Bearer "+impersonated).Code)
+
+		api = newAuthTestAPI(t, AuthConfig{Maker: maker, Sessions: stubSessionValidator{}})
+		assert.Equal(t, http.StatusOK, api.Get("/public", "Authorization: Bearer "+impersonated).Code)
+	})
+}
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/newmo-oss/ergo"
+)
+
+// TrustedProxies は X-Forwarded-For などのヘッダーを信頼するプロキシ (ロードバランサー、Nginx など) のアドレス範囲です。
+// 信頼しないアドレスから送信されたヘッダーは無視されるため、クライアントによる IP アドレスの詐称を防げます。
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies は CIDR 表記 (例: "10.0.0.0/8") または単一の IP アドレスのリストを解析します。
+func ParseTrustedProxies(cidrs ...string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, ergo.Wrap(err, "invalid trusted proxy address")
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, ergo.Wrap(err, "invalid trusted proxy cidr")
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// MustParseTrustedProxies は ParseTrustedProxies と同様に解析し、失敗した場合は panic します。
+// 設定値が固定されている初期化処理で使用します。
+func MustParseTrustedProxies(cidrs ...string) TrustedProxies {
+	proxies, err := ParseTrustedProxies(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return proxies
+}
+
+// trusted はアドレスが信頼するプロキシに含まれるかを判定します。
+func (p TrustedProxies) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP はリクエストの送信元のクライアントの IP アドレスを返します。
+//
+// 直接の接続元 (remoteAddr) が信頼するプロキシの場合のみ X-Forwarded-For を右から順に確認し、
+// 信頼するプロキシ以外で最初に現れたアドレスをクライアントとします。
+// X-Forwarded-For がない場合は X-Real-IP を使用します。
+func (p TrustedProxies) ClientIP(remoteAddr string, header func(string) string) string {
+	remote, ok := parseIP(remoteAddr)
+	if !ok {
+		return remoteAddr
+	}
+	if !p.trusted(remote) {
+		return remote.String()
+	}
+
+	if xff := header("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, ok := parseIP(hops[i])
+			if !ok {
+				// 不正な値が含まれる場合は、それより左側を信頼しない
+				break
+			}
+			if !p.trusted(addr) || i == 0 {
+				return addr.String()
+			}
+		}
+	}
+	if realIP, ok := parseIP(header("X-Real-IP")); ok {
+		return realIP.String()
+	}
+	return remote.String()
+}
+
+// parseIP は "host:port" または IP アドレスの文字列を解析します。
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
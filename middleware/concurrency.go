@@ -0,0 +1,315 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/newmo-oss/ergo"
+
+	"github.com/golaboratory/gloudia/api"
+)
+
+// ConcurrencyMetadataKey は huma.Operation の Metadata で、オペレーションごとの同時実行数の上限 (int) を指定するキーです。
+// Excel 出力や PDF 変換など、重い処理を行うオペレーションに指定します。
+//
+//	huma.Operation{Metadata: map[string]any{middleware.ConcurrencyMetadataKey: 4}}
+const ConcurrencyMetadataKey = "maxConcurrency"
+
+var (
+	errConcurrencyQueueFull = ergo.NewSentinel("concurrency queue is full")
+	errConcurrencyTimeout   = ergo.NewSentinel("concurrency queue wait timed out")
+)
+
+// ConcurrencyConfig は同時実行数制限ミドルウェアの設定構造体です。
+type ConcurrencyConfig struct {
+	// MaxInFlight はアプリケーション全体で同時に処理するリクエスト数の上限です (0 の場合は無制限)。
+	MaxInFlight int
+	// MaxPerTenant はテナントごとに同時に処理するリクエスト数の上限です (0 の場合は無制限)。
+	MaxPerTenant int
+	// MaxQueue は上限に達した場合に待機できるリクエスト数です (上限ごと)。0 の場合は待機せずに拒否します。
+	MaxQueue int
+	// QueueTimeout は待機の最大時間です。超過した場合は拒否します。
+	QueueTimeout time.Duration
+	// RetryAfter は拒否時に Retry-After ヘッダーで通知する時間です。
+	RetryAfter time.Duration
+	// Adaptive を指定した場合、観測したレイテンシーに応じて MaxInFlight を自動で増減させます。
+	Adaptive *AdaptiveConcurrencyConfig
+}
+
+// AdaptiveConcurrencyConfig は同時実行数の自動調整 (適応的な負荷制限) の設定です。
+//
+// 平均レイテンシーが TargetLatency を超えた場合は上限を減らし (乗算的減少)、
+// 下回っている間は上限を MaxInFlight まで 1 ずつ戻します (加算的増加)。
+type AdaptiveConcurrencyConfig struct {
+	TargetLatency  time.Duration // 目標とするレイテンシー
+	MinInFlight    int           // 上限の最小値
+	DecreaseFactor float64       // 減少時に上限に乗じる係数 (0 < x < 1)
+	Interval       time.Duration // 上限を調整する最小間隔
+}
+
+// DefaultConcurrencyConfig は標準的な設定を返します。
+func DefaultConcurrencyConfig() ConcurrencyConfig {
+	return ConcurrencyConfig{
+		MaxInFlight:  100,
+		MaxQueue:     100,
+		QueueTimeout: 5 * time.Second,
+		RetryAfter:   time.Second,
+	}
+}
+
+// NewConcurrencyLimiter は同時実行数を制限する Huma ミドルウェアを生成します。
+//
+// 全体 (MaxInFlight)、オペレーションごと (ConcurrencyMetadataKey)、テナントごと (MaxPerTenant) の上限を適用し、
+// 上限に達したリクエストは QueueTimeout まで待機させます。
+// 待機できない場合は Retry-After ヘッダーと api.UnifiedResponse 形式のボディで 503 を返します。
+// テナントごとの上限を使用する場合は、テナント解決・認証のミドルウェアの後に登録してください。
+func NewConcurrencyLimiter(config ConcurrencyConfig) func(huma.Context, func(huma.Context)) {
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = DefaultConcurrencyConfig().RetryAfter
+	}
+
+	var (
+		global   *concurrencyGate
+		adaptive *adaptiveController
+	)
+	if config.MaxInFlight > 0 {
+		global = newConcurrencyGate(config.MaxInFlight, config.MaxQueue)
+		if config.Adaptive != nil && config.Adaptive.TargetLatency > 0 {
+			adaptive = newAdaptiveController(*config.Adaptive, config.MaxInFlight, global)
+		}
+	}
+	operations := newConcurrencyGates(config.MaxQueue)
+	tenants := newConcurrencyGates(config.MaxQueue)
+
+	return func(ctx huma.Context, next func(huma.Context)) {
+		waitCtx := ctx.Context()
+		if config.QueueTimeout > 0 {
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(waitCtx, config.QueueTimeout)
+			defer cancel()
+		}
+
+		var releases []func()
+		defer func() {
+			for i := len(releases) - 1; i >= 0; i-- {
+				releases[i]()
+			}
+		}()
+
+		// オペレーション → テナント → 全体の順に枠を確保する
+		acquire := func(scope string, gate *concurrencyGate, release func()) bool {
+			if err := gate.acquire(waitCtx); err != nil {
+				release()
+				slog.WarnContext(ctx.Context(), "Request rejected by concurrency limit", "scope", scope, "reason", err.Error())
+				retryAfterSec := strconv.Itoa(max(int(config.RetryAfter/time.Second), 1))
+				ctx.SetHeader("Retry-After", retryAfterSec)
+				writeInvalidResponse(ctx, http.StatusServiceUnavailable,
+					"The server is busy. Please try again later.",
+					api.InvalidItem{"retryAfter": api.ErrorMessage(retryAfterSec)})
+				return false
+			}
+			releases = append(releases, func() {
+				gate.release()
+				release()
+			})
+			return true
+		}
+
+		if op := ctx.Operation(); op != nil {
+			if limit, ok := op.Metadata[ConcurrencyMetadataKey].(int); ok && limit > 0 {
+				key := op.Method + " " + op.Path
+				gate, release := operations.get(key, limit)
+				if !acquire("operation", gate, release) {
+					return
+				}
+			}
+		}
+		if config.MaxPerTenant > 0 {
+			if tenantID := MetricsTenant(ctx.Context()); tenantID != "" {
+				gate, release := tenants.get(tenantID, config.MaxPerTenant)
+				if !acquire("tenant", gate, release) {
+					return
+				}
+			}
+		}
+		if global != nil && !acquire("global", global, func() {}) {
+			return
+		}
+
+		start := time.Now()
+		next(ctx)
+		adaptive.observe(time.Since(start))
+	}
+}
+
+// concurrencyGate は待機キューを持つセマフォです。上限は実行中に変更できます。
+type concurrencyGate struct {
+	mu       sync.Mutex
+	limit    int
+	maxQueue int
+	inFlight int
+	waiters  []chan struct{}
+}
+
+func newConcurrencyGate(limit int, maxQueue int) *concurrencyGate {
+	return &concurrencyGate{limit: limit, maxQueue: maxQueue}
+}
+
+// acquire は枠を確保します。上限に達している場合は ctx が終了するまで先着順に待機します。
+func (g *concurrencyGate) acquire(ctx context.Context) error {
+	g.mu.Lock()
+	if g.inFlight < g.limit && len(g.waiters) == 0 {
+		g.inFlight++
+		g.mu.Unlock()
+		return nil
+	}
+	if len(g.waiters) >= g.maxQueue {
+		g.mu.Unlock()
+		return errConcurrencyQueueFull
+	}
+	ch := make(chan struct{})
+	g.waiters = append(g.waiters, ch)
+	g.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		for i, w := range g.waiters {
+			if w == ch {
+				g.waiters = append(g.waiters[:i], g.waiters[i+1:]...)
+				g.mu.Unlock()
+				return errConcurrencyTimeout
+			}
+		}
+		g.mu.Unlock()
+		// タイムアウトと同時に枠を譲り受けていた場合は返却する
+		g.release()
+		return errConcurrencyTimeout
+	}
+}
+
+// release は枠を返却します。待機中のリクエストがあれば、枠をそのまま先頭のリクエストに引き渡します。
+func (g *concurrencyGate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.waiters) > 0 && g.inFlight <= g.limit {
+		close(g.waiters[0])
+		g.waiters = g.waiters[1:]
+		return
+	}
+	g.inFlight--
+}
+
+// setLimit は上限を変更し、増えた枠を待機中のリクエストに割り当てます。
+func (g *concurrencyGate) setLimit(limit int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.limit = limit
+	for g.inFlight < g.limit && len(g.waiters) > 0 {
+		g.inFlight++
+		close(g.waiters[0])
+		g.waiters = g.waiters[1:]
+	}
+}
+
+// concurrencyGates はキー (オペレーション、テナント) ごとの concurrencyGate を管理します。
+// 使用中のリクエストがなくなったキーは削除されるため、テナント数が多くてもメモリを消費し続けません。
+type concurrencyGates struct {
+	mu       sync.Mutex
+	maxQueue int
+	gates    map[string]*refGate
+}
+
+type refGate struct {
+	gate *concurrencyGate
+	refs int
+}
+
+func newConcurrencyGates(maxQueue int) *concurrencyGates {
+	return &concurrencyGates{maxQueue: maxQueue, gates: make(map[string]*refGate)}
+}
+
+// get はキーの concurrencyGate と、使用後に呼び出す関数を返します。
+func (g *concurrencyGates) get(key string, limit int) (*concurrencyGate, func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	rg, ok := g.gates[key]
+	if !ok {
+		rg = &refGate{gate: newConcurrencyGate(limit, g.maxQueue)}
+		g.gates[key] = rg
+	}
+	rg.refs++
+	return rg.gate, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		rg.refs--
+		if rg.refs == 0 {
+			delete(g.gates, key)
+		}
+	}
+}
+
+// adaptiveController はレイテンシーの指数移動平均に基づいて concurrencyGate の上限を調整します (AIMD)。
+type adaptiveController struct {
+	mu         sync.Mutex
+	cfg        AdaptiveConcurrencyConfig
+	maxLimit   int
+	limit      int
+	ewma       time.Duration
+	lastAdjust time.Time
+	gate       *concurrencyGate
+	now        func() time.Time
+}
+
+func newAdaptiveController(cfg AdaptiveConcurrencyConfig, maxLimit int, gate *concurrencyGate) *adaptiveController {
+	if cfg.MinInFlight <= 0 {
+		cfg.MinInFlight = 1
+	}
+	if cfg.DecreaseFactor <= 0 || cfg.DecreaseFactor >= 1 {
+		cfg.DecreaseFactor = 0.9
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	return &adaptiveController{cfg: cfg, maxLimit: maxLimit, limit: maxLimit, gate: gate, now: time.Now}
+}
+
+// observe はリクエストのレイテンシーを記録し、必要に応じて上限を調整します。
+func (a *adaptiveController) observe(latency time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.ewma == 0 {
+		a.ewma = latency
+	} else {
+		a.ewma = (a.ewma*4 + latency) / 5
+	}
+
+	now := a.now()
+	if now.Sub(a.lastAdjust) < a.cfg.Interval {
+		return
+	}
+
+	limit := a.limit
+	if a.ewma > a.cfg.TargetLatency {
+		limit = max(int(float64(limit)*a.cfg.DecreaseFactor), a.cfg.MinInFlight)
+	} else if limit < a.maxLimit {
+		limit++
+	}
+	a.lastAdjust = now
+	if limit != a.limit {
+		slog.Info("Adjusted concurrency limit", "from", a.limit, "to", limit, "latency", a.ewma)
+		a.limit = limit
+		a.gate.setLimit(limit)
+	}
+}
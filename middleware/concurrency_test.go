@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyGate(t *testing.T) {
+	g := newConcurrencyGate(1, 1)
+	ctx := context.Background()
+	require.NoError(t, g.acquire(ctx))
+
+	// 待機キューに入り、枠の返却で先頭から実行される
+	acquired := make(chan error, 1)
+	go func() { acquired <- g.acquire(ctx) }()
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return len(g.waiters) == 1
+	}, time.Second, time.Millisecond)
+
+	// キューが満杯の場合は即座に拒否される
+	assert.ErrorIs(t, g.acquire(ctx), errConcurrencyQueueFull)
+
+	g.release()
+	require.NoError(t, <-acquired)
+
+	// タイムアウト
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, g.acquire(timeoutCtx), errConcurrencyTimeout)
+
+	g.release()
+	assert.Equal(t, 0, g.inFlight)
+	assert.Empty(t, g.waiters)
+}
+
+func TestNewConcurrencyLimiter(t *testing.T) {
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewConcurrencyLimiter(ConcurrencyConfig{
+		MaxInFlight:  10,
+		MaxQueue:     0,
+		QueueTimeout: 10 * time.Millisecond,
+		RetryAfter:   2 * time.Second,
+	}))
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	huma.Register(api, huma.Operation{
+		Method:   http.MethodGet,
+		Path:     "/export",
+		Metadata: map[string]any{ConcurrencyMetadataKey: 1},
+	}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		started <- struct{}{}
+		<-unblock
+		return nil, nil
+	})
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items"}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		return nil, nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		assert.Equal(t, http.StatusNoContent, api.Get("/export").Code)
+	})
+	<-started
+
+	resp := api.Get("/export")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "2", resp.Header().Get("Retry-After"))
+	assert.Contains(t, resp.Body.String(), `"isInvalid":true`)
+
+	// 他のオペレーションには影響しない
+	assert.Equal(t, http.StatusNoContent, api.Get("/items").Code)
+
+	close(unblock)
+	wg.Wait()
+}
+
+func TestConcurrencyGatesCleanup(t *testing.T) {
+	gates := newConcurrencyGates(0)
+	g1, release1 := gates.get("tenant-a", 2)
+	g2, release2 := gates.get("tenant-a", 2)
+	assert.Same(t, g1, g2)
+
+	release1()
+	assert.Len(t, gates.gates, 1)
+	release2()
+	assert.Empty(t, gates.gates)
+}
+
+func TestAdaptiveController(t *testing.T) {
+	gate := newConcurrencyGate(10, 0)
+	a := newAdaptiveController(AdaptiveConcurrencyConfig{TargetLatency: 100 * time.Millisecond, MinInFlight: 2, DecreaseFactor: 0.5}, 10, gate)
+	now := time.Unix(1_700_000_000, 0)
+	a.now = func() time.Time { return now }
+
+	// レイテンシーが目標を超えると上限を減らす
+	a.observe(time.Second)
+	assert.Equal(t, 5, gate.limit)
+	now = now.Add(time.Second)
+	a.observe(time.Second)
+	assert.Equal(t, 2, gate.limit)
+	now = now.Add(time.Second)
+	a.observe(time.Second)
+	assert.Equal(t, 2, gate.limit, "never goes below MinInFlight")
+
+	// 調整間隔内は変更しない
+	a.ewma = 0
+	a.observe(time.Millisecond)
+	assert.Equal(t, 2, gate.limit)
+
+	// レイテンシーが回復すると 1 ずつ戻す
+	now = now.Add(time.Second)
+	a.observe(time.Millisecond)
+	assert.Equal(t, 3, gate.limit)
+}
@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/golaboratory/gloudia/auth"
+	"github.com/golaboratory/gloudia/correlation"
+)
+
+// ClaimsFrom はコンテキストから認証済みユーザーの Claims を取得します。
+// 未認証（ゲスト）のリクエストでは false を返します。
+func ClaimsFrom(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(KeyClaims).(*auth.Claims)
+	return claims, ok && claims != nil
+}
+
+// WithClaims は Claims を保持するコンテキストを返します。
+// テストやバックグラウンドジョブで、認証済みのリクエストと同じコンテキストを作成する場合に使用します。
+func WithClaims(ctx context.Context, claims *auth.Claims) context.Context {
+	return context.WithValue(ctx, KeyClaims, claims)
+}
+
+// AuthMethod はリクエストを認証した方法です。
+type AuthMethod string
+
+const (
+	// AuthMethodBearer は Authorization ヘッダーの Bearer トークンによる認証です。
+	AuthMethodBearer AuthMethod = "bearer"
+	// AuthMethodAPIKey は X-API-Key ヘッダー、または "Authorization: ApiKey" による認証です。
+	AuthMethodAPIKey AuthMethod = "api_key"
+)
+
+// AuthMethodFrom はコンテキストからリクエストを認証した方法を取得します。
+// NewAuthProvider / NewAPIKeyProvider で認証されていない場合は false を返します。
+func AuthMethodFrom(ctx context.Context) (AuthMethod, bool) {
+	method, ok := ctx.Value(KeyAuthMethod).(AuthMethod)
+	return method, ok && method != ""
+}
+
+// WithAuthMethod はリクエストを認証した方法を保持するコンテキストを返します。
+func WithAuthMethod(ctx context.Context, method AuthMethod) context.Context {
+	return context.WithValue(ctx, KeyAuthMethod, method)
+}
+
+// TenantFrom はコンテキストからテナント ID を取得します。
+// テナントが特定されていない場合は false を返します。
+func TenantFrom(ctx context.Context) (string, bool) {
+	tenantID, ok := ctx.Value(KeyTenantID).(string)
+	return tenantID, ok && tenantID != ""
+}
+
+// WithTenant はテナント ID を保持するコンテキストを返します。
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, KeyTenantID, tenantID)
+}
+
+// TenantDomainNameFrom はコンテキストからテナント名（サブドメイン）を取得します。
+func TenantDomainNameFrom(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(KeyTenantDomainName).(string)
+	return name, ok && name != ""
+}
+
+// WithTenantDomainName はテナント名を保持するコンテキストを返します。
+func WithTenantDomainName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, KeyTenantDomainName, name)
+}
+
+// TxFrom はコンテキストから NewRLSProvider が開始したトランザクションを取得します。
+func TxFrom(ctx context.Context) (pgx.Tx, bool) {
+	tx, ok := ctx.Value(KeyDBTx).(pgx.Tx)
+	return tx, ok && tx != nil
+}
+
+// WithTx はトランザクションを保持するコンテキストを返します。
+func WithTx(ctx context.Context, tx pgx.Tx) context.Context {
+	return context.WithValue(ctx, KeyDBTx, tx)
+}
+
+// CSPNonceFrom はコンテキストから NewSecurityHeaders が生成した CSP の nonce を取得します。
+// サーバーサイドでレンダリングする HTML の <script nonce="..."> などに使用します。
+func CSPNonceFrom(ctx context.Context) (string, bool) {
+	nonce, ok := ctx.Value(KeyCSPNonce).(string)
+	return nonce, ok && nonce != ""
+}
+
+// WithCSPNonce は CSP の nonce を保持するコンテキストを返します。
+func WithCSPNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, KeyCSPNonce, nonce)
+}
+
+// SignedURLFrom はコンテキストから NewSignedURLVerifier が検証した署名付き URL の情報を取得します。
+func SignedURLFrom(ctx context.Context) (*auth.SignedURLClaims, bool) {
+	claims, ok := ctx.Value(KeySignedURL).(*auth.SignedURLClaims)
+	return claims, ok && claims != nil
+}
+
+// WithSignedURL は署名付き URL の情報を保持するコンテキストを返します。
+func WithSignedURL(ctx context.Context, claims *auth.SignedURLClaims) context.Context {
+	return context.WithValue(ctx, KeySignedURL, claims)
+}
+
+// ContextValues はリクエストのコンテキストから引き継ぐ値の集合です。
+// JSON に変換できますが、署名されていない JSON から Claims を復元すると権限を詐称できるため、
+// プロセスをまたいで引き継ぐ場合は worker.JobPayload.WithContext のように ID のみを引き継いでください。
+//
+// トランザクション (KeyDBTx) はリクエストの終了とともにコミットまたはロールバックされるため、引き継ぎの対象外です。
+type ContextValues struct {
+	Claims           *auth.Claims `json:"claims,omitempty"`
+	TenantID         string       `json:"tenant_id,omitempty"`
+	TenantDomainName string       `json:"tenant_domain_name,omitempty"`
+
+	// リクエスト ID と traceparent
+	correlation.Values
+}
+
+// CaptureContext はコンテキストから引き継ぐ値を取り出します。
+func CaptureContext(ctx context.Context) ContextValues {
+	var v ContextValues
+	v.Claims, _ = ClaimsFrom(ctx)
+	v.TenantID, _ = TenantFrom(ctx)
+	v.TenantDomainName, _ = TenantDomainNameFrom(ctx)
+	v.Values = correlation.Capture(ctx)
+	return v
+}
+
+// Apply は値を ctx に設定したコンテキストを返します。設定されていない値は ctx に追加しません。
+func (v ContextValues) Apply(ctx context.Context) context.Context {
+	if v.Claims != nil {
+		ctx = WithClaims(ctx, v.Claims)
+	}
+	if v.TenantID != "" {
+		ctx = WithTenant(ctx, v.TenantID)
+	}
+	if v.TenantDomainName != "" {
+		ctx = WithTenantDomainName(ctx, v.TenantDomainName)
+	}
+	return v.Values.Apply(ctx)
+}
+
+// Detach はリクエストのキャンセルやタイムアウトの影響を受けない新しいコンテキストに、
+// Claims とテナントの情報、リクエスト ID をコピーして返します。
+// レスポンスを返した後も動作するゴルーチン（ワーカーへのジョブ投入や、リアルタイム通知の送信など）で使用します。
+// プロセスをまたぐ場合は worker.JobPayload.WithContext、リアルタイム通知は realtime.Hub.Publish が内部で使用します。
+// トランザクションはコピーしないため、必要に応じて新しいトランザクションを開始してください。
+func Detach(ctx context.Context) context.Context {
+	return CaptureContext(ctx).Apply(context.Background())
+}
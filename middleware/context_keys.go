@@ -1,11 +1,16 @@
 package middleware
 
+// contextKey はコンテキストに値を保存するためのキーの型です。
+// 値の取得・設定には ClaimsFrom / WithClaims などのアクセサ (context.go) を使用してください。
 type contextKey string
 
 const (
 	// KeyClaims は認証トークンから抽出したユーザー情報(Claims)を保持します
 	KeyClaims contextKey = "claims"
 
+	// KeyAuthMethod はリクエストを認証した方法 (AuthMethod) を保持します
+	KeyAuthMethod contextKey = "auth_method"
+
 	// KeyTenantID はテナントID(UUID)を保持します
 	KeyTenantID contextKey = "tenant_id"
 
@@ -14,4 +19,13 @@ const (
 
 	// KeyTenantDomeinName はテナント名を保持します
 	KeyTenantDomainName contextKey = "tenant_domain_name"
+
+	// KeySignedURL は検証済みの署名付き URL の情報 (*auth.SignedURLClaims) を保持します
+	KeySignedURL contextKey = "signed_url"
+
+	// KeyCSPNonce は NewSecurityHeaders が生成した Content-Security-Policy の nonce を保持します
+	KeyCSPNonce contextKey = "csp_nonce"
+
+	// keyAccessLogState はアクセスログへ認証情報を引き渡すための状態 (*accessLogState) を保持します
+	keyAccessLogState contextKey = "access_log_state"
 )
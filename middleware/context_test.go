@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+func TestContextAccessors(t *testing.T) {
+	ctx := context.Background()
+
+	_, ok := ClaimsFrom(ctx)
+	assert.False(t, ok)
+	_, ok = TenantFrom(WithTenant(ctx, ""))
+	assert.False(t, ok)
+	_, ok = TxFrom(ctx)
+	assert.False(t, ok)
+
+	claims := &auth.Claims{UserID: 1, TenantID: "t1"}
+	ctx = WithClaims(ctx, claims)
+	ctx = WithTenant(ctx, "t1")
+
+	got, ok := ClaimsFrom(ctx)
+	require.True(t, ok)
+	assert.Same(t, claims, got)
+	tenantID, ok := TenantFrom(ctx)
+	require.True(t, ok)
+	assert.Equal(t, "t1", tenantID)
+}
+
+func TestDetach(t *testing.T) {
+	parent, cancel := context.WithTimeout(context.Background(), time.Minute)
+	parent = WithClaims(parent, &auth.Claims{UserID: 7, TenantID: "t1"})
+	parent = WithTenant(parent, "t1")
+	parent = WithTenantDomainName(parent, "shrine")
+	parent = WithTx(parent, nil)
+
+	detached := Detach(parent)
+	cancel()
+
+	assert.NoError(t, detached.Err())
+	_, hasDeadline := detached.Deadline()
+	assert.False(t, hasDeadline)
+
+	claims, ok := ClaimsFrom(detached)
+	require.True(t, ok)
+	assert.Equal(t, int64(7), claims.UserID)
+	name, _ := TenantDomainNameFrom(detached)
+	assert.Equal(t, "shrine", name)
+	_, ok = TxFrom(detached)
+	assert.False(t, ok)
+
+	// ジョブのペイロードを経由した引き継ぎ
+	b, err := json.Marshal(CaptureContext(parent))
+	require.NoError(t, err)
+	var values ContextValues
+	require.NoError(t, json.Unmarshal(b, &values))
+	restored := values.Apply(context.Background())
+	tenantID, _ := TenantFrom(restored)
+	assert.Equal(t, "t1", tenantID)
+	claims, _ = ClaimsFrom(restored)
+	assert.Equal(t, int64(7), claims.UserID)
+}
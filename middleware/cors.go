@@ -1,29 +1,266 @@
 package middleware
 
 import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-chi/cors"
+	"github.com/newmo-oss/ergo"
+
+	"github.com/golaboratory/gloudia/environment"
 )
 
-// NewCORS は Chi ルーター用の CORS 設定を返します。
-// main.go で router.Use(middleware.NewCORS()) のように使用します。
-func NewCORS() *cors.Cors {
-	return cors.New(cors.Options{
-		// 開発環境と本番環境で許可オリジンを切り替える必要があります。
-		// 環境変数から取得することを推奨します。
-		AllowedOrigins: []string{"https://*", "http://localhost:5173"}, // Vite Default Port
+// CORSConfig は CORS の設定構造体です。environment.NewEnvValue で環境変数から読み込めます。
+//
+// AllowedOrigins には完全一致のオリジン (例: "https://app.example.com") と、
+// サブドメインのパターン (例: "https://*.example.com") を指定できます。
+// パターンは指定したドメインのサブドメインにのみ一致し、ドメイン自身やスキーム・ポートが異なるオリジンには一致しません。
+type CORSConfig struct {
+	AllowedOrigins   []string `envconfig:"CORS_ALLOWED_ORIGINS"`
+	AllowedMethods   []string `envconfig:"CORS_ALLOWED_METHODS" default:"GET,POST,PUT,DELETE,OPTIONS,PATCH"`
+	AllowedHeaders   []string `envconfig:"CORS_ALLOWED_HEADERS" default:"Accept,Authorization,Content-Type,X-CSRF-Token,X-Request-ID,X-API-Key,traceparent,Idempotency-Key,X-Tenant-ID,X-Forwarded-Host"`
+	ExposedHeaders   []string `envconfig:"CORS_EXPOSED_HEADERS" default:"Link,X-Request-ID,Retry-After,traceparent,X-RateLimit-Limit,X-RateLimit-Remaining,X-RateLimit-Reset,Idempotent-Replayed"`
+	AllowCredentials bool     `envconfig:"CORS_ALLOW_CREDENTIALS" default:"true"`
+	MaxAge           int      `envconfig:"CORS_MAX_AGE" default:"300"` // Preflightリクエストのキャッシュ時間 (秒)
 
-		AllowedMethods: []string{
-			"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH",
-		},
+	// TenantOrigins を指定した場合、AllowedOrigins に一致しないオリジンをテナントごとの設定で判定します。
+	// テナントの独自ドメインを再デプロイなしで許可できます。テナントの特定後 (NewTenantResolution の後) に登録してください。
+	TenantOrigins TenantOriginStore `ignored:"true"`
+	// TenantOriginsTTL は TenantOrigins の結果をキャッシュする期間です。0 の場合は 1 分、負の値の場合はキャッシュしません。
+	TenantOriginsTTL time.Duration `envconfig:"CORS_TENANT_ORIGINS_TTL"`
+	// TenantOriginsCacheSize は TenantOrigins の結果をキャッシュするテナントの最大数です。0 の場合は 10000 です。
+	// テナント ID はクライアントが指定できる場合 (TenantFromHeader など) があるため、上限を超えた場合は古いエントリから破棄します。
+	TenantOriginsCacheSize int `envconfig:"CORS_TENANT_ORIGINS_CACHE_SIZE"`
+}
+
+// TenantOriginStore はテナントごとに許可するオリジンを返すインターフェースです。
+type TenantOriginStore interface {
+	// AllowedOrigins はテナントが許可するオリジン (完全一致またはサブドメインのパターン) を返します。
+	AllowedOrigins(ctx context.Context, tenantID string) ([]string, error)
+}
+
+// DefaultCORSConfig は標準的な設定を返します。許可するオリジンは空のため、AllowedOrigins を指定してください。
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
 		AllowedHeaders: []string{
-			"Accept",
-			"Authorization",
-			"Content-Type",
-			"X-CSRF-Token",
-			"X-Forwarded-Host", // テナント指定用
+			"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Request-ID", APIKeyHeader, "traceparent", IdempotencyKeyHeader,
+			"X-Tenant-ID", "X-Forwarded-Host",
+		},
+		ExposedHeaders: []string{
+			"Link", "X-Request-ID", "Retry-After", "traceparent",
+			"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", idempotencyReplayedHeader,
 		},
-		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
-		MaxAge:           300, // Preflightリクエストのキャッシュ時間
-	})
+		MaxAge:           300,
+	}
+}
+
+// NewCORS は Chi ルーター用の CORS 設定を返します。
+// main.go で router.Use(middleware.NewCORS().Handler) のように使用します。
+//
+// 設定は環境変数 (CORS_ALLOWED_ORIGINS など) から読み込みます。
+// 読み込みや検証に失敗した場合はエラーを記録し、クロスオリジンのリクエストをすべて拒否します。
+func NewCORS() *cors.Cors {
+	cfg, err := environment.NewEnvValue[CORSConfig]()
+	if err == nil {
+		var c *cors.Cors
+		if c, err = NewCORSWithConfig(cfg); err == nil {
+			return c
+		}
+	}
+	slog.Error("Invalid CORS configuration, cross-origin requests are denied", "error", err)
+	return cors.New(cors.Options{AllowOriginFunc: func(*http.Request, string) bool { return false }})
+}
+
+// NewCORSWithConfig は CORSConfig から Chi ルーター用の CORS 設定を生成します。
+// AllowCredentials と "*" の併用など、危険な設定の場合はエラーを返します。
+func NewCORSWithConfig(cfg CORSConfig) (*cors.Cors, error) {
+	static, err := parseOriginMatchers(cfg.AllowedOrigins)
+	if err != nil {
+		return nil, err
+	}
+	// 前後の空白などを除いた解析結果で判定する (" *" のような指定も "*" として扱われるため)
+	if cfg.AllowCredentials && static.any {
+		return nil, ergo.New("cors: allowing all origins with credentials is not permitted")
+	}
+
+	var tenants *tenantOrigins
+	if cfg.TenantOrigins != nil {
+		tenants = newTenantOrigins(cfg.TenantOrigins, cfg.TenantOriginsTTL, cfg.TenantOriginsCacheSize)
+	}
+
+	return cors.New(cors.Options{
+		AllowOriginFunc: func(r *http.Request, origin string) bool {
+			if static.match(origin) {
+				return true
+			}
+			if tenants == nil {
+				return false
+			}
+			tenantID, ok := TenantFrom(r.Context())
+			if !ok {
+				return false
+			}
+			return tenants.allowed(r.Context(), tenantID, origin)
+		},
+		AllowedMethods:   cfg.AllowedMethods,
+		AllowedHeaders:   cfg.AllowedHeaders,
+		ExposedHeaders:   cfg.ExposedHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           cfg.MaxAge,
+	}), nil
+}
+
+// originMatchers は許可するオリジンの一覧です。
+type originMatchers struct {
+	any      bool
+	exact    map[string]struct{}
+	patterns []originPattern
+}
+
+// originPattern は "https://*.example.com" 形式のサブドメインのパターンです。
+type originPattern struct {
+	scheme string
+	suffix string // ".example.com" (ポートを含む場合は ".example.com:8443")
+}
+
+// parseOriginMatchers はオリジンの一覧を解析します。
+func parseOriginMatchers(origins []string) (*originMatchers, error) {
+	m := &originMatchers{exact: make(map[string]struct{})}
+	for _, origin := range origins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		switch {
+		case origin == "":
+			continue
+		case origin == "*":
+			m.any = true
+			continue
+		}
+
+		scheme, host, ok := strings.Cut(origin, "://")
+		if !ok || (scheme != "http" && scheme != "https") || host == "" || strings.ContainsAny(host, "/?#@") {
+			return nil, ergo.New("cors: invalid origin", slog.String("origin", origin))
+		}
+		if rest, ok := strings.CutPrefix(host, "*."); ok {
+			if rest == "" || strings.Contains(rest, "*") || !strings.Contains(rest, ".") {
+				return nil, ergo.New("cors: invalid origin pattern", slog.String("origin", origin))
+			}
+			m.patterns = append(m.patterns, originPattern{scheme: scheme, suffix: "." + rest})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return nil, ergo.New("cors: wildcard is only allowed as the leftmost label", slog.String("origin", origin))
+		}
+		m.exact[origin] = struct{}{}
+	}
+	return m, nil
+}
+
+// match はオリジンが許可されているかを判定します。
+func (m *originMatchers) match(origin string) bool {
+	if m.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if _, ok := m.exact[origin]; ok {
+		return true
+	}
+	if len(m.patterns) == 0 {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") {
+		return false
+	}
+	for _, p := range m.patterns {
+		if u.Scheme != p.scheme {
+			continue
+		}
+		sub, ok := strings.CutSuffix(u.Host, p.suffix)
+		// サブドメイン部分にポートが含まれる場合 ("evil.com:443" など) は一致させない
+		if ok && sub != "" && !strings.ContainsAny(sub, ":[]") {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantOrigins は TenantOriginStore の結果を TTL 付きでキャッシュします。
+type tenantOrigins struct {
+	store TenantOriginStore
+	ttl   time.Duration
+	size  int
+	now   func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]tenantOriginsEntry
+}
+
+type tenantOriginsEntry struct {
+	matchers  *originMatchers
+	expiresAt time.Time
+}
+
+func newTenantOrigins(store TenantOriginStore, ttl time.Duration, size int) *tenantOrigins {
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+	if size <= 0 {
+		size = 10000
+	}
+	return &tenantOrigins{store: store, ttl: ttl, size: size, now: time.Now, entries: make(map[string]tenantOriginsEntry)}
+}
+
+// allowed はテナントがオリジンを許可しているかを判定します。ストアのエラー時は許可しません。
+func (t *tenantOrigins) allowed(ctx context.Context, tenantID string, origin string) bool {
+	now := t.now()
+	t.mu.Lock()
+	entry, ok := t.entries[tenantID]
+	t.mu.Unlock()
+
+	if !ok || !now.Before(entry.expiresAt) {
+		origins, err := t.store.AllowedOrigins(ctx, tenantID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to load tenant cors origins", "tenant_id", tenantID, "error", err)
+			return false
+		}
+		matchers, err := parseOriginMatchers(origins)
+		if err != nil {
+			slog.WarnContext(ctx, "Invalid tenant cors origins", "tenant_id", tenantID, "error", err)
+			matchers = &originMatchers{}
+		}
+		// テナントの設定ではすべてのオリジンの許可 ("*") は無視する
+		matchers.any = false
+		entry = tenantOriginsEntry{matchers: matchers, expiresAt: now.Add(t.ttl)}
+		if t.ttl > 0 {
+			t.put(now, tenantID, entry)
+		}
+	}
+	return entry.matchers.match(origin)
+}
+
+func (t *tenantOrigins) put(now time.Time, tenantID string, entry tenantOriginsEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.entries[tenantID]; !ok && len(t.entries) >= t.size {
+		// 上限に達した場合は期限切れのエントリを削除し、それでも空きがなければ任意の 1 件を削除する
+		for k, e := range t.entries {
+			if !now.Before(e.expiresAt) {
+				delete(t.entries, k)
+			}
+		}
+		for k := range t.entries {
+			if len(t.entries) < t.size {
+				break
+			}
+			delete(t.entries, k)
+		}
+	}
+	t.entries[tenantID] = entry
 }
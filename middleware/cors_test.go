@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/environment"
+)
+
+func TestOriginMatchers(t *testing.T) {
+	m, err := parseOriginMatchers([]string{"https://app.example.com", "https://*.shrine.jp", "http://localhost:5173"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://tenant-a.shrine.jp", true},
+		{"https://a.b.shrine.jp", true},
+		{"https://shrine.jp", false},
+		{"https://evilshrine.jp", false},
+		{"http://tenant-a.shrine.jp", false},
+		{"https://tenant-a.shrine.jp:8443", false},
+		{"http://localhost:5173", true},
+		{"http://localhost:3000", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, m.match(tt.origin), tt.origin)
+	}
+
+	for _, invalid := range []string{"example.com", "https://*", "https://*.com", "https://a.*.example.com", "ftp://example.com", "https://example.com/path"} {
+		_, err := parseOriginMatchers([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNewCORSWithConfig(t *testing.T) {
+	cfg := DefaultCORSConfig()
+	cfg.AllowedOrigins = []string{"*"}
+	_, err := NewCORSWithConfig(cfg)
+	assert.Error(t, err, "wildcard with credentials must be rejected")
+	cfg.AllowedOrigins = []string{"https://app.example.com", " *"}
+	_, err = NewCORSWithConfig(cfg)
+	assert.Error(t, err, "untrimmed wildcard with credentials must be rejected")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com, *")
+	c, err := environment.NewEnvValue[CORSConfig]()
+	require.NoError(t, err)
+	_, err = NewCORSWithConfig(c)
+	assert.Error(t, err, "wildcard from the environment must be rejected")
+	// 環境変数の既定値は DefaultCORSConfig と一致する
+	assert.Equal(t, cfg.AllowedHeaders, c.AllowedHeaders)
+	assert.Equal(t, cfg.ExposedHeaders, c.ExposedHeaders)
+	assert.Contains(t, c.AllowedHeaders, APIKeyHeader)
+	assert.Contains(t, c.AllowedHeaders, IdempotencyKeyHeader)
+	// テナントの解決 (TenantFromHeader / X-Forwarded-Host) で読み取るヘッダー
+	assert.Contains(t, c.AllowedHeaders, "X-Tenant-ID")
+	assert.Contains(t, c.AllowedHeaders, "X-Forwarded-Host")
+	assert.Contains(t, c.ExposedHeaders, idempotencyReplayedHeader)
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com,https://*.shrine.jp")
+	handler := NewCORS().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	preflight := func(origin string) string {
+		r := httptest.NewRequest(http.MethodOptions, "/items", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Header().Get("Access-Control-Allow-Origin")
+	}
+	assert.Equal(t, "https://tenant-a.shrine.jp", preflight("https://tenant-a.shrine.jp"))
+	assert.Empty(t, preflight("https://evil.example.net"))
+}
+
+type fakeTenantOriginStore struct {
+	origins map[string][]string
+	calls   int
+}
+
+func (s *fakeTenantOriginStore) AllowedOrigins(_ context.Context, tenantID string) ([]string, error) {
+	s.calls++
+	return s.origins[tenantID], nil
+}
+
+func TestNewCORSWithTenantOrigins(t *testing.T) {
+	store := &fakeTenantOriginStore{origins: map[string][]string{"tenant-1": {"https://reserve.shrine.co.jp", " *"}}}
+	cfg := DefaultCORSConfig()
+	cfg.AllowedOrigins = []string{"https://app.example.com"}
+	cfg.TenantOrigins = store
+	c, err := NewCORSWithConfig(cfg)
+	require.NoError(t, err)
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(tenantID string, origin string) string {
+		r := httptest.NewRequest(http.MethodGet, "/items", nil)
+		if tenantID != "" {
+			r = r.WithContext(WithTenant(r.Context(), tenantID))
+		}
+		r.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	assert.Equal(t, "https://reserve.shrine.co.jp", request("tenant-1", "https://reserve.shrine.co.jp"))
+	assert.Equal(t, "https://reserve.shrine.co.jp", request("tenant-1", "https://reserve.shrine.co.jp"))
+	assert.Equal(t, 1, store.calls, "tenant origins are cached")
+	assert.Empty(t, request("tenant-1", "https://evil.example.net"), "wildcard from the store is ignored")
+	assert.Empty(t, request("tenant-2", "https://reserve.shrine.co.jp"))
+	assert.Empty(t, request("", "https://reserve.shrine.co.jp"))
+	assert.Equal(t, "https://app.example.com", request("", "https://app.example.com"))
+}
+
+func TestTenantOriginsCacheSize(t *testing.T) {
+	store := &fakeTenantOriginStore{origins: map[string][]string{"tenant-1": {"https://reserve.shrine.co.jp"}}}
+	tenants := newTenantOrigins(store, time.Minute, 2)
+	ctx := context.Background()
+
+	for i := range 10 {
+		tenants.allowed(ctx, fmt.Sprintf("tenant-%d", i), "https://reserve.shrine.co.jp")
+	}
+	assert.Len(t, tenants.entries, 2, "cache does not grow beyond its size")
+	assert.True(t, tenants.allowed(ctx, "tenant-1", "https://reserve.shrine.co.jp"))
+}
@@ -0,0 +1,255 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// CSRFConfig は CSRF 対策ミドルウェアの設定構造体です。
+// Cookie に保存したトークンと、リクエストヘッダーで送信されたトークンを照合する
+// Double Submit Cookie 方式で検証します。
+type CSRFConfig struct {
+	// Secret はトークンに HMAC 署名を付与するための秘密鍵です。
+	// 指定した場合、サブドメインなどから注入された Cookie を拒否できます（Signed Double Submit Cookie）。
+	Secret []byte
+	// CookieName はトークンを保存する Cookie の名前です。既定値は "csrf_token" です。
+	CookieName string
+	// HeaderName はトークンを送信するリクエストヘッダーの名前です。既定値は "X-CSRF-Token" です。
+	HeaderName string
+	// CookiePath は Cookie の Path 属性です。既定値は "/" です。
+	CookiePath string
+	// CookieDomain は Cookie の Domain 属性です。
+	CookieDomain string
+	// Secure は Cookie の Secure 属性です。本番環境では true にしてください。
+	Secure bool
+	// SameSite は Cookie の SameSite 属性です。既定値は Lax です。
+	SameSite http.SameSite
+	// MaxAge は Cookie の有効期間 (秒) です。0 の場合はセッション Cookie となります。
+	MaxAge int
+	// ExemptPaths は検証を行わないパスのプレフィックスです (例: Webhook の受信エンドポイント)。
+	ExemptPaths []string
+	// SessionCookieName は Cookie で認証を行う場合の、セッション Cookie の名前です。
+	// この Cookie が送信されたリクエストは、Bearer トークンや API キーで認証済みであっても検証します。
+	SessionCookieName string
+}
+
+// DefaultCSRFConfig は標準的な設定を返します。
+func DefaultCSRFConfig() CSRFConfig {
+	return CSRFConfig{
+		CookieName: "csrf_token",
+		HeaderName: "X-CSRF-Token",
+		CookiePath: "/",
+		Secure:     true,
+		SameSite:   http.SameSiteLaxMode,
+	}
+}
+
+// csrfProtector は Chi と Huma のミドルウェアで共通の、CSRF トークンの発行・検証ロジックです。
+type csrfProtector struct {
+	cfg CSRFConfig
+}
+
+func newCSRFProtector(cfg CSRFConfig) *csrfProtector {
+	def := DefaultCSRFConfig()
+	if cfg.CookieName == "" {
+		cfg.CookieName = def.CookieName
+	}
+	if cfg.HeaderName == "" {
+		cfg.HeaderName = def.HeaderName
+	}
+	if cfg.CookiePath == "" {
+		cfg.CookiePath = def.CookiePath
+	}
+	if cfg.SameSite == 0 {
+		cfg.SameSite = def.SameSite
+	}
+	return &csrfProtector{cfg: cfg}
+}
+
+// isSafeMethod は状態を変更しない (CSRF の対象外の) HTTP メソッドかどうかを判定します。
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// isExempt はリクエストが CSRF 検証の対象外かどうかを判定します。
+// Bearer トークンや API キーはブラウザが自動送信しないため、CSRF の影響を受けません。
+// ただしヘッダーが送信されているだけでは対象外とせず、NewAuthProvider / NewAPIKeyProvider が
+// そのヘッダーで認証済みであり、かつセッション Cookie が送信されていない場合に限ります。
+func (p *csrfProtector) isExempt(ctx context.Context, path string, hasCookie func(string) bool) bool {
+	if slices.ContainsFunc(p.cfg.ExemptPaths, func(prefix string) bool { return strings.HasPrefix(path, prefix) }) {
+		return true
+	}
+	if _, ok := ClaimsFrom(ctx); !ok {
+		return false
+	}
+	method, _ := AuthMethodFrom(ctx)
+	if method != AuthMethodBearer && method != AuthMethodAPIKey {
+		return false
+	}
+	return p.cfg.SessionCookieName == "" || !hasCookie(p.cfg.SessionCookieName)
+}
+
+// validToken は Cookie のトークンが (Secret 指定時は) 正しく署名されていることを検証します。
+func (p *csrfProtector) validToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	if len(p.cfg.Secret) == 0 {
+		return true
+	}
+	value, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(p.sign(value)))
+}
+
+// verify は Cookie のトークンとヘッダーのトークンが一致することを定数時間で検証します。
+func (p *csrfProtector) verify(cookieToken string, headerToken string) bool {
+	if !p.validToken(cookieToken) || headerToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) == 1
+}
+
+// newToken は新しいトークンを生成します。Secret 指定時は "<value>.<signature>" の形式となります。
+func (p *csrfProtector) newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+	if len(p.cfg.Secret) == 0 {
+		return value, nil
+	}
+	return value + "." + p.sign(value), nil
+}
+
+func (p *csrfProtector) sign(value string) string {
+	mac := hmac.New(sha256.New, p.cfg.Secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookie はトークンを保存する Cookie を生成します。
+// JavaScript からトークンを読み取ってヘッダーに設定するため、HttpOnly は付与しません。
+func (p *csrfProtector) cookie(token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     p.cfg.CookieName,
+		Value:    token,
+		Path:     p.cfg.CookiePath,
+		Domain:   p.cfg.CookieDomain,
+		MaxAge:   p.cfg.MaxAge,
+		Secure:   p.cfg.Secure,
+		HttpOnly: false,
+		SameSite: p.cfg.SameSite,
+	}
+}
+
+// NewCSRF は Chi ルーター用の CSRF 対策ミドルウェアを返します。
+//
+// 安全なメソッド (GET など) のリクエストでは、トークンの Cookie が未発行であれば発行します。
+// それ以外のメソッドでは、Cookie とヘッダーのトークンが一致しない場合に 403 を返します。
+// ExemptPaths に一致するパスは検証の対象外です。
+// Bearer トークンや API キーで認証済みのリクエストも対象外となりますが、
+// 通常このミドルウェアは認証より前に実行されるため、それらのリクエストを対象外とする場合は
+// 認証の後に NewHumaCSRF を使用してください。
+func NewCSRF(cfg CSRFConfig) func(http.Handler) http.Handler {
+	p := newCSRFProtector(cfg)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var cookieToken string
+			if c, err := r.Cookie(p.cfg.CookieName); err == nil {
+				cookieToken = c.Value
+			}
+
+			if isSafeMethod(r.Method) {
+				if !p.validToken(cookieToken) {
+					token, err := p.newToken()
+					if err != nil {
+						slog.ErrorContext(r.Context(), "Failed to generate csrf token", "error", err)
+						writeInvalidJSON(w, r, http.StatusInternalServerError, "Failed to generate CSRF token", nil)
+						return
+					}
+					http.SetCookie(w, p.cookie(token))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			hasCookie := func(name string) bool {
+				_, err := r.Cookie(name)
+				return err == nil
+			}
+			if p.isExempt(r.Context(), r.URL.Path, hasCookie) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !p.verify(cookieToken, r.Header.Get(p.cfg.HeaderName)) {
+				slog.WarnContext(r.Context(), "CSRF token mismatch", "method", r.Method, "path", r.URL.Path)
+				writeInvalidJSON(w, r, http.StatusForbidden, "CSRF token is missing or invalid", nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NewHumaCSRF は NewCSRF と同じ検証を行う Huma ミドルウェアを生成します。
+// Chi のミドルウェアを使用できない構成 (Huma のグループ単位での適用など) で使用します。
+// NewAuthProvider / NewAPIKeyProvider の後に登録すると、それらで認証済みのリクエストは検証の対象外となります。
+func NewHumaCSRF(cfg CSRFConfig) func(huma.Context, func(huma.Context)) {
+	p := newCSRFProtector(cfg)
+	return func(ctx huma.Context, next func(huma.Context)) {
+		var cookieToken string
+		if c, err := huma.ReadCookie(ctx, p.cfg.CookieName); err == nil {
+			cookieToken = c.Value
+		}
+
+		if isSafeMethod(ctx.Method()) {
+			if !p.validToken(cookieToken) {
+				token, err := p.newToken()
+				if err != nil {
+					slog.ErrorContext(ctx.Context(), "Failed to generate csrf token", "error", err)
+					writeInvalidResponse(ctx, http.StatusInternalServerError, "Failed to generate CSRF token", nil)
+					return
+				}
+				ctx.AppendHeader("Set-Cookie", p.cookie(token).String())
+			}
+			next(ctx)
+			return
+		}
+
+		u := ctx.URL()
+		hasCookie := func(name string) bool {
+			_, err := huma.ReadCookie(ctx, name)
+			return err == nil
+		}
+		if p.isExempt(ctx.Context(), u.Path, hasCookie) {
+			next(ctx)
+			return
+		}
+
+		if !p.verify(cookieToken, ctx.Header(p.cfg.HeaderName)) {
+			slog.WarnContext(ctx.Context(), "CSRF token mismatch", "method", ctx.Method(), "path", u.Path)
+			writeInvalidResponse(ctx, http.StatusForbidden, "CSRF token is missing or invalid", nil)
+			return
+		}
+		next(ctx)
+	}
+}
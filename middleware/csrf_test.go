@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+func TestNewCSRF(t *testing.T) {
+	cfg := DefaultCSRFConfig()
+	cfg.Secret = []byte("0123456789abcdef0123456789abcdef")
+	cfg.ExemptPaths = []string{"/webhooks/"}
+	cfg.SessionCookieName = "session"
+
+	handler := NewCSRF(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// GET でトークンの Cookie を取得
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	token := cookies[0]
+	assert.Equal(t, "csrf_token", token.Name)
+	assert.False(t, token.HttpOnly)
+
+	post := func(setup func(r *http.Request)) int {
+		r := httptest.NewRequest(http.MethodPost, "/reservations", nil)
+		setup(r)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	t.Run("matching cookie and header pass", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, post(func(r *http.Request) {
+			r.AddCookie(token)
+			r.Header.Set("X-CSRF-Token", token.Value)
+		}))
+	})
+
+	t.Run("missing header is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, post(func(r *http.Request) {
+			r.AddCookie(token)
+		}))
+	})
+
+	t.Run("unsigned injected cookie is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, post(func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: "csrf_token", Value: "attacker"})
+			r.Header.Set("X-CSRF-Token", "attacker")
+		}))
+	})
+
+	authenticated := func(r *http.Request, method AuthMethod) {
+		ctx := WithClaims(r.Context(), &auth.Claims{UserID: 1, TenantID: "tenant-a"})
+		*r = *r.WithContext(WithAuthMethod(ctx, method))
+	}
+
+	t.Run("bearer and api key requests are exempt only when authenticated", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, post(func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer v4.local.xxx")
+			authenticated(r, AuthMethodBearer)
+		}))
+		assert.Equal(t, http.StatusNoContent, post(func(r *http.Request) {
+			r.Header.Set(APIKeyHeader, "gld_xxx")
+			authenticated(r, AuthMethodAPIKey)
+		}))
+
+		// ヘッダーが送信されているだけでは対象外としない
+		assert.Equal(t, http.StatusForbidden, post(func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer x")
+		}))
+		assert.Equal(t, http.StatusForbidden, post(func(r *http.Request) {
+			r.Header.Set(APIKeyHeader, "x")
+		}))
+	})
+
+	t.Run("session cookie disables the exemption", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, post(func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer v4.local.xxx")
+			r.AddCookie(&http.Cookie{Name: "session", Value: "s"})
+			authenticated(r, AuthMethodBearer)
+		}))
+	})
+
+	t.Run("exempt path passes", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/webhooks/stripe", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	})
+}
+
+func TestNewHumaCSRF(t *testing.T) {
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewHumaCSRF(DefaultCSRFConfig()))
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items"}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		return nil, nil
+	})
+	huma.Register(api, huma.Operation{Method: http.MethodPost, Path: "/items"}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		return nil, nil
+	})
+
+	resp := api.Get("/items")
+	require.Equal(t, http.StatusNoContent, resp.Code)
+	cookies := resp.Result().Cookies()
+	require.Len(t, cookies, 1)
+	token := cookies[0].Value
+
+	resp = api.Post("/items", "Cookie: csrf_token="+token, "X-CSRF-Token: "+token)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	resp = api.Post("/items", "Cookie: csrf_token="+token)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"isInvalid":true`)
+}
+
+func TestNewHumaCSRF_AfterAuth(t *testing.T) {
+	maker, err := auth.NewTokenMaker(auth.GenerateRandomKey())
+	require.NoError(t, err)
+	token, err := maker.CreateToken(1, "tenant-a", 2, time.Minute)
+	require.NoError(t, err)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewAuthProviderWithConfig(AuthConfig{Maker: maker, Mode: AuthModeOptional}))
+	api.UseMiddleware(NewHumaCSRF(DefaultCSRFConfig()))
+	huma.Register(api, huma.Operation{Method: http.MethodPost, Path: "/items"}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		return nil, nil
+	})
+
+	// Bearer トークンで認証済みのリクエストは対象外
+	resp := api.Post("/items", "Authorization: Bearer "+token)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	// 未認証のリクエストは検証される
+	resp = api.Post("/items")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
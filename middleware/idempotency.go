@@ -0,0 +1,258 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// IdempotencyKeyHeader は冪等キーを送信するリクエストヘッダーです。
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyReplayedHeader は保存済みのレスポンスを再送したことを示すレスポンスヘッダーです。
+const idempotencyReplayedHeader = "Idempotent-Replayed"
+
+// IdempotencyConfig は冪等キーのミドルウェアの設定構造体です。
+type IdempotencyConfig struct {
+	// Methods は冪等キーを扱う HTTP メソッドです。既定値は POST と PATCH です。
+	Methods []string
+	// Required が true の場合、冪等キーのないリクエストを 400 で拒否します。
+	Required bool
+	// TTL は処理結果を保存する期間です。既定値は 24 時間です。
+	TTL time.Duration
+	// LockTTL は処理中であることを示すロックの有効期間です。処理がこれより長くかかる場合、重複を検知できません。既定値は 1 分です。
+	LockTTL time.Duration
+	// Prefix は Redis のキーの接頭辞です。既定値は "idempotency" です。
+	Prefix string
+}
+
+// DefaultIdempotencyConfig は標準的な設定を返します。
+func DefaultIdempotencyConfig() IdempotencyConfig {
+	return IdempotencyConfig{
+		Methods: []string{http.MethodPost, http.MethodPatch},
+		TTL:     24 * time.Hour,
+		LockTTL: time.Minute,
+		Prefix:  "idempotency",
+	}
+}
+
+// idempotencyRecord は Redis に保存する処理状態とレスポンスです。
+type idempotencyRecord struct {
+	Completed   bool                `json:"completed"`
+	Fingerprint string              `json:"fingerprint"`
+	Status      int                 `json:"status,omitempty"`
+	Headers     []idempotencyHeader `json:"headers,omitempty"`
+	Body        []byte              `json:"body,omitempty"`
+}
+
+type idempotencyHeader struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Append bool   `json:"append,omitempty"`
+}
+
+// NewIdempotency は Idempotency-Key ヘッダーによる冪等性を提供する Huma ミドルウェアを生成します。
+//
+// 同じキーでの再送には、初回のレスポンス (ステータス、ヘッダー、ボディ) をそのまま返します。
+// 初回の処理中に同じキーのリクエストを受けた場合は 409、同じキーで異なるリクエストを受けた場合は 422 を返します。
+// 5xx のレスポンスは保存しないため、クライアントは同じキーで再試行できます。
+// キーはテナントとユーザー (API キー) ごとに分離されるため、認証とテナント解決の後に登録してください。
+// 認証されていない (Claims のない) リクエストは利用者を区別できず、他の利用者のレスポンスを再送してしまうため、
+// 冪等性の検証を行わずに処理します (Required も適用しません)。
+// Redis の障害時は冪等性の検証を行わずに処理を継続します。
+func NewIdempotency(rdb *redis.Client, config IdempotencyConfig) func(huma.Context, func(huma.Context)) {
+	def := DefaultIdempotencyConfig()
+	if len(config.Methods) == 0 {
+		config.Methods = def.Methods
+	}
+	if config.TTL <= 0 {
+		config.TTL = def.TTL
+	}
+	if config.LockTTL <= 0 {
+		config.LockTTL = def.LockTTL
+	}
+	if config.Prefix == "" {
+		config.Prefix = def.Prefix
+	}
+
+	return func(ctx huma.Context, next func(huma.Context)) {
+		if !slices.Contains(config.Methods, ctx.Method()) {
+			next(ctx)
+			return
+		}
+		subject, ok := idempotencySubject(ctx)
+		if !ok {
+			next(ctx)
+			return
+		}
+
+		// 1. 冪等キーの検証
+		idempotencyKey := ctx.Header(IdempotencyKeyHeader)
+		if idempotencyKey == "" {
+			if config.Required {
+				writeInvalidResponse(ctx, http.StatusBadRequest, "Idempotency-Key header is required", nil)
+				return
+			}
+			next(ctx)
+			return
+		}
+		if len(idempotencyKey) > 255 {
+			writeInvalidResponse(ctx, http.StatusBadRequest, "Idempotency-Key header is too long", nil)
+			return
+		}
+
+		// 2. リクエストの指紋 (メソッド、パス、ボディ) の計算
+		body, err := readReplayableBody(ctx)
+		if err != nil {
+			writeInvalidResponse(ctx, http.StatusBadRequest, "Failed to read request body", nil)
+			return
+		}
+		u := ctx.URL()
+		fingerprint := requestFingerprint(ctx.Method(), u.RequestURI(), body)
+
+		// 3. ロックの取得 (初回のリクエストのみ成功する)
+		key := idempotencyRedisKey(config.Prefix, ctx, subject, idempotencyKey)
+		lock, _ := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+		acquired, err := rdb.SetNX(ctx.Context(), key, lock, config.LockTTL).Result()
+		if err != nil {
+			slog.ErrorContext(ctx.Context(), "Redis idempotency error", "error", err)
+			next(withReplayBody(ctx, body))
+			return
+		}
+
+		if !acquired {
+			replayIdempotent(ctx, rdb, key, fingerprint)
+			return
+		}
+
+		// 4. 初回のリクエストの処理とレスポンスの保存
+		buffered := newBufferedContext(ctx, ctx.Context(), body)
+		completed := false
+		defer func() {
+			// パニックなどで保存できなかった場合は、再試行できるようロックを解除する
+			if !completed {
+				rdb.Del(context.WithoutCancel(ctx.Context()), key)
+			}
+		}()
+
+		next(buffered)
+
+		if buffered.Status() < 500 {
+			record := idempotencyRecord{
+				Completed:   true,
+				Fingerprint: fingerprint,
+				Status:      buffered.Status(),
+				Body:        buffered.buf.Bytes(),
+			}
+			for _, h := range buffered.headers {
+				record.Headers = append(record.Headers, idempotencyHeader{Name: h.name, Value: h.value, Append: h.append})
+			}
+			// クライアントの切断などでリクエストがキャンセルされても、処理済みの結果は保存する
+			if data, err := json.Marshal(record); err != nil {
+				slog.ErrorContext(ctx.Context(), "Failed to encode idempotency record", "error", err)
+			} else if err := rdb.Set(context.WithoutCancel(ctx.Context()), key, data, config.TTL).Err(); err != nil {
+				slog.ErrorContext(ctx.Context(), "Failed to save idempotency record", "error", err)
+			} else {
+				completed = true
+			}
+		}
+
+		if err := buffered.flush(); err != nil {
+			slog.ErrorContext(ctx.Context(), "Failed to write response", "error", err)
+		}
+	}
+}
+
+// withReplayBody は読み込み済みのリクエストボディを後続に渡すための huma.Context を返します。
+func withReplayBody(ctx huma.Context, body []byte) huma.Context {
+	return &replayBodyContext{humaContext: ctx, body: body}
+}
+
+type replayBodyContext struct {
+	humaContext
+	body []byte
+}
+
+func (c *replayBodyContext) BodyReader() io.Reader { return bytes.NewReader(c.body) }
+
+// replayIdempotent は保存済みの処理状態に応じて、レスポンスの再送または 409 / 422 を返します。
+func replayIdempotent(ctx huma.Context, rdb *redis.Client, key string, fingerprint string) {
+	data, err := rdb.Get(ctx.Context(), key).Bytes()
+	if err == redis.Nil {
+		// 初回の処理が 5xx で終了し、ロックが解除された直後
+		writeInvalidResponse(ctx, http.StatusConflict, "A request with the same Idempotency-Key is being processed", nil)
+		return
+	}
+	var record idempotencyRecord
+	if err == nil {
+		err = json.Unmarshal(data, &record)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx.Context(), "Failed to load idempotency record", "error", err)
+		writeInvalidResponse(ctx, http.StatusInternalServerError, "Failed to verify Idempotency-Key", nil)
+		return
+	}
+
+	switch {
+	case record.Fingerprint != fingerprint:
+		writeInvalidResponse(ctx, http.StatusUnprocessableEntity, "Idempotency-Key has already been used for a different request", nil)
+	case !record.Completed:
+		writeInvalidResponse(ctx, http.StatusConflict, "A request with the same Idempotency-Key is being processed", nil)
+	default:
+		for _, h := range record.Headers {
+			if h.Append {
+				ctx.AppendHeader(h.Name, h.Value)
+			} else {
+				ctx.SetHeader(h.Name, h.Value)
+			}
+		}
+		ctx.SetHeader(idempotencyReplayedHeader, "true")
+		if record.Status != 0 {
+			ctx.SetStatus(record.Status)
+		}
+		if len(record.Body) > 0 {
+			if _, err := ctx.BodyWriter().Write(record.Body); err != nil {
+				slog.ErrorContext(ctx.Context(), "Failed to write response", "error", err)
+			}
+		}
+	}
+}
+
+// requestFingerprint はリクエストのメソッド、パス (クエリを含む)、ボディから指紋を計算します。
+func requestFingerprint(method string, requestURI string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", method, requestURI)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencySubject は冪等キーを分離する利用者 (ユーザーまたは API キー) を返します。
+// 認証されていない場合は false を返します。
+func idempotencySubject(ctx huma.Context) (string, bool) {
+	claims, ok := ClaimsFrom(ctx.Context())
+	if !ok {
+		return "", false
+	}
+	if claims.IsAPIKey() {
+		return "apikey:" + claims.APIKeyID, true
+	}
+	return fmt.Sprintf("user:%d", claims.UserID), true
+}
+
+// idempotencyRedisKey はテナントとユーザーで分離した Redis のキーを返します。
+// 冪等キーはクライアントが自由に指定できるため、他のユーザーのレスポンスを取得できないようにします。
+func idempotencyRedisKey(prefix string, ctx huma.Context, subject string, idempotencyKey string) string {
+	sum := sha256.Sum256([]byte(idempotencyKey))
+	return fmt.Sprintf("%s:%s:%s:%s", prefix, MetricsTenant(ctx.Context()), subject, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+type reservationInput struct {
+	Body struct {
+		Room string `json:"room"`
+	}
+}
+
+type reservationOutput struct {
+	Location string `header:"Location"`
+	Body     struct {
+		ID   int    `json:"id"`
+		Room string `json:"room"`
+	}
+}
+
+func newIdempotencyTestAPI(t *testing.T, handler func(ctx context.Context, in *reservationInput) (*reservationOutput, error)) (humatest.TestAPI, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(func(ctx huma.Context, next func(huma.Context)) {
+		if user := ctx.Header("X-Test-User"); user != "" {
+			claims := &auth.Claims{UserID: int64(len(user)), TenantID: "tenant-1"}
+			ctx = huma.WithContext(ctx, WithClaims(ctx.Context(), claims))
+		}
+		next(ctx)
+	})
+	api.UseMiddleware(NewIdempotency(rdb, DefaultIdempotencyConfig()))
+	huma.Register(api, huma.Operation{Method: http.MethodPost, Path: "/reservations", DefaultStatus: http.StatusCreated}, handler)
+	return api, mr
+}
+
+func TestNewIdempotency(t *testing.T) {
+	var created int
+	api, _ := newIdempotencyTestAPI(t, func(ctx context.Context, in *reservationInput) (*reservationOutput, error) {
+		created++
+		out := &reservationOutput{Location: "/reservations/1"}
+		out.Body.ID = created
+		out.Body.Room = in.Body.Room
+		return out, nil
+	})
+	body := map[string]any{"room": "A"}
+
+	first := api.Post("/reservations", "Idempotency-Key: key-1", "X-Test-User: u", body)
+	require.Equal(t, http.StatusCreated, first.Code)
+
+	t.Run("retry replays stored response", func(t *testing.T) {
+		resp := api.Post("/reservations", "Idempotency-Key: key-1", "X-Test-User: u", body)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+		assert.Equal(t, first.Body.String(), resp.Body.String())
+		assert.Equal(t, "/reservations/1", resp.Header().Get("Location"))
+		assert.Equal(t, "true", resp.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, 1, created)
+	})
+
+	t.Run("different body is rejected", func(t *testing.T) {
+		resp := api.Post("/reservations", "Idempotency-Key: key-1", "X-Test-User: u", map[string]any{"room": "B"})
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"isInvalid":true`)
+	})
+
+	t.Run("keys are scoped per user", func(t *testing.T) {
+		resp := api.Post("/reservations", "Idempotency-Key: key-1", "X-Test-User: other", body)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+		assert.Equal(t, 2, created)
+	})
+
+	t.Run("requests without key are not deduplicated", func(t *testing.T) {
+		api.Post("/reservations", "X-Test-User: u", body)
+		api.Post("/reservations", "X-Test-User: u", body)
+		assert.Equal(t, 4, created)
+	})
+
+	t.Run("anonymous requests are not deduplicated", func(t *testing.T) {
+		// 認証されていない利用者どうしでレスポンスを共有しない
+		first := api.Post("/reservations", "Idempotency-Key: key-anonymous", body)
+		second := api.Post("/reservations", "Idempotency-Key: key-anonymous", body)
+		assert.Equal(t, http.StatusCreated, second.Code)
+		assert.Empty(t, second.Header().Get("Idempotent-Replayed"))
+		assert.NotEqual(t, first.Body.String(), second.Body.String())
+		assert.Equal(t, 6, created)
+	})
+}
+
+func TestNewIdempotencyConcurrentDuplicate(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	api, _ := newIdempotencyTestAPI(t, func(ctx context.Context, in *reservationInput) (*reservationOutput, error) {
+		close(started)
+		<-unblock
+		return &reservationOutput{}, nil
+	})
+	body := map[string]any{"room": "A"}
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		assert.Equal(t, http.StatusCreated, api.Post("/reservations", "Idempotency-Key: key-1", "X-Test-User: u", body).Code)
+	})
+	<-started
+
+	assert.Equal(t, http.StatusConflict, api.Post("/reservations", "Idempotency-Key: key-1", "X-Test-User: u", body).Code)
+	close(unblock)
+	wg.Wait()
+}
+
+func TestNewIdempotencyServerErrorIsNotStored(t *testing.T) {
+	var calls int
+	api, _ := newIdempotencyTestAPI(t, func(ctx context.Context, in *reservationInput) (*reservationOutput, error) {
+		calls++
+		if calls == 1 {
+			return nil, huma.Error503ServiceUnavailable("temporarily unavailable")
+		}
+		return &reservationOutput{}, nil
+	})
+	body := map[string]any{"room": "A"}
+
+	assert.Equal(t, http.StatusServiceUnavailable, api.Post("/reservations", "Idempotency-Key: key-1", "X-Test-User: u", body).Code)
+	assert.Equal(t, http.StatusCreated, api.Post("/reservations", "Idempotency-Key: key-1", "X-Test-User: u", body).Code)
+	assert.Equal(t, 2, calls)
+}
@@ -2,27 +2,97 @@ package middleware
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"io"
 	"log/slog"
+	"maps"
+	"math/rand/v2"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/danielgtaylor/huma/v2"
+
+	"github.com/golaboratory/gloudia/auth"
 	"github.com/golaboratory/gloudia/environment"
 )
 
-var (
-	IsDebug = false
-)
+// LoggerConfig はアクセスログを出力するミドルウェアの設定構造体です。
+type LoggerConfig struct {
+	// Logger はログの出力先です。nil の場合は slog.Default() を使用します。
+	Logger *slog.Logger
+	// LogRequestBody が true の場合、リクエストボディを出力します。
+	// ボディは JSON とフォーム (application/x-www-form-urlencoded) のみマスクして出力し、text/* などその他の形式は出力しません。
+	LogRequestBody bool
+	// LogResponseBody が true の場合、レスポンスボディを出力します。
+	LogResponseBody bool
+	// MaxBodySize は出力するボディの最大バイト数です。既定値は 4096 です。
+	// 上限を超えたボディは安全にマスクできないため出力しません。
+	MaxBodySize int
+	// RedactFields はボディ内でマスクするフィールド名です。nil の場合は password, secret, token などの既定値を使用します。
+	// 大文字・小文字、"_" と "-" は区別せず、末尾が一致するフィールド名も対象とします。
+	RedactFields []string
+	// RedactQueryParams は RedactFields に加えて、クエリ文字列でマスクするパラメーター名です (完全一致)。
+	// nil の場合は署名付き URL の "sig" や OIDC の "code", "state" などの既定値を使用します。
+	// クエリ文字列は LogRequestBody の設定にかかわらず、常にマスクして出力します。
+	RedactQueryParams []string
+	// SkipPaths はログを出力しないパスです (例: "/healthz")。末尾が "*" の場合は前方一致で比較します。
+	SkipPaths []string
+	// SampleRates はパスごとのサンプリング率 (0.0〜1.0) です。キーは SkipPaths と同じ形式で比較します。
+	// 複数のキーに該当する場合は、最も長い (前方一致より完全一致を優先) キーを使用します。
+	// 該当しないパスは DefaultSampleRate を使用します。ステータスが 400 以上のリクエストは常に出力します。
+	SampleRates map[string]float64
+	// DefaultSampleRate は SampleRates に該当しないパスのサンプリング率です。
+	// 0 以下の場合は 1.0 (すべて出力) として扱います。
+	DefaultSampleRate float64
+	// StatusLevel はステータスコードに応じたログレベルを返します。
+	// nil の場合、5xx は Error、4xx は Warn、それ以外は Info となります。
+	StatusLevel func(status int) slog.Level
+}
+
+// DefaultLoggerConfig は標準的な設定を返します。
+// 環境変数 IS_DEBUG が true の場合、リクエストボディを (マスクした上で) 出力します。
+func DefaultLoggerConfig() LoggerConfig {
+	cfg := LoggerConfig{
+		MaxBodySize:       4096,
+		DefaultSampleRate: 1.0,
+	}
+	if env, err := environment.NewEnvValue[environment.GloudiaEnv](); err == nil {
+		cfg.LogRequestBody = env.IsDebug
+	}
+	return cfg
+}
+
+// defaultStatusLevel はステータスコードのクラスに応じたログレベルを返します。
+func defaultStatusLevel(status int) slog.Level {
+	switch {
+	case status >= 500:
+		return slog.LevelError
+	case status >= 400:
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
 
 // accessLogResponseWriter は、ステータスコードとレスポンスサイズをキャプチャするためのラッパーです
 type accessLogResponseWriter struct {
 	http.ResponseWriter
 	status int
 	size   int
+
+	// capture が true の場合、レスポンスボディを limit バイトまで body に保存します
+	capture   bool
+	limit     int
+	body      bytes.Buffer
+	truncated bool
 }
 
 func (w *accessLogResponseWriter) WriteHeader(statusCode int) {
-	w.status = statusCode
+	if w.status == 0 {
+		w.status = statusCode
+	}
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
@@ -32,30 +102,165 @@ func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
 	}
 	n, err := w.ResponseWriter.Write(b)
 	w.size += n
+	if w.capture {
+		if rest := w.limit - w.body.Len(); rest >= n {
+			w.body.Write(b[:n])
+		} else {
+			w.body.Write(b[:max(rest, 0)])
+			w.truncated = true
+		}
+	}
 	return n, err
 }
 
-// NewLogger は、アクセスログを出力するミドルウェアを返します
+// Unwrap は http.ResponseController から元の ResponseWriter (Flush など) を利用できるようにします。
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessLogState は、下流のミドルウェアで判明した認証情報やテナントを
+// アクセスログへ引き渡すための構造体です。
+type accessLogState struct {
+	claims   *auth.Claims
+	tenantID string
+}
+
+// setAccessLogClaims はアクセスログに出力する認証情報を記録します。
+// NewLogger の外側で呼び出された場合は何もしません。
+func setAccessLogClaims(ctx context.Context, claims *auth.Claims) {
+	if state, ok := ctx.Value(keyAccessLogState).(*accessLogState); ok {
+		state.claims = claims
+	}
+}
+
+// setAccessLogTenant はアクセスログに出力するテナント ID を記録します。
+// NewLogger の外側で呼び出された場合は何もしません。
+func setAccessLogTenant(ctx context.Context, tenantID string) {
+	if state, ok := ctx.Value(keyAccessLogState).(*accessLogState); ok {
+		state.tenantID = tenantID
+	}
+}
+
+// withAccessLogState は Huma ミドルウェアが下流で判明した認証情報やテナントを受け取るための状態を返します。
+// NewLogger の内側では NewLogger の状態を共有し、それ以外では新しい状態を Context に保存します。
+func withAccessLogState(ctx huma.Context) (huma.Context, *accessLogState) {
+	if state, ok := ctx.Context().Value(keyAccessLogState).(*accessLogState); ok {
+		return ctx, state
+	}
+	state := &accessLogState{}
+	return huma.WithValue(ctx, keyAccessLogState, state), state
+}
+
+// tenant は状態とコンテキストからテナント ID を決定します。
+func (s *accessLogState) tenant(ctx context.Context) string {
+	if s.tenantID != "" {
+		return s.tenantID
+	}
+	if tenantID := MetricsTenant(ctx); tenantID != "" {
+		return tenantID
+	}
+	if s.claims != nil {
+		return s.claims.TenantID
+	}
+	return ""
+}
+
+// pathMatches はパスがパターンに一致するかどうかを判定します。末尾が "*" のパターンは前方一致で比較します。
+func pathMatches(pattern string, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return pattern == path
+}
+
+// NewLogger は、アクセスログを出力するミドルウェアを返します。
+// 設定は DefaultLoggerConfig を使用します。
 func NewLogger() func(http.Handler) http.Handler {
-	env, err := environment.NewEnvValue[environment.GloudiaEnv]()
-	if err != nil {
-		IsDebug = false
+	return NewLoggerWithConfig(DefaultLoggerConfig())
+}
+
+// NewLoggerWithConfig は、LoggerConfig を使用してアクセスログを出力するミドルウェアを返します。
+//
+// ボディを出力する場合、JSON とフォームは RedactFields に一致するフィールドをマスクし、
+// マスクできないボディ (バイナリや上限を超えたもの) は出力しません。
+// 利用者の情報 (user_id, tenant_id) は、下流の認証・テナント解決ミドルウェアで判明したものを出力します。
+func NewLoggerWithConfig(cfg LoggerConfig) func(http.Handler) http.Handler {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = 4096
+	}
+	if cfg.DefaultSampleRate <= 0 {
+		cfg.DefaultSampleRate = 1.0
+	}
+	if cfg.StatusLevel == nil {
+		cfg.StatusLevel = defaultStatusLevel
 	}
-	IsDebug = env.IsDebug
+	if cfg.RedactFields == nil {
+		cfg.RedactFields = defaultRedactFields
+	}
+	if cfg.RedactQueryParams == nil {
+		cfg.RedactQueryParams = defaultRedactQueryParams
+	}
+	rd := newRedactor(cfg.RedactFields, cfg.RedactQueryParams)
+
+	// マップの反復順に依存しないよう、具体的な (長い) パターンから順に比較する
+	samplePatterns := slices.Collect(maps.Keys(cfg.SampleRates))
+	slices.SortFunc(samplePatterns, func(a, b string) int {
+		if c := cmp.Compare(len(b), len(a)); c != 0 {
+			return c
+		}
+		if wa, wb := strings.HasSuffix(a, "*"), strings.HasSuffix(b, "*"); wa != wb {
+			if wb {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	sampleRate := func(path string) float64 {
+		for _, pattern := range samplePatterns {
+			if pathMatches(pattern, path) {
+				return cfg.SampleRates[pattern]
+			}
+		}
+		return cfg.DefaultSampleRate
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, pattern := range cfg.SkipPaths {
+				if pathMatches(pattern, r.URL.Path) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
 			start := time.Now()
 
-			// リクエストボディを読み取る
-			var bodyBytes []byte
-			if IsDebug && r.Body != nil {
-				bodyBytes, _ = io.ReadAll(r.Body)
-				// 読み取ったボディを元に戻す
-				r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+			// リクエストボディを上限まで読み取り、読み取った分を元に戻す
+			var reqBody []byte
+			reqTruncated := false
+			if cfg.LogRequestBody && r.Body != nil && r.Body != http.NoBody {
+				read, _ := io.ReadAll(io.LimitReader(r.Body, int64(cfg.MaxBodySize)+1))
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(read), r.Body), r.Body}
+				reqBody = read
+				if len(read) > cfg.MaxBodySize {
+					reqBody = read[:cfg.MaxBodySize]
+					reqTruncated = true
+				}
 			}
 
 			// ステータスコードキャプチャ用のラッパーを作成
-			lrw := &accessLogResponseWriter{ResponseWriter: w}
+			lrw := &accessLogResponseWriter{ResponseWriter: w, capture: cfg.LogResponseBody, limit: cfg.MaxBodySize}
+
+			// 認証情報の受け渡し用の状態を Context に保存
+			state := &accessLogState{}
+			r = r.WithContext(context.WithValue(r.Context(), keyAccessLogState, state))
 
 			next.ServeHTTP(lrw, r)
 
@@ -64,32 +269,63 @@ func NewLogger() func(http.Handler) http.Handler {
 				lrw.status = http.StatusOK
 			}
 
+			// エラーは常に出力し、それ以外はサンプリング率に従う
+			if lrw.status < 400 {
+				if rate := sampleRate(r.URL.Path); rate < 1 && rand.Float64() >= rate {
+					return
+				}
+			}
+
 			duration := time.Since(start)
 
-			if IsDebug {
-				slog.Info("Access Log",
-					slog.String("method", r.Method),
-					slog.String("path", r.URL.Path),
-					slog.String("query", r.URL.RawQuery),
-					slog.Int("status", lrw.status),
-					slog.Int("size", lrw.size),
-					slog.String("ip", r.RemoteAddr),
-					slog.String("user_agent", r.UserAgent()),
-					slog.Duration("duration", duration),
-					slog.String("body", string(bodyBytes)),
-				)
-			} else {
-				slog.Info("Access Log",
-					slog.String("method", r.Method),
-					slog.String("path", r.URL.Path),
-					slog.String("query", r.URL.RawQuery),
-					slog.Int("status", lrw.status),
-					slog.Int("size", lrw.size),
-					slog.String("ip", r.RemoteAddr),
-					slog.String("user_agent", r.UserAgent()),
-					slog.Duration("duration", duration),
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("query", rd.redactQuery(r.URL.RawQuery)),
+				slog.Int("status", lrw.status),
+				slog.Int("size", lrw.size),
+				slog.String("ip", r.RemoteAddr),
+				slog.String("user_agent", r.UserAgent()),
+				slog.Duration("duration", duration),
+			}
+			if cfg.LogRequestBody {
+				attrs = append(attrs, bodyAttr("body", rd, r.Header.Get("Content-Type"), reqBody, reqTruncated))
+			}
+			if cfg.LogResponseBody {
+				attrs = append(attrs, bodyAttr("response_body", rd, lrw.Header().Get("Content-Type"), lrw.body.Bytes(), lrw.truncated))
+			}
+
+			// 下流の認証・テナント解決ミドルウェアで判明した利用者の情報を付与
+			if claims := state.claims; claims != nil {
+				attrs = append(attrs, slog.Int64("user_id", claims.UserID))
+			}
+			if tenantID := state.tenant(r.Context()); tenantID != "" {
+				attrs = append(attrs, slog.String("tenant_id", tenantID))
+			}
+			// なりすまし中のアクセスは、操作した管理者を必ず記録する
+			if claims := state.claims; claims != nil && claims.IsImpersonated() {
+				attrs = append(attrs,
+					slog.Bool("impersonated", true),
+					slog.Int64("actor_user_id", claims.ActorUserID),
+					slog.String("actor_tenant_id", claims.ActorTenantID),
+					slog.String("impersonation_id", claims.ImpersonationID),
 				)
 			}
+
+			cfg.Logger.LogAttrs(r.Context(), cfg.StatusLevel(lrw.status), "Access Log", attrs...)
 		})
 	}
 }
+
+// bodyAttr はマスクしたボディのログ属性を返します。
+// 上限を超えたボディは安全にマスクできないため出力しません。
+func bodyAttr(key string, rd *redactor, contentType string, body []byte, truncated bool) slog.Attr {
+	if truncated {
+		return slog.String(key, "[omitted: exceeds max body size]")
+	}
+	redacted, ok := rd.redact(contentType, body)
+	if !ok {
+		return slog.String(key, "[omitted: unsupported content]")
+	}
+	return slog.String(key, redacted)
+}
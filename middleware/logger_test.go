@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+func newTestAccessLogger(cfg LoggerConfig) (*bytes.Buffer, func(http.Handler) http.Handler) {
+	buf := &bytes.Buffer{}
+	cfg.Logger = slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return buf, NewLoggerWithConfig(cfg)
+}
+
+func decodeLogLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNewLoggerWithConfig(t *testing.T) {
+	t.Run("redacts request and response bodies", func(t *testing.T) {
+		buf, mw := newTestAccessLogger(LoggerConfig{LogRequestBody: true, LogResponseBody: true})
+		var handlerBody []byte
+		handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerBody, _ = io.ReadAll(r.Body)
+			setAccessLogClaims(r.Context(), &auth.Claims{UserID: 5, TenantID: "t1"})
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"accessToken":"abc","user":{"name":"taro"}}`))
+		}))
+
+		reqBody := `{"email":"a@example.com","password":"hunter2","totp_code":"123456"}`
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(reqBody))
+		r.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		// ハンドラーには元のボディが渡される
+		assert.Equal(t, reqBody, string(handlerBody))
+
+		records := decodeLogLines(t, buf)
+		require.Len(t, records, 1)
+		record := records[0]
+		assert.NotContains(t, buf.String(), "hunter2")
+		assert.NotContains(t, buf.String(), "123456")
+		assert.NotContains(t, buf.String(), `abc`)
+		assert.Contains(t, record["body"], "a@example.com")
+		assert.Contains(t, record["response_body"], "taro")
+		assert.Equal(t, float64(5), record["user_id"])
+		assert.Equal(t, "t1", record["tenant_id"])
+		assert.Equal(t, "INFO", record["level"])
+	})
+
+	t.Run("omits oversized json body", func(t *testing.T) {
+		buf, mw := newTestAccessLogger(LoggerConfig{LogRequestBody: true, MaxBodySize: 16})
+		var handlerBody []byte
+		handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerBody, _ = io.ReadAll(r.Body)
+		}))
+
+		reqBody := `{"name":"long enough","password":"hunter2"}`
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
+		r.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		assert.Equal(t, reqBody, string(handlerBody))
+		assert.NotContains(t, buf.String(), "hunter2")
+		assert.Contains(t, buf.String(), "exceeds max body size")
+	})
+
+	t.Run("skip, sampling and level by status", func(t *testing.T) {
+		buf, mw := newTestAccessLogger(LoggerConfig{
+			SkipPaths:   []string{"/healthz"},
+			SampleRates: map[string]float64{"/poll/*": 0, "/poll/important/*": 1, "/*": 0},
+		})
+		status := http.StatusOK
+		handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		serve := func(path string) {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}
+
+		serve("/healthz")
+		serve("/poll/1")
+		assert.Empty(t, buf.String())
+
+		// 複数のパターンに該当する場合は最も長いパターンを使用する
+		for range 20 {
+			serve("/poll/important/1")
+		}
+		assert.Len(t, decodeLogLines(t, buf), 20)
+		buf.Reset()
+
+		// エラーはサンプリングの対象外
+		status = http.StatusServiceUnavailable
+		serve("/poll/1")
+		status = http.StatusNotFound
+		serve("/items")
+
+		records := decodeLogLines(t, buf)
+		require.Len(t, records, 2)
+		assert.Equal(t, "ERROR", records[0]["level"])
+		assert.Equal(t, "WARN", records[1]["level"])
+	})
+}
+
+func TestRedactor(t *testing.T) {
+	rd := newRedactor(defaultRedactFields, defaultRedactQueryParams)
+
+	out, ok := rd.redact("application/json; charset=utf-8", []byte(`[{"newPassword":"x","client_secret":"y","footprint":1}]`))
+	require.True(t, ok)
+	assert.JSONEq(t, `[{"newPassword":"[REDACTED]","client_secret":"[REDACTED]","footprint":1}]`, out)
+
+	out, ok = rd.redact("application/x-www-form-urlencoded", []byte("user=taro&password=x"))
+	require.True(t, ok)
+	assert.Equal(t, "password=%5BREDACTED%5D&user=taro", out)
+
+	_, ok = rd.redact("application/json", []byte(`{"password":`))
+	assert.False(t, ok)
+	_, ok = rd.redact("application/octet-stream", []byte{0x01})
+	assert.False(t, ok)
+	// text/* はフィールドを確実に検出できないため出力しない
+	_, ok = rd.redact("text/plain; charset=utf-8", []byte("user=taro&password=x"))
+	assert.False(t, ok)
+
+	assert.Equal(t, "[omitted: exceeds max body size]", bodyAttr("body", rd, "text/plain", []byte("password=x"), true).Value.String())
+	assert.Equal(t, "[omitted: unsupported content]", bodyAttr("body", rd, "text/html", []byte("password=x"), false).Value.String())
+
+	// クエリ文字列は RedactFields とクエリ専用のパラメーター名をマスクする
+	assert.Equal(t, "access_token=%5BREDACTED%5D&code=%5BREDACTED%5D&page=2&sig=%5BREDACTED%5D&state=%5BREDACTED%5D",
+		rd.redactQuery("page=2&sig=abc&code=xyz&state=s1&access_token=t"))
+	assert.Equal(t, "zipcode=100", rd.redactQuery("zipcode=100"))
+	assert.Equal(t, "[omitted: malformed query]", rd.redactQuery("a=%zz"))
+}
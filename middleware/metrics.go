@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+
+	"github.com/golaboratory/gloudia/metrics"
+)
+
+// NewMetrics は HTTP リクエストの件数とレイテンシを記録する Huma ミドルウェアを生成します。
+//
+// ラベルの route にはオペレーションのパスのテンプレート (例: "/items/{id}") を使用するため、
+// パスパラメータによってカーディナリティが増えることはありません。
+// tenant ラベルには、下流の認証・テナント解決ミドルウェアで判明したテナント ID を使用します。
+// レイテンシを正確に記録するため、できるだけ先に (外側に) 登録してください。
+func NewMetrics(m *metrics.Metrics) func(huma.Context, func(huma.Context)) {
+	return func(ctx huma.Context, next func(huma.Context)) {
+		start := time.Now()
+
+		// 下流で判明するテナントを受け取るための状態
+		ctx, state := withAccessLogState(ctx)
+
+		next(ctx)
+
+		route := ""
+		if op := ctx.Operation(); op != nil {
+			route = op.Path
+		}
+		tenantID := state.tenant(ctx.Context())
+
+		status := ctx.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.ObserveHTTPRequest(tenantID, ctx.Method(), route, status, time.Since(start))
+	}
+}
+
+// MetricsTenant はメトリクスの tenant ラベルに使用するテナント ID をコンテキストから取得します。
+// metrics.Config の TenantFromContext に指定できます。
+func MetricsTenant(ctx context.Context) string {
+	if tenantID, ok := TenantFrom(ctx); ok {
+		return tenantID
+	}
+	if claims, ok := ClaimsFrom(ctx); ok {
+		return claims.TenantID
+	}
+	return ""
+}
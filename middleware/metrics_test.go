@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/metrics"
+)
+
+func TestNewMetrics(t *testing.T) {
+	m, err := metrics.New(metrics.Config{})
+	require.NoError(t, err)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewMetrics(m))
+	api.UseMiddleware(func(ctx huma.Context, next func(huma.Context)) {
+		setAccessLogTenant(ctx.Context(), "t1")
+		next(ctx)
+	})
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items/{id}"}, func(ctx context.Context, _ *struct {
+		ID string `path:"id"`
+	}) (*struct{}, error) {
+		return nil, nil
+	})
+
+	api.Get("/items/1")
+	api.Get("/items/2")
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), `gloudia_http_requests_total{method="GET",route="/items/{id}",status="204",tenant="t1"} 2`)
+}
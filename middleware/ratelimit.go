@@ -1,122 +1,233 @@
 package middleware
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
-	"github.com/go-redis/redis_rate/v10"
 	"github.com/redis/go-redis/v9"
+
+	"github.com/golaboratory/gloudia/api"
+	"github.com/golaboratory/gloudia/metrics"
 )
 
+// RateLimitMetadataKey は huma.Operation の Metadata で、オペレーションごとのレート制限 ([]RateLimit) を指定するキーです。
+// 空のスライスを指定した場合、そのオペレーションではレート制限を行いません。
+//
+//	huma.Operation{Metadata: map[string]any{middleware.RateLimitMetadataKey: []middleware.RateLimit{{Rate: 5, Period: time.Minute}}}}
+const RateLimitMetadataKey = "rateLimit"
+
+// RateLimit は 1 つのレート制限の定義です。
+type RateLimit struct {
+	Name   string        // 制限の識別子 (例: "second", "day")。キーの一部として使用されます
+	Rate   int           // 期間あたりの許可リクエスト数。Period とともに 0 以下の場合は制限しない
+	Burst  int           // バースト（瞬間的な許容超過数）。0 の場合は Rate と同じ値
+	Period time.Duration // 期間 (例: 1秒, 1日)
+}
+
+// RateLimitKeyFunc はレート制限のキー (制限の単位) をリクエストから取り出す関数です。
+// 空文字を返した場合、そのリクエストはレート制限の対象外となります。
+type RateLimitKeyFunc func(ctx huma.Context) string
+
 // RateLimitConfig レート制限の設定構造体
 type RateLimitConfig struct {
 	Rate   int           // 期間あたりの許可リクエスト数
 	Burst  int           // バースト（瞬間的な許容超過数）
 	Period time.Duration // 期間 (例: 1秒, 1分)
 	Name   string        // レートリミット識別子 (例: "global", "login")
+
+	// Limits は重ねて適用するレート制限です (例: 毎秒 10 回かつ 1 日 10000 回)。
+	// 先頭から順に評価し、超過した制限があればそれ以降の制限は評価しない (回数を消費しない) ため、
+	// 期間の短い制限から順に指定してください。指定した場合、Rate / Burst / Period は使用されません。
+	Limits []RateLimit
+	// KeyFunc はレート制限のキーを取り出す関数です。nil の場合はクライアントの IP アドレス (RateLimitByIP) を使用します。
+	KeyFunc RateLimitKeyFunc
+	// TrustedProxies は X-Forwarded-For / X-Real-IP を信頼するプロキシです。KeyFunc が nil の場合に使用されます。
+	// 指定しない場合、ヘッダーは信頼せず直接の接続元のアドレスを使用します。
+	TrustedProxies TrustedProxies
+	// FailClosed が true の場合、バックエンドの障害時に 503 を返します。false の場合は制限せずに通過させます (Fail-Open)。
+	// 障害時もプロセス単位で制限を継続する場合は、NewFallbackLimiter を使用してください。
+	FailClosed bool
+
+	Metrics *metrics.Metrics // 判定結果を記録するメトリクス (nil の場合は記録しない)
+}
+
+// RateLimitByIP はクライアントの IP アドレスをキーとする RateLimitKeyFunc を返します。
+func RateLimitByIP(proxies TrustedProxies) RateLimitKeyFunc {
+	return func(ctx huma.Context) string {
+		return "ip:" + proxies.ClientIP(ctx.RemoteAddr(), ctx.Header)
+	}
+}
+
+// RateLimitByUser は認証済みユーザーをキーとする RateLimitKeyFunc を返します。未認証のリクエストは対象外です。
+func RateLimitByUser() RateLimitKeyFunc {
+	return func(ctx huma.Context) string {
+		claims, ok := ClaimsFrom(ctx.Context())
+		if !ok || claims.IsAPIKey() {
+			return ""
+		}
+		return fmt.Sprintf("user:%s:%d", claims.TenantID, claims.UserID)
+	}
+}
+
+// RateLimitByTenant はテナントをキーとする RateLimitKeyFunc を返します。テナントが特定できないリクエストは対象外です。
+func RateLimitByTenant() RateLimitKeyFunc {
+	return func(ctx huma.Context) string {
+		if tenantID := MetricsTenant(ctx.Context()); tenantID != "" {
+			return "tenant:" + tenantID
+		}
+		return ""
+	}
+}
+
+// RateLimitByAPIKey は API キーをキーとする RateLimitKeyFunc を返します。API キー以外のリクエストは対象外です。
+func RateLimitByAPIKey() RateLimitKeyFunc {
+	return func(ctx huma.Context) string {
+		if claims, ok := ClaimsFrom(ctx.Context()); ok && claims.IsAPIKey() {
+			return "apikey:" + claims.APIKeyID
+		}
+		return ""
+	}
+}
+
+// FirstRateLimitKey は指定された関数を順に試し、最初に得られたキーを使用する RateLimitKeyFunc を返します。
+// 例: FirstRateLimitKey(RateLimitByAPIKey(), RateLimitByUser(), RateLimitByIP(proxies))
+func FirstRateLimitKey(funcs ...RateLimitKeyFunc) RateLimitKeyFunc {
+	return func(ctx huma.Context) string {
+		for _, f := range funcs {
+			if key := f(ctx); key != "" {
+				return key
+			}
+		}
+		return ""
+	}
 }
 
 // NewRedisRateLimiter ミドルウェアを生成するファクトリ関数
+//
+// Redis (RedisLimiter) をバックエンドとして NewRateLimiter を生成します。
 func NewRedisRateLimiter(rdb *redis.Client, config RateLimitConfig) func(huma.Context, func(huma.Context)) {
-	// redis_rate ライブラリの初期化
-	limiter := redis_rate.NewLimiter(rdb)
+	return NewRateLimiter(NewRedisLimiter(rdb), config)
+}
 
-	limitNameInit := config.Name
-	if limitNameInit == "" {
-		limitNameInit = "default"
+// NewRateLimiter は指定された RateLimiter をバックエンドとするレート制限ミドルウェアを生成します。
+//
+// RateLimitConfig の設定に従い、キーごとにレート制限を行います。
+// 制限を超えた場合は Retry-After ヘッダーと api.UnifiedResponse 形式のボディで 429 を返します。
+// オペレーションの Metadata に RateLimitMetadataKey が指定されている場合は、そのレート制限を使用します。
+func NewRateLimiter(limiter RateLimiter, config RateLimitConfig) func(huma.Context, func(huma.Context)) {
+	// Nameが未指定の場合は "default" とする
+	limitName := config.Name
+	if limitName == "" {
+		limitName = "default"
 	}
-	// 初期化時に既存のレートリミット情報をクリアする
-	// パターン: ratelimit:<limitName>:*
-	pattern := fmt.Sprintf("ratelimit:%s:*", limitNameInit)
-	ctxBg := context.Background()
-
-	// SCANコマンドでキーを検索して削除
-	iter := rdb.Scan(ctxBg, 0, pattern, 0).Iterator()
-	for iter.Next(ctxBg) {
-		rdb.Del(ctxBg, iter.Val())
+
+	defaultLimits := config.Limits
+	if len(defaultLimits) == 0 {
+		defaultLimits = []RateLimit{{Rate: config.Rate, Burst: config.Burst, Period: config.Period}}
 	}
-	if err := iter.Err(); err != nil {
-		slog.Error("Failed to clear existing rate limit keys", "error", err)
+
+	keyFunc := config.KeyFunc
+	if keyFunc == nil {
+		keyFunc = RateLimitByIP(config.TrustedProxies)
 	}
 
 	return func(ctx huma.Context, next func(huma.Context)) {
-		// 1. クライアントIPの特定 (Nginx考慮)
-		// 統合仕様書のNginx設定にある "proxy_set_header X-Real-IP $remote_addr;" を信頼します
-		clientIP := ctx.Header("X-Real-IP")
-		if clientIP == "" {
-			// ヘッダーがない場合はX-Forwarded-Forを確認
-			xff := ctx.Header("X-Forwarded-For")
-			if xff != "" {
-				parts := strings.Split(xff, ",")
-				clientIP = strings.TrimSpace(parts[0])
+		// 1. 適用するレート制限の決定 (オペレーションごとの上書き)
+		limits := defaultLimits
+		if op := ctx.Operation(); op != nil {
+			if override, ok := op.Metadata[RateLimitMetadataKey].([]RateLimit); ok {
+				limits = override
 			}
 		}
-		if clientIP == "" {
-			// それでも取れなければ直接接続元のIP (開発環境など)
-			clientIP = ctx.RemoteAddr()
+		if len(limits) == 0 {
+			next(ctx)
+			return
 		}
 
-		// Redisのキー: "ratelimit:<Name>:<IP>"
-		// Nameが未指定の場合は "default" とする
-		limitName := config.Name
-		if limitName == "" {
-			limitName = "default"
-		}
-		key := fmt.Sprintf("ratelimit:%s:%s", limitName, clientIP)
-
-		// 2. レート制限のチェック
-		// Limitオブジェクトの生成
-		limit := redis_rate.Limit{
-			Rate:   config.Rate,
-			Period: config.Period,
-			Burst:  config.Burst,
+		// 2. キーの特定
+		subject := keyFunc(ctx)
+		if subject == "" {
+			next(ctx)
+			return
 		}
+		tenantID, _ := TenantFrom(ctx.Context())
 
-		res, err := limiter.Allow(ctx.Context(), key, limit)
+		// 3. レート制限のチェック (すべての制限を満たす必要がある)
+		// 超過した制限があればそこで打ち切り、以降の制限 (日単位の上限など) の回数を消費しないようにする
+		var (
+			denied     bool
+			retryAfter time.Duration
+			reported   *RateLimitResult
+			reportedAt RateLimit
+		)
+		for i, l := range limits {
+			// Rate または Period が 0 以下の制限は「制限なし」として評価しない
+			if unlimited(l) {
+				continue
+			}
+			name := l.Name
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			// Redisのキー: "ratelimit:<Name>:<制限名>:<キー>"
+			key := fmt.Sprintf("ratelimit:%s:%s:%s", limitName, name, subject)
+			res, err := limiter.Allow(ctx.Context(), key, l)
 
-		// 3. Fail-Open (Redis障害時のハンドリング)
-		if err != nil {
-			// Redisがダウンしていても、ユーザーをブロックせず通す (ログ出力推奨)
-			// logger.Error("Redis rate limit error", "error", err)
-			next(ctx)
-			return
+			// 4. バックエンド障害時のハンドリング
+			if err != nil {
+				slog.ErrorContext(ctx.Context(), "Rate limit backend error", "limit", limitName, "name", name, "error", err)
+				config.Metrics.RecordRateLimit(tenantID, limitName, "error")
+				if config.FailClosed {
+					writeInvalidResponse(ctx, http.StatusServiceUnavailable, "Rate limiter is unavailable. Please try again later.", nil)
+					return
+				}
+				// Fail-Open: この制限はスキップし、残りの制限は引き続き評価する
+				continue
+			}
+
+			// ヘッダーには最も残り回数の少ない制限を表示する
+			if reported == nil || res.Remaining < reported.Remaining {
+				reported, reportedAt = &res, l
+			}
+			if !res.Allowed {
+				denied = true
+				retryAfter = res.RetryAfter
+				break
+			}
 		}
 
-		// 4. レート制限ヘッダーの付与 (RFC 6585 / 一般的な慣習準拠)
+		// 5. レート制限ヘッダーの付与 (RFC 6585 / 一般的な慣習準拠)
 		// これによりクライアントは「あと何回叩けるか」を知ることができます
-		ctx.SetHeader("X-RateLimit-Limit", strconv.Itoa(config.Rate))
-		ctx.SetHeader("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
-		ctx.SetHeader("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(res.ResetAfter).Unix(), 10))
+		if reported != nil {
+			ctx.SetHeader("X-RateLimit-Limit", strconv.Itoa(reportedAt.Rate))
+			ctx.SetHeader("X-RateLimit-Remaining", strconv.Itoa(reported.Remaining))
+			ctx.SetHeader("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(reported.ResetAfter).Unix(), 10))
+		}
+
+		// 6. 制限超過時の処理
+		if denied {
+			config.Metrics.RecordRateLimit(tenantID, limitName, "denied")
 
-		// 5. 制限超過時の処理
-		if res.Allowed == 0 {
 			// Retry-After ヘッダー (秒数)
-			retryAfterSec := int(res.RetryAfter / time.Second)
+			retryAfterSec := int((retryAfter + time.Second - 1) / time.Second)
 			if retryAfterSec < 1 {
 				retryAfterSec = 1
 			}
 			ctx.SetHeader("Retry-After", strconv.Itoa(retryAfterSec))
 
 			// 429 Too Many Requests を返却
-			ctx.SetStatus(http.StatusTooManyRequests)
-			ctx.SetHeader("Content-Type", "application/json")
-			json.NewEncoder(ctx.BodyWriter()).Encode(map[string]any{
-				"title":   "Too Many Requests",
-				"status":  429,
-				"detail":  "API request limit exceeded. Please try again later.",
-				"message": fmt.Sprintf("Rate limit exceeded. Retry after %d seconds.", retryAfterSec),
-			})
+			writeInvalidResponse(ctx, http.StatusTooManyRequests,
+				fmt.Sprintf("Rate limit exceeded. Retry after %d seconds.", retryAfterSec),
+				api.InvalidItem{"retryAfter": api.ErrorMessage(strconv.Itoa(retryAfterSec))})
 			return // next(ctx) を呼ばずに終了
 		}
 
 		// 制限内であれば次の処理へ
+		config.Metrics.RecordRateLimit(tenantID, limitName, "allowed")
 		next(ctx)
 	}
 }
@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	proxies := MustParseTrustedProxies("10.0.0.0/8", "192.0.2.1")
+	headers := func(h map[string]string) func(string) string {
+		return func(name string) string { return h[name] }
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted remote ignores headers", "203.0.113.9:1234", map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-IP": "1.2.3.4"}, "203.0.113.9"},
+		{"trusted remote uses rightmost untrusted hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"all hops trusted uses leftmost", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"falls back to x-real-ip", "192.0.2.1:1234", map[string]string{"X-Real-IP": "198.51.100.8"}, "198.51.100.8"},
+		{"no headers uses remote", "10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, proxies.ClientIP(tt.remote, headers(tt.headers)))
+		})
+	}
+
+	_, err := ParseTrustedProxies("not-a-cidr/8")
+	assert.Error(t, err)
+}
+
+func newRateLimitTestAPI(t *testing.T, cfg RateLimitConfig) (humatest.TestAPI, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewRedisRateLimiter(rdb, cfg))
+	handler := func(ctx context.Context, _ *struct{}) (*struct{}, error) { return nil, nil }
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items"}, handler)
+	huma.Register(api, huma.Operation{
+		Method:   http.MethodGet,
+		Path:     "/login",
+		Metadata: map[string]any{RateLimitMetadataKey: []RateLimit{{Rate: 1, Period: time.Minute}}},
+	}, handler)
+	huma.Register(api, huma.Operation{
+		Method:   http.MethodGet,
+		Path:     "/health",
+		Metadata: map[string]any{RateLimitMetadataKey: []RateLimit{}},
+	}, handler)
+	return api, mr
+}
+
+func TestNewRedisRateLimiter(t *testing.T) {
+	t.Run("stacked limits deny with unified 429", func(t *testing.T) {
+		api, _ := newRateLimitTestAPI(t, RateLimitConfig{
+			Name: "global",
+			Limits: []RateLimit{
+				{Name: "second", Rate: 10, Period: time.Second},
+				{Name: "day", Rate: 2, Period: 24 * time.Hour},
+			},
+		})
+
+		for range 2 {
+			resp := api.Get("/items")
+			require.Equal(t, http.StatusNoContent, resp.Code)
+		}
+		resp := api.Get("/items")
+		assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+		assert.Equal(t, "2", resp.Header().Get("X-RateLimit-Limit"))
+		assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+		assert.Contains(t, resp.Body.String(), `"isInvalid":true`)
+		assert.Contains(t, resp.Body.String(), `"retryAfter"`)
+	})
+
+	t.Run("spoofed forwarded header is ignored", func(t *testing.T) {
+		api, _ := newRateLimitTestAPI(t, RateLimitConfig{Rate: 1, Period: time.Minute})
+
+		require.Equal(t, http.StatusNoContent, api.Get("/items", "X-Forwarded-For: 1.1.1.1").Code)
+		assert.Equal(t, http.StatusTooManyRequests, api.Get("/items", "X-Forwarded-For: 2.2.2.2").Code)
+	})
+
+	t.Run("custom key function", func(t *testing.T) {
+		api, _ := newRateLimitTestAPI(t, RateLimitConfig{
+			Rate:    1,
+			Period:  time.Minute,
+			KeyFunc: func(ctx huma.Context) string { return ctx.Header("X-Client") },
+		})
+
+		require.Equal(t, http.StatusNoContent, api.Get("/items", "X-Client: a").Code)
+		assert.Equal(t, http.StatusNoContent, api.Get("/items", "X-Client: b").Code)
+		assert.Equal(t, http.StatusTooManyRequests, api.Get("/items", "X-Client: a").Code)
+		// キーが空の場合は制限しない
+		assert.Equal(t, http.StatusNoContent, api.Get("/items").Code)
+		assert.Equal(t, http.StatusNoContent, api.Get("/items").Code)
+	})
+
+	t.Run("per-operation overrides", func(t *testing.T) {
+		api, _ := newRateLimitTestAPI(t, RateLimitConfig{Rate: 100, Period: time.Minute})
+
+		require.Equal(t, http.StatusNoContent, api.Get("/login").Code)
+		assert.Equal(t, http.StatusTooManyRequests, api.Get("/login").Code)
+		for range 3 {
+			resp := api.Get("/health")
+			assert.Equal(t, http.StatusNoContent, resp.Code)
+			assert.Empty(t, resp.Header().Get("X-RateLimit-Limit"))
+		}
+	})
+
+	t.Run("non-positive limits are not enforced", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { rdb.Close() })
+
+		limiter := NewRedisLimiter(rdb)
+		for _, limit := range []RateLimit{{Rate: 0, Period: time.Second}, {Rate: 1}} {
+			for range 3 {
+				res, err := limiter.Allow(context.Background(), "a", limit)
+				require.NoError(t, err)
+				assert.True(t, res.Allowed)
+			}
+		}
+
+		api, _ := newRateLimitTestAPI(t, RateLimitConfig{Limits: []RateLimit{{Name: "disabled", Period: time.Minute}}})
+		for range 3 {
+			resp := api.Get("/items")
+			assert.Equal(t, http.StatusNoContent, resp.Code)
+			assert.Empty(t, resp.Header().Get("X-RateLimit-Limit"))
+		}
+	})
+
+	t.Run("fail-open and fail-closed", func(t *testing.T) {
+		open, mr := newRateLimitTestAPI(t, RateLimitConfig{Rate: 1, Period: time.Minute})
+		mr.Close()
+		assert.Equal(t, http.StatusNoContent, open.Get("/items").Code)
+
+		closed, mr := newRateLimitTestAPI(t, RateLimitConfig{Rate: 1, Period: time.Minute, FailClosed: true})
+		mr.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, closed.Get("/items").Code)
+	})
+}
+
+// scriptedLimiter は制限名ごとに MemoryLimiter へ委譲し、指定した制限ではエラーを返す RateLimiter です。
+type scriptedLimiter struct {
+	memory *MemoryLimiter
+	fail   map[string]bool
+	calls  map[string]int
+}
+
+func (l *scriptedLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	l.calls[limit.Name]++
+	if l.fail[limit.Name] {
+		return RateLimitResult{}, errors.New("backend unavailable")
+	}
+	return l.memory.Allow(ctx, key, limit)
+}
+
+func TestNewRateLimiter_StackedLimits(t *testing.T) {
+	newAPI := func(t *testing.T, limiter RateLimiter) humatest.TestAPI {
+		_, api := humatest.New(t)
+		api.UseMiddleware(NewRateLimiter(limiter, RateLimitConfig{
+			Name: "global",
+			Limits: []RateLimit{
+				{Name: "minute", Rate: 1, Period: time.Minute},
+				{Name: "day", Rate: 3, Period: 24 * time.Hour},
+			},
+		}))
+		huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items"}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+			return nil, nil
+		})
+		return api
+	}
+
+	t.Run("denied request does not consume later limits", func(t *testing.T) {
+		limiter := &scriptedLimiter{memory: NewMemoryLimiter(MemoryLimiterConfig{}), calls: map[string]int{}}
+		api := newAPI(t, limiter)
+
+		require.Equal(t, http.StatusNoContent, api.Get("/items").Code)
+		for range 3 {
+			resp := api.Get("/items")
+			assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+			assert.Equal(t, "1", resp.Header().Get("X-RateLimit-Limit"))
+		}
+		assert.Equal(t, 4, limiter.calls["minute"])
+		assert.Equal(t, 1, limiter.calls["day"], "the day limit is evaluated only while the minute limit allows")
+	})
+
+	t.Run("fail-open keeps evaluating remaining limits", func(t *testing.T) {
+		limiter := &scriptedLimiter{
+			memory: NewMemoryLimiter(MemoryLimiterConfig{}),
+			fail:   map[string]bool{"minute": true},
+			calls:  map[string]int{},
+		}
+		api := newAPI(t, limiter)
+
+		for range 3 {
+			resp := api.Get("/items")
+			require.Equal(t, http.StatusNoContent, resp.Code)
+			assert.Equal(t, "3", resp.Header().Get("X-RateLimit-Limit"))
+		}
+		assert.Equal(t, http.StatusTooManyRequests, api.Get("/items").Code)
+	})
+}
@@ -0,0 +1,259 @@
+package middleware
+
+import (
+	"context"
+	"hash/maphash"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis_rate/v10"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitResult はレート制限の判定結果です。
+type RateLimitResult struct {
+	Allowed    bool          // リクエストが許可されたかどうか
+	Remaining  int           // 期間内に残っている許可リクエスト数
+	RetryAfter time.Duration // 拒否された場合に、次に許可されるまでの時間
+	ResetAfter time.Duration // 制限が完全に回復するまでの時間
+}
+
+// RateLimiter はレート制限の判定を行うバックエンドのインターフェースです。
+type RateLimiter interface {
+	// Allow はキーに対するリクエストを 1 件消費し、判定結果を返します。
+	// Rate または Period が 0 以下の制限は「制限なし」として、常に許可します。
+	Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// unlimited は Rate または Period が 0 以下の、制限として扱わない定義かどうかを判定します。
+func unlimited(limit RateLimit) bool {
+	return limit.Rate <= 0 || limit.Period <= 0
+}
+
+// burstOf は Burst が未指定の場合に Rate を使用します。
+func burstOf(limit RateLimit) int {
+	if limit.Burst == 0 {
+		return limit.Rate
+	}
+	return limit.Burst
+}
+
+// RedisLimiter は Redis (redis_rate) を使用する RateLimiter の実装です。
+// 複数のアプリケーションサーバー間で制限を共有できます。
+type RedisLimiter struct {
+	limiter *redis_rate.Limiter
+}
+
+// NewRedisLimiter は新しい RedisLimiter を作成します。
+func NewRedisLimiter(rdb *redis.Client) *RedisLimiter {
+	return &RedisLimiter{limiter: redis_rate.NewLimiter(rdb)}
+}
+
+// Allow は redis_rate の GCRA アルゴリズムで判定します。
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	if unlimited(limit) {
+		return RateLimitResult{Allowed: true}, nil
+	}
+	res, err := l.limiter.Allow(ctx, key, redis_rate.Limit{Rate: limit.Rate, Burst: burstOf(limit), Period: limit.Period})
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return RateLimitResult{
+		Allowed:    res.Allowed > 0,
+		Remaining:  res.Remaining,
+		RetryAfter: max(res.RetryAfter, 0),
+		ResetAfter: res.ResetAfter,
+	}, nil
+}
+
+// MemoryLimiterConfig は MemoryLimiter の設定構造体です。
+type MemoryLimiterConfig struct {
+	Shards          int           // ロックを分散するためのシャード数
+	MaxKeys         int           // 保持するキーの最大数 (0 の場合は無制限)。超過した場合は古いキーから破棄します
+	CleanupInterval time.Duration // 期限切れのキーを削除する間隔 (0 の場合はバックグラウンドでの削除を行わない)
+}
+
+// DefaultMemoryLimiterConfig は標準的な設定を返します。
+func DefaultMemoryLimiterConfig() MemoryLimiterConfig {
+	return MemoryLimiterConfig{
+		Shards:          64,
+		MaxKeys:         100000,
+		CleanupInterval: time.Minute,
+	}
+}
+
+// MemoryLimiter はプロセス内のメモリで判定する RateLimiter の実装です。
+// Redis を使用しない構成や、Redis の障害時のフォールバックとして使用します。
+// 判定は RedisLimiter と同じ GCRA アルゴリズムで行いますが、制限はプロセスごとに独立します。
+type MemoryLimiter struct {
+	shards   []*memoryShard
+	seed     maphash.Seed
+	maxKeys  int
+	now      func() time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]time.Time // キーごとの TAT (Theoretical Arrival Time)
+}
+
+// NewMemoryLimiter は新しい MemoryLimiter を作成します。
+// CleanupInterval を指定した場合はバックグラウンドで期限切れのキーを削除するため、不要になったら Close を呼び出してください。
+func NewMemoryLimiter(cfg MemoryLimiterConfig) *MemoryLimiter {
+	if cfg.Shards <= 0 {
+		cfg.Shards = DefaultMemoryLimiterConfig().Shards
+	}
+	l := &MemoryLimiter{
+		shards: make([]*memoryShard, cfg.Shards),
+		seed:   maphash.MakeSeed(),
+		now:    time.Now,
+		stop:   make(chan struct{}),
+	}
+	if cfg.MaxKeys > 0 {
+		l.maxKeys = max(cfg.MaxKeys/cfg.Shards, 1)
+	}
+	for i := range l.shards {
+		l.shards[i] = &memoryShard{entries: make(map[string]time.Time)}
+	}
+	if cfg.CleanupInterval > 0 {
+		go l.cleanupLoop(cfg.CleanupInterval)
+	}
+	return l
+}
+
+// Close はバックグラウンドの削除処理を停止します。
+func (l *MemoryLimiter) Close() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// Allow は GCRA アルゴリズムで判定します。
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	if unlimited(limit) {
+		return RateLimitResult{Allowed: true}, nil
+	}
+	now := l.now()
+	emission := limit.Period / time.Duration(limit.Rate)
+	burstOffset := emission * time.Duration(burstOf(limit))
+
+	shard := l.shards[maphash.String(l.seed, key)%uint64(len(l.shards))]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	tat, ok := shard.entries[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(emission)
+	diff := now.Sub(newTAT.Add(-burstOffset))
+	if diff < 0 {
+		return RateLimitResult{
+			Allowed:    false,
+			Remaining:  0,
+			RetryAfter: -diff,
+			ResetAfter: tat.Sub(now),
+		}, nil
+	}
+
+	if !ok && l.maxKeys > 0 && len(shard.entries) >= l.maxKeys {
+		shard.evict(now, l.maxKeys)
+	}
+	shard.entries[key] = newTAT
+	return RateLimitResult{
+		Allowed:    true,
+		Remaining:  int(diff / emission),
+		ResetAfter: newTAT.Sub(now),
+	}, nil
+}
+
+// evict は期限切れのキーを削除し、それでも上限を超える場合は TAT の最も古いキーを削除します。
+func (s *memoryShard) evict(now time.Time, maxKeys int) {
+	s.removeExpired(now)
+	if len(s.entries) < maxKeys {
+		return
+	}
+	var (
+		oldestKey string
+		oldest    time.Time
+	)
+	for k, tat := range s.entries {
+		if oldestKey == "" || tat.Before(oldest) {
+			oldestKey, oldest = k, tat
+		}
+	}
+	delete(s.entries, oldestKey)
+}
+
+// removeExpired は制限が完全に回復した (TAT が現在時刻を過ぎた) キーを削除します。
+func (s *memoryShard) removeExpired(now time.Time) {
+	for k, tat := range s.entries {
+		if !tat.After(now) {
+			delete(s.entries, k)
+		}
+	}
+}
+
+func (l *MemoryLimiter) cleanupLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := l.now()
+			for _, shard := range l.shards {
+				shard.mu.Lock()
+				shard.removeExpired(now)
+				shard.mu.Unlock()
+			}
+		}
+	}
+}
+
+// FallbackLimiter は通常 Primary (Redis など) で判定し、Primary の障害時は Fallback (MemoryLimiter など) で判定する RateLimiter です。
+// Redis の障害中もレート制限を無効にせず、プロセス単位の制限で保護を継続できます。
+type FallbackLimiter struct {
+	Primary  RateLimiter
+	Fallback RateLimiter
+	// RetryInterval は Primary の障害を検知してから、再び Primary を試行するまでの間隔です。
+	// 障害中に毎回 Primary のタイムアウトを待たないようにするために使用します。
+	RetryInterval time.Duration
+
+	downUntil atomic.Int64     // Primary を使用しない期限 (UnixNano)
+	now       func() time.Time // nil の場合は time.Now
+}
+
+// NewFallbackLimiter は新しい FallbackLimiter を作成します。RetryInterval は既定で 5 秒です。
+func NewFallbackLimiter(primary RateLimiter, fallback RateLimiter) *FallbackLimiter {
+	return &FallbackLimiter{
+		Primary:       primary,
+		Fallback:      fallback,
+		RetryInterval: 5 * time.Second,
+		now:           time.Now,
+	}
+}
+
+// Allow は Primary で判定し、エラーの場合は Fallback で判定します。
+func (l *FallbackLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if now.UnixNano() >= l.downUntil.Load() {
+		res, err := l.Primary.Allow(ctx, key, limit)
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return RateLimitResult{}, err
+		}
+		if l.downUntil.Swap(now.Add(l.RetryInterval).UnixNano()) <= now.UnixNano() {
+			slog.WarnContext(ctx, "Primary rate limiter failed, falling back", "error", err)
+		}
+	}
+	return l.Fallback.Allow(ctx, key, limit)
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	l := NewMemoryLimiter(MemoryLimiterConfig{Shards: 4})
+	now := time.Unix(1_700_000_000, 0)
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+	limit := RateLimit{Rate: 2, Period: time.Second}
+
+	res, err := l.Allow(ctx, "a", limit)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining)
+
+	res, _ = l.Allow(ctx, "a", limit)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	res, _ = l.Allow(ctx, "a", limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 500*time.Millisecond, res.RetryAfter)
+
+	// 別のキーは独立して判定される
+	res, _ = l.Allow(ctx, "b", limit)
+	assert.True(t, res.Allowed)
+
+	// 時間の経過で回復する
+	now = now.Add(500 * time.Millisecond)
+	res, _ = l.Allow(ctx, "a", limit)
+	assert.True(t, res.Allowed)
+
+	// Rate または Period が 0 以下の場合は制限しない
+	for _, unlimited := range []RateLimit{{Rate: 0, Period: time.Second}, {Rate: 1}} {
+		res, err = l.Allow(ctx, "a", unlimited)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+	}
+}
+
+func TestMemoryLimiterEviction(t *testing.T) {
+	l := NewMemoryLimiter(MemoryLimiterConfig{Shards: 1, MaxKeys: 2})
+	now := time.Unix(1_700_000_000, 0)
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+	limit := RateLimit{Rate: 1, Period: time.Minute}
+
+	for _, key := range []string{"a", "b", "c"} {
+		res, _ := l.Allow(ctx, key, limit)
+		require.True(t, res.Allowed)
+		now = now.Add(time.Second)
+	}
+	assert.Len(t, l.shards[0].entries, 2)
+	assert.NotContains(t, l.shards[0].entries, "a")
+
+	// 期限切れのキーは削除される
+	now = now.Add(time.Hour)
+	l.shards[0].removeExpired(now)
+	assert.Empty(t, l.shards[0].entries)
+}
+
+type failingLimiter struct {
+	calls int
+	err   error
+}
+
+func (f *failingLimiter) Allow(context.Context, string, RateLimit) (RateLimitResult, error) {
+	f.calls++
+	return RateLimitResult{}, f.err
+}
+
+func TestFallbackLimiter(t *testing.T) {
+	primary := &failingLimiter{err: errors.New("redis: connection refused")}
+	fallback := NewMemoryLimiter(MemoryLimiterConfig{Shards: 1})
+	l := NewFallbackLimiter(primary, fallback)
+	now := time.Unix(1_700_000_000, 0)
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+	limit := RateLimit{Rate: 1, Period: time.Minute}
+
+	res, err := l.Allow(ctx, "a", limit)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	res, _ = l.Allow(ctx, "a", limit)
+	assert.False(t, res.Allowed, "fallback keeps limiting while primary is down")
+	assert.Equal(t, 1, primary.calls, "primary is skipped during the retry interval")
+
+	primary.err = nil
+	now = now.Add(l.RetryInterval)
+	res, _ = l.Allow(ctx, "a", limit)
+	assert.Equal(t, 2, primary.calls, "primary is retried after the interval")
+	assert.Equal(t, RateLimitResult{}, res)
+}
+
+func TestFallbackLimiterLiteral(t *testing.T) {
+	l := &FallbackLimiter{
+		Primary:  &failingLimiter{err: errors.New("redis: connection refused")},
+		Fallback: NewMemoryLimiter(MemoryLimiterConfig{Shards: 1}),
+	}
+
+	res, err := l.Allow(context.Background(), "a", RateLimit{Rate: 1, Period: time.Minute})
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+}
+
+func TestNewRateLimiterWithMemoryBackend(t *testing.T) {
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewRateLimiter(NewMemoryLimiter(MemoryLimiterConfig{}), RateLimitConfig{Rate: 1, Period: time.Minute}))
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items"}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		return nil, nil
+	})
+
+	assert.Equal(t, http.StatusNoContent, api.Get("/items").Code)
+	assert.Equal(t, http.StatusTooManyRequests, api.Get("/items").Code)
+}
@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/newmo-oss/ergo"
+
+	"github.com/golaboratory/gloudia/correlation"
+)
+
+// errInternalServer はパニック時にクライアントへ返すエラーです。内部の情報を含めないよう固定のメッセージとします。
+var errInternalServer = ergo.NewSentinel("Internal Server Error")
+
+// PanicReport はハンドラーで発生したパニックの情報です。
+type PanicReport struct {
+	Value     any    // recover() の戻り値
+	Stack     []byte // パニック発生時のスタックトレース
+	Method    string
+	Path      string
+	RequestID string
+	TenantID  string
+	UserID    int64 // 未認証の場合は 0
+}
+
+// PanicReporter はパニックを Sentry などのエラー監視サービスへ通知するインターフェースです。
+type PanicReporter interface {
+	ReportPanic(ctx context.Context, report *PanicReport)
+}
+
+// PanicReporterFunc は関数を PanicReporter として使用するためのアダプターです。
+type PanicReporterFunc func(ctx context.Context, report *PanicReport)
+
+// ReportPanic は f(ctx, report) を呼び出します。
+func (f PanicReporterFunc) ReportPanic(ctx context.Context, report *PanicReport) {
+	f(ctx, report)
+}
+
+// RecoverConfig はパニックから復帰するミドルウェアの設定構造体です。
+type RecoverConfig struct {
+	// Reporter はパニックの通知先です。nil の場合はログ出力のみ行います。
+	Reporter PanicReporter
+}
+
+// recoverer は Chi と Huma のミドルウェアで共通の、パニックの記録・通知ロジックです。
+type recoverer struct {
+	cfg RecoverConfig
+}
+
+// handle はパニックをログに出力し、Reporter に通知します。
+func (rc recoverer) handle(ctx context.Context, value any, method string, path string, state *accessLogState) {
+	report := &PanicReport{
+		Value:  value,
+		Stack:  debug.Stack(),
+		Method: method,
+		Path:   path,
+	}
+	report.RequestID, _ = correlation.RequestIDFrom(ctx)
+	report.TenantID = state.tenant(ctx)
+	if claims, ok := ClaimsFrom(ctx); ok {
+		report.UserID = claims.UserID
+	} else if state.claims != nil {
+		report.UserID = state.claims.UserID
+	}
+
+	slog.ErrorContext(ctx, "Recovered from panic",
+		"panic", value,
+		"method", method,
+		"path", path,
+		"request_id", report.RequestID,
+		"tenant_id", report.TenantID,
+		"user_id", report.UserID,
+		"stack", string(report.Stack),
+	)
+
+	if rc.cfg.Reporter != nil {
+		func() {
+			// 通知処理自体のパニックでリクエストの処理を中断しない
+			defer func() {
+				if p := recover(); p != nil {
+					slog.ErrorContext(ctx, "Panic reporter failed", "panic", p)
+				}
+			}()
+			rc.cfg.Reporter.ReportPanic(context.WithoutCancel(ctx), report)
+		}()
+	}
+}
+
+// NewRecoverer はハンドラーで発生したパニックから復帰する Chi ミドルウェアを返します。
+//
+// パニックの内容とスタックトレースをリクエスト ID・テナント・ユーザーとともにログに出力して Reporter に通知し、
+// api.NewErrorResponse 形式の 500 を返します。レスポンスの書き込みが始まっていた場合は、接続を閉じます。
+// 下流で判明したテナントやユーザーを記録できるよう、ルーターの最も外側 (NewLogger の内側) に登録してください。
+func NewRecoverer(cfg RecoverConfig) func(http.Handler) http.Handler {
+	rc := recoverer{cfg: cfg}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			state, ok := r.Context().Value(keyAccessLogState).(*accessLogState)
+			if !ok {
+				state = &accessLogState{}
+				r = r.WithContext(context.WithValue(r.Context(), keyAccessLogState, state))
+			}
+			rw := &recoverResponseWriter{ResponseWriter: w}
+
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				// net/http の規約により、ErrAbortHandler は意図的な中断のためそのまま伝播させる
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				rc.handle(r.Context(), p, r.Method, r.URL.Path, state)
+				if rw.wroteHeader {
+					panic(http.ErrAbortHandler)
+				}
+				writeErrorJSON(w, r, http.StatusInternalServerError, errInternalServer)
+			}()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// recoverResponseWriter はレスポンスの書き込みが始まったかを記録します。
+type recoverResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recoverResponseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recoverResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoverResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Hijack は WebSocket (gorilla/websocket) などで接続を引き継ぐために使用します。
+func (w *recoverResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.wroteHeader = true
+	return h.Hijack()
+}
+
+func (w *recoverResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// NewHumaRecoverer は NewRecoverer と同様にパニックから復帰する Huma ミドルウェアを生成します。
+// レスポンスの書き込みが始まっていた場合は、500 を返さずに接続を閉じます。
+// Huma のミドルウェアの最も外側に登録すると、NewRLSProvider がロールバック後に再送出したパニックも処理できます。
+func NewHumaRecoverer(cfg RecoverConfig) func(huma.Context, func(huma.Context)) {
+	rc := recoverer{cfg: cfg}
+	return func(hctx huma.Context, next func(huma.Context)) {
+		hctx, state := withAccessLogState(hctx)
+		ctx := &recoverContext{humaContext: hctx}
+
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			u := ctx.URL()
+			rc.handle(ctx.Context(), p, ctx.Method(), u.Path, state)
+			if ctx.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			writeErrorResponse(hctx, http.StatusInternalServerError, errInternalServer)
+		}()
+
+		next(ctx)
+	}
+}
+
+// recoverContext は recoverResponseWriter と同様に、レスポンスの書き込みが始まったかを記録する huma.Context です。
+type recoverContext struct {
+	humaContext
+	wroteHeader bool
+}
+
+func (c *recoverContext) SetStatus(code int) {
+	c.wroteHeader = true
+	c.humaContext.SetStatus(code)
+}
+
+// Unwrap は元の huma.Context を返します (humachi.Unwrap などで使用されます)。
+func (c *recoverContext) Unwrap() huma.Context {
+	return c.humaContext
+}
+
+func (c *recoverContext) BodyWriter() io.Writer {
+	return &recoverBodyWriter{Writer: c.humaContext.BodyWriter(), ctx: c}
+}
+
+// recoverBodyWriter は書き込みを recoverContext に記録します。
+// SSE (huma/sse) や http.ResponseController が元の http.ResponseWriter の機能を使用できるよう、Flush と Unwrap を提供します。
+type recoverBodyWriter struct {
+	io.Writer
+	ctx *recoverContext
+}
+
+func (w *recoverBodyWriter) Write(b []byte) (int, error) {
+	w.ctx.wroteHeader = true
+	return w.Writer.Write(b)
+}
+
+func (w *recoverBodyWriter) Flush() {
+	w.ctx.wroteHeader = true
+	switch t := w.Writer.(type) {
+	case http.ResponseWriter:
+		_ = http.NewResponseController(t).Flush()
+	case http.Flusher:
+		t.Flush()
+	}
+}
+
+func (w *recoverBodyWriter) Unwrap() http.ResponseWriter {
+	rw, _ := w.Writer.(http.ResponseWriter)
+	return rw
+}
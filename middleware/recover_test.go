@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+	"github.com/golaboratory/gloudia/correlation"
+)
+
+func TestNewRecoverer(t *testing.T) {
+	var reports []*PanicReport
+	reporter := PanicReporterFunc(func(ctx context.Context, report *PanicReport) {
+		reports = append(reports, report)
+	})
+
+	handler := NewRecoverer(RecoverConfig{Reporter: reporter})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 下流のミドルウェアで判明したテナントとユーザー
+		ctx := WithTenant(r.Context(), "tenant-1")
+		setAccessLogTenant(ctx, "tenant-1")
+		setAccessLogClaims(ctx, &auth.Claims{UserID: 42, TenantID: "tenant-1"})
+		panic("database password is hunter2")
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/reservations", nil)
+	r = r.WithContext(correlation.WithRequestID(r.Context(), "req-1"))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"isInvalid":true`)
+	assert.Contains(t, rec.Body.String(), `"summaryMessage":"Internal Server Error"`)
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+
+	require.Len(t, reports, 1)
+	report := reports[0]
+	assert.Equal(t, "database password is hunter2", report.Value)
+	assert.Equal(t, "req-1", report.RequestID)
+	assert.Equal(t, "tenant-1", report.TenantID)
+	assert.Equal(t, int64(42), report.UserID)
+	assert.Equal(t, "/reservations", report.Path)
+	assert.Contains(t, string(report.Stack), "recover_test.go")
+}
+
+func TestNewRecovererAbort(t *testing.T) {
+	handler := NewRecoverer(RecoverConfig{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+
+	// レスポンスの書き込み後のパニックは接続を中断する
+	handler = NewRecoverer(RecoverConfig{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("boom")
+	}))
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestNewHumaRecoverer(t *testing.T) {
+	var report *PanicReport
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewHumaRecoverer(RecoverConfig{Reporter: PanicReporterFunc(func(ctx context.Context, r *PanicReport) {
+		report = r
+	})}))
+	api.UseMiddleware(func(ctx huma.Context, next func(huma.Context)) {
+		claims := &auth.Claims{UserID: 7, TenantID: "tenant-2"}
+		ctx = huma.WithContext(ctx, WithClaims(ctx.Context(), claims))
+		setAccessLogClaims(ctx.Context(), claims)
+		next(ctx)
+	})
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items/{id}"}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		var m map[string]int
+		m["x"] = 1 // nil map への書き込み
+		return nil, nil
+	})
+
+	resp := api.Get("/items/1")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"summaryMessage":"Internal Server Error"`)
+	require.NotNil(t, report)
+	assert.Equal(t, "tenant-2", report.TenantID)
+	assert.Equal(t, int64(7), report.UserID)
+	assert.Equal(t, "/items/1", report.Path)
+}
+
+func TestNewHumaRecovererAbort(t *testing.T) {
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewHumaRecoverer(RecoverConfig{}))
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/stream"}, func(ctx context.Context, _ *struct{}) (*huma.StreamResponse, error) {
+		return &huma.StreamResponse{Body: func(ctx huma.Context) {
+			ctx.SetStatus(http.StatusOK)
+			_, _ = ctx.BodyWriter().Write([]byte("partial"))
+			panic("boom")
+		}}, nil
+	})
+
+	// レスポンスの書き込み後のパニックは 500 を追記せずに接続を中断する
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		api.Get("/stream")
+	})
+}
+
+// hijackRecorder は http.Hijacker を実装する httptest.ResponseRecorder です。
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return nil, nil, nil
+}
+
+func TestNewRecovererHijack(t *testing.T) {
+	handler := NewRecoverer(RecoverConfig{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := w.(http.Hijacker)
+		require.True(t, ok, "gorilla/websocket asserts http.Hijacker")
+		_, _, err := h.Hijack()
+		assert.NoError(t, err)
+	}))
+	rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	assert.True(t, rec.hijacked)
+
+	// 元の ResponseWriter が対応していない場合はエラーを返す
+	handler = NewRecoverer(RecoverConfig{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := w.(http.Hijacker).Hijack()
+		assert.ErrorIs(t, err, http.ErrNotSupported)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ws", nil))
+}
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// redactedValue はマスクした値の代わりに出力する文字列です。
+const redactedValue = "[REDACTED]"
+
+// defaultRedactFields は既定でマスクするフィールド名です。
+// フィールド名は大文字・小文字、"_" と "-" を区別せずに比較し、末尾が一致するもの
+// (例: "newPassword", "access_token", "clientSecret") もマスクの対象とします。
+var defaultRedactFields = []string{
+	"password", "passwd", "secret", "token", "apikey", "authorization",
+	"otp", "totp", "otpcode", "totpcode", "passcode", "creditcard", "cardnumber", "cvv",
+}
+
+// defaultRedactQueryParams は RedactFields に加えて、クエリ文字列でのみマスクするパラメーター名です。
+// 署名付き URL の署名 (auth.URLSigner) や OIDC の認可コード・state など、
+// ボディでは一般的なフィールド名のため RedactFields には含めないものを指定します。
+var defaultRedactQueryParams = []string{"sig", "signature", "code", "state"}
+
+// redactor はリクエスト・レスポンスのボディやクエリ文字列から機密情報をマスクします。
+type redactor struct {
+	fields      []string
+	queryParams []string
+}
+
+func newRedactor(fields []string, queryParams []string) *redactor {
+	rd := &redactor{}
+	for _, f := range fields {
+		if n := normalizeFieldName(f); n != "" {
+			rd.fields = append(rd.fields, n)
+		}
+	}
+	for _, q := range queryParams {
+		if n := normalizeFieldName(q); n != "" {
+			rd.queryParams = append(rd.queryParams, n)
+		}
+	}
+	return rd
+}
+
+func normalizeFieldName(name string) string {
+	name = strings.ToLower(name)
+	name = strings.ReplaceAll(name, "_", "")
+	return strings.ReplaceAll(name, "-", "")
+}
+
+// sensitive はフィールド名がマスクの対象かどうかを判定します。
+func (rd *redactor) sensitive(name string) bool {
+	n := normalizeFieldName(name)
+	for _, f := range rd.fields {
+		if strings.HasSuffix(n, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact はコンテンツタイプに応じてボディをマスクして返します。
+// JSON とフォームは RedactFields に一致するフィールドをマスクします。
+// 安全にマスクできない (解析できない JSON やフォーム、text/* を含むその他の) 場合は ok が false となり、
+// ボディを出力してはいけません。text/* のボディは形式が決まっておらず、"password=..." のような値を
+// 確実に検出できないため出力しません。
+func (rd *redactor) redact(contentType string, body []byte) (string, bool) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return "", true
+	}
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return rd.redactJSON(body)
+	case mediaType == "application/x-www-form-urlencoded":
+		return rd.redactForm(body)
+	}
+	return "", false
+}
+
+func (rd *redactor) redactJSON(body []byte) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return "", false
+	}
+	b, err := json.Marshal(rd.walk(v))
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+func (rd *redactor) walk(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			if rd.sensitive(k) {
+				t[k] = redactedValue
+				continue
+			}
+			t[k] = rd.walk(child)
+		}
+	case []any:
+		for i, child := range t {
+			t[i] = rd.walk(child)
+		}
+	}
+	return v
+}
+
+// redactQuery はクエリ文字列をマスクして返します。
+// RedactFields に一致するパラメーターに加えて、クエリ専用のパラメーター名 (完全一致) もマスクします。
+// 解析できないクエリ文字列は安全にマスクできないため、出力しません。
+func (rd *redactor) redactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "[omitted: malformed query]"
+	}
+	for k := range values {
+		if rd.sensitive(k) || slices.Contains(rd.queryParams, normalizeFieldName(k)) {
+			values[k] = []string{redactedValue}
+		}
+	}
+	return values.Encode()
+}
+
+func (rd *redactor) redactForm(body []byte) (string, bool) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", false
+	}
+	for k := range values {
+		if rd.sensitive(k) {
+			values[k] = []string{redactedValue}
+		}
+	}
+	return values.Encode(), true
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/golaboratory/gloudia/correlation"
+)
+
+// NewRequestID はリクエスト ID と W3C Trace Context (traceparent) を扱うミドルウェアを返します。
+//
+// X-Request-ID ヘッダーが妥当な値であれば引き継ぎ、なければ新しく生成します。
+// traceparent ヘッダーが妥当な値であれば同じトレースの新しいスパンとして、なければ新しいトレースを開始します。
+// いずれもコンテキストに保存し、リクエスト ID はレスポンスヘッダーにも設定します。
+// traceparent はクライアントの値を反射しないよう、レスポンスヘッダーには設定しません。
+// NewTracing を併用している場合、traceparent は NewTracing が開始したスパンのものに置き換えられ、
+// そのスパンの traceparent がレスポンスヘッダーに設定されます。
+//
+// アクセスログやエラーログにリクエスト ID を付与するため、NewLogger より外側 (先) に登録し、
+// slog のハンドラーを correlation.NewLogHandler でラップしてください。
+func NewRequestID() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get(correlation.HeaderRequestID)
+			if !correlation.ValidRequestID(requestID) {
+				requestID = correlation.NewRequestID()
+			}
+
+			tp, ok := correlation.ParseTraceParent(r.Header.Get(correlation.HeaderTraceParent))
+			if ok {
+				tp = tp.Child()
+			} else {
+				tp = correlation.NewTraceParent()
+			}
+
+			ctx := correlation.WithRequestID(r.Context(), requestID)
+			ctx = correlation.WithTraceParent(ctx, tp)
+
+			w.Header().Set(correlation.HeaderRequestID, requestID)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
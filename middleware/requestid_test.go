@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/correlation"
+)
+
+func TestNewRequestID(t *testing.T) {
+	var gotID string
+	var gotTP correlation.TraceParent
+	handler := NewRequestID()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID, _ = correlation.RequestIDFrom(r.Context())
+		gotTP, _ = correlation.TraceParentFrom(r.Context())
+	}))
+
+	t.Run("propagates incoming headers", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Request-ID", "upstream-1")
+		r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		assert.Equal(t, "upstream-1", gotID)
+		assert.Equal(t, "upstream-1", rec.Header().Get("X-Request-ID"))
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", gotTP.TraceID)
+		assert.NotEqual(t, "00f067aa0ba902b7", gotTP.SpanID)
+		assert.Empty(t, rec.Header().Get("traceparent"))
+	})
+
+	t.Run("generates ids for invalid headers", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Request-ID", "evil\tvalue")
+		r.Header.Set("traceparent", "garbage")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		require.NotEmpty(t, gotID)
+		assert.NotEqual(t, "evil\tvalue", gotID)
+		_, ok := correlation.ParseTraceParent(gotTP.String())
+		assert.True(t, ok)
+		assert.Empty(t, rec.Header().Get("traceparent"))
+	})
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/danielgtaylor/huma/v2"
+
+	"github.com/golaboratory/gloudia/api"
+)
+
+// writeInvalidResponse はハンドラーに到達せずに処理を終えるミドルウェアのために、
+// api.UnifiedResponse 形式のエラーレスポンスを書き込みます。
+func writeInvalidResponse(ctx huma.Context, status int, message string, details api.InvalidItem) {
+	resp := api.NewInvalidResponse[any](message, details)
+
+	ctx.SetHeader("Content-Type", "application/json")
+	ctx.SetStatus(status)
+	if err := json.NewEncoder(ctx.BodyWriter()).Encode(resp.Body); err != nil {
+		slog.ErrorContext(ctx.Context(), "Failed to write error response", "error", err)
+	}
+}
+
+// writeInvalidJSON は Chi (net/http) のミドルウェアのために、
+// api.UnifiedResponse 形式のエラーレスポンスを書き込みます。
+func writeInvalidJSON(w http.ResponseWriter, r *http.Request, status int, message string, details api.InvalidItem) {
+	resp := api.NewInvalidResponse[any](message, details)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp.Body); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write error response", "error", err)
+	}
+}
+
+// writeErrorResponse は Huma のミドルウェアのために、api.NewErrorResponse 形式のエラーレスポンスを書き込みます。
+func writeErrorResponse(ctx huma.Context, status int, err error) {
+	resp := api.NewErrorResponse[any](err)
+
+	ctx.SetHeader("Content-Type", "application/json")
+	ctx.SetStatus(status)
+	if err := json.NewEncoder(ctx.BodyWriter()).Encode(resp.Body); err != nil {
+		slog.ErrorContext(ctx.Context(), "Failed to write error response", "error", err)
+	}
+}
+
+// writeErrorJSON は Chi (net/http) のミドルウェアのために、api.NewErrorResponse 形式のエラーレスポンスを書き込みます。
+func writeErrorJSON(w http.ResponseWriter, r *http.Request, status int, err error) {
+	resp := api.NewErrorResponse[any](err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp.Body); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write error response", "error", err)
+	}
+}
@@ -1,87 +1,280 @@
 package middleware
 
 import (
-	"fmt"
+	"context"
 	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/newmo-oss/ergo"
+
+	"github.com/golaboratory/gloudia/auth"
 )
 
+// RLSVariable は RLS ポリシーから参照するセッション変数 (GUC) の定義です。
+// ポリシーからは current_setting('<Name>', true) で参照します。
+// 未認証などで値がない場合は空文字が設定されるため、数値として使用する場合は NULLIF で変換してください。
+//
+//	CREATE POLICY ... USING (owner_id = NULLIF(current_setting('app.current_user_id', true), '')::bigint);
+type RLSVariable struct {
+	// Name は変数名です (例: "app.current_user_id")。PostgreSQL の仕様により "." を含む必要があります。
+	Name string
+	// Value は Claims から変数の値を取り出す関数です。claims は未認証の場合 nil です。
+	Value func(claims *auth.Claims) string
+}
+
+// RLSConfig は NewRLSProviderWithConfig の設定構造体です。
+type RLSConfig struct {
+	// TenantVariable はテナント ID を設定する変数名です。既定値は "app.current_tenant_id" です。
+	TenantVariable string
+	// Variables はテナント ID 以外に設定する変数です。
+	Variables []RLSVariable
+	// ValidateTenantID はテナント ID の形式を検証する関数です。nil の場合は UUID 形式であることを検証します。
+	ValidateTenantID func(tenantID string) bool
+	// DefaultPolicy はオペレーションに TxPolicy が指定されていない場合に使用するトランザクションの設定です。
+	DefaultPolicy TxPolicy
+}
+
+// DefaultRLSVariables は標準で設定する変数を返します。
+//   - app.current_user_id: ユーザー ID
+//   - app.current_role_id: ロール ID
+//   - app.actor_user_id: なりすまし中の管理者のユーザー ID (なりすまし時以外は空)
+func DefaultRLSVariables() []RLSVariable {
+	return []RLSVariable{
+		{Name: "app.current_user_id", Value: claimID(func(c *auth.Claims) int64 { return c.UserID })},
+		{Name: "app.current_role_id", Value: claimID(func(c *auth.Claims) int64 { return c.RoleID })},
+		{Name: "app.actor_user_id", Value: claimID(func(c *auth.Claims) int64 { return c.ActorUserID })},
+	}
+}
+
+// claimID は Claims の ID を文字列として取り出す RLSVariable.Value を返します。
+// Claims がない場合や ID が 0 の場合は空文字となります。
+func claimID(get func(c *auth.Claims) int64) func(*auth.Claims) string {
+	return func(c *auth.Claims) string {
+		if c == nil {
+			return ""
+		}
+		if id := get(c); id != 0 {
+			return strconv.FormatInt(id, 10)
+		}
+		return ""
+	}
+}
+
+// DefaultRLSConfig は標準的な設定を返します。
+func DefaultRLSConfig() RLSConfig {
+	return RLSConfig{
+		TenantVariable: "app.current_tenant_id",
+		Variables:      DefaultRLSVariables(),
+	}
+}
+
+// validTenantUUID はテナント ID が正規形式 (ハイフン区切り 36 文字) の UUID であるかを判定します。
+func validTenantUUID(tenantID string) bool {
+	if len(tenantID) != 36 {
+		return false
+	}
+	_, err := uuid.Parse(tenantID)
+	return err == nil
+}
+
+// rlsStatement は RLSConfig のすべての変数をトランザクション内でのみ有効な値として設定する SQL と引数を組み立てます。
+// 値はすべて set_config のパラメータとして渡すため、SQL インジェクションの余地はありません。
+func (cfg RLSConfig) rlsStatement(tenantID string, claims *auth.Claims) (string, []any) {
+	args := make([]any, 0, 2*(len(cfg.Variables)+1))
+	calls := make([]string, 0, len(cfg.Variables)+1)
+	add := func(name string, value string) {
+		args = append(args, name, value)
+		calls = append(calls, "set_config($"+strconv.Itoa(len(args)-1)+", $"+strconv.Itoa(len(args))+", true)")
+	}
+
+	add(cfg.TenantVariable, tenantID)
+	for _, v := range cfg.Variables {
+		add(v.Name, v.Value(claims))
+	}
+	return "SELECT " + strings.Join(calls, ", "), args
+}
+
 // NewRLSProvider は Huma のミドルウェアとして動作し、以下の責務を持ちます。
 // 1. リクエストの認証情報またはヘッダーから tenant_id を特定
-// 2. DBトランザクションを開始
-// 3. SET LOCAL app.current_tenant_id を実行 (RLS有効化)
+// 2. オペレーションの TxPolicy に従って DBトランザクションを開始
+// 3. set_config で app.current_tenant_id などのセッション変数を設定 (RLS有効化)
 // 4. トランザクションをContextに注入
 // 5. 処理成功時にCommit, エラー時にRollback
+//
+// レスポンスはコミットが完了するまでメモリにバッファリングされるため、コミットに失敗した場合も
+// ハンドラーのレスポンスを送信せずに 500 を返せます。ストリーミングするオペレーションでは TxPolicy.Streaming を指定してください。
+// DefaultRLSConfig の設定で NewRLSProviderWithConfig を呼び出します。
 func NewRLSProvider(db *pgxpool.Pool) func(huma.Context, func(huma.Context)) {
+	return NewRLSProviderWithConfig(db, DefaultRLSConfig())
+}
+
+// NewRLSProviderWithConfig は設定を指定して RLS ミドルウェアを生成します。
+// オペレーションの Metadata に TxPolicyMetadataKey が指定されている場合は、RLSConfig.DefaultPolicy の代わりにその TxPolicy を使用します。
+func NewRLSProviderWithConfig(db *pgxpool.Pool, config RLSConfig) func(huma.Context, func(huma.Context)) {
+	return newRLSProvider(db, config)
+}
+
+// txBeginner はトランザクションを開始するインターフェースです (*pgxpool.Pool が満たします)。
+type txBeginner interface {
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+}
+
+func newRLSProvider(db txBeginner, config RLSConfig) func(huma.Context, func(huma.Context)) {
+	if config.TenantVariable == "" {
+		config.TenantVariable = DefaultRLSConfig().TenantVariable
+	}
+	if config.ValidateTenantID == nil {
+		config.ValidateTenantID = validTenantUUID
+	}
+
 	return func(ctx huma.Context, next func(huma.Context)) {
+		policy := txPolicyFor(ctx, config.DefaultPolicy)
+
 		// 1. テナントID (tenant_id) の取得
-		// 本来は AuthMiddleware が先に走り、Context に Claims が入っている想定です。
-		// 未ログイン時(ゲスト予約など)の扱いは仕様によりますが、ここでは
-		// "X-Tenant-ID" ヘッダー または 認証情報 からの取得を試みます。
-		var tenantID string
-
-		// ケースA: 認証済みユーザーの場合
-		if id, ok := ctx.Context().Value(KeyTenantID).(string); ok {
-			tenantID = id
-		}
+		// 本来は AuthMiddleware や NewTenantResolution が先に走り、Context に tenant_id が入っている想定です。
+		tenantID, _ := TenantFrom(ctx.Context())
 
 		// tenant_id が特定できない場合はエラー (400 Bad Request)
-		// ※ トップページなどテナント不要なAPIの場合はこのチェックを緩和する必要があります
-		if tenantID == "" {
-			ctx.SetStatus(400)
+		// トップページなどテナント不要なAPIでは TxPolicy.TenantOptional を指定します。
+		if tenantID == "" && !policy.TenantOptional {
+			writeInvalidResponse(ctx, http.StatusBadRequest, "Tenant could not be determined", nil)
+			return
+		}
+		// テナント ID は X-Forwarded-Host などクライアントが指定できる値に由来する場合があるため、形式を検証する
+		if tenantID != "" && !config.ValidateTenantID(tenantID) {
+			slog.WarnContext(ctx.Context(), "Invalid tenant id", "tenant_id", tenantID)
+			writeInvalidResponse(ctx, http.StatusBadRequest, "Invalid tenant", nil)
 			return
 		}
+		if tenantID != "" {
+			setAccessLogTenant(ctx.Context(), tenantID)
+		}
 
-		// 2. トランザクション開始
-		tx, err := db.Begin(ctx.Context())
-		if err != nil {
-			slog.Error("Failed to begin transaction", "error", err)
-			ctx.SetStatus(500)
+		if policy.NoTransaction {
+			next(ctx)
 			return
 		}
 
-		// defer でパニック時や途中リターン時のロールバックを保証
-		defer func() {
-			if p := recover(); p != nil {
-				tx.Rollback(ctx.Context())
-				panic(p) // 再パニック
+		// ストリーミングするオペレーションはレスポンスを送信済みのため再実行できない
+		if policy.Streaming {
+			policy.MaxRetries = 0
+		}
+
+		// シリアライズ失敗時に再実行する場合は、リクエストボディを再読み込みできるよう保持する
+		var body []byte
+		if policy.MaxRetries > 0 {
+			var err error
+			if body, err = readReplayableBody(ctx); err != nil {
+				slog.WarnContext(ctx.Context(), "Failed to read request body", "error", err)
+				writeInvalidResponse(ctx, http.StatusBadRequest, "Failed to read request body", nil)
+				return
 			}
-			// ステータスコードが 4xx, 5xx の場合はロールバック
-			if ctx.Status() >= 400 {
-				tx.Rollback(ctx.Context())
+		}
+		claims, _ := ClaimsFrom(ctx.Context())
+
+		for attempt := 0; ; attempt++ {
+			buffered, serialization, err := runRLSTx(ctx, db, config, policy, tenantID, claims, body, next)
+			if serialization && attempt < policy.MaxRetries {
+				slog.WarnContext(ctx.Context(), "Retrying transaction after serialization failure", "attempt", attempt+1)
+				if !sleepContext(ctx.Context(), time.Duration(attempt+1)*10*time.Millisecond+time.Duration(rand.Int64N(int64(10*time.Millisecond)))) {
+					writeInvalidResponse(ctx, http.StatusServiceUnavailable, "Request was canceled", nil)
+					return
+				}
+				continue
+			}
+			if err != nil {
+				slog.ErrorContext(ctx.Context(), "Transaction failed", "error", err)
+				// ストリーミングの場合はレスポンスを送信済みのため、エラーのレスポンスは返せない
+				if buffered != nil && buffered.passthrough {
+					return
+				}
+				if serialization {
+					writeInvalidResponse(ctx, http.StatusConflict, "The request conflicted with a concurrent update. Please try again.", nil)
+				} else {
+					writeInvalidResponse(ctx, http.StatusInternalServerError, "Internal Server Error", nil)
+				}
+				return
+			}
+			if err := buffered.flush(); err != nil {
+				slog.ErrorContext(ctx.Context(), "Failed to write response", "error", err)
 			}
-		}()
-
-		// 3. RLSポリシーの設定 (SET LOCAL)
-		// SQLインジェクション対策のため、プレースホルダではなく文字列として組み立てる場合は
-		// UUID形式であることを事前に検証するか、pgx ドライバの機能を使うことが望ましいですが、
-		// ここでは Exec でパラメータバインドを試みます。
-		// ※ SET LOCAL はパラメータバインドが効かないケースがあるため、Sprintf で埋め込むのが一般的ですが、
-		//    tenantID は信頼できるソース(Token等)由来前提とします。
-		query := fmt.Sprintf("SET LOCAL app.current_tenant_id = '%s'", tenantID)
-		if _, err := tx.Exec(ctx.Context(), query); err != nil {
-			slog.Error("Failed to set RLS context", "error", err)
-			tx.Rollback(ctx.Context())
-			ctx.SetStatus(500)
 			return
 		}
+	}
+}
 
-		// 4. Context に Tx と tenant_id を保存
-		// Huma の WithValue ヘルパーを使用して Context を更新し、下流のハンドラへ渡します。
-		ctx = huma.WithValue(ctx, KeyDBTx, tx)
-		ctx = huma.WithValue(ctx, KeyTenantID, tenantID)
-
-		next(ctx)
+// runRLSTx は 1 回分のトランザクションの中でハンドラーを実行します。
+// ハンドラーのレスポンスはバッファリングされ、呼び出し元がコミットの成否に応じて送信または破棄します。
+// TxPolicy.Streaming の場合はバッファリングせず、ハンドラーのレスポンスをそのまま送信します。
+// serialization はハンドラーまたはコミットでシリアライズ失敗が発生したかどうか、
+// err はハンドラー以外 (開始・変数の設定・コミット) で発生したエラーです。
+// コミットに失敗した場合も、ハンドラーが実行された場合は buffered を返します。
+func runRLSTx(ctx huma.Context, db txBeginner, config RLSConfig, policy TxPolicy, tenantID string, claims *auth.Claims, body []byte, next func(huma.Context)) (buffered *bufferedContext, serialization bool, err error) {
+	// 2. トランザクション開始
+	tx, err := db.BeginTx(ctx.Context(), policy.txOptions())
+	if err != nil {
+		return nil, false, ergo.Wrap(err, "failed to begin transaction")
+	}
+	rollback := func() { tx.Rollback(context.WithoutCancel(ctx.Context())) }
 
-		// 5. コミット制御
-		// ハンドラが戻ってきた後、ステータスを確認してコミット
-		if ctx.Status() < 400 {
-			if err := tx.Commit(ctx.Context()); err != nil {
-				slog.Error("Failed to commit transaction", "error", err)
-				ctx.SetStatus(500)
-			}
+	// パニック時のロールバックを保証
+	defer func() {
+		if p := recover(); p != nil {
+			rollback()
+			panic(p) // 再パニック
 		}
+	}()
+
+	// 3. RLSポリシーの設定
+	// SET LOCAL はパラメータバインドができないため、同等の set_config(name, value, true) を使用します。
+	query, args := config.rlsStatement(tenantID, claims)
+	if _, err := tx.Exec(ctx.Context(), query, args...); err != nil {
+		rollback()
+		return nil, false, ergo.Wrap(err, "failed to set rls context")
+	}
+
+	// 4. Context に Tx と tenant_id を保存
+	recorder := &recordingTx{Tx: tx}
+	reqCtx := WithTx(ctx.Context(), recorder)
+	if tenantID != "" {
+		reqCtx = WithTenant(reqCtx, tenantID)
+	}
+	buffered = newBufferedContext(ctx, reqCtx, body)
+	buffered.passthrough = policy.Streaming
+
+	next(buffered)
+
+	// 5. コミット制御
+	// ステータスコードが 4xx, 5xx の場合はロールバック
+	if buffered.Status() >= 400 {
+		rollback()
+		return buffered, recorder.serializationFailure.Load(), nil
+	}
+	if err := tx.Commit(ctx.Context()); err != nil {
+		// ハンドラーがシリアライズ失敗を握りつぶした場合、コミットは "commit unexpectedly resulted in rollback" となるため、
+		// 実行中に記録したシリアライズ失敗も考慮する
+		serialization := isSerializationFailure(err) || recorder.serializationFailure.Load()
+		return buffered, serialization, ergo.Wrap(err, "failed to commit transaction")
+	}
+	return buffered, false, nil
+}
+
+// sleepContext は d だけ待機します。待機中に ctx が終了した場合は false を返します。
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
 }
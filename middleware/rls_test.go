@@ -0,0 +1,282 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+func TestRLSStatement(t *testing.T) {
+	cfg := DefaultRLSConfig()
+	tenantID := "0b6e9a4e-2f0e-4b8e-9d7e-6d8c1c1f3a10"
+
+	query, args := cfg.rlsStatement(tenantID, &auth.Claims{UserID: 42, TenantID: tenantID, RoleID: 3, ActorUserID: 7})
+	assert.Equal(t, "SELECT set_config($1, $2, true), set_config($3, $4, true), set_config($5, $6, true), set_config($7, $8, true)", query)
+	assert.Equal(t, []any{
+		"app.current_tenant_id", tenantID,
+		"app.current_user_id", "42",
+		"app.current_role_id", "3",
+		"app.actor_user_id", "7",
+	}, args)
+
+	// 未認証の場合は空文字を設定する
+	_, args = cfg.rlsStatement(tenantID, nil)
+	assert.Equal(t, []any{
+		"app.current_tenant_id", tenantID,
+		"app.current_user_id", "",
+		"app.current_role_id", "",
+		"app.actor_user_id", "",
+	}, args)
+
+	// 変数は Claims から自由に追加できる
+	cfg.Variables = []RLSVariable{{Name: "app.session_id", Value: func(c *auth.Claims) string { return c.SessionID }}}
+	_, args = cfg.rlsStatement(tenantID, &auth.Claims{SessionID: "s1"})
+	assert.Equal(t, []any{"app.current_tenant_id", tenantID, "app.session_id", "s1"}, args)
+}
+
+func TestValidTenantUUID(t *testing.T) {
+	assert.True(t, validTenantUUID("0b6e9a4e-2f0e-4b8e-9d7e-6d8c1c1f3a10"))
+	assert.False(t, validTenantUUID("acme"))
+	assert.False(t, validTenantUUID("x'; DROP TABLE users; --"))
+	assert.False(t, validTenantUUID("{0b6e9a4e-2f0e-4b8e-9d7e-6d8c1c1f3a10}"))
+	assert.False(t, validTenantUUID("urn:uuid:0b6e9a4e-2f0e-4b8e-9d7e-6d8c1c1f3a10"))
+}
+
+func TestNewRLSProviderRejectsInvalidTenant(t *testing.T) {
+	_, api := humatest.New(t)
+	api.UseMiddleware(func(ctx huma.Context, next func(huma.Context)) {
+		if tenantID := ctx.Header("X-Test-Tenant"); tenantID != "" {
+			ctx = huma.WithContext(ctx, WithTenant(ctx.Context(), tenantID))
+		}
+		next(ctx)
+	})
+	// テナント ID の検証で拒否されるため、DB には接続しない
+	api.UseMiddleware(NewRLSProvider(nil))
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items"}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		return nil, nil
+	})
+
+	resp := api.Get("/items", "X-Test-Tenant: ' OR 1=1 --")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), `"isInvalid":true`)
+
+	resp = api.Get("/items")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestTxPolicy(t *testing.T) {
+	opts := TxPolicy{ReadOnly: true, IsoLevel: pgx.Serializable, Deferrable: true}.txOptions()
+	assert.Equal(t, pgx.TxOptions{IsoLevel: pgx.Serializable, AccessMode: pgx.ReadOnly, DeferrableMode: pgx.Deferrable}, opts)
+	assert.Equal(t, pgx.TxOptions{}, TxPolicy{}.txOptions())
+}
+
+func TestNewRLSProviderPolicies(t *testing.T) {
+	_, api := humatest.New(t)
+	// トランザクションを開始しないオペレーションのみのため、DB には接続しない
+	api.UseMiddleware(NewRLSProvider(nil))
+	huma.Register(api, huma.Operation{
+		Method:   http.MethodGet,
+		Path:     "/health",
+		Metadata: map[string]any{TxPolicyMetadataKey: TxPolicy{NoTransaction: true, TenantOptional: true}},
+	}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		_, ok := TxFrom(ctx)
+		assert.False(t, ok)
+		return nil, nil
+	})
+
+	assert.Equal(t, http.StatusNoContent, api.Get("/health").Code)
+}
+
+type fakeTx struct {
+	pgx.Tx
+	err error
+}
+
+func (f *fakeTx) Exec(context.Context, string, ...any) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, f.err
+}
+
+func TestRecordingTx(t *testing.T) {
+	tx := &recordingTx{Tx: &fakeTx{err: errors.New("syntax error")}}
+	_, _ = tx.Exec(context.Background(), "SELECT 1")
+	assert.False(t, tx.serializationFailure.Load())
+
+	serialization := fmt.Errorf("update failed: %w", &pgconn.PgError{Code: "40001"})
+	tx = &recordingTx{Tx: &fakeTx{err: serialization}}
+	_, err := tx.Exec(context.Background(), "UPDATE reservations SET ...")
+	assert.ErrorIs(t, err, serialization)
+	assert.True(t, tx.serializationFailure.Load())
+}
+
+func TestBufferedContext(t *testing.T) {
+	_, api := humatest.New(t)
+	var attempts int
+	api.UseMiddleware(func(ctx huma.Context, next func(huma.Context)) {
+		body, err := readReplayableBody(ctx)
+		require.NoError(t, err)
+
+		// 1 回目のレスポンスは破棄し、2 回目のレスポンスのみ送信する
+		var buffered *bufferedContext
+		for range 2 {
+			buffered = newBufferedContext(ctx, ctx.Context(), body)
+			next(buffered)
+		}
+		require.NoError(t, buffered.flush())
+	})
+	type input struct {
+		Body struct {
+			Name string `json:"name"`
+		}
+	}
+	type output struct {
+		Attempt int `header:"X-Attempt"`
+		Body    struct {
+			Name    string `json:"name"`
+			Attempt int    `json:"attempt"`
+		}
+	}
+	huma.Register(api, huma.Operation{Method: http.MethodPost, Path: "/items"}, func(ctx context.Context, in *input) (*output, error) {
+		attempts++
+		out := &output{Attempt: attempts}
+		out.Body.Name = in.Body.Name
+		out.Body.Attempt = attempts
+		return out, nil
+	})
+
+	resp := api.Post("/items", map[string]any{"name": "room"})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "2", resp.Header().Get("X-Attempt"))
+	assert.JSONEq(t, `{"name":"room","attempt":2}`, resp.Body.String())
+}
+
+// scriptedTx は Exec と Commit の結果を指定できる pgx.Tx です。
+type scriptedTx struct {
+	pgx.Tx
+	execErr    error // ハンドラーの Exec で返すエラー (RLS の変数の設定では返さない)
+	commitErr  error
+	committed  bool
+	rolledBack bool
+}
+
+func (t *scriptedTx) Exec(_ context.Context, sql string, _ ...any) (pgconn.CommandTag, error) {
+	if strings.HasPrefix(sql, "SELECT set_config") {
+		return pgconn.CommandTag{}, nil
+	}
+	return pgconn.CommandTag{}, t.execErr
+}
+
+func (t *scriptedTx) Commit(context.Context) error {
+	t.committed = true
+	return t.commitErr
+}
+
+func (t *scriptedTx) Rollback(context.Context) error {
+	t.rolledBack = true
+	return nil
+}
+
+// scriptedBeginner は BeginTx のたびに txs を先頭から順に返します。
+type scriptedBeginner struct {
+	txs []*scriptedTx
+	n   int
+}
+
+func (b *scriptedBeginner) BeginTx(context.Context, pgx.TxOptions) (pgx.Tx, error) {
+	tx := b.txs[b.n]
+	b.n++
+	return tx, nil
+}
+
+func TestNewRLSProviderRetry(t *testing.T) {
+	serialization := &pgconn.PgError{Code: "40001"}
+	type output struct {
+		Body struct {
+			Attempt int `json:"attempt"`
+		}
+	}
+
+	newAPI := func(t *testing.T, db txBeginner, policy TxPolicy, swallow bool) humatest.TestAPI {
+		_, api := humatest.New(t)
+		cfg := DefaultRLSConfig()
+		cfg.DefaultPolicy = policy
+		api.UseMiddleware(newRLSProvider(db, cfg))
+		var attempts int
+		huma.Register(api, huma.Operation{Method: http.MethodPost, Path: "/items"}, func(ctx context.Context, _ *struct{}) (*output, error) {
+			attempts++
+			tx, ok := TxFrom(ctx)
+			require.True(t, ok)
+			if _, err := tx.Exec(ctx, "UPDATE reservations SET ..."); err != nil && !swallow {
+				return nil, huma.Error500InternalServerError("update failed", err)
+			}
+			out := &output{}
+			out.Body.Attempt = attempts
+			return out, nil
+		})
+		return api
+	}
+
+	t.Run("handler serialization failure is retried", func(t *testing.T) {
+		db := &scriptedBeginner{txs: []*scriptedTx{{execErr: serialization}, {}}}
+		api := newAPI(t, db, TxPolicy{TenantOptional: true, MaxRetries: 2}, false)
+
+		resp := api.Post("/items", map[string]any{})
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.JSONEq(t, `{"attempt":2}`, resp.Body.String())
+		assert.True(t, db.txs[0].rolledBack)
+		assert.False(t, db.txs[0].committed)
+		assert.True(t, db.txs[1].committed)
+	})
+
+	t.Run("commit serialization failure is retried until exhausted", func(t *testing.T) {
+		db := &scriptedBeginner{txs: []*scriptedTx{{commitErr: serialization}, {commitErr: serialization}}}
+		api := newAPI(t, db, TxPolicy{TenantOptional: true, MaxRetries: 1}, false)
+
+		resp := api.Post("/items", map[string]any{})
+		assert.Equal(t, http.StatusConflict, resp.Code)
+		assert.NotContains(t, resp.Body.String(), "attempt")
+		assert.Equal(t, 2, db.n)
+	})
+
+	t.Run("swallowed serialization failure is retried after commit fails", func(t *testing.T) {
+		// ハンドラーがエラーを無視した場合、コミットは SQLSTATE を伴わないエラーとなる
+		rolledBack := errors.New("commit unexpectedly resulted in rollback")
+		db := &scriptedBeginner{txs: []*scriptedTx{{execErr: serialization, commitErr: rolledBack}, {}}}
+		api := newAPI(t, db, TxPolicy{TenantOptional: true, MaxRetries: 1}, true)
+
+		resp := api.Post("/items", map[string]any{})
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.JSONEq(t, `{"attempt":2}`, resp.Body.String())
+	})
+
+	t.Run("commit failure discards the buffered response", func(t *testing.T) {
+		db := &scriptedBeginner{txs: []*scriptedTx{{commitErr: errors.New("connection reset")}}}
+		api := newAPI(t, db, TxPolicy{TenantOptional: true, MaxRetries: 3}, false)
+
+		resp := api.Post("/items", map[string]any{})
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.NotContains(t, resp.Body.String(), "attempt")
+		assert.Equal(t, 1, db.n, "non-serialization failures are not retried")
+	})
+
+	t.Run("streaming responses are not buffered or retried", func(t *testing.T) {
+		db := &scriptedBeginner{txs: []*scriptedTx{{commitErr: serialization}}}
+		api := newAPI(t, db, TxPolicy{TenantOptional: true, MaxRetries: 3, Streaming: true}, false)
+
+		resp := api.Post("/items", map[string]any{})
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.JSONEq(t, `{"attempt":1}`, resp.Body.String())
+		assert.Equal(t, 1, db.n)
+	})
+}
@@ -4,12 +4,11 @@ import (
 	"net/http"
 )
 
+// DefaultRobotsTag は検索エンジンによるインデックスを拒否する X-Robots-Tag の値です。
+const DefaultRobotsTag = "noindex, nofollow, noarchive"
+
+// NewRobotTag は X-Robots-Tag ヘッダーのみを設定するミドルウェアを返します。
+// 他のセキュリティヘッダーと併せて設定する場合は、NewSecurityHeaders の RobotsTag を使用してください。
 func NewRobotTag() func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// レスポンスヘッダに noindex をセット
-			w.Header().Set("X-Robots-Tag", "noindex, nofollow, noarchive")
-			next.ServeHTTP(w, r)
-		})
-	}
+	return NewSecurityHeaders(SecurityHeadersConfig{RobotsTag: DefaultRobotsTag})
 }
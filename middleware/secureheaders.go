@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSPNoncePlaceholder は ContentSecurityPolicy 内でリクエストごとの nonce に置き換えられる文字列です。
+//
+//	script-src 'self' 'nonce-{nonce}'
+const CSPNoncePlaceholder = "{nonce}"
+
+// SecurityHeadersConfig はセキュリティ関連のレスポンスヘッダーの設定構造体です。空の項目のヘッダーは設定されません。
+type SecurityHeadersConfig struct {
+	// HSTSMaxAge は Strict-Transport-Security の max-age です。0 の場合はヘッダーを設定しません。
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+
+	// ContentSecurityPolicy は Content-Security-Policy の値です。
+	// CSPNoncePlaceholder を含む場合はリクエストごとに nonce を生成し、CSPNonceFrom で取得できるようにします。
+	ContentSecurityPolicy string
+	// CSPReportOnly が true の場合、Content-Security-Policy-Report-Only として設定します (導入時の検証用)。
+	CSPReportOnly bool
+
+	// ContentTypeNosniff が true の場合、X-Content-Type-Options: nosniff を設定します。
+	ContentTypeNosniff bool
+	// FrameOptions は X-Frame-Options の値です (例: "DENY")。
+	FrameOptions string
+	// ReferrerPolicy は Referrer-Policy の値です。
+	ReferrerPolicy string
+	// PermissionsPolicy は Permissions-Policy の値です。
+	PermissionsPolicy string
+	// CrossOriginOpenerPolicy は Cross-Origin-Opener-Policy の値です。
+	CrossOriginOpenerPolicy string
+	// CrossOriginResourcePolicy は Cross-Origin-Resource-Policy の値です。
+	CrossOriginResourcePolicy string
+	// RobotsTag は X-Robots-Tag の値です (例: DefaultRobotsTag)。
+	RobotsTag string
+
+	// Routes はパスごとに設定を上書きします。先頭から順に判定し、最初に一致したルートの設定を使用します。
+	Routes []SecurityHeadersRoute
+}
+
+// SecurityHeadersRoute はパスごとのセキュリティヘッダーの設定です。
+type SecurityHeadersRoute struct {
+	// Path は対象のパスです。末尾が "*" の場合は前方一致で判定します (例: "/app/*")。
+	Path string
+	// Config はこのパスで使用する設定です。Routes は無視されます。
+	Config SecurityHeadersConfig
+}
+
+// APISecurityHeaders は JSON を返す API 向けの設定を返します。
+// API のレスポンスはブラウザで描画されないため、CSP ですべてのリソースの読み込みとフレーム内での表示を禁止します。
+func APISecurityHeaders() SecurityHeadersConfig {
+	return SecurityHeadersConfig{
+		HSTSMaxAge:                2 * 365 * 24 * time.Hour,
+		HSTSIncludeSubdomains:     true,
+		ContentSecurityPolicy:     "default-src 'none'; frame-ancestors 'none'",
+		ContentTypeNosniff:        true,
+		FrameOptions:              "DENY",
+		ReferrerPolicy:            "no-referrer",
+		PermissionsPolicy:         "camera=(), microphone=(), geolocation=(), payment=()",
+		CrossOriginOpenerPolicy:   "same-origin",
+		CrossOriginResourcePolicy: "same-origin",
+		RobotsTag:                 DefaultRobotsTag,
+	}
+}
+
+// HTMLSecurityHeaders はサーバーサイドでレンダリングする HTML 向けの設定を返します。
+// インラインのスクリプトとスタイルは nonce を付与したもののみ許可します。
+func HTMLSecurityHeaders() SecurityHeadersConfig {
+	return SecurityHeadersConfig{
+		HSTSMaxAge:            2 * 365 * 24 * time.Hour,
+		HSTSIncludeSubdomains: true,
+		ContentSecurityPolicy: "default-src 'self'; " +
+			"script-src 'self' 'nonce-" + CSPNoncePlaceholder + "'; " +
+			"style-src 'self' 'nonce-" + CSPNoncePlaceholder + "'; " +
+			"img-src 'self' data:; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'",
+		ContentTypeNosniff:        true,
+		FrameOptions:              "DENY",
+		ReferrerPolicy:            "strict-origin-when-cross-origin",
+		PermissionsPolicy:         "camera=(), microphone=(), geolocation=(), payment=()",
+		CrossOriginOpenerPolicy:   "same-origin",
+		CrossOriginResourcePolicy: "same-origin",
+	}
+}
+
+// securityHeaders はリクエストごとに変化しないヘッダーを事前に組み立てた設定です。
+type securityHeaders struct {
+	headers [][2]string
+	csp     string
+	cspName string
+	nonce   bool
+}
+
+func newSecurityHeaders(cfg SecurityHeadersConfig) *securityHeaders {
+	h := &securityHeaders{}
+	add := func(name string, value string) {
+		if value != "" {
+			h.headers = append(h.headers, [2]string{name, value})
+		}
+	}
+
+	if cfg.HSTSMaxAge > 0 {
+		hsts := "max-age=" + strconv.FormatInt(int64(cfg.HSTSMaxAge/time.Second), 10)
+		if cfg.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if cfg.HSTSPreload {
+			hsts += "; preload"
+		}
+		add("Strict-Transport-Security", hsts)
+	}
+	if cfg.ContentTypeNosniff {
+		add("X-Content-Type-Options", "nosniff")
+	}
+	add("X-Frame-Options", cfg.FrameOptions)
+	add("Referrer-Policy", cfg.ReferrerPolicy)
+	add("Permissions-Policy", cfg.PermissionsPolicy)
+	add("Cross-Origin-Opener-Policy", cfg.CrossOriginOpenerPolicy)
+	add("Cross-Origin-Resource-Policy", cfg.CrossOriginResourcePolicy)
+	add("X-Robots-Tag", cfg.RobotsTag)
+
+	h.csp = cfg.ContentSecurityPolicy
+	h.cspName = "Content-Security-Policy"
+	if cfg.CSPReportOnly {
+		h.cspName = "Content-Security-Policy-Report-Only"
+	}
+	h.nonce = strings.Contains(h.csp, CSPNoncePlaceholder)
+	return h
+}
+
+// NewSecurityHeaders はセキュリティ関連のレスポンスヘッダーを設定する Chi ミドルウェアを返します。
+//
+// 用途に応じて APISecurityHeaders または HTMLSecurityHeaders を基に設定し、
+// 管理画面など一部のパスのみ異なる設定が必要な場合は Routes で上書きします。
+//
+//	cfg := middleware.APISecurityHeaders()
+//	cfg.Routes = []middleware.SecurityHeadersRoute{{Path: "/app/*", Config: middleware.HTMLSecurityHeaders()}}
+//	router.Use(middleware.NewSecurityHeaders(cfg))
+func NewSecurityHeaders(cfg SecurityHeadersConfig) func(http.Handler) http.Handler {
+	def := newSecurityHeaders(cfg)
+	routes := make([]*securityHeaders, len(cfg.Routes))
+	for i, route := range cfg.Routes {
+		routes[i] = newSecurityHeaders(route.Config)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := def
+			for i, route := range cfg.Routes {
+				if pathMatches(route.Path, r.URL.Path) {
+					h = routes[i]
+					break
+				}
+			}
+
+			header := w.Header()
+			for _, kv := range h.headers {
+				header.Set(kv[0], kv[1])
+			}
+
+			if h.csp != "" {
+				csp := h.csp
+				if h.nonce {
+					nonce, err := newCSPNonce()
+					if err != nil {
+						slog.ErrorContext(r.Context(), "Failed to generate csp nonce", "error", err)
+						writeInvalidJSON(w, r, http.StatusInternalServerError, "Internal Server Error", nil)
+						return
+					}
+					csp = strings.ReplaceAll(csp, CSPNoncePlaceholder, nonce)
+					r = r.WithContext(WithCSPNonce(r.Context(), nonce))
+				}
+				header.Set(h.cspName, csp)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// newCSPNonce は 128 ビットのランダムな nonce を生成します。
+func newCSPNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSecurityHeaders(t *testing.T) {
+	cfg := APISecurityHeaders()
+	cfg.Routes = []SecurityHeadersRoute{{Path: "/app/*", Config: HTMLSecurityHeaders()}}
+
+	var nonce string
+	handler := NewSecurityHeaders(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, _ = CSPNonceFrom(r.Context())
+	}))
+
+	serve := func(path string) http.Header {
+		nonce = ""
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Header()
+	}
+
+	t.Run("api preset", func(t *testing.T) {
+		h := serve("/api/items")
+		assert.Equal(t, "max-age=63072000; includeSubDomains", h.Get("Strict-Transport-Security"))
+		assert.Equal(t, "default-src 'none'; frame-ancestors 'none'", h.Get("Content-Security-Policy"))
+		assert.Equal(t, "nosniff", h.Get("X-Content-Type-Options"))
+		assert.Equal(t, "no-referrer", h.Get("Referrer-Policy"))
+		assert.Equal(t, "same-origin", h.Get("Cross-Origin-Opener-Policy"))
+		assert.Equal(t, "same-origin", h.Get("Cross-Origin-Resource-Policy"))
+		assert.NotEmpty(t, h.Get("Permissions-Policy"))
+		assert.Equal(t, DefaultRobotsTag, h.Get("X-Robots-Tag"))
+		assert.Empty(t, nonce)
+	})
+
+	t.Run("html route override with nonce", func(t *testing.T) {
+		h := serve("/app/dashboard")
+		require.NotEmpty(t, nonce)
+		csp := h.Get("Content-Security-Policy")
+		assert.Contains(t, csp, "script-src 'self' 'nonce-"+nonce+"'")
+		assert.NotContains(t, csp, CSPNoncePlaceholder)
+		assert.Empty(t, h.Get("X-Robots-Tag"))
+
+		first := nonce
+		serve("/app/dashboard")
+		assert.NotEqual(t, first, nonce, "nonce is generated per request")
+	})
+}
+
+func TestSecurityHeadersReportOnly(t *testing.T) {
+	handler := NewSecurityHeaders(SecurityHeadersConfig{
+		ContentSecurityPolicy: "default-src 'self'",
+		CSPReportOnly:         true,
+		HSTSMaxAge:            0,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "default-src 'self'", rec.Header().Get("Content-Security-Policy-Report-Only"))
+	assert.Empty(t, rec.Header().Get("Content-Security-Policy"))
+	assert.Empty(t, rec.Header().Get("Strict-Transport-Security"))
+}
+
+func TestNewRobotTag(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewRobotTag()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "noindex, nofollow, noarchive", rec.Header().Get("X-Robots-Tag"))
+	assert.Len(t, rec.Header(), 1)
+}
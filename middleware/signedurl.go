@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+// NewSignedURLVerifier は auth.URLSigner で署名された URL を検証する Chi 用ミドルウェアを返します。
+//
+// 署名と有効期限の検証に成功した場合、URL に含まれるテナント ID を KeyTenantID として、
+// URL の情報 (*auth.SignedURLClaims) を KeySignedURL としてコンテキストに保存します。
+// これにより NewTenantResolution を通した場合と同様に、後続の RLS などが動作します。
+// URL がユーザーに紐づいている場合は、同じテナントの同じユーザーとして認証済みのリクエストのみ許可します。
+// このミドルウェアは Chi の層で動作し、Huma の NewAuthProviderWithConfig より先に実行されるため、
+// ユーザーに紐づく URL を扱うルートでは、NewAuthHandler をこのミドルウェアより前に登録してください。
+//
+//	r.With(middleware.NewAuthHandler(authCfg), middleware.NewSignedURLVerifier(signer)).Get("/files/*", download)
+//
+// ブラウザーのリンク (<a href> やメール内のリンク) は Authorization ヘッダーを送信しないため、ユーザーに紐づく URL は検証できません。
+// そのような URL は UserID を指定せずに発行してください (テナントと有効期限のみで保護されます)。
+func NewSignedURLVerifier(signer *auth.URLSigner) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, err := signer.Verify(r.URL)
+			if err != nil {
+				if errors.Is(err, auth.ErrSignedURLExpired) {
+					writeInvalidJSON(w, r, http.StatusGone, "The download link has expired", nil)
+					return
+				}
+				writeInvalidJSON(w, r, http.StatusForbidden, "Invalid download link", nil)
+				return
+			}
+
+			// ユーザーに紐づく URL は、未認証または別のユーザーによる利用を拒否
+			if claims.UserID != 0 {
+				user, ok := ClaimsFrom(r.Context())
+				if !ok {
+					writeInvalidJSON(w, r, http.StatusUnauthorized, "Authentication is required", nil)
+					return
+				}
+				if user.UserID != claims.UserID || user.TenantID != claims.TenantID {
+					writeInvalidJSON(w, r, http.StatusForbidden, "The download link is not valid for this user", nil)
+					return
+				}
+			}
+
+			// ホストなどから解決済みのテナントと異なる場合は拒否
+			if tenantID, ok := TenantFrom(r.Context()); ok && tenantID != claims.TenantID {
+				writeInvalidJSON(w, r, http.StatusForbidden, "The download link is not valid for this tenant", nil)
+				return
+			}
+
+			ctx := WithTenant(r.Context(), claims.TenantID)
+			ctx = WithSignedURL(ctx, claims)
+			setAccessLogTenant(ctx, claims.TenantID)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
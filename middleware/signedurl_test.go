@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+func TestSignedURLVerifier(t *testing.T) {
+	key, err := auth.NewURLSigningKey("k1", auth.GenerateRandomKey())
+	require.NoError(t, err)
+	signer, err := auth.NewURLSigner(key)
+	require.NoError(t, err)
+
+	handler := NewSignedURLVerifier(signer)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantID, _ := TenantFrom(r.Context())
+		w.Write([]byte(tenantID))
+	}))
+	serve := func(target string, claims *auth.Claims) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if claims != nil {
+			req = req.WithContext(WithClaims(req.Context(), claims))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("url without user binding is allowed anonymously", func(t *testing.T) {
+		signed, err := signer.Sign("/reports/1.pdf", "tenant-a", 0, time.Minute)
+		require.NoError(t, err)
+
+		rec := serve(signed, nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "tenant-a", rec.Body.String())
+	})
+
+	t.Run("url bound to user requires the same user", func(t *testing.T) {
+		signed, err := signer.Sign("/reports/1.pdf", "tenant-a", 42, time.Minute)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusUnauthorized, serve(signed, nil).Code)
+		assert.Equal(t, http.StatusForbidden, serve(signed, &auth.Claims{UserID: 7, TenantID: "tenant-a"}).Code)
+		assert.Equal(t, http.StatusForbidden, serve(signed, &auth.Claims{UserID: 42, TenantID: "tenant-b"}).Code, "same user id in another tenant")
+		assert.Equal(t, http.StatusOK, serve(signed, &auth.Claims{UserID: 42, TenantID: "tenant-a"}).Code)
+	})
+
+	t.Run("chi auth handler authenticates user bound urls", func(t *testing.T) {
+		maker, err := auth.NewTokenMaker(auth.GenerateRandomKey())
+		require.NoError(t, err)
+		token, err := maker.CreateToken(42, "tenant-a", 1, time.Minute)
+		require.NoError(t, err)
+		chain := NewAuthHandler(AuthConfig{Maker: maker, Mode: AuthModeOptional})(handler)
+
+		signed, err := signer.Sign("/reports/1.pdf", "tenant-a", 42, time.Minute)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, signed, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		chain.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		req = httptest.NewRequest(http.MethodGet, signed, nil)
+		req.Header.Set("Authorization", "Bearer broken")
+		rec = httptest.NewRecorder()
+		chain.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Contains(t, rec.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+	})
+
+	t.Run("invalid signature is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, serve("/reports/1.pdf", nil).Code)
+	})
+}
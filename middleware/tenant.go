@@ -2,53 +2,348 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/newmo-oss/ergo"
+
+	"github.com/golaboratory/gloudia/auth"
 )
 
+// ErrTenantNotFound はドメイン名に対応するテナントが存在しない場合に、Dispatcher が返すことが期待されるエラーです。
+// pgx.ErrNoRows も同様に扱われます。
+var ErrTenantNotFound = ergo.NewSentinel("tenant not found")
+
+// Dispatcher はドメイン名 (サブドメインのラベル、カスタムドメインなど) からテナント ID を検索するインターフェースです。
 type Dispatcher interface {
 	FindTenantIDByDomainName(ctx context.Context, domainName string) (string, error)
 }
 
+// TenantHint は TenantStrategy がリクエストから取り出したテナントの手がかりです。
+// DomainName と TenantID のいずれか一方が設定されます。
+type TenantHint struct {
+	// DomainName は Dispatcher で検索するドメイン名です。
+	DomainName string
+	// TenantID は検索が不要な、テナント ID そのものです (ヘッダーやトークンから取り出した場合)。
+	TenantID string
+}
+
+// TenantStrategy はリクエストからテナントの手がかりを取り出す関数です。host はポート番号を除いたホスト名です。
+// 該当しない場合は false を返し、次の TenantStrategy が試されます。
+type TenantStrategy func(r *http.Request, host string) (TenantHint, bool)
+
+// TenantFromSubdomain はホスト名の先頭のラベル (例: tenant-a.example.com の "tenant-a") をドメイン名とします。
+// baseDomains を指定した場合、そのいずれかのサブドメインであるホストのみを対象とします。
+func TenantFromSubdomain(baseDomains ...string) TenantStrategy {
+	return func(r *http.Request, host string) (TenantHint, bool) {
+		label, rest, ok := strings.Cut(host, ".")
+		if label == "" {
+			return TenantHint{}, false
+		}
+		if len(baseDomains) == 0 {
+			return TenantHint{DomainName: label}, true
+		}
+		for _, base := range baseDomains {
+			if ok && strings.EqualFold(rest, base) {
+				return TenantHint{DomainName: label}, true
+			}
+		}
+		return TenantHint{}, false
+	}
+}
+
+// TenantFromHost はホスト名全体 (例: reserve.tenant-a.co.jp) をドメイン名とします。テナント独自のカスタムドメインで使用します。
+func TenantFromHost() TenantStrategy {
+	return func(r *http.Request, host string) (TenantHint, bool) {
+		return TenantHint{DomainName: host}, host != ""
+	}
+}
+
+// TenantFromHeader は指定されたヘッダー (空の場合は "X-Tenant-ID") の値をテナント ID とします。
+// ヘッダーの値は Dispatcher で検証せずにそのまま使用します。ヘッダーはクライアントが自由に指定できるため、
+// 社内のサービス間通信など信頼できる経路でのみ使用してください。
+// TenantResolutionConfig.Strict を指定しても、他の Strategy でテナントを特定できなかった場合 (ホスト名が一致しない場合など) は
+// ヘッダーの値がそのまま使用されるため、クライアントからのリクエストに対する保護にはなりません。
+func TenantFromHeader(name string) TenantStrategy {
+	if name == "" {
+		name = "X-Tenant-ID"
+	}
+	return func(r *http.Request, host string) (TenantHint, bool) {
+		tenantID := strings.TrimSpace(r.Header.Get(name))
+		return TenantHint{TenantID: tenantID}, tenantID != ""
+	}
+}
+
+// TenantFromPathPrefix はパスの prefix に続くセグメント (例: prefix が "/t/" の場合、/t/tenant-a/items の "tenant-a") をドメイン名とします。
+func TenantFromPathPrefix(prefix string) TenantStrategy {
+	return func(r *http.Request, host string) (TenantHint, bool) {
+		rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok {
+			return TenantHint{}, false
+		}
+		segment, _, _ := strings.Cut(rest, "/")
+		return TenantHint{DomainName: segment}, segment != ""
+	}
+}
+
+// TenantFromToken は Authorization ヘッダーの Bearer トークンに含まれるテナント ID を使用します。
+// 検証に失敗したトークンは対象外とします (認証自体は後続の NewAuthProvider で行われます)。
+func TenantFromToken(maker *auth.TokenMaker) TenantStrategy {
+	return func(r *http.Request, host string) (TenantHint, bool) {
+		scheme, token, ok := strings.Cut(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+		if !ok || !strings.EqualFold(scheme, "bearer") {
+			return TenantHint{}, false
+		}
+		claims, err := maker.VerifyToken(strings.TrimSpace(token))
+		if err != nil || claims.TenantID == "" {
+			return TenantHint{}, false
+		}
+		return TenantHint{TenantID: claims.TenantID}, true
+	}
+}
+
+// TenantResolutionConfig は NewTenantResolutionWithConfig の設定構造体です。
+type TenantResolutionConfig struct {
+	// Dispatcher はドメイン名からテナント ID を検索します。
+	Dispatcher Dispatcher
+	// Strategies はテナントを特定する方法です。先頭から順に試し、最初に特定できたテナントを使用します。
+	// nil の場合は TenantFromSubdomain() のみを使用します。
+	Strategies []TenantStrategy
+	// TrustedProxies は X-Forwarded-Host を信頼するプロキシです。
+	// 直接の接続元がこれに含まれない場合、X-Forwarded-Host は無視して Host ヘッダーを使用します。
+	// 空の場合は常に Host ヘッダーを使用するため、X-Forwarded-Host でテナントを判定するリバースプロキシの背後では、
+	// プロキシのアドレスを指定してください。
+	TrustedProxies TrustedProxies
+	// TrustForwardedHost が true の場合、接続元にかかわらず X-Forwarded-Host を信頼します (以前の NewTenantResolution の動作)。
+	// X-Forwarded-Host はクライアントが自由に指定できるため、プロキシが必ず上書きし、アプリケーションに直接接続できない
+	// 構成でのみ使用してください。可能であれば TrustedProxies を指定してください。
+	TrustForwardedHost bool
+	// Strict が true の場合、すべての Strategies を評価し、特定できたテナントが一致しない場合は 403 を返します。
+	// TenantFromToken と組み合わせることで、ホストのテナントと異なるテナントのトークンを拒否できます。
+	Strict bool
+	// Optional が true の場合、テナントを特定できなくても処理を継続します。
+	Optional bool
+	// CacheTTL は検索結果をキャッシュする期間です。0 の場合は 5 分、負の値の場合はキャッシュしません。
+	CacheTTL time.Duration
+	// NegativeCacheTTL はテナントが存在しなかった結果をキャッシュする期間です。0 の場合は 30 秒、負の値の場合はキャッシュしません。
+	NegativeCacheTTL time.Duration
+	// CacheSize はキャッシュするドメイン名の最大数です。0 の場合は 10000 です。
+	CacheSize int
+}
+
+// NewTenantResolution はホスト名のサブドメインからテナントを特定する Chi ミドルウェアを生成します。
+// 検索結果は既定の設定でキャッシュされます。詳細な設定は NewTenantResolutionWithConfig を使用してください。
+//
+// TrustedProxies を指定しないため、X-Forwarded-Host は使用せず常に Host ヘッダーからテナントを特定します。
+// 以前は X-Forwarded-Host を常に優先していたため、X-Forwarded-Host でテナントを判定していた構成では、
+// プロキシが元の Host ヘッダーを引き継ぐよう設定する (Nginx の proxy_set_header Host $host など) か、
+// NewTenantResolutionWithConfig で TrustedProxies (または以前の動作とする TrustForwardedHost) を指定してください。
+// 無視した X-Forwarded-Host を受け取った場合は、初回のみ警告を出力します。
 func NewTenantResolution(tenantConv Dispatcher) func(http.Handler) http.Handler {
+	return NewTenantResolutionWithConfig(TenantResolutionConfig{Dispatcher: tenantConv})
+}
+
+// NewTenantResolutionWithConfig はリクエストからテナントを特定し、テナント ID とドメイン名をコンテキストに保存する Chi ミドルウェアを生成します。
+//
+// テナントを特定できない場合は 400、Strict モードでテナントが一致しない場合は 403、
+// Dispatcher の検索に失敗した場合は 500 を、いずれも api.UnifiedResponse 形式で返します。
+func NewTenantResolutionWithConfig(cfg TenantResolutionConfig) func(http.Handler) http.Handler {
+	if len(cfg.Strategies) == 0 {
+		cfg.Strategies = []TenantStrategy{TenantFromSubdomain()}
+	}
+	resolver := newTenantResolver(cfg)
+	var warnIgnoredForwardedHost sync.Once
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// A. ホスト名の取得
-			// Nginxが付与した X-Forwarded-Host を優先し、なければ Host を使用
-			host := r.Header.Get("X-Forwarded-Host")
-			if host == "" {
-				host = r.Host
+			host, ignored := requestHost(r, cfg.TrustedProxies, cfg.TrustForwardedHost)
+			if ignored && len(cfg.TrustedProxies) == 0 {
+				// TrustedProxies の指定漏れで X-Forwarded-Host が使われていないことに気付けるよう、初回のみ警告する
+				warnIgnoredForwardedHost.Do(func() {
+					slog.WarnContext(r.Context(), "Ignoring X-Forwarded-Host for tenant resolution; set TrustedProxies or TrustForwardedHost if requests come through a reverse proxy",
+						"host", host)
+				})
 			}
 
-			// ポート番号が含まれる場合は除去 (例: localhost:8888 -> localhost)
-			if strings.Contains(host, ":") {
-				host = strings.Split(host, ":")[0]
-			}
+			// B. テナントの特定
+			var (
+				tenantID   string
+				domainName string
+				matched    bool
+			)
+			for _, strategy := range cfg.Strategies {
+				hint, ok := strategy(r, host)
+				if !ok {
+					continue
+				}
+				matched = true
 
-			// B. テナントの特定ロジック
-			// 例: tenant-a.example.com -> "tenant-a" を抽出
-			parts := strings.Split(host, ".")
-			tenantName := parts[0]
+				id, err := resolver.resolve(r.Context(), hint)
+				if errors.Is(err, ErrTenantNotFound) {
+					continue
+				}
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to resolve tenant", "domain_name", hint.DomainName, "error", err)
+					writeInvalidJSON(w, r, http.StatusInternalServerError, "Failed to resolve tenant", nil)
+					return
+				}
+
+				if tenantID == "" {
+					tenantID, domainName = id, hint.DomainName
+					if !cfg.Strict {
+						break
+					}
+					continue
+				}
+				if id != tenantID {
+					slog.WarnContext(r.Context(), "Tenant mismatch", "host", host, "tenant_id", tenantID, "other_tenant_id", id)
+					writeInvalidJSON(w, r, http.StatusForbidden, "Tenant does not match", nil)
+					return
+				}
+			}
 
-			// ローカル開発用などでIP直打ちの場合のフォールバックなどを適宜追加
-			// if tenantName == "localhost" || tenantName == "127" {
-			// 	tenantName = "default-tenant"
-			// }
+			if tenantID == "" {
+				switch {
+				case matched:
+					writeInvalidJSON(w, r, http.StatusBadRequest, "Unknown tenant", nil)
+				case cfg.Optional:
+					next.ServeHTTP(w, r)
+				default:
+					writeInvalidJSON(w, r, http.StatusBadRequest, "Tenant could not be determined", nil)
+				}
+				return
+			}
 
-			slog.Debug("Resolved tenant name: %s from host: %s", tenantName, host)
+			slog.DebugContext(r.Context(), "Resolved tenant", "tenant_id", tenantID, "domain_name", domainName, "host", host)
 
 			// C. Contextにテナント情報を保存
-			tenantID, err := tenantConv.FindTenantIDByDomainName(r.Context(), tenantName)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
+			ctx := WithTenant(r.Context(), tenantID)
+			if domainName != "" {
+				ctx = WithTenantDomainName(ctx, domainName)
 			}
-			ctx := context.WithValue(r.Context(), KeyTenantDomainName, tenantName)
-			ctx = context.WithValue(ctx, KeyTenantID, tenantID)
+			setAccessLogTenant(ctx, tenantID)
 
 			// 次の処理へContextを引き継いでリクエストを回す
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// requestHost はリクエストのホスト名をポート番号を除いて小文字で返します。
+// 直接の接続元が信頼するプロキシの場合 (trustForwarded が true の場合は常に)、Nginx などが付与した X-Forwarded-Host を優先します。
+// X-Forwarded-Host を信頼せずに無視した場合は ignored が true となります。
+func requestHost(r *http.Request, proxies TrustedProxies, trustForwarded bool) (host string, ignored bool) {
+	host = r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		if remote, ok := parseIP(r.RemoteAddr); trustForwarded || (ok && proxies.trusted(remote)) {
+			host, _, _ = strings.Cut(forwarded, ",")
+		} else {
+			ignored = true
+		}
+	}
+	host = strings.TrimSpace(host)
+	// ポート番号が含まれる場合は除去 (例: localhost:8888 -> localhost)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, ".")), ignored
+}
+
+// tenantResolver は Dispatcher の検索結果を TTL 付きでキャッシュします。
+// 存在しないドメイン名の結果もキャッシュ (ネガティブキャッシュ) するため、不正なホスト名による DB への負荷を抑えられます。
+type tenantResolver struct {
+	dispatcher  Dispatcher
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]tenantCacheEntry
+}
+
+type tenantCacheEntry struct {
+	tenantID  string // 空の場合はテナントが存在しない
+	expiresAt time.Time
+}
+
+func newTenantResolver(cfg TenantResolutionConfig) *tenantResolver {
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = 5 * time.Minute
+	}
+	if cfg.NegativeCacheTTL == 0 {
+		cfg.NegativeCacheTTL = 30 * time.Second
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = 10000
+	}
+	return &tenantResolver{
+		dispatcher:  cfg.Dispatcher,
+		ttl:         cfg.CacheTTL,
+		negativeTTL: cfg.NegativeCacheTTL,
+		size:        cfg.CacheSize,
+		now:         time.Now,
+		entries:     make(map[string]tenantCacheEntry),
+	}
+}
+
+// resolve は TenantHint からテナント ID を返します。テナントが存在しない場合は ErrTenantNotFound を返します。
+func (t *tenantResolver) resolve(ctx context.Context, hint TenantHint) (string, error) {
+	if hint.TenantID != "" {
+		return hint.TenantID, nil
+	}
+	key := strings.ToLower(hint.DomainName)
+
+	now := t.now()
+	t.mu.Lock()
+	entry, ok := t.entries[key]
+	t.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		if entry.tenantID == "" {
+			return "", ErrTenantNotFound
+		}
+		return entry.tenantID, nil
+	}
+
+	tenantID, err := t.dispatcher.FindTenantIDByDomainName(ctx, hint.DomainName)
+	if errors.Is(err, ErrTenantNotFound) || errors.Is(err, pgx.ErrNoRows) || (err == nil && tenantID == "") {
+		t.store(key, "", t.negativeTTL)
+		return "", ErrTenantNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	t.store(key, tenantID, t.ttl)
+	return tenantID, nil
+}
+
+func (t *tenantResolver) store(key string, tenantID string, ttl time.Duration) {
+	if ttl < 0 {
+		return
+	}
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.entries[key]; !ok && len(t.entries) >= t.size {
+		// 上限に達した場合は期限切れのエントリを削除し、それでも空きがなければ任意の 1 件を削除する
+		for k, e := range t.entries {
+			if !now.Before(e.expiresAt) {
+				delete(t.entries, k)
+			}
+		}
+		for k := range t.entries {
+			if len(t.entries) < t.size {
+				break
+			}
+			delete(t.entries, k)
+		}
+	}
+	t.entries[key] = tenantCacheEntry{tenantID: tenantID, expiresAt: now.Add(ttl)}
+}
@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/auth"
+)
+
+type fakeDispatcher struct {
+	tenants map[string]string
+	calls   int
+	err     error
+}
+
+func (d *fakeDispatcher) FindTenantIDByDomainName(_ context.Context, domainName string) (string, error) {
+	d.calls++
+	if d.err != nil {
+		return "", d.err
+	}
+	if id, ok := d.tenants[domainName]; ok {
+		return id, nil
+	}
+	return "", ErrTenantNotFound
+}
+
+func serveTenant(t *testing.T, handler http.Handler, setup func(r *http.Request)) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	setup(r)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		return rec, ""
+	}
+	return rec, rec.Body.String()
+}
+
+func tenantEcho() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantID, _ := TenantFrom(r.Context())
+		w.Write([]byte(tenantID))
+	})
+}
+
+func TestNewTenantResolution(t *testing.T) {
+	dispatcher := &fakeDispatcher{tenants: map[string]string{"shrine": "tenant-1", "reserve.shrine.co.jp": "tenant-2"}}
+	handler := NewTenantResolutionWithConfig(TenantResolutionConfig{
+		Dispatcher:     dispatcher,
+		Strategies:     []TenantStrategy{TenantFromSubdomain("example.com"), TenantFromHost(), TenantFromPathPrefix("/t/")},
+		TrustedProxies: MustParseTrustedProxies("10.0.0.0/8"),
+	})(tenantEcho())
+
+	t.Run("subdomain", func(t *testing.T) {
+		rec, tenantID := serveTenant(t, handler, func(r *http.Request) { r.Host = "shrine.example.com:8888" })
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "tenant-1", tenantID)
+	})
+
+	t.Run("custom domain", func(t *testing.T) {
+		_, tenantID := serveTenant(t, handler, func(r *http.Request) { r.Host = "Reserve.Shrine.co.jp" })
+		assert.Equal(t, "tenant-2", tenantID)
+	})
+
+	t.Run("path prefix", func(t *testing.T) {
+		_, tenantID := serveTenant(t, handler, func(r *http.Request) {
+			r.Host = "api.internal"
+			r.URL.Path = "/t/shrine/items"
+		})
+		assert.Equal(t, "tenant-1", tenantID)
+	})
+
+	t.Run("forwarded host only from trusted proxy", func(t *testing.T) {
+		_, tenantID := serveTenant(t, handler, func(r *http.Request) {
+			r.RemoteAddr = "10.0.0.2:5000"
+			r.Host = "backend:8080"
+			r.Header.Set("X-Forwarded-Host", "shrine.example.com")
+		})
+		assert.Equal(t, "tenant-1", tenantID)
+
+		rec, _ := serveTenant(t, handler, func(r *http.Request) {
+			r.Host = "unknown.example.com"
+			r.Header.Set("X-Forwarded-Host", "shrine.example.com")
+		})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"isInvalid":true`)
+	})
+}
+
+func TestNewTenantResolutionForwardedHost(t *testing.T) {
+	dispatcher := &fakeDispatcher{tenants: map[string]string{"shrine": "tenant-1", "backend": "tenant-backend"}}
+	forwarded := func(r *http.Request) {
+		r.Host = "backend.internal:8080"
+		r.Header.Set("X-Forwarded-Host", "shrine.example.com")
+	}
+
+	// NewTenantResolution は X-Forwarded-Host を信頼せず、Host ヘッダーを使用する
+	_, tenantID := serveTenant(t, NewTenantResolution(dispatcher)(tenantEcho()), forwarded)
+	assert.Equal(t, "tenant-backend", tenantID)
+
+	// 以前の動作は TrustForwardedHost で明示的に有効にする
+	legacy := NewTenantResolutionWithConfig(TenantResolutionConfig{Dispatcher: dispatcher, TrustForwardedHost: true})(tenantEcho())
+	_, tenantID = serveTenant(t, legacy, forwarded)
+	assert.Equal(t, "tenant-1", tenantID)
+	_, tenantID = serveTenant(t, legacy, func(r *http.Request) { r.Host = "shrine.example.com" })
+	assert.Equal(t, "tenant-1", tenantID)
+}
+
+func TestTenantResolutionCache(t *testing.T) {
+	dispatcher := &fakeDispatcher{tenants: map[string]string{"shrine": "tenant-1"}}
+	cfg := TenantResolutionConfig{Dispatcher: dispatcher, CacheTTL: time.Minute, NegativeCacheTTL: time.Second}
+	resolver := newTenantResolver(cfg)
+	now := time.Unix(1_700_000_000, 0)
+	resolver.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for range 3 {
+		id, err := resolver.resolve(ctx, TenantHint{DomainName: "shrine"})
+		require.NoError(t, err)
+		assert.Equal(t, "tenant-1", id)
+	}
+	assert.Equal(t, 1, dispatcher.calls)
+
+	// ネガティブキャッシュ
+	for range 3 {
+		_, err := resolver.resolve(ctx, TenantHint{DomainName: "unknown"})
+		assert.ErrorIs(t, err, ErrTenantNotFound)
+	}
+	assert.Equal(t, 2, dispatcher.calls)
+
+	// 期限切れ後は再検索する
+	now = now.Add(2 * time.Second)
+	_, _ = resolver.resolve(ctx, TenantHint{DomainName: "unknown"})
+	_, _ = resolver.resolve(ctx, TenantHint{DomainName: "shrine"})
+	assert.Equal(t, 3, dispatcher.calls)
+
+	// 一時的なエラーはキャッシュしない
+	dispatcher.err = errors.New("connection refused")
+	now = now.Add(time.Hour)
+	_, err := resolver.resolve(ctx, TenantHint{DomainName: "shrine"})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrTenantNotFound)
+	_, _ = resolver.resolve(ctx, TenantHint{DomainName: "shrine"})
+	assert.Equal(t, 5, dispatcher.calls)
+}
+
+func TestTenantResolutionStrict(t *testing.T) {
+	maker, err := auth.NewTokenMaker(auth.GenerateRandomKey())
+	require.NoError(t, err)
+	dispatcher := &fakeDispatcher{tenants: map[string]string{"shrine": "tenant-1"}}
+	handler := NewTenantResolutionWithConfig(TenantResolutionConfig{
+		Dispatcher: dispatcher,
+		Strategies: []TenantStrategy{TenantFromSubdomain(), TenantFromToken(maker)},
+		Strict:     true,
+	})(tenantEcho())
+
+	ownToken, err := maker.CreateToken(1, "tenant-1", 1, time.Hour)
+	require.NoError(t, err)
+	otherToken, err := maker.CreateToken(2, "tenant-9", 1, time.Hour)
+	require.NoError(t, err)
+
+	_, tenantID := serveTenant(t, handler, func(r *http.Request) {
+		r.Host = "shrine.example.com"
+		r.Header.Set("Authorization", "Bearer "+ownToken)
+	})
+	assert.Equal(t, "tenant-1", tenantID)
+
+	rec, _ := serveTenant(t, handler, func(r *http.Request) {
+		r.Host = "shrine.example.com"
+		r.Header.Set("Authorization", "Bearer "+otherToken)
+	})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestTenantResolutionOptional(t *testing.T) {
+	handler := NewTenantResolutionWithConfig(TenantResolutionConfig{
+		Dispatcher: &fakeDispatcher{},
+		Strategies: []TenantStrategy{TenantFromHeader("")},
+		Optional:   true,
+	})(tenantEcho())
+
+	rec, tenantID := serveTenant(t, handler, func(r *http.Request) {})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, tenantID)
+
+	_, tenantID = serveTenant(t, handler, func(r *http.Request) { r.Header.Set("X-Tenant-ID", "tenant-3") })
+	assert.Equal(t, "tenant-3", tenantID)
+}
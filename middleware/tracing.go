@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/danielgtaylor/huma/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/golaboratory/gloudia/correlation"
+	"github.com/golaboratory/gloudia/tracing"
+)
+
+// humaHeaderCarrier は Huma のリクエストヘッダーからトレースコンテキストを読み取るための TextMapCarrier です。
+type humaHeaderCarrier struct {
+	ctx huma.Context
+}
+
+func (c humaHeaderCarrier) Get(key string) string { return c.ctx.Header(key) }
+func (c humaHeaderCarrier) Set(string, string)    {}
+func (c humaHeaderCarrier) Keys() []string        { return nil }
+
+// NewTracing は Huma のオペレーションごとにスパンを作成するミドルウェアを生成します。
+//
+// リクエストヘッダー (traceparent) のトレースコンテキストを引き継ぎ、スパン名は "<METHOD> <パスのテンプレート>" となります。
+// テナントとユーザーの属性は、下流の認証・テナント解決ミドルウェアで判明したものを付与します。
+//
+// NewRequestID を併用している場合は、コンテキストとレスポンスヘッダーの traceparent をこのスパンに置き換えるため、
+// アクセスログやジョブ、メールのトレース ID はスパンのトレース ID と一致します。
+func NewTracing(t *tracing.Tracer) func(huma.Context, func(huma.Context)) {
+	return func(ctx huma.Context, next func(huma.Context)) {
+		route := ""
+		if op := ctx.Operation(); op != nil {
+			route = op.Path
+		}
+
+		parent := t.Extract(ctx.Context(), humaHeaderCarrier{ctx: ctx})
+		spanCtx, span := t.Start(parent, ctx.Method()+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", ctx.Method()),
+				attribute.String("http.route", route),
+			),
+		)
+		defer span.End()
+
+		if sc := span.SpanContext(); sc.IsValid() {
+			if tp := correlation.FromSpanContext(sc); correlation.SetTraceParent(spanCtx, tp) {
+				ctx.SetHeader(correlation.HeaderTraceParent, tp.String())
+			}
+		}
+
+		ctx = huma.WithContext(ctx, spanCtx)
+		ctx, state := withAccessLogState(ctx)
+
+		next(ctx)
+
+		status := ctx.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+		if tenantID := state.tenant(ctx.Context()); tenantID != "" {
+			span.SetAttributes(tracing.AttrTenantID.String(tenantID))
+		}
+		if state.claims != nil {
+			span.SetAttributes(tracing.AttrUserID.Int64(state.claims.UserID))
+		}
+	}
+}
+
+// TraceAttributes はスパンに付与するテナントとユーザーの属性をコンテキストから取得します。
+// tracing.Config の AttributesFromContext に指定できます。
+func TraceAttributes(ctx context.Context) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if tenantID := MetricsTenant(ctx); tenantID != "" {
+		attrs = append(attrs, tracing.AttrTenantID.String(tenantID))
+	}
+	if claims, ok := ClaimsFrom(ctx); ok {
+		attrs = append(attrs, tracing.AttrUserID.Int64(claims.UserID))
+	}
+	return attrs
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/golaboratory/gloudia/auth"
+	"github.com/golaboratory/gloudia/correlation"
+	"github.com/golaboratory/gloudia/tracing"
+)
+
+func TestNewTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := tracing.New(tracing.Config{TracerProvider: tp, AttributesFromContext: TraceAttributes})
+
+	maker, err := auth.NewTokenMaker(auth.GenerateRandomKey())
+	require.NoError(t, err)
+	token, err := maker.CreateToken(42, "t1", 1, time.Minute)
+	require.NoError(t, err)
+
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewTracing(tracer))
+	api.UseMiddleware(NewAuthProvider(maker))
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items/{id}"}, func(ctx context.Context, _ *struct {
+		ID string `path:"id"`
+	}) (*struct{}, error) {
+		// ハンドラー内のスパンはリクエストのスパンの子になる
+		_, span := tracer.Start(ctx, "handler")
+		span.End()
+		return nil, nil
+	})
+
+	resp := api.Get("/items/1",
+		"Authorization: Bearer "+token,
+		"traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Equal(t, http.StatusNoContent, resp.Code)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	handler, server := spans[0], spans[1]
+	assert.Equal(t, "GET /items/{id}", server.Name)
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceID().String())
+	assert.Contains(t, server.Attributes, attribute.String("gloudia.tenant_id", "t1"))
+	assert.Contains(t, server.Attributes, attribute.Int64("gloudia.user_id", 42))
+	assert.Contains(t, server.Attributes, attribute.Int("http.response.status_code", http.StatusNoContent))
+	assert.Equal(t, server.SpanContext.SpanID(), handler.Parent.SpanID())
+	assert.Contains(t, handler.Attributes, attribute.String("gloudia.tenant_id", "t1"))
+}
+
+func TestNewTracing_AlignsRequestTraceParent(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := tracing.New(tracing.Config{TracerProvider: tp})
+
+	var handlerTP correlation.TraceParent
+	_, api := humatest.New(t)
+	api.UseMiddleware(NewTracing(tracer))
+	huma.Register(api, huma.Operation{Method: http.MethodGet, Path: "/items"}, func(ctx context.Context, _ *struct{}) (*struct{}, error) {
+		handlerTP, _ = correlation.TraceParentFrom(ctx)
+		return nil, nil
+	})
+
+	// NewRequestID (Chi) の内側で Huma のオペレーションを実行し、外側のコンテキストからも参照する
+	var outerTP correlation.TraceParent
+	handler := NewRequestID()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.Adapter().ServeHTTP(w, r)
+		outerTP, _ = correlation.TraceParentFrom(r.Context())
+	}))
+
+	// traceparent なしのリクエストでも、ログ・レスポンスヘッダー・スパンのトレース ID が一致する
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/items", nil))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	traceID := spans[0].SpanContext.TraceID().String()
+	assert.Equal(t, traceID, handlerTP.TraceID)
+	assert.Equal(t, traceID, outerTP.TraceID)
+	header, ok := correlation.ParseTraceParent(rec.Header().Get("traceparent"))
+	require.True(t, ok)
+	assert.Equal(t, traceID, header.TraceID)
+	assert.Equal(t, spans[0].SpanContext.SpanID().String(), header.SpanID)
+}
@@ -0,0 +1,259 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TxPolicyMetadataKey は huma.Operation の Metadata で、オペレーションごとのトランザクションの設定 (TxPolicy) を指定するキーです。
+//
+//	huma.Operation{Metadata: map[string]any{middleware.TxPolicyMetadataKey: middleware.TxPolicy{ReadOnly: true}}}
+const TxPolicyMetadataKey = "txPolicy"
+
+// pgSerializationFailure はシリアライズ失敗を表す SQLSTATE です。
+const pgSerializationFailure = "40001"
+
+// TxPolicy は NewRLSProvider が開始するトランザクションの設定です。
+type TxPolicy struct {
+	// NoTransaction が true の場合、トランザクションを開始しません (ヘルスチェックや外部 API の中継など)。
+	// テナントが特定できている場合は、コンテキストへの保存のみ行います。
+	NoTransaction bool
+	// TenantOptional が true の場合、テナントが特定できなくても処理を継続します (ログイン前の画面など)。
+	// テナント ID の変数には空文字が設定されます。
+	TenantOptional bool
+	// ReadOnly が true の場合、読み取り専用のトランザクションを開始します。
+	ReadOnly bool
+	// IsoLevel はトランザクションの分離レベルです。空の場合はデータベースの既定値を使用します。
+	IsoLevel pgx.TxIsoLevel
+	// Deferrable が true の場合、DEFERRABLE を指定します (SERIALIZABLE かつ READ ONLY の場合のみ有効)。
+	Deferrable bool
+	// MaxRetries はシリアライズ失敗 (SQLSTATE 40001) 時にハンドラーを再実行する最大回数です。
+	// ハンドラー全体を再実行するため、冪等なオペレーション (外部へのメール送信などの副作用がないもの) にのみ指定してください。
+	MaxRetries int
+	// Streaming が true の場合、レスポンスをバッファリングせずにそのままクライアントへ送信します。
+	// 既定ではコミットの成否が確定するまでレスポンス全体をメモリに保持するため、
+	// SSE やファイルのダウンロードなどストリーミングするオペレーション、大きなレスポンスを返すオペレーションで指定します。
+	// コミットに失敗してもレスポンスは送信済みのためエラーを返せず (ログのみ出力)、MaxRetries も無効になります。
+	Streaming bool
+}
+
+// txOptions は pgx.TxOptions に変換します。
+func (p TxPolicy) txOptions() pgx.TxOptions {
+	opts := pgx.TxOptions{IsoLevel: p.IsoLevel}
+	if p.ReadOnly {
+		opts.AccessMode = pgx.ReadOnly
+	}
+	if p.Deferrable {
+		opts.DeferrableMode = pgx.Deferrable
+	}
+	return opts
+}
+
+// txPolicyFor はオペレーションの Metadata に指定された TxPolicy を返します。指定がない場合は既定の TxPolicy を返します。
+func txPolicyFor(ctx huma.Context, def TxPolicy) TxPolicy {
+	if op := ctx.Operation(); op != nil {
+		if p, ok := op.Metadata[TxPolicyMetadataKey].(TxPolicy); ok {
+			return p
+		}
+	}
+	return def
+}
+
+// isSerializationFailure はエラーがシリアライズ失敗 (SQLSTATE 40001) かどうかを判定します。
+func isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgSerializationFailure
+}
+
+// recordingTx はハンドラーに渡すトランザクションのラッパーで、実行中に発生したシリアライズ失敗を記録します。
+// ハンドラーがエラーを 500 などのレスポンスに変換した後でも、再実行すべきかを判定するために使用します。
+type recordingTx struct {
+	pgx.Tx
+	serializationFailure atomic.Bool
+}
+
+func (t *recordingTx) record(err error) error {
+	if isSerializationFailure(err) {
+		t.serializationFailure.Store(true)
+	}
+	return err
+}
+
+func (t *recordingTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	tag, err := t.Tx.Exec(ctx, sql, args...)
+	return tag, t.record(err)
+}
+
+func (t *recordingTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	rows, err := t.Tx.Query(ctx, sql, args...)
+	if err != nil {
+		return rows, t.record(err)
+	}
+	return &recordingRows{Rows: rows, tx: t}, nil
+}
+
+func (t *recordingTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &recordingRow{row: t.Tx.QueryRow(ctx, sql, args...), tx: t}
+}
+
+func (t *recordingTx) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	n, err := t.Tx.CopyFrom(ctx, tableName, columnNames, rowSrc)
+	return n, t.record(err)
+}
+
+func (t *recordingTx) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	return &recordingBatchResults{BatchResults: t.Tx.SendBatch(ctx, b), tx: t}
+}
+
+type recordingRows struct {
+	pgx.Rows
+	tx *recordingTx
+}
+
+func (r *recordingRows) Err() error {
+	return r.tx.record(r.Rows.Err())
+}
+
+type recordingRow struct {
+	row pgx.Row
+	tx  *recordingTx
+}
+
+func (r *recordingRow) Scan(dest ...any) error {
+	return r.tx.record(r.row.Scan(dest...))
+}
+
+type recordingBatchResults struct {
+	pgx.BatchResults
+	tx *recordingTx
+}
+
+func (b *recordingBatchResults) Exec() (pgconn.CommandTag, error) {
+	tag, err := b.BatchResults.Exec()
+	return tag, b.tx.record(err)
+}
+
+func (b *recordingBatchResults) Close() error {
+	return b.tx.record(b.BatchResults.Close())
+}
+
+// bufferedContext はレスポンスをバッファリングする huma.Context です。
+// コミットの成否が確定するまでクライアントへの送信を保留し、コミット失敗時や再実行時にレスポンスを破棄できるようにします。
+// レスポンスのボディはすべてメモリに保持されるため、ストリーミングするオペレーションでは TxPolicy.Streaming を指定し、
+// passthrough (バッファリングせずに元の huma.Context へ直接書き込む) で使用します。
+type bufferedContext struct {
+	humaContext
+	ctx         context.Context
+	body        []byte // 再実行のために保持したリクエストボディ (nil の場合は元のリーダーを使用)
+	passthrough bool
+	status      int
+	headers     []bufferedHeader
+	buf         bytes.Buffer
+}
+
+// humaContext は huma.Context の Context メソッドと名前が衝突しないよう、埋め込み用に別名を付けた型です。
+type humaContext huma.Context
+
+type bufferedHeader struct {
+	name, value string
+	append      bool
+}
+
+func newBufferedContext(ctx huma.Context, reqCtx context.Context, body []byte) *bufferedContext {
+	return &bufferedContext{humaContext: ctx, ctx: reqCtx, body: body}
+}
+
+func (c *bufferedContext) Context() context.Context { return c.ctx }
+
+func (c *bufferedContext) BodyReader() io.Reader {
+	if c.body != nil {
+		return bytes.NewReader(c.body)
+	}
+	return c.humaContext.BodyReader()
+}
+
+func (c *bufferedContext) SetStatus(code int) {
+	if c.passthrough {
+		c.humaContext.SetStatus(code)
+		return
+	}
+	c.status = code
+}
+
+func (c *bufferedContext) Status() int {
+	if c.passthrough || c.status == 0 {
+		return c.humaContext.Status()
+	}
+	return c.status
+}
+
+func (c *bufferedContext) SetHeader(name, value string) {
+	if c.passthrough {
+		c.humaContext.SetHeader(name, value)
+		return
+	}
+	c.headers = append(c.headers, bufferedHeader{name: name, value: value})
+}
+
+func (c *bufferedContext) AppendHeader(name, value string) {
+	if c.passthrough {
+		c.humaContext.AppendHeader(name, value)
+		return
+	}
+	c.headers = append(c.headers, bufferedHeader{name: name, value: value, append: true})
+}
+
+func (c *bufferedContext) BodyWriter() io.Writer {
+	if c.passthrough {
+		return c.humaContext.BodyWriter()
+	}
+	return &c.buf
+}
+
+// flush はバッファリングしたレスポンスを元の huma.Context に書き込みます。
+// passthrough の場合は書き込み済みのため何もしません。
+func (c *bufferedContext) flush() error {
+	if c.passthrough {
+		return nil
+	}
+	for _, h := range c.headers {
+		if h.append {
+			c.humaContext.AppendHeader(h.name, h.value)
+		} else {
+			c.humaContext.SetHeader(h.name, h.value)
+		}
+	}
+	if c.status != 0 {
+		c.humaContext.SetStatus(c.status)
+	}
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	_, err := c.humaContext.BodyWriter().Write(c.buf.Bytes())
+	return err
+}
+
+// readReplayableBody は再実行のためにリクエストボディを読み込みます。
+// オペレーションの上限 (MaxBodyBytes) を超える部分は読み込まず、上限の検証は Huma に任せます。
+func readReplayableBody(ctx huma.Context) ([]byte, error) {
+	limit := int64(1024 * 1024) // Huma の既定値
+	if op := ctx.Operation(); op != nil && op.MaxBodyBytes != 0 {
+		limit = op.MaxBodyBytes
+	}
+	reader := ctx.BodyReader()
+	if limit > 0 {
+		reader = io.LimitReader(reader, limit+1)
+	}
+	body, err := io.ReadAll(reader)
+	if body == nil {
+		body = []byte{}
+	}
+	return body, err
+}
@@ -1,6 +1,15 @@
 package mail
 
+import "context"
+
 // Sender はメール送信のインターフェースです
 type Sender interface {
 	SendEmail(subject string, content string, to []string, cc []string, bcc []string, attachFiles []string) error
 }
+
+// ContextSender はコンテキストを受け取ってメールを送信できる Sender です。
+// コンテキストのリクエスト ID などをメールヘッダーに引き継ぎます。
+type ContextSender interface {
+	Sender
+	SendEmailContext(ctx context.Context, subject string, content string, to []string, cc []string, bcc []string, attachFiles []string) error
+}
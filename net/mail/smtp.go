@@ -2,6 +2,7 @@ package mail
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
@@ -18,6 +19,12 @@ import (
 	"time"
 
 	"github.com/newmo-oss/ergo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/golaboratory/gloudia/correlation"
+	"github.com/golaboratory/gloudia/metrics"
+	"github.com/golaboratory/gloudia/tracing"
 )
 
 // SMTPSender は SMTP を使用してメールを送信する Sender インターフェースの実装です。
@@ -31,6 +38,8 @@ type SMTPSender struct {
 	useSSL   bool
 	insecure bool
 	timeout  time.Duration
+	metrics  *metrics.Metrics
+	tracer   *tracing.Tracer
 }
 
 // SMTPConfig は SMTP 送信者の詳細な設定を保持する構造体です。
@@ -52,6 +61,10 @@ type SMTPConfig struct {
 	Insecure bool
 	// Timeout は接続および各コマンドのタイムアウト時間です。指定しない場合は 10秒となります。
 	Timeout time.Duration
+	// Metrics は送信結果を記録するメトリクスです。nil の場合は記録しません。
+	Metrics *metrics.Metrics
+	// Tracer は送信のスパンを作成します。nil の場合はスパンを作成しません。
+	Tracer *tracing.Tracer
 }
 
 // NewSMTPSender は従来のパラメータ形式で SMTPSender を作成します。
@@ -85,6 +98,8 @@ func NewSMTPSenderWithConfig(cfg SMTPConfig) Sender {
 		useSSL:   cfg.UseSSL,
 		insecure: cfg.Insecure,
 		timeout:  cfg.Timeout,
+		metrics:  cfg.Metrics,
+		tracer:   cfg.Tracer,
 	}
 }
 
@@ -92,6 +107,24 @@ func NewSMTPSenderWithConfig(cfg SMTPConfig) Sender {
 // 宛先 (to, cc, bcc) や添付ファイル (attachFiles) をサポートし、
 // 日本語の件名や名前は RFC 2047 形式で自動的にエンコードされます。
 func (s *SMTPSender) SendEmail(subject string, content string, to []string, cc []string, bcc []string, attachFiles []string) error {
+	return s.SendEmailContext(context.Background(), subject, content, to, cc, bcc, attachFiles)
+}
+
+// SendEmailContext は SendEmail と同様にメールを送信します。
+// ctx にリクエスト ID や traceparent が含まれる場合は、X-Request-ID / Traceparent ヘッダーとしてメールに付与します。
+func (s *SMTPSender) SendEmailContext(ctx context.Context, subject string, content string, to []string, cc []string, bcc []string, attachFiles []string) (err error) {
+	ctx, span := s.tracer.Start(ctx, "mail.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("server.address", s.host),
+			attribute.Int("mail.recipients", len(to)+len(cc)+len(bcc)),
+		),
+	)
+	defer func() {
+		s.metrics.RecordMailSend(ctx, err)
+		tracing.End(span, err)
+	}()
+
 	to = s.filterEmpty(to)
 	cc = s.filterEmpty(cc)
 	bcc = s.filterEmpty(bcc)
@@ -101,7 +134,7 @@ func (s *SMTPSender) SendEmail(subject string, content string, to []string, cc [
 	}
 
 	// メッセージの構築
-	message, err := s.buildMessage(subject, content, to, cc, attachFiles)
+	message, err := s.buildMessage(subject, content, to, cc, attachFiles, correlationHeaders(ctx))
 	if err != nil {
 		return ergo.New("failed to build email", slog.String("error", err.Error()))
 	}
@@ -113,7 +146,8 @@ func (s *SMTPSender) SendEmail(subject string, content string, to []string, cc [
 }
 
 // buildMessage は MIME 形式のメッセージデータを構築します。
-func (s *SMTPSender) buildMessage(subject, content string, to, cc, attachFiles []string) ([]byte, error) {
+// headers には追加のヘッダー (ASCII のみ) を指定します。
+func (s *SMTPSender) buildMessage(subject, content string, to, cc, attachFiles []string, headers textproto.MIMEHeader) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 
 	// RFC 5322 ヘッダー
@@ -125,6 +159,11 @@ func (s *SMTPSender) buildMessage(subject, content string, to, cc, attachFiles [
 	// 件名の日本語エンコード
 	buf.WriteString(fmt.Sprintf("Subject: %s\r\n", mime.BEncoding.Encode("utf-8", subject)))
 	buf.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
+	for key, values := range headers {
+		for _, v := range values {
+			buf.WriteString(fmt.Sprintf("%s: %s\r\n", key, v))
+		}
+	}
 	buf.WriteString("MIME-Version: 1.0\r\n")
 
 	contentType := "text/plain"
@@ -278,6 +317,18 @@ func (s *SMTPSender) send(recipients []string, message []byte) error {
 	return nil
 }
 
+// correlationHeaders は ctx のリクエスト ID と traceparent をメールヘッダーとして返します。
+func correlationHeaders(ctx context.Context) textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	if id, ok := correlation.RequestIDFrom(ctx); ok {
+		h.Set(correlation.HeaderRequestID, id)
+	}
+	if tp, ok := correlation.TraceParentFrom(ctx); ok {
+		h.Set(correlation.HeaderTraceParent, tp.String())
+	}
+	return h
+}
+
 // isHTML はコンテンツが HTML かどうかを判定します。
 func (s *SMTPSender) isHTML(content string) bool {
 	c := strings.ToLower(strings.TrimSpace(content))
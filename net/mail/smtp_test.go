@@ -1,6 +1,7 @@
 package mail
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,6 +10,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/golaboratory/gloudia/correlation"
 )
 
 func TestEncodeAddress(t *testing.T) {
@@ -89,7 +92,7 @@ func TestBuildMessage(t *testing.T) {
 		to := []string{"to@example.com"}
 		cc := []string{"cc@example.com"}
 
-		msg, err := s.buildMessage(subject, content, to, cc, nil)
+		msg, err := s.buildMessage(subject, content, to, cc, nil, nil)
 		require.NoError(t, err)
 
 		smsg := string(msg)
@@ -100,12 +103,20 @@ func TestBuildMessage(t *testing.T) {
 		assert.Contains(t, smsg, "Content-Type: text/plain; charset=utf-8")
 	})
 
+	t.Run("Correlation headers", func(t *testing.T) {
+		ctx := correlation.WithRequestID(context.Background(), "req-123")
+		msg, err := s.buildMessage("Subject", "body", []string{"to@example.com"}, nil, nil, correlationHeaders(ctx))
+		require.NoError(t, err)
+
+		assert.Contains(t, string(msg), "X-Request-Id: req-123\r\n")
+	})
+
 	t.Run("HTML message", func(t *testing.T) {
 		subject := "HTML Test"
 		content := "<html><body><h1>Hello</h1></body></html>"
 		to := []string{"to@example.com"}
 
-		msg, err := s.buildMessage(subject, content, to, nil, nil)
+		msg, err := s.buildMessage(subject, content, to, nil, nil, nil)
 		require.NoError(t, err)
 
 		smsg := string(msg)
@@ -125,7 +136,7 @@ func TestBuildMessage(t *testing.T) {
 		content := "本文です。"
 		to := []string{"宛先 <to@example.com>"}
 
-		msg, err := s.buildMessage(subject, content, to, nil, []string{tmpFile})
+		msg, err := s.buildMessage(subject, content, to, nil, []string{tmpFile}, nil)
 		require.NoError(t, err)
 
 		smsg := string(msg)
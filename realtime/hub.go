@@ -1,10 +1,26 @@
 package realtime
 
 import (
+	"context"
 	"log/slog"
 	"sync"
+
+	"github.com/newmo-oss/ergo"
+
+	"github.com/golaboratory/gloudia/metrics"
+	"github.com/golaboratory/gloudia/middleware"
 )
 
+// ErrNoTenant は Publish のコンテキストからテナントを特定できない場合に返されます。
+var ErrNoTenant = ergo.NewSentinel("realtime: tenant is not found in context")
+
+// outbound はクライアントへ送信するメッセージです。tenantID が空の場合は全クライアントへ送信します。
+type outbound struct {
+	ctx      context.Context
+	tenantID string
+	message  []byte
+}
+
 // Hub はアクティブなクライアントの集合を管理し、メッセージをブロードキャストします。
 type Hub struct {
 	// 登録されたクライアントのマップ (boolはダミー値)
@@ -14,7 +30,7 @@ type Hub struct {
 	// inbound chan []byte
 
 	// クライアントへのブロードキャスト用チャネル
-	broadcast chan []byte
+	broadcast chan outbound
 
 	// クライアント登録用チャネル
 	register chan *Client
@@ -26,11 +42,15 @@ type Hub struct {
 	// 外部から安全にアクセスするためにRWMutexを持つパターンもある。
 	// ここではGo標準のHubパターンに従い、チャネルによる同期を行います)
 	mu sync.RWMutex
+
+	// Metrics は接続数や切断数を記録するメトリクスです。nil の場合は記録しません。
+	// Run を呼び出す前に設定してください。
+	Metrics *metrics.Metrics
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
+		broadcast:  make(chan outbound),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
@@ -43,24 +63,31 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			h.Metrics.HubConnected(client.tenantID)
 			slog.Debug("Client registered", "user_id", client.userID)
 
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
+				h.Metrics.HubDisconnected(client.tenantID)
 				slog.Debug("Client unregistered", "user_id", client.userID)
 			}
 
-		case message := <-h.broadcast:
-			// 全クライアントへメッセージ送信
+		case out := <-h.broadcast:
+			// 対象のクライアント (テナント指定がない場合は全クライアント) へメッセージ送信
 			for client := range h.clients {
+				if out.tenantID != "" && client.tenantID != out.tenantID {
+					continue
+				}
 				select {
-				case client.send <- message:
+				case client.send <- out.message:
 				default:
 					// 送信バッファがいっぱい、または切断されている場合
 					close(client.send)
 					delete(h.clients, client)
+					h.Metrics.HubDropped(client.tenantID)
+					slog.WarnContext(out.ctx, "Dropped slow client", "user_id", client.userID)
 				}
 			}
 		}
@@ -70,8 +97,24 @@ func (h *Hub) Run() {
 // BroadcastToAll は全接続クライアントにメッセージを送信します。
 // 外部パッケージ(Service等)から呼び出すためのメソッドです。
 func (h *Hub) BroadcastToAll(message []byte) {
-	h.broadcast <- message
+	h.broadcast <- outbound{ctx: context.Background(), message: message}
 }
 
-// 必要に応じて「特定のテナント(shrine_id)のみに送信」するメソッドを追加実装します。
-// その場合、Client構造体にshrine_idを持たせ、Hub側でフィルタリングします。
+// Publish は ctx のテナント (middleware.TenantFrom、または Claims のテナント) に接続している
+// クライアントにのみメッセージを送信します。テナントを特定できない場合は ErrNoTenant を返します。
+//
+// 送信はリクエストから切り離したコンテキスト (middleware.Detach) で行うため、
+// レスポンスを返した後のゴルーチンから呼び出しても、送信時のログにリクエスト ID などが引き継がれます。
+func (h *Hub) Publish(ctx context.Context, message []byte) error {
+	tenantID, ok := middleware.TenantFrom(ctx)
+	if !ok {
+		if claims, hasClaims := middleware.ClaimsFrom(ctx); hasClaims {
+			tenantID = claims.TenantID
+		}
+	}
+	if tenantID == "" {
+		return ErrNoTenant
+	}
+	h.broadcast <- outbound{ctx: middleware.Detach(ctx), tenantID: tenantID, message: message}
+	return nil
+}
@@ -1,6 +1,8 @@
 package realtime
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -8,6 +10,8 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/golaboratory/gloudia/middleware"
 )
 
 func TestHub_Run_Broadcast(t *testing.T) {
@@ -68,3 +72,62 @@ func TestHub_Run_Broadcast(t *testing.T) {
 
 	// 6. 複数クライアントのテストや登録解除のテストも追加可能
 }
+
+func TestHub_Publish_Tenant(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		client := &Client{
+			hub:      hub,
+			conn:     conn,
+			send:     make(chan []byte, 256),
+			tenantID: r.URL.Query().Get("tenant"),
+		}
+		hub.register <- client
+		go client.writePump()
+		go client.readPump()
+	}))
+	defer server.Close()
+
+	dial := func(tenantID string) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "?tenant=" + tenantID
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		return ws
+	}
+	wsA := dial("tenant-a")
+	defer wsA.Close()
+	wsB := dial("tenant-b")
+	defer wsB.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// テナントを特定できない場合は送信しない
+	if err := hub.Publish(context.Background(), []byte("x")); !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("expected ErrNoTenant, got %v", err)
+	}
+
+	// リクエストがキャンセルされた後でも送信できる
+	ctx, cancel := context.WithCancel(middleware.WithTenant(context.Background(), "tenant-a"))
+	cancel()
+	if err := hub.Publish(ctx, []byte("for a")); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	wsA.SetReadDeadline(time.Now().Add(time.Second))
+	if _, p, err := wsA.ReadMessage(); err != nil || string(p) != "for a" {
+		t.Fatalf("tenant-a expected message, got %q, %v", p, err)
+	}
+	wsB.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, p, err := wsB.ReadMessage(); err == nil {
+		t.Errorf("tenant-b must not receive message, got %q", p)
+	}
+}
@@ -6,12 +6,23 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/golaboratory/gloudia/metrics"
+	"github.com/golaboratory/gloudia/tracing"
 )
 
 // Client はGotenberg APIとの通信を行うクライアントです
 type Client struct {
 	BaseURL    string
 	HTTPClient *http.Client
+	// Metrics は変換のレイテンシを記録するメトリクスです。nil の場合は記録しません。
+	Metrics *metrics.Metrics
+	// Tracer は変換の HTTP 呼び出しのスパンを作成します。nil の場合はスパンを作成しません。
+	Tracer *tracing.Tracer
 }
 
 // NewClient は新しいGotenbergクライアントを作成します
@@ -24,7 +35,14 @@ func NewClient(baseURL string) *Client {
 
 // Convert はExcel(io.Reader)を受け取り、PDF(io.ReadCloser)を返します。
 // 呼び出し元は、返却されたReadCloserを必ずCloseする必要があります。
-func (c *Client) Convert(ctx context.Context, filename string, src io.Reader, opts *ConvertOptions) (io.ReadCloser, error) {
+func (c *Client) Convert(ctx context.Context, filename string, src io.Reader, opts *ConvertOptions) (_ io.ReadCloser, err error) {
+	start := time.Now()
+	ctx, span := c.Tracer.Start(ctx, "pdf.convert", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		c.Metrics.ObservePDFConversion(ctx, err, time.Since(start))
+		tracing.End(span, err)
+	}()
+
 	if opts == nil {
 		opts = DefaultOptions()
 	}
@@ -70,6 +88,7 @@ func (c *Client) Convert(ctx context.Context, filename string, src io.Reader, op
 		return nil, fmt.Errorf("request creation failed: %w", err)
 	}
 	req.Header.Set("Content-Type", writer.FormDataContentType())
+	c.Tracer.Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	// リクエスト送信
 	resp, err := c.HTTPClient.Do(req)
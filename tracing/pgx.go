@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PgxTracer はクエリごとにスパンを作成する pgx.QueryTracer を返します。
+// pgxpool.Config の ConnConfig.Tracer に設定すると、NewRLSProvider のトランザクション内のクエリも記録されます。
+//
+//	cfg.ConnConfig.Tracer = tracer.PgxTracer()
+func (t *Tracer) PgxTracer() pgx.QueryTracer {
+	return &pgxTracer{t: t}
+}
+
+type pgxTracer struct {
+	t *Tracer
+}
+
+// pgxSpanKey は TraceQueryStart で開始したスパンを保持するコンテキストのキーです。
+// TraceQueryEnd で呼び出し元のスパン (trace.SpanFromContext) を誤って終了しないよう、専用のキーで受け渡します。
+type pgxSpanKey struct{}
+
+func (p *pgxTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx, span := p.t.Start(ctx, "db.query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.statement", data.SQL),
+		),
+	)
+	return context.WithValue(ctx, pgxSpanKey{}, span)
+}
+
+func (p *pgxTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span, ok := ctx.Value(pgxSpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	if data.Err == nil {
+		span.SetAttributes(attribute.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+	}
+	err := data.Err
+	// 行が存在しないことは異常ではないため、エラーとして記録しない
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = nil
+	}
+	End(span, err)
+}
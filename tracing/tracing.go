@@ -0,0 +1,105 @@
+// Package tracing は gloudia の各コンポーネントに OpenTelemetry のトレースを追加するためのヘルパーです。
+//
+// 各コンポーネントは *Tracer を受け取る設定項目を持ち、nil の場合はスパンを作成しません。
+// *Tracer のメソッドはすべて nil レシーバーで安全に呼び出せます。
+// エクスポーターの設定 (stdout、OTLP、テスト用のインメモリなど) は TracerProvider 側で行います。
+//
+//	exporter, _ := stdouttrace.New(stdouttrace.WithPrettyPrint())
+//	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+//	tracer := tracing.New(tracing.Config{TracerProvider: tp, AttributesFromContext: middleware.TraceAttributes})
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// InstrumentationName は gloudia が作成するスパンの計装ライブラリ名です。
+const InstrumentationName = "github.com/golaboratory/gloudia"
+
+// 共通で使用するスパンの属性キーです。
+const (
+	AttrTenantID = attribute.Key("gloudia.tenant_id")
+	AttrUserID   = attribute.Key("gloudia.user_id")
+)
+
+// Config はトレースの設定構造体です。
+type Config struct {
+	// TracerProvider はスパンの作成に使用するプロバイダーです。nil の場合は otel.GetTracerProvider() を使用します。
+	TracerProvider trace.TracerProvider
+	// Propagator はトレースコンテキストの伝播 (HTTP ヘッダー、ジョブのペイロード) に使用します。
+	// nil の場合は W3C Trace Context と Baggage を使用します。
+	Propagator propagation.TextMapPropagator
+	// AttributesFromContext はコンテキストからスパンに付与する属性 (テナント、ユーザーなど) を取得する関数です。
+	// 例: middleware.TraceAttributes
+	AttributesFromContext func(ctx context.Context) []attribute.KeyValue
+}
+
+// Tracer は gloudia のコンポーネントがスパンを作成するための構造体です。
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	attributes func(ctx context.Context) []attribute.KeyValue
+}
+
+// New は新しい Tracer を作成します。
+func New(cfg Config) *Tracer {
+	tp := cfg.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	propagator := cfg.Propagator
+	if propagator == nil {
+		propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	}
+	return &Tracer{
+		tracer:     tp.Tracer(InstrumentationName),
+		propagator: propagator,
+		attributes: cfg.AttributesFromContext,
+	}
+}
+
+// Start はスパンを開始します。AttributesFromContext で取得した属性も付与します。
+// t が nil の場合は何も記録しないスパンを返します。
+func (t *Tracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+	if t.attributes != nil {
+		if attrs := t.attributes(ctx); len(attrs) > 0 {
+			opts = append(opts, trace.WithAttributes(attrs...))
+		}
+	}
+	return t.tracer.Start(ctx, name, opts...)
+}
+
+// End はエラーがあればスパンに記録してから、スパンを終了します。
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject は ctx のトレースコンテキストを carrier に書き込みます。
+func (t *Tracer) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	if t == nil {
+		return
+	}
+	t.propagator.Inject(ctx, carrier)
+}
+
+// Extract は carrier のトレースコンテキストを ctx に読み込みます。
+func (t *Tracer) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return t.propagator.Extract(ctx, carrier)
+}
@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestTracer(t *testing.T) (*Tracer, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+
+	tracer := New(Config{
+		TracerProvider: tp,
+		AttributesFromContext: func(ctx context.Context) []attribute.KeyValue {
+			return []attribute.KeyValue{AttrTenantID.String("t1")}
+		},
+	})
+	return tracer, exporter
+}
+
+func TestTracerStartAndPropagation(t *testing.T) {
+	tracer, exporter := newTestTracer(t)
+
+	ctx, span := tracer.Start(context.Background(), "parent")
+	carrier := propagation.MapCarrier{}
+	tracer.Inject(ctx, carrier)
+	End(span, errors.New("boom"))
+
+	require.Contains(t, carrier, "traceparent")
+
+	remote := tracer.Extract(context.Background(), carrier)
+	_, child := tracer.Start(remote, "child")
+	End(child, nil)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Contains(t, spans[0].Attributes, AttrTenantID.String("t1"))
+	assert.Equal(t, spans[0].SpanContext.TraceID(), spans[1].SpanContext.TraceID())
+	assert.Equal(t, spans[0].SpanContext.SpanID(), spans[1].Parent.SpanID())
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "noop")
+	End(span, nil)
+	tracer.Inject(ctx, propagation.MapCarrier{})
+	assert.Equal(t, ctx, tracer.Extract(ctx, propagation.MapCarrier{}))
+}
+
+func TestRedisHook(t *testing.T) {
+	tracer, exporter := newTestTracer(t)
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	// 接続時のハンドシェイクのコマンドを除外するため、先に接続しておく
+	ctx := context.Background()
+	require.NoError(t, rdb.Ping(ctx).Err())
+	rdb.AddHook(tracer.RedisHook())
+
+	require.NoError(t, rdb.Set(ctx, "k", "v", 0).Err())
+	assert.ErrorIs(t, rdb.Get(ctx, "missing").Err(), redis.Nil)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "redis.set", spans[0].Name)
+	assert.Equal(t, "redis.get", spans[1].Name)
+	// redis.Nil はエラーとして記録しない
+	assert.Equal(t, codes.Unset, spans[1].Status.Code)
+}
+
+func TestPgxTracer(t *testing.T) {
+	tracer, exporter := newTestTracer(t)
+	qt := tracer.PgxTracer()
+
+	ctx := qt.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+	qt.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{CommandTag: pgconn.NewCommandTag("SELECT 1")})
+	ctx = qt.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT broken"})
+	qt.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{Err: errors.New("syntax error")})
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	assert.Contains(t, spans[0].Attributes, attribute.String("db.statement", "SELECT 1"))
+	assert.Contains(t, spans[0].Attributes, attribute.Int64("db.rows_affected", 1))
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+}
+
+func TestPgxTracerNil(t *testing.T) {
+	tracer, exporter := newTestTracer(t)
+	ctx, parent := tracer.Start(context.Background(), "parent")
+
+	// nil の Tracer でも、呼び出し元のスパンを終了しない
+	var nilTracer *Tracer
+	qt := nilTracer.PgxTracer()
+	queryCtx := qt.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+	qt.TraceQueryEnd(queryCtx, nil, pgx.TraceQueryEndData{Err: errors.New("syntax error")})
+	assert.Empty(t, exporter.GetSpans())
+
+	End(parent, nil)
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "parent", spans[0].Name)
+	assert.NotEqual(t, codes.Error, spans[0].Status.Code)
+}
@@ -6,12 +6,144 @@ import (
 	"log/slog"
 
 	"github.com/newmo-oss/ergo"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/golaboratory/gloudia/correlation"
+	"github.com/golaboratory/gloudia/middleware"
 )
 
 // JobPayload はジョブの引数（JSON）をマッピングする汎用構造体です。
 // 具体的なジョブの実装内で、このマップや構造体へデコードして使用します。
 type JobPayload map[string]any
 
+const (
+	// PayloadKeyRequestID はジョブを投入したリクエストのリクエスト ID を保持するペイロードのキーです。
+	PayloadKeyRequestID = "request_id"
+	// PayloadKeyTraceParent はジョブを投入したリクエストの traceparent を保持するペイロードのキーです。
+	// OpenTelemetry のトレースを使用している場合は、投入したリクエストのスパンの traceparent となり、
+	// ジョブの処理のスパンはそのトレースに含まれます。
+	PayloadKeyTraceParent = "traceparent"
+	// PayloadKeyUserID はジョブを投入したユーザーの ID を保持するペイロードのキーです。
+	// ペイロードは署名されていないため、Claims (ロールやスコープ) は引き継ぎません。
+	// ジョブの処理で権限が必要な場合は、UserIDFrom で取得した ID からユーザーの権限を読み込み直してください。
+	PayloadKeyUserID = "user_id"
+	// PayloadKeyTenantID はジョブを投入したリクエストのテナント ID を保持するペイロードのキーです。
+	PayloadKeyTenantID = "tenant_id"
+	// PayloadKeyTenantDomainName はジョブを投入したリクエストのテナント名を保持するペイロードのキーです。
+	PayloadKeyTenantDomainName = "tenant_domain_name"
+)
+
+// WithCorrelation は ctx のリクエスト ID と traceparent をペイロードに追加して返します。
+// ジョブの投入時に使用すると、ジョブの処理中のログにも同じリクエスト ID が付与されます。
+func (p JobPayload) WithCorrelation(ctx context.Context) JobPayload {
+	if p == nil {
+		p = JobPayload{}
+	}
+	return p.withCorrelation(correlation.Capture(ctx))
+}
+
+// WithContext は ctx のユーザー ID、テナント、リクエスト ID と traceparent (middleware.CaptureContext) を
+// ペイロードに追加して返します。ジョブの投入時に使用すると、ジョブの処理はリクエストと同じ
+// テナントのコンテキスト (middleware.TenantFrom) で実行され、投入したユーザーの ID を UserIDFrom で取得できます。
+// Claims はペイロードに含めないため、ジョブの処理中に middleware.ClaimsFrom は値を返しません。
+func (p JobPayload) WithContext(ctx context.Context) JobPayload {
+	if p == nil {
+		p = JobPayload{}
+	}
+	v := middleware.CaptureContext(ctx)
+	if v.Claims != nil && v.Claims.UserID != 0 {
+		p[PayloadKeyUserID] = v.Claims.UserID
+	}
+	if v.TenantID != "" {
+		p[PayloadKeyTenantID] = v.TenantID
+	}
+	if v.TenantDomainName != "" {
+		p[PayloadKeyTenantDomainName] = v.TenantDomainName
+	}
+	return p.withCorrelation(v.Values)
+}
+
+func (p JobPayload) withCorrelation(v correlation.Values) JobPayload {
+	if v.RequestID != "" {
+		p[PayloadKeyRequestID] = v.RequestID
+	}
+	if v.TraceParent != "" {
+		p[PayloadKeyTraceParent] = v.TraceParent
+	}
+	return p
+}
+
+// traceCarrier はジョブの JSON に含まれる traceparent を、トレースコンテキストの carrier として返します。
+// ジョブの最上位、または "payload" フィールドのオブジェクトに含まれる値を対象とします。
+func traceCarrier(jobJSON json.RawMessage) propagation.MapCarrier {
+	var job struct {
+		TraceParent string `json:"traceparent"`
+		Payload     struct {
+			TraceParent string `json:"traceparent"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(jobJSON, &job); err != nil {
+		return propagation.MapCarrier{}
+	}
+	if job.TraceParent == "" {
+		job.TraceParent = job.Payload.TraceParent
+	}
+	if job.TraceParent == "" {
+		return propagation.MapCarrier{}
+	}
+	return propagation.MapCarrier{correlation.HeaderTraceParent: job.TraceParent}
+}
+
+// jobUserKey はジョブを投入したユーザーの ID を保持するコンテキストのキーです。
+type jobUserKey struct{}
+
+// UserIDFrom はジョブを投入したユーザーの ID (WithContext で追加) をコンテキストから取得します。
+// ペイロードの値をそのまま設定したものであり、認証済みの値ではありません。
+// ジョブの処理で権限を確認する場合は、この ID からユーザーのロールや状態を読み込み直してください。
+func UserIDFrom(ctx context.Context) (int64, bool) {
+	userID, ok := ctx.Value(jobUserKey{}).(int64)
+	return userID, ok && userID != 0
+}
+
+// jobValues はジョブの JSON からコンテキストに引き継ぐ値です。
+type jobValues struct {
+	UserID           int64  `json:"user_id,omitempty"`
+	TenantID         string `json:"tenant_id,omitempty"`
+	TenantDomainName string `json:"tenant_domain_name,omitempty"`
+
+	correlation.Values
+}
+
+// apply は値を ctx に設定したコンテキストを返します。設定されていない値は ctx に追加しません。
+func (v jobValues) apply(ctx context.Context) context.Context {
+	if v.UserID != 0 {
+		ctx = context.WithValue(ctx, jobUserKey{}, v.UserID)
+	}
+	return middleware.ContextValues{
+		TenantID:         v.TenantID,
+		TenantDomainName: v.TenantDomainName,
+		Values:           v.Values,
+	}.Apply(ctx)
+}
+
+// jobContext はジョブの JSON に含まれるユーザー ID、テナント、リクエスト ID と traceparent を ctx に設定して返します。
+// ジョブの最上位、または "payload" フィールドのオブジェクトに含まれる値を対象とします。
+// WorkerProcess がジョブを取得した時点で 1 度だけ適用します。
+// ペイロードは署名されていないため、"claims" キーが含まれていても Claims は復元しません。
+func jobContext(ctx context.Context, jobJSON json.RawMessage) context.Context {
+	var values jobValues
+	if err := json.Unmarshal(jobJSON, &values); err == nil && values != (jobValues{}) {
+		return values.apply(ctx)
+	}
+	var nested struct {
+		Payload jobValues `json:"payload"`
+	}
+	if err := json.Unmarshal(jobJSON, &nested); err == nil {
+		return nested.Payload.apply(ctx)
+	}
+	return ctx
+}
+
 // Processor はジョブ実行ロジックを管理する構造体です。
 // ジョブタイプとそれに対応する JobProcessor のマッピングを保持します。
 type Processor struct {
@@ -35,6 +167,8 @@ func NewProcessor(processors map[string]JobProcessor) *Processor {
 // Process はジョブタイプに応じて処理を振り分けます。
 // 登録された JobProcessor の中から jobType に一致するものを探し、実行します。
 // 未知のジョブタイプの場合はエラーを返します。
+// ペイロードに含まれるリクエストのコンテキスト (WithContext / WithCorrelation で追加) は、
+// 呼び出し元の WorkerProcess が ctx に設定済みです。
 func (p *Processor) Process(ctx context.Context, jobType string, payloadJSON json.RawMessage) error {
 	slog.InfoContext(ctx, "Processing job", "type", jobType)
 
@@ -8,6 +8,12 @@ import (
 	"fmt"
 	"log/slog"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/golaboratory/gloudia/metrics"
+	"github.com/golaboratory/gloudia/tracing"
 )
 
 // Config はワーカーの設定です。
@@ -35,7 +41,12 @@ type Worker interface {
 // WorkerProcess は非同期ジョブを実行するワーカープロセスです。
 // 定期的にジョブキューをポーリングし、登録されたプロセッサーを使用してジョブを処理します。
 type WorkerProcess struct {
-	Worker    Worker
+	Worker Worker
+	// Metrics はジョブの処理結果と処理時間を記録するメトリクスです。nil の場合は記録しません。
+	Metrics *metrics.Metrics
+	// Tracer はジョブの処理のスパンを作成します。nil の場合はスパンを作成しません。
+	// ペイロードに traceparent (JobPayload.WithContext / WithCorrelation) が含まれる場合は、そのトレースに含めます。
+	Tracer    *tracing.Tracer
 	processor *Processor
 	cfg       Config
 }
@@ -96,7 +107,21 @@ func (w *WorkerProcess) processNextJob(ctx context.Context) {
 		return
 	}
 
+	// ジョブを投入したリクエストのユーザー ID、テナント、リクエスト ID を引き継ぐ
+	ctx = jobContext(ctx, jsonJob)
+
+	ctx, span := w.Tracer.Start(w.Tracer.Extract(ctx, traceCarrier(jsonJob)), "worker.job "+jobType,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.Int64("worker.job.id", jobID),
+			attribute.String("worker.job.type", jobType),
+		),
+	)
+
+	start := time.Now()
 	processErr := w.processor.Process(ctx, jobType, jsonJob)
+	w.Metrics.ObserveJob(ctx, jobType, processErr, time.Since(start))
+	tracing.End(span, processErr)
 
 	if processErr != nil {
 		slog.ErrorContext(ctx, "Job failed", "id", jobID, "error", processErr)
@@ -106,7 +131,7 @@ func (w *WorkerProcess) processNextJob(ctx context.Context) {
 
 		updateErr := w.Worker.FailJob(ctx, jobID, resultJSON)
 		if updateErr != nil {
-			slog.Error("Failed to update job status", "id", jobID, "error", updateErr)
+			slog.ErrorContext(ctx, "Failed to update job status", "id", jobID, "error", updateErr)
 		}
 	} else {
 		// 成功時の結果 (必要であれば戻り値を保存)
@@ -115,7 +140,7 @@ func (w *WorkerProcess) processNextJob(ctx context.Context) {
 		updateErr := w.Worker.CompleteJob(ctx, jobID, resultJSON)
 
 		if updateErr != nil {
-			slog.Error("Failed to update job status", "id", jobID, "error", updateErr)
+			slog.ErrorContext(ctx, "Failed to update job status", "id", jobID, "error", updateErr)
 		}
 	}
 }